@@ -0,0 +1,195 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// accountCoinCodes returns the codes of the coins whose accounts are loaded on the network the
+// backend runs on.
+func (backend *Backend) accountCoinCodes() map[string]struct{} {
+	var codes []string
+	switch {
+	case backend.arguments.Regtest():
+		codes = []string{"rbtc"}
+	case backend.arguments.Testing():
+		codes = []string{coinTBTC, coinTLTC}
+		if backend.arguments.DevMode() {
+			codes = append(codes, coinTETH)
+		}
+	default:
+		codes = []string{coinBTC, coinLTC}
+		if backend.arguments.DevMode() {
+			codes = append(codes, coinETH)
+		}
+	}
+	result := map[string]struct{}{}
+	for _, code := range codes {
+		result[code] = struct{}{}
+	}
+	return result
+}
+
+// initConfiguredAccounts creates and adds the accounts of the account registry which belong to the
+// given keystore, or the watch-only accounts if registered is nil.
+func (backend *Backend) initConfiguredAccounts(registered *registeredKeystore) {
+	coinCodes := backend.accountCoinCodes()
+	for _, accountConfig := range backend.config.Config().Backend.Accounts {
+		log := backend.log.WithField("code", accountConfig.Code).WithField("name", accountConfig.Name)
+		if _, ok := coinCodes[accountConfig.CoinCode]; !ok {
+			continue
+		}
+		if registered == nil && !accountConfig.WatchOnly() ||
+			registered != nil && !accountConfig.ForKeystore(registered.identifier) {
+			continue
+		}
+		if accountConfig.Hidden {
+			log.Info("skipping hidden account")
+			continue
+		}
+		log.Info("init account")
+		if err := backend.createAndAddConfiguredAccount(accountConfig, registered); err != nil {
+			log.WithError(err).Error("skipping invalid account")
+		}
+	}
+}
+
+// createAndAddConfiguredAccount creates the account described by the registry entry and adds it to
+// the backend. Accounts derived from a keystore use the given registered keystore, which is nil for
+// watch-only accounts.
+func (backend *Backend) createAndAddConfiguredAccount(
+	accountConfig config.Account, registered *registeredKeystore) error {
+	coin, err := backend.Coin(accountConfig.CoinCode)
+	if err != nil {
+		return err
+	}
+	scriptType := signing.ScriptTypeP2WPKH
+	if !config.IsEthereum(accountConfig.CoinCode) {
+		scriptType, err = signing.DecodeScriptType(accountConfig.ScriptType)
+		if err != nil {
+			return err
+		}
+	}
+	code := accountConfig.Code
+	keystores := backend.keystores
+	var getSigningConfiguration func() (*signing.Configuration, error)
+	if accountConfig.WatchOnly() {
+		extendedPublicKey, err := hdkeychain.NewKeyFromString(accountConfig.ExtendedPublicKey)
+		if err != nil {
+			return errp.WithStack(err)
+		}
+		configuration := signing.NewSinglesigConfiguration(
+			scriptType, signing.NewEmptyAbsoluteKeypath(), extendedPublicKey)
+		getSigningConfiguration = func() (*signing.Configuration, error) {
+			return configuration, nil
+		}
+	} else {
+		absoluteKeypath, err := signing.NewAbsoluteKeypath(accountConfig.Keypath)
+		if err != nil {
+			return err
+		}
+		if accountConfig.Keystore == "" {
+			code += registered.codeSuffix
+		}
+		keystores = registered.keystores
+		getSigningConfiguration = func() (*signing.Configuration, error) {
+			return keystores.Configuration(scriptType, absoluteKeypath, keystores.Count())
+		}
+	}
+	var gapLimits *btc.GapLimits
+	if accountConfig.GapLimit != 0 || accountConfig.ChangeGapLimit != 0 {
+		gapLimits = &btc.GapLimits{Receive: accountConfig.GapLimit, Change: accountConfig.ChangeGapLimit}
+	}
+	backend.CreateAndAddAccount(coin, code, accountConfig.Name, scriptType, gapLimits,
+		getSigningConfiguration, keystores)
+	return nil
+}
+
+// AccountConfigs returns the entries of the account registry.
+func (backend *Backend) AccountConfigs() []config.Account {
+	return backend.config.Config().Backend.Accounts
+}
+
+// AddAccountConfig adds an entry to the account registry and reloads the accounts. Missing codes
+// and keypaths are derived from the coin, script type and account index.
+func (backend *Backend) AddAccountConfig(accountConfig config.Account) (*config.Account, error) {
+	if _, err := backend.Coin(accountConfig.CoinCode); err != nil {
+		return nil, err
+	}
+	if !config.IsEthereum(accountConfig.CoinCode) {
+		if _, err := signing.DecodeScriptType(accountConfig.ScriptType); err != nil {
+			return nil, err
+		}
+	}
+	defaults, err := config.NewAccount(accountConfig.CoinCode, accountConfig.ScriptType,
+		accountConfig.AccountIndex, accountConfig.Name)
+	if err != nil {
+		return nil, err
+	}
+	if accountConfig.Code == "" {
+		accountConfig.Code = defaults.Code
+	}
+	if !accountConfig.WatchOnly() {
+		if accountConfig.Keypath == "" {
+			accountConfig.Keypath = defaults.Keypath
+		}
+		if _, err := signing.NewAbsoluteKeypath(accountConfig.Keypath); err != nil {
+			return nil, err
+		}
+	}
+	if err := backend.config.ModifyAccounts(func(backendConfig *config.Backend) error {
+		return backendConfig.AddAccount(accountConfig)
+	}); err != nil {
+		return nil, err
+	}
+	backend.reinitAccounts()
+	return &accountConfig, nil
+}
+
+// UpdateAccountConfig changes the settings of a registry entry and reloads the accounts. See
+// config.Backend.UpdateAccount for the fields which can be changed.
+func (backend *Backend) UpdateAccountConfig(accountConfig config.Account) error {
+	if err := backend.config.ModifyAccounts(func(backendConfig *config.Backend) error {
+		return backendConfig.UpdateAccount(accountConfig)
+	}); err != nil {
+		return err
+	}
+	backend.reinitAccounts()
+	return nil
+}
+
+// DeleteAccountConfig removes an entry from the account registry and reloads the accounts.
+func (backend *Backend) DeleteAccountConfig(code string) error {
+	if err := backend.config.ModifyAccounts(func(backendConfig *config.Backend) error {
+		return backendConfig.DeleteAccount(code)
+	}); err != nil {
+		return err
+	}
+	backend.reinitAccounts()
+	return nil
+}
+
+// reinitAccounts reloads the accounts after the account registry changed.
+func (backend *Backend) reinitAccounts() {
+	if backend.arguments.Multisig() {
+		return
+	}
+	backend.initAccounts()
+}
@@ -44,6 +44,9 @@ type Arguments struct {
 	// devmode stores whether the application is in dev mode and, therefore, connects to the dev environment
 	devmode bool
 
+	// simulator stores whether a simulated BitBox is registered in addition to the plugged in devices.
+	simulator bool
+
 	// log is the logger for this context
 	log *logrus.Entry
 }
@@ -55,6 +58,7 @@ func NewArguments(
 	regtest bool,
 	multisig bool,
 	devmode bool,
+	simulator bool,
 ) *Arguments {
 	if !testing && regtest {
 		panic("Cannot use -regtest with -mainnet.")
@@ -74,6 +78,7 @@ func NewArguments(
 		regtest:            regtest,
 		multisig:           multisig,
 		devmode:            devmode,
+		simulator:          simulator,
 		log:                log,
 	}
 
@@ -117,3 +122,8 @@ func (arguments *Arguments) Regtest() bool {
 func (arguments *Arguments) Multisig() bool {
 	return arguments.multisig
 }
+
+// Simulator returns whether a simulated BitBox is registered in addition to the plugged in devices.
+func (arguments *Arguments) Simulator() bool {
+	return arguments.simulator
+}
@@ -15,10 +15,8 @@
 package backend
 
 import (
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"context"
+	"sync"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/cloudfoundry-attic/jibber_jabber"
@@ -30,10 +28,14 @@ import (
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/eth"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/ltc"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/simulator"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/device"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/usb"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/jsonrpc"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
@@ -54,25 +56,8 @@ const (
 	coinTETH = "teth"
 )
 
-type backendEvent struct {
-	Type string `json:"type"`
-	Data string `json:"data"`
-}
-
-type deviceEvent struct {
-	DeviceID string `json:"deviceID"`
-	Type     string `json:"type"`
-	Data     string `json:"data"`
-	// TODO: rename Data to Event, Meta to Data.
-	Meta interface{} `json:"meta"`
-}
-
-// AccountEvent models an event triggered by an account.
-type AccountEvent struct {
-	Type string `json:"type"`
-	Code string `json:"code"`
-	Data string `json:"data"`
-}
+// eventsHistorySize is the number of events kept for clients resuming after reconnecting.
+const eventsHistorySize = 1000
 
 // Backend ties everything together and is the main starting point to use the BitBox wallet library.
 type Backend struct {
@@ -80,10 +65,18 @@ type Backend struct {
 
 	config *config.Config
 
-	events chan interface{}
+	events *events.Bus
+
+	devices map[string]device.Interface
+	// keystores contains all registered keystores. In multisig mode, they share the accounts.
+	// Otherwise, every keystore has its own accounts, see registeredKeystores.
+	keystores keystore.Keystores
+	// registeredKeystores are the registered keystores in the order of registration.
+	registeredKeystores []*registeredKeystore
+	// deviceKeystores maps the IDs of the registered devices to their unlocked keystores.
+	deviceKeystores map[string]keystore.Keystore
+	keystoresLock   locker.Locker
 
-	devices         map[string]device.Interface
-	keystores       keystore.Keystores
 	onAccountInit   func(btc.Interface)
 	onAccountUninit func(btc.Interface)
 	onDeviceInit    func(device.Interface)
@@ -95,25 +88,80 @@ type Backend struct {
 	accounts     []btc.Interface
 	accountsLock locker.Locker
 
+	// passwordKey is set if the wallet data is encrypted, and key once it is unlocked. migrating is
+	// set if the data written in plaintext has not been encrypted completely yet.
+	passwordKey    *encryption.PasswordKey
+	key            *encryption.Key
+	migrating      bool
+	encryptionLock locker.Locker
+
+	usbManager     *usb.Manager
+	started        bool
+	unobserveRates func()
+	updateChecker  *UpdateChecker
+
+	// ctx is cancelled by Close(). goroutines tracks the background work of the backend, which
+	// Close() waits for.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	goroutines sync.WaitGroup
+	// closed is set by Close(). Afterwards, no goroutines are started.
+	closed    bool
+	closeLock locker.Locker
+	closeOnce sync.Once
+
 	log *logrus.Entry
 }
 
 // NewBackend creates a new backend with the given arguments.
-func NewBackend(arguments *arguments.Arguments) *Backend {
+func NewBackend(arguments *arguments.Arguments) (*Backend, error) {
 	log := logging.Get().WithGroup("backend")
+	appConfig, err := config.NewConfig(arguments.ConfigFilename())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	backend := &Backend{
 		arguments: arguments,
-		config:    config.NewConfig(arguments.ConfigFilename()),
-		events:    make(chan interface{}, 1000),
-
-		devices:   map[string]device.Interface{},
-		keystores: keystore.NewKeystores(),
-		coins:     map[string]coin.Coin{},
-		accounts:  []btc.Interface{},
-		log:       log,
+		config:    appConfig,
+		events:    events.NewBus(eventsHistorySize),
+
+		devices:         map[string]device.Interface{},
+		keystores:       keystore.NewKeystores(),
+		deviceKeystores: map[string]keystore.Keystore{},
+		coins:           map[string]coin.Coin{},
+		accounts:        []btc.Interface{},
+		ctx:             ctx,
+		cancel:          cancel,
+		log:             log,
+	}
+	if err := backend.loadPasswordKey(); err != nil {
+		log.WithError(err).Error("Could not load the encryption settings")
+	}
+	backend.unobserveRates = GetRatesUpdaterInstance().Observe(
+		func(event observable.Event) { backend.emit(events.ObservablePayload(event)) })
+	return backend, nil
+}
+
+// emit publishes an event with the given payload. Publishing never blocks, so events can be
+// emitted while holding locks and while the backend is closing. The bus ignores the events emitted
+// after Close().
+func (backend *Backend) emit(payload events.Payload) {
+	backend.events.Publish(payload)
+}
+
+// spawn runs f in a goroutine which Close() waits for. Nothing is started once the backend is
+// closed.
+func (backend *Backend) spawn(f func()) {
+	defer backend.closeLock.RLock()()
+	if backend.closed {
+		return
 	}
-	GetRatesUpdaterInstance().Observe(func(event observable.Event) { backend.events <- event })
-	return backend
+	backend.goroutines.Add(1)
+	go func() {
+		defer backend.goroutines.Done()
+		f()
+	}()
 }
 
 // addAccount adds the given account to the backend.
@@ -121,39 +169,44 @@ func (backend *Backend) addAccount(account btc.Interface) {
 	defer backend.accountsLock.Lock()()
 	backend.accounts = append(backend.accounts, account)
 	backend.onAccountInit(account)
-	backend.events <- backendEvent{Type: "backend", Data: "accountsStatusChanged"}
+	backend.emit(events.BackendPayload{Data: "accountsStatusChanged"})
 }
 
 // CreateAndAddAccount creates an account with the given parameters and adds it to the backend.
+// gapLimits is only used by bitcoin-like accounts and can be nil to use the defaults. The account
+// signs with the given keystores.
 func (backend *Backend) CreateAndAddAccount(
 	coin coin.Coin,
 	code string,
 	name string,
 	scriptType signing.ScriptType,
+	gapLimits *btc.GapLimits,
 	getSigningConfiguration func() (*signing.Configuration, error),
+	keystores keystore.Keystores,
 ) {
 	switch specificCoin := coin.(type) {
 	case *btc.Coin:
 		onEvent := func(code string) func(btc.Event) {
 			return func(event btc.Event) {
-				backend.events <- AccountEvent{Type: "account", Code: code, Data: string(event)}
+				backend.emit(events.AccountPayload{Code: code, Data: string(event)})
 			}
 		}
-		account := btc.NewAccount(specificCoin, backend.arguments.CacheDirectoryPath(), code, name,
-			getSigningConfiguration, backend.keystores, onEvent(code), backend.log)
+		account := btc.NewAccount(specificCoin, backend.arguments.CacheDirectoryPath(), backend.dbKey(),
+			code, name, getSigningConfiguration, keystores, gapLimits, onEvent(code), backend.log)
 		backend.addAccount(account)
 	case *eth.Coin:
 		onEvent := func(event eth.Event) {
-			backend.events <- AccountEvent{Type: "account", Code: code, Data: string(event)}
+			backend.emit(events.AccountPayload{Code: code, Data: string(event)})
 		}
-		account := eth.NewAccount(specificCoin, backend.arguments.CacheDirectoryPath(), code, name,
-			getSigningConfiguration, backend.keystores, onEvent, backend.log)
+		account := eth.NewAccount(specificCoin, backend.arguments.CacheDirectoryPath(), backend.dbKey(),
+			code, name, getSigningConfiguration, keystores, onEvent, backend.log)
 		backend.addAccount(account)
 	default:
 		panic("unknown coin type")
 	}
 }
 
+// createAndAddAccount creates a multisig account at the given keypath.
 func (backend *Backend) createAndAddAccount(
 	coin coin.Coin,
 	code string,
@@ -161,10 +214,6 @@ func (backend *Backend) createAndAddAccount(
 	keypath string,
 	scriptType signing.ScriptType,
 ) {
-	if !backend.arguments.Multisig() && !backend.config.Config().Backend.AccountActive(code) {
-		backend.log.WithField("code", code).WithField("name", name).Info("skipping inactive account")
-		return
-	}
 	backend.log.WithField("code", code).WithField("name", name).Info("init account")
 	absoluteKeypath, err := signing.NewAbsoluteKeypath(keypath)
 	if err != nil {
@@ -176,7 +225,8 @@ func (backend *Backend) createAndAddAccount(
 	if backend.arguments.Multisig() {
 		name = name + " Multisig"
 	}
-	backend.CreateAndAddAccount(coin, code, name, scriptType, getSigningConfiguration)
+	backend.CreateAndAddAccount(coin, code, name, scriptType, nil, getSigningConfiguration,
+		backend.keystores)
 }
 
 // Config returns the app config.
@@ -184,8 +234,8 @@ func (backend *Backend) Config() *config.Config {
 	return backend.config
 }
 
-// DefaultConfig returns the default app config.y
-func (backend *Backend) DefaultConfig() config.AppConfig {
+// DefaultConfig returns the default app config.
+func (backend *Backend) DefaultConfig() (config.AppConfig, error) {
 	return config.NewDefaultConfig()
 }
 
@@ -269,31 +319,40 @@ func (backend *Backend) defaultElectrumXServers(code string) []*rpc.ServerInfo {
 // Coin returns the coin with the given code or an error if no such coin exists.
 func (backend *Backend) Coin(code string) (coin.Coin, error) {
 	defer backend.coinsLock.Lock()()
+	if backend.ctx.Err() != nil {
+		return nil, errp.New("the backend is closed")
+	}
+	if backend.EncryptionStatus().Locked {
+		return nil, errp.New("the wallet data is locked")
+	}
 	coin, ok := backend.coins[code]
 	if ok {
 		return coin, nil
 	}
 	dbFolder := backend.arguments.CacheDirectoryPath()
+	dbKey := backend.dbKey()
+	discoverServers := backend.config.Config().Backend.ElectrumServerDiscovery
 	switch code {
 	case "rbtc":
 		servers := []*rpc.ServerInfo{{Server: "127.0.0.1:52001", TLS: false, PEMCert: ""}}
-		coin = btc.NewCoin("rbtc", "RBTC", &chaincfg.RegressionNetParams, dbFolder, servers, "")
+		coin = btc.NewCoin("rbtc", "RBTC", &chaincfg.RegressionNetParams, dbFolder, dbKey, servers,
+			discoverServers, "")
 	case coinTBTC:
 		servers := backend.defaultElectrumXServers(code)
-		coin = btc.NewCoin(coinTBTC, "TBTC", &chaincfg.TestNet3Params, dbFolder, servers,
-			"https://blockstream.info/testnet/tx/")
+		coin = btc.NewCoin(coinTBTC, "TBTC", &chaincfg.TestNet3Params, dbFolder, dbKey, servers,
+			discoverServers, "https://blockstream.info/testnet/tx/")
 	case coinBTC:
 		servers := backend.defaultElectrumXServers(code)
-		coin = btc.NewCoin(coinBTC, "BTC", &chaincfg.MainNetParams, dbFolder, servers,
-			"https://blockstream.info/tx/")
+		coin = btc.NewCoin(coinBTC, "BTC", &chaincfg.MainNetParams, dbFolder, dbKey, servers,
+			discoverServers, "https://blockstream.info/tx/")
 	case coinTLTC:
 		servers := backend.defaultElectrumXServers(code)
-		coin = btc.NewCoin(coinTLTC, "TLTC", &ltc.TestNet4Params, dbFolder, servers,
-			"http://explorer.litecointools.com/tx/")
+		coin = btc.NewCoin(coinTLTC, "TLTC", &ltc.TestNet4Params, dbFolder, dbKey, servers,
+			discoverServers, "http://explorer.litecointools.com/tx/")
 	case coinLTC:
 		servers := backend.defaultElectrumXServers(code)
-		coin = btc.NewCoin(coinLTC, "LTC", &ltc.MainNetParams, dbFolder, servers,
-			"https://insight.litecore.io/tx/")
+		coin = btc.NewCoin(coinLTC, "LTC", &ltc.MainNetParams, dbFolder, dbKey, servers,
+			discoverServers, "https://insight.litecore.io/tx/")
 	case coinETH:
 		coin = eth.NewCoin(code, params.MainnetChainConfig,
 			"https://etherscan.io/tx/", backend.config.Config().Backend.ETH.NodeURL)
@@ -304,76 +363,42 @@ func (backend *Backend) Coin(code string) (coin.Coin, error) {
 		return nil, errp.Newf("unknown coin code %s", code)
 	}
 	backend.coins[code] = coin
-	coin.Observe(func(event observable.Event) { backend.events <- event })
+	coin.Observe(func(event observable.Event) { backend.emit(events.ObservablePayload(event)) })
 	return coin, nil
 }
 
 func (backend *Backend) initAccounts() {
 	// Since initAccounts replaces all previous accounts, we need to properly close them first.
 	backend.uninitAccounts()
+	if backend.ctx.Err() != nil {
+		return
+	}
 
-	if backend.arguments.Testing() {
-		if backend.arguments.Multisig() {
+	if backend.arguments.Multisig() {
+		if backend.keystores.Count() < 2 {
+			return
+		}
+		if backend.arguments.Testing() {
 			TBTC, _ := backend.Coin(coinTBTC)
 			backend.createAndAddAccount(TBTC, "tbtc-multisig", "Bitcoin Testnet", "m/48'/1'/0'",
 				signing.ScriptTypeP2PKH)
 			TLTC, _ := backend.Coin(coinTLTC)
 			backend.createAndAddAccount(TLTC, "tltc-multisig", "Litecoin Testnet", "m/48'/1'/0'",
 				signing.ScriptTypeP2PKH)
-		} else if backend.arguments.Regtest() {
-			RBTC, _ := backend.Coin("rbtc")
-			backend.createAndAddAccount(RBTC, "rbtc-p2pkh", "Bitcoin Regtest Legacy", "m/44'/1'/0'",
-				signing.ScriptTypeP2PKH)
-			backend.createAndAddAccount(RBTC, "rbtc-p2wpkh-p2sh", "Bitcoin Regtest Segwit", "m/49'/1'/0'",
-				signing.ScriptTypeP2WPKHP2SH)
 		} else {
-			TBTC, _ := backend.Coin(coinTBTC)
-			backend.createAndAddAccount(TBTC, "tbtc-p2wpkh-p2sh", "Bitcoin Testnet", "m/49'/1'/0'",
-				signing.ScriptTypeP2WPKHP2SH)
-			backend.createAndAddAccount(TBTC, "tbtc-p2wpkh", "Bitcoin Testnet: bech32", "m/84'/1'/0'",
-				signing.ScriptTypeP2WPKH)
-			backend.createAndAddAccount(TBTC, "tbtc-p2pkh", "Bitcoin Testnet Legacy", "m/44'/1'/0'",
-				signing.ScriptTypeP2PKH)
-
-			TLTC, _ := backend.Coin(coinTLTC)
-			backend.createAndAddAccount(TLTC, "tltc-p2wpkh-p2sh", "Litecoin Testnet", "m/49'/1'/0'",
-				signing.ScriptTypeP2WPKHP2SH)
-			backend.createAndAddAccount(TLTC, "tltc-p2wpkh", "Litecoin Testnet: bech32", "m/84'/1'/0'",
-				signing.ScriptTypeP2WPKH)
-
-			if backend.arguments.DevMode() {
-				TETH, _ := backend.Coin(coinTETH)
-				backend.createAndAddAccount(TETH, "teth", "Ethereum Rinkeby", "m/44'/1'/0'/0/0", signing.ScriptTypeP2WPKH)
-			}
-		}
-	} else {
-		if backend.arguments.Multisig() {
 			BTC, _ := backend.Coin(coinBTC)
 			backend.createAndAddAccount(BTC, "btc-multisig", "Bitcoin", "m/48'/0'/0'",
 				signing.ScriptTypeP2PKH)
 			LTC, _ := backend.Coin(coinLTC)
 			backend.createAndAddAccount(LTC, "ltc-multisig", "Litecoin", "m/48'/2'/0'",
 				signing.ScriptTypeP2PKH)
-		} else {
-			BTC, _ := backend.Coin(coinBTC)
-			backend.createAndAddAccount(BTC, "btc-p2wpkh-p2sh", "Bitcoin", "m/49'/0'/0'",
-				signing.ScriptTypeP2WPKHP2SH)
-			backend.createAndAddAccount(BTC, "btc-p2wpkh", "Bitcoin: bech32", "m/84'/0'/0'",
-				signing.ScriptTypeP2WPKH)
-			backend.createAndAddAccount(BTC, "btc-p2pkh", "Bitcoin Legacy", "m/44'/0'/0'",
-				signing.ScriptTypeP2PKH)
-
-			LTC, _ := backend.Coin(coinLTC)
-			backend.createAndAddAccount(LTC, "ltc-p2wpkh-p2sh", "Litecoin", "m/49'/2'/0'",
-				signing.ScriptTypeP2WPKHP2SH)
-			backend.createAndAddAccount(LTC, "ltc-p2wpkh", "Litecoin: bech32", "m/84'/2'/0'",
-				signing.ScriptTypeP2WPKH)
-
-			if backend.arguments.DevMode() {
-				ETH, _ := backend.Coin(coinETH)
-				backend.createAndAddAccount(ETH, "eth", "Ethereum", "m/44'/60'/0'/0/0", signing.ScriptTypeP2WPKH)
-			}
 		}
+		return
+	}
+
+	backend.initConfiguredAccounts(nil)
+	for _, registered := range backend.registered() {
+		backend.initConfiguredAccounts(registered)
 	}
 }
 
@@ -430,15 +455,100 @@ func (backend *Backend) OnDeviceUninit(f func(string)) {
 	backend.onDeviceUninit = f
 }
 
-// Start starts the background services. It returns a channel of events to handle by the library
-// client.
-func (backend *Backend) Start() <-chan interface{} {
-	usb.NewManager(backend.arguments.MainDirectoryPath(), backend.Register, backend.Deregister).Start()
-	return backend.events
+// Start starts the background services. The events for the library client are published on
+// Events().
+func (backend *Backend) Start() {
+	GetRatesUpdaterInstance().Start()
+	backend.startUpdateChecker()
+	backend.started = true
+	if backend.EncryptionStatus().Locked {
+		backend.log.Info("Waiting for the password to unlock the wallet data")
+		backend.emit(events.BackendPayload{Data: "locked"})
+		return
+	}
+	backend.startWallet()
 }
 
-// Events returns the push notifications channel.
-func (backend *Backend) Events() <-chan interface{} {
+// startWallet loads the accounts and starts listening for devices. If the wallet data is encrypted,
+// it is called once it is unlocked.
+func (backend *Backend) startWallet() {
+	if backend.ctx.Err() != nil {
+		return
+	}
+	// Watch-only accounts do not need a keystore and are available right away.
+	backend.initAccounts()
+	backend.usbManager = usb.NewManager(
+		backend.arguments.MainDirectoryPath(), backend.dbKey(), backend.Register, backend.Deregister)
+	if backend.arguments.Simulator() {
+		backend.usbManager.AddSimulator(simulator.NewSimulator(bitbox.BundledFirmwareVersion()))
+	}
+	backend.usbManager.Start()
+}
+
+// startUpdateChecker periodically checks the signed update manifest and emits the "update" event
+// when a newer release is found.
+func (backend *Backend) startUpdateChecker() {
+	keyring, err := bundledUpdateKeyring()
+	if err != nil {
+		backend.log.WithError(err).Error("Could not load the update signing keys")
+		return
+	}
+	backend.updateChecker = NewUpdateChecker(
+		updateManifestURL,
+		keyring,
+		Version,
+		func() string { return backend.config.Config().Backend.UpdateChannel },
+		func(updateFile *UpdateFile) {
+			backend.emit(events.BackendPayload{Data: "update", Meta: updateFile})
+		},
+	)
+	backend.updateChecker.Start(updateCheckInterval)
+}
+
+// Update returns the newer release found by the last update check, or nil if there is none.
+func (backend *Backend) Update() *UpdateFile {
+	if backend.updateChecker == nil {
+		return nil
+	}
+	return backend.updateChecker.Last()
+}
+
+// Close stops the background services, closes the accounts, their databases and the connections
+// to the blockchain backends, and closes the events bus once all goroutines have stopped. It is safe
+// to call it more than once.
+func (backend *Backend) Close() {
+	backend.closeOnce.Do(func() {
+		backend.log.Info("Closing the backend")
+		backend.cancel()
+		func() {
+			defer backend.closeLock.Lock()()
+			backend.closed = true
+		}()
+		if backend.usbManager != nil {
+			backend.usbManager.Close()
+		}
+		backend.goroutines.Wait()
+		backend.uninitAccounts()
+		func() {
+			defer backend.coinsLock.Lock()()
+			for _, coin := range backend.coins {
+				coin.Close()
+			}
+		}()
+		backend.unobserveRates()
+		if backend.started {
+			GetRatesUpdaterInstance().Stop()
+		}
+		if backend.updateChecker != nil {
+			backend.updateChecker.Stop()
+		}
+		backend.events.Close()
+		backend.log.Info("Closed the backend")
+	})
+}
+
+// Events returns the bus of the push notifications.
+func (backend *Backend) Events() *events.Bus {
 	return backend.events
 }
 
@@ -455,31 +565,7 @@ func (backend *Backend) uninitAccounts() {
 		account.Close()
 	}
 	backend.accounts = []btc.Interface{}
-	backend.events <- backendEvent{Type: "backend", Data: "accountsStatusChanged"}
-}
-
-// Keystores returns the keystores registered at this backend.
-func (backend *Backend) Keystores() keystore.Keystores {
-	return backend.keystores
-}
-
-// RegisterKeystore registers the given keystore at this backend.
-func (backend *Backend) RegisterKeystore(keystore keystore.Keystore) {
-	backend.log.Info("registering keystore")
-	if err := backend.keystores.Add(keystore); err != nil {
-		backend.log.Panic("Failed to add a keystore.", err)
-	}
-	if backend.arguments.Multisig() && backend.keystores.Count() != 2 {
-		return
-	}
-	backend.initAccounts()
-}
-
-// DeregisterKeystore removes the registered keystore.
-func (backend *Backend) DeregisterKeystore() {
-	backend.log.Info("deregistering keystore")
-	backend.keystores = keystore.NewKeystores()
-	backend.uninitAccounts()
+	backend.emit(events.BackendPayload{Data: "accountsStatusChanged"})
 }
 
 // Register registers the given device at this backend.
@@ -488,11 +574,10 @@ func (backend *Backend) Register(theDevice device.Interface) error {
 	backend.onDeviceInit(theDevice)
 	theDevice.Init(backend.Testing())
 
-	mainKeystore := len(backend.devices) == 1
 	theDevice.SetOnEvent(func(event device.Event, data interface{}) {
 		switch event {
 		case device.EventKeystoreGone:
-			backend.DeregisterKeystore()
+			backend.deregisterDeviceKeystore(theDevice.Identifier())
 		case device.EventKeystoreAvailable:
 			// absoluteKeypath := signing.NewEmptyAbsoluteKeypath().Child(44, signing.Hardened)
 			// extendedPublicKey, err := backend.device.ExtendedPublicKey(absoluteKeypath)
@@ -501,31 +586,15 @@ func (backend *Backend) Register(theDevice device.Interface) error {
 			// }
 			// configuration := signing.NewConfiguration(absoluteKeypath,
 			// 	[]*hdkeychain.ExtendedKey{extendedPublicKey}, 1)
-			if backend.arguments.Multisig() {
-				backend.RegisterKeystore(
-					theDevice.KeystoreForConfiguration(nil, backend.keystores.Count()))
-			} else if mainKeystore {
-				// HACK: for device based, only one is supported at the moment.
-				backend.keystores = keystore.NewKeystores()
-
-				backend.RegisterKeystore(
-					theDevice.KeystoreForConfiguration(nil, backend.keystores.Count()))
-			}
+			backend.registerDeviceKeystore(theDevice)
 		}
-		backend.events <- deviceEvent{
+		backend.emit(events.DevicePayload{
 			DeviceID: theDevice.Identifier(),
-			Type:     "device",
 			Data:     string(event),
 			Meta:     data,
-		}
+		})
 	})
-	select {
-	case backend.events <- backendEvent{
-		Type: "devices",
-		Data: "registeredChanged",
-	}:
-	default:
-	}
+	backend.emit(events.DevicesPayload{Data: "registeredChanged"})
 	return nil
 }
 
@@ -534,8 +603,8 @@ func (backend *Backend) Deregister(deviceID string) {
 	if _, ok := backend.devices[deviceID]; ok {
 		backend.onDeviceUninit(deviceID)
 		delete(backend.devices, deviceID)
-		backend.DeregisterKeystore()
-		backend.events <- backendEvent{Type: "devices", Data: "registeredChanged"}
+		backend.deregisterDeviceKeystore(deviceID)
+		backend.emit(events.DevicesPayload{Data: "registeredChanged"})
 	}
 }
 
@@ -546,28 +615,7 @@ func (backend *Backend) Rates() map[string]map[string]float64 {
 
 // DownloadCert downloads the first element of the remote certificate chain.
 func (backend *Backend) DownloadCert(server string) (string, error) {
-	var pemCert []byte
-	conn, err := tls.Dial("tcp", server, &tls.Config{
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			if len(rawCerts) == 0 {
-				return errp.New("no remote certs")
-			}
-
-			certificatePEM := &pem.Block{Type: "CERTIFICATE", Bytes: rawCerts[0]}
-			certificatePEMBytes := &bytes.Buffer{}
-			if err := pem.Encode(certificatePEMBytes, certificatePEM); err != nil {
-				panic(err)
-			}
-			pemCert = certificatePEMBytes.Bytes()
-			return nil
-		},
-		InsecureSkipVerify: true,
-	})
-	if err != nil {
-		return "", err
-	}
-	_ = conn.Close()
-	return string(pemCert), nil
+	return electrum.DownloadCert(server)
 }
 
 // CheckElectrumServer checks if a tls connection can be established with the electrum server, and
@@ -0,0 +1,64 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/arguments"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/observable"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/observable/action"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newBackend(t *testing.T, backendArguments *arguments.Arguments) *backend.Backend {
+	t.Helper()
+	theBackend, err := backend.NewBackend(backendArguments)
+	require.NoError(t, err)
+	return theBackend
+}
+
+// TestCloseWithSlowSubscriber checks that a subscriber which does not read its events blocks
+// neither the emitters nor Close().
+func TestCloseWithSlowSubscriber(t *testing.T) {
+	theBackend := newBackend(t, arguments.NewArguments(
+		test.TstTempDir("backend_test"), true, true, false, false, false))
+	subscription := theBackend.Events().Subscribe(events.Filter{}, 0, 1)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for i := 0; i < 10; i++ {
+			backend.GetRatesUpdaterInstance().Notify(observable.Event{
+				Subject: "rates",
+				Action:  action.Replace,
+				Object:  i,
+			})
+		}
+		theBackend.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "the backend did not close")
+	}
+	// The buffered event is still delivered, then the channel is closed.
+	for range subscription.Events() {
+	}
+}
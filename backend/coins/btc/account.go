@@ -16,8 +16,10 @@ package btc
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"sort"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -34,6 +36,7 @@ import (
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/ltc"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/sirupsen/logrus"
@@ -42,8 +45,29 @@ import (
 const (
 	gapLimit       = 20
 	changeGapLimit = 6
+
+	// maxLookahead limits the gap limits of a rescan, as every address is subscribed at the server.
+	maxLookahead = 1000
+
+	// rescanProgressInterval is the minimum time between two EventRescanProgress events, as a
+	// rescan issues thousands of requests.
+	rescanProgressInterval = 500 * time.Millisecond
+)
+
+// minRetryDelay and maxRetryDelay bound the delay before the synchronization is retried after an
+// error. The delay doubles with each consecutive failure.
+var (
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
 )
 
+// GapLimits are the numbers of unused addresses kept at the end of the receive and the change
+// address chain. A zero value selects the default.
+type GapLimits struct {
+	Receive int
+	Change  int
+}
+
 // Interface is the API of a Account.
 type Interface interface {
 	Info() *Info
@@ -57,8 +81,17 @@ type Interface interface {
 	Initialized() bool
 	Offline() bool
 	Close()
-	Transactions() []coin.Transaction
-	Balance() *coin.Balance
+	// Transactions returns the transactions of the account in the order of
+	// coin.SortTransactions.
+	Transactions() ([]coin.Transaction, error)
+	// TransactionLabels returns the labels of the transactions by their ID.
+	TransactionLabels() map[string]string
+	// SetTransactionLabel sets the label of the transaction with the given ID. An empty label
+	// removes it.
+	SetTransactionLabel(txID string, label string) error
+	// TransactionDetails returns all details of the transaction with the given ID.
+	TransactionDetails(txID string) (*TxDetails, error)
+	Balance() (*coin.Balance, error)
 	// Creates, signs and broadcasts a transaction. Returns keystore.ErrSigningAborted on user
 	// abort.
 	SendTx(string, coin.SendAmount, FeeTargetCode, map[wire.OutPoint]struct{}, []byte) error
@@ -69,7 +102,18 @@ type Interface interface {
 	VerifyAddress(addressID string) (bool, error)
 	ConvertToLegacyAddress(addressID string) (btcutil.Address, error)
 	Keystores() keystore.Keystores
-	SpendableOutputs() []*SpendableOutput
+	SpendableOutputs() ([]*SpendableOutput, error)
+	// SetOutputFrozen freezes or unfreezes an unspent output.
+	SetOutputFrozen(wire.OutPoint, bool) error
+	// Rescan discards the transaction history and synchronizes the account from scratch.
+	Rescan(lookahead *GapLimits) error
+	// RescanProgress returns whether a rescan is running, and how many of the requests of the
+	// current synchronization are done.
+	RescanProgress() (bool, int, int)
+	// Error returns the error which stopped the synchronization of the account, or nil.
+	Error() error
+	// LastReorg returns the last reorganization of the chain since the account was loaded, or nil.
+	LastReorg() *headers.Reorg
 }
 
 // Account is a account whose addresses are derived from an xpub.
@@ -78,13 +122,17 @@ type Account struct {
 
 	coin                    *Coin
 	dbFolder                string
+	dbKey                   *encryption.Key
 	code                    string
 	name                    string
 	db                      transactions.DBInterface
+	labels                  *coin.Labels
 	getSigningConfiguration func() (*signing.Configuration, error)
 	signingConfiguration    *signing.Configuration
 	keystores               keystore.Keystores
 	blockchain              blockchain.Interface
+	// gapLimits are the configured gap limits, nil for the defaults.
+	gapLimits *GapLimits
 
 	receiveAddresses *addresses.AddressChain
 	changeAddresses  *addresses.AddressChain
@@ -95,10 +143,35 @@ type Account struct {
 
 	feeTargets []*FeeTarget
 
+	// lastReorg is the last reorg which replaced blocks since the account was loaded, or nil.
+	lastReorg *headers.Reorg
+
+	// unsubscribe removes the callbacks registered with the blockchain and the headers.
+	unsubscribe []func()
+	// unsubscribeAddresses removes the address subscriptions, which are replaced on a rescan.
+	unsubscribeAddresses []func()
+	// generation is incremented by a rescan. The server responses to requests of an earlier
+	// generation, which can still arrive after the subscriptions were removed, are ignored, as
+	// they belong to the discarded address chains and database. It is guarded by the account lock.
+	generation int
+
+	// syncErrorLock guards syncError and the retry state. It is separate from the account lock,
+	// as errors are reported while the account lock is held.
+	syncErrorLock locker.Locker
+	syncError     error
+	retryTimer    *time.Timer
+	retryDelay    time.Duration
+
 	initialized bool
 	offline     bool
-	onEvent     func(Event)
-	log         *logrus.Entry
+	// rescanning is true from a rescan until the following sync finished. It is guarded by the
+	// account lock, as is rescanProgressNotified, the time EventRescanProgress was last fired.
+	rescanning             bool
+	rescanProgressNotified time.Time
+	// closed is only modified while holding both the account lock and syncErrorLock.
+	closed  bool
+	onEvent func(Event)
+	log     *logrus.Entry
 }
 
 // Status indicates the connection and initialization status.
@@ -116,16 +189,22 @@ const (
 
 	// OfflineMode indicates that the connection to the blockchain network could not be established.
 	OfflineMode Status = "offlineMode"
+
+	// AccountError indicates that the synchronization failed. It is retried automatically. Check
+	// the error using Error().
+	AccountError Status = "accountError"
 )
 
-// NewAccount creates a new account.
+// NewAccount creates a new account. Its database is encrypted with dbKey, unless it is nil.
 func NewAccount(
 	coin *Coin,
 	dbFolder string,
+	dbKey *encryption.Key,
 	code string,
 	name string,
 	getSigningConfiguration func() (*signing.Configuration, error),
 	keystores keystore.Keystores,
+	gapLimits *GapLimits,
 	onEvent func(Event),
 	log *logrus.Entry,
 ) *Account {
@@ -136,11 +215,13 @@ func NewAccount(
 	account := &Account{
 		coin:                    coin,
 		dbFolder:                dbFolder,
+		dbKey:                   dbKey,
 		code:                    code,
 		name:                    name,
 		getSigningConfiguration: getSigningConfiguration,
 		signingConfiguration:    nil,
 		keystores:               keystores,
+		gapLimits:               gapLimits,
 
 		// feeTargets must be sorted by ascending priority.
 		feeTargets: []*FeeTarget{
@@ -158,17 +239,45 @@ func NewAccount(
 	account.synchronizer = synchronizer.NewSynchronizer(
 		func() { onEvent(EventSyncStarted) },
 		func() {
-			if !account.initialized {
-				account.initialized = true
+			account.resetRetryDelay()
+			if account.markInitialized() {
 				onEvent(EventStatusChanged)
 			}
 			onEvent(EventSyncDone)
 		},
 		log,
 	)
+	account.synchronizer.OnProgress(func(done, total int) {
+		if account.rescanProgressDue() {
+			onEvent(EventRescanProgress)
+		}
+	})
 	return account
 }
 
+// markInitialized marks the account as initialized and ends a rescan once the sync finished. It
+// returns whether the account was not initialized before.
+func (account *Account) markInitialized() bool {
+	defer account.Lock()()
+	if account.initialized {
+		return false
+	}
+	account.initialized = true
+	account.rescanning = false
+	return true
+}
+
+// rescanProgressDue returns whether EventRescanProgress should be fired, which is the case during a
+// rescan at most every rescanProgressInterval.
+func (account *Account) rescanProgressDue() bool {
+	defer account.Lock()()
+	if !account.rescanning || time.Since(account.rescanProgressNotified) < rescanProgressInterval {
+		return false
+	}
+	account.rescanProgressNotified = time.Now()
+	return true
+}
+
 // String returns a representation of the account for logging.
 func (account *Account) String() string {
 	return fmt.Sprintf("%s-%s", account.Coin().Code(), account.code)
@@ -211,14 +320,16 @@ func (account *Account) Initialize() error {
 		account.log.Debug("Account has already been initialized")
 		return nil
 	}
-	dbName := fmt.Sprintf("account-%s-%s.db", account.signingConfiguration.Hash(), account.code)
-	account.log.Debugf("Opening the database '%s' to persist the transactions.", dbName)
-	db, err := transactionsdb.NewDB(path.Join(account.dbFolder, dbName))
+	if err := account.openDB(); err != nil {
+		return err
+	}
+	labels, err := coin.NewLabels(account.dbFolder,
+		fmt.Sprintf("labels-%s-%s.json", account.signingConfiguration.Hash(), account.code),
+		account.dbKey)
 	if err != nil {
 		return err
 	}
-	account.db = db
-	account.log.Debugf("Opened the database '%s' to persist the transactions.", dbName)
+	account.labels = labels
 
 	onConnectionStatusChanged := func(status blockchain.Status) {
 		if status == blockchain.DISCONNECTED {
@@ -240,41 +351,232 @@ func (account *Account) Initialize() error {
 	account.blockchain = account.coin.Blockchain()
 	account.offline = account.blockchain.ConnectionStatus() == blockchain.DISCONNECTED
 	account.onEvent(EventStatusChanged)
-	account.blockchain.RegisterOnConnectionStatusChangedEvent(onConnectionStatusChanged)
+	unsubscribeConnectionStatus := account.blockchain.RegisterOnConnectionStatusChangedEvent(
+		onConnectionStatusChanged)
 
 	theHeaders := account.coin.Headers()
-	theHeaders.SubscribeEvent(func(event headers.Event) {
+	unsubscribeHeadersEvent := theHeaders.SubscribeEvent(func(event headers.Event) {
 		if event == headers.EventSynced {
 			account.onEvent(EventHeadersSynced)
 		}
 	})
 	account.transactions = transactions.NewTransactions(
 		account.coin.Net(), account.db, theHeaders, account.synchronizer,
-		account.blockchain, account.log)
+		account.blockchain, account.setError, account.onDoubleSpend, account.onReorg, account.log)
+
+	account.initAddressChains(account.effectiveGapLimits())
+	if err := account.ensureAddresses(); err != nil {
+		account.setError(err)
+	}
+	unsubscribeHeaders := account.blockchain.HeadersSubscribe(
+		func() func() { return func() {} }, account.onNewHeader)
+	func() {
+		defer account.Lock()()
+		account.unsubscribe = append(account.unsubscribe,
+			unsubscribeConnectionStatus, unsubscribeHeadersEvent, unsubscribeHeaders)
+	}()
+	return nil
+}
+
+// dbFilename returns the path of the database holding the transactions of the account.
+func (account *Account) dbFilename() string {
+	dbName := fmt.Sprintf("account-%s-%s.db", account.signingConfiguration.Hash(), account.code)
+	return path.Join(account.dbFolder, dbName)
+}
 
-	fixGapLimit := gapLimit
-	fixChangeGapLimit := changeGapLimit
+func (account *Account) openDB() error {
+	dbFilename := account.dbFilename()
+	account.log.Debugf("Opening the database '%s' to persist the transactions.", dbFilename)
+	db, err := transactionsdb.NewDB(dbFilename, account.dbKey)
+	if err != nil {
+		return err
+	}
+	account.db = db
+	account.log.Debugf("Opened the database '%s' to persist the transactions.", dbFilename)
+	return nil
+}
+
+// effectiveGapLimits returns the configured gap limits, using the defaults for the signing
+// configuration where none are configured.
+func (account *Account) effectiveGapLimits() GapLimits {
+	limits := GapLimits{Receive: gapLimit, Change: changeGapLimit}
 	if account.signingConfiguration.Singlesig() &&
 		account.signingConfiguration.ScriptType() == signing.ScriptTypeP2PKH {
 		// usually 6, but BWS uses 20, so for legacy accounts, we have to do that too.
-		fixChangeGapLimit = 20
+		limits.Change = 20
 
 		// usually 20, but BWS used to not have any limit. We put it fairly high to cover most
 		// outliers.
-		fixGapLimit = 60
-		account.log.Warning("increased change gap limit to 20 and gap limit to 60 for BWS compatibility")
+		limits.Receive = 60
 	}
+	if account.gapLimits != nil {
+		if account.gapLimits.Receive > 0 {
+			limits.Receive = account.gapLimits.Receive
+		}
+		if account.gapLimits.Change > 0 {
+			limits.Change = account.gapLimits.Change
+		}
+	}
+	return limits
+}
 
+func (account *Account) initAddressChains(limits GapLimits) {
+	account.log.WithFields(logrus.Fields{"gap-limit": limits.Receive, "change-gap-limit": limits.Change}).
+		Debug("creating address chain structures")
 	account.receiveAddresses = addresses.NewAddressChain(
-		account.signingConfiguration, account.coin.Net(), fixGapLimit, 0, account.log)
-	account.log.Debug("creating change address chain structure")
+		account.signingConfiguration, account.coin.Net(), limits.Receive, 0, account.log)
 	account.changeAddresses = addresses.NewAddressChain(
-		account.signingConfiguration, account.coin.Net(), fixChangeGapLimit, 1, account.log)
-	account.ensureAddresses()
-	account.blockchain.HeadersSubscribe(func() func() { return func() {} }, account.onNewHeader)
+		account.signingConfiguration, account.coin.Net(), limits.Change, 1, account.log)
+}
+
+// Rescan discards the transaction history of the account and synchronizes it again from scratch,
+// resubscribing all addresses. If lookahead is not nil, its gap limits are used where they are
+// larger than the configured ones, until the account is loaded again. EventRescanProgress is fired
+// while the rescan is running.
+func (account *Account) Rescan(lookahead *GapLimits) error {
+	if lookahead != nil && (lookahead.Receive > maxLookahead || lookahead.Change > maxLookahead) {
+		return errp.Newf("the lookahead must not exceed %d addresses", maxLookahead)
+	}
+	err := func() error {
+		defer account.Lock()()
+		if account.db == nil || account.closed {
+			return errp.New("the account is not initialized")
+		}
+		if account.rescanning {
+			return errp.New("a rescan is already running")
+		}
+		account.log.Info("Rescanning account")
+		// Frozen outputs are a user setting and have to survive the rescan.
+		frozenOutputs, err := account.transactions.FrozenOutputs()
+		if err != nil {
+			return err
+		}
+		account.transactions.Close()
+		for _, unsubscribe := range account.unsubscribeAddresses {
+			unsubscribe()
+		}
+		account.unsubscribeAddresses = nil
+		account.generation++
+		if err := account.db.Close(); err != nil {
+			return errp.WithStack(err)
+		}
+		if err := os.Remove(account.dbFilename()); err != nil && !os.IsNotExist(err) {
+			return errp.WithStack(err)
+		}
+		if err := account.openDB(); err != nil {
+			return err
+		}
+		account.transactions = transactions.NewTransactions(
+			account.coin.Net(), account.db, account.coin.Headers(), account.synchronizer,
+			account.blockchain, account.setError, account.onDoubleSpend, account.onReorg, account.log)
+		if err := account.transactions.RestoreFrozenOutputs(frozenOutputs); err != nil {
+			return err
+		}
+		limits := account.effectiveGapLimits()
+		if lookahead != nil {
+			if lookahead.Receive > limits.Receive {
+				limits.Receive = lookahead.Receive
+			}
+			if lookahead.Change > limits.Change {
+				limits.Change = lookahead.Change
+			}
+		}
+		account.initAddressChains(limits)
+		account.initialized = false
+		account.rescanning = true
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	account.onEvent(EventStatusChanged)
+	if err := account.ensureAddresses(); err != nil {
+		account.setError(err)
+	}
 	return nil
 }
 
+// RescanProgress implements Interface.
+func (account *Account) RescanProgress() (bool, int, int) {
+	done, total := account.synchronizer.Progress()
+	defer account.RLock()()
+	return account.rescanning, done, total
+}
+
+// Error implements Interface.
+func (account *Account) Error() error {
+	defer account.syncErrorLock.RLock()()
+	return account.syncError
+}
+
+// setError is called when the synchronization failed, e.g. because of a database error or an
+// invalid response of the server. It moves the account into the AccountError status and schedules
+// a retry. Other accounts are not affected.
+func (account *Account) setError(err error) {
+	retryDelay := func() time.Duration {
+		defer account.syncErrorLock.Lock()()
+		if account.closed {
+			return 0
+		}
+		account.syncError = err
+		if account.retryTimer != nil {
+			// A retry is already scheduled.
+			return 0
+		}
+		account.retryDelay *= 2
+		if account.retryDelay < minRetryDelay {
+			account.retryDelay = minRetryDelay
+		}
+		if account.retryDelay > maxRetryDelay {
+			account.retryDelay = maxRetryDelay
+		}
+		account.retryTimer = time.AfterFunc(account.retryDelay, account.retrySync)
+		return account.retryDelay
+	}()
+	account.log.WithError(err).Error("Synchronization failed")
+	if retryDelay == 0 {
+		return
+	}
+	account.log.Infof("Retrying the synchronization in %s", retryDelay)
+	account.onEvent(EventSyncError)
+	account.onEvent(EventStatusChanged)
+}
+
+// retrySync clears the error and fetches the history of all addresses again.
+func (account *Account) retrySync() {
+	closed := func() bool {
+		defer account.syncErrorLock.Lock()()
+		account.retryTimer = nil
+		account.syncError = nil
+		return account.closed
+	}()
+	if closed {
+		return
+	}
+	account.log.Info("Retrying the synchronization")
+	account.onEvent(EventStatusChanged)
+	if err := account.ensureAddresses(); err != nil {
+		account.setError(err)
+		return
+	}
+	accountAddresses, generation := func() ([]*addresses.AccountAddress, int) {
+		defer account.RLock()()
+		return append(account.receiveAddresses.Addresses(), account.changeAddresses.Addresses()...),
+			account.generation
+	}()
+	for _, address := range accountAddresses {
+		account.fetchAddressHistory(address, nil, generation)
+	}
+}
+
+// resetRetryDelay resets the backoff of the retries once the account synchronized without errors.
+func (account *Account) resetRetryDelay() {
+	defer account.syncErrorLock.Lock()()
+	if account.syncError == nil && account.retryTimer == nil {
+		account.retryDelay = 0
+	}
+}
+
 // Info holds account information.
 type Info struct {
 	SigningConfiguration *signing.Configuration `json:"signingConfiguration"`
@@ -350,29 +652,54 @@ func (account *Account) Offline() bool {
 // Initialized indicates whether the account has loaded and finished the initial sync of the
 // addresses.
 func (account *Account) Initialized() bool {
+	defer account.RLock()()
 	return account.initialized
 }
 
 // Close stops the account.
 func (account *Account) Close() {
-	account.log.Info("Closed account")
-	if account.db != nil {
-		if err := account.db.Close(); err != nil {
-			account.log.WithError(err).Error("couldn't close db")
+	closed := func() bool {
+		defer account.Lock()()
+		if account.closed {
+			return false
 		}
-		account.log.Info("Closed DB")
-	}
-	// TODO: deregister from json RPC client. The client can be closed when no account uses
-	// the client any longer.
-	account.initialized = false
-	if account.transactions != nil {
-		account.transactions.Close()
+		func() {
+			defer account.syncErrorLock.Lock()()
+			account.closed = true
+			if account.retryTimer != nil {
+				account.retryTimer.Stop()
+				account.retryTimer = nil
+			}
+		}()
+		for _, unsubscribe := range append(account.unsubscribe, account.unsubscribeAddresses...) {
+			unsubscribe()
+		}
+		account.unsubscribe = nil
+		account.unsubscribeAddresses = nil
+		if account.transactions != nil {
+			account.transactions.Close()
+		}
+		if account.db != nil {
+			if err := account.db.Close(); err != nil {
+				account.log.WithError(err).Error("couldn't close db")
+			}
+			account.log.Info("Closed DB")
+		}
+		account.initialized = false
+		return true
+	}()
+	if !closed {
+		return
 	}
+	account.log.Info("Closed account")
 	account.onEvent(EventStatusChanged)
 }
 
 func (account *Account) updateFeeTargets() {
 	defer account.RLock()()
+	if account.closed {
+		return
+	}
 	for _, feeTarget := range account.feeTargets {
 		func(feeTarget *FeeTarget) {
 			setFee := func(feeRatePerKb btcutil.Amount) error {
@@ -435,7 +762,7 @@ outer:
 }
 
 // Balance implements the interface.
-func (account *Account) Balance() *coin.Balance {
+func (account *Account) Balance() (*coin.Balance, error) {
 	return account.transactions.Balance()
 }
 
@@ -449,27 +776,53 @@ func (account *Account) addresses(change bool) *addresses.AddressChain {
 // onAddressStatus is called when the status (tx history) of an address might have changed. It is
 // called when the address is initialized, and when the backend notifies us of changes to it. If
 // there was indeed change, the tx history is downloaded and processed.
-func (account *Account) onAddressStatus(address *addresses.AccountAddress, status string) {
+func (account *Account) onAddressStatus(
+	address *addresses.AccountAddress, status string, generation int) {
 	if status == address.HistoryStatus {
 		// Address didn't change.
 		return
 	}
 
 	account.log.Debug("Address status changed, fetching history.")
+	account.fetchAddressHistory(address, &status, generation)
+}
 
+// fetchAddressHistory downloads and processes the tx history of the address. If status is not nil,
+// it is the status the history is expected to have. The response is ignored if the account was
+// rescanned since the given generation. Errors are reported using setError and not returned to the
+// blockchain client, so that a bad response does not affect other accounts.
+func (account *Account) fetchAddressHistory(
+	address *addresses.AccountAddress, status *string, generation int) {
 	done := account.synchronizer.IncRequestsCounter()
 	account.blockchain.ScriptHashGetHistory(
 		address.PubkeyScriptHashHex(),
 		func(history blockchain.TxHistory) error {
-			func() {
+			ignored, err := func() (bool, error) {
 				defer account.Lock()()
+				if account.closed || account.generation != generation {
+					return true, nil
+				}
+				err := account.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), history)
+				if err != nil {
+					return false, err
+				}
+				// Only remember the status once the history is stored, so that the history is
+				// fetched again if the address changes or the synchronization is retried.
 				address.HistoryStatus = history.Status()
-				if address.HistoryStatus != status {
+				if status != nil && address.HistoryStatus != *status {
 					account.log.Warning("client status should match after sync")
 				}
-				account.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), history)
+				return false, nil
 			}()
-			account.ensureAddresses()
+			if err != nil {
+				account.setError(err)
+				return nil
+			}
+			if !ignored {
+				if err := account.ensureAddresses(); err != nil {
+					account.setError(err)
+				}
+			}
 			return nil
 		},
 		func() { done() },
@@ -480,70 +833,155 @@ func (account *Account) onAddressStatus(address *addresses.AccountAddress, statu
 // address chains to discover all funds, with respect to the gap limit. In the end, there are
 // `gapLimit` unused addresses in the tail. It is also called whenever the status (tx history) of
 // changes, to keep the gapLimit tail.
-func (account *Account) ensureAddresses() {
-	defer account.Lock()()
+func (account *Account) ensureAddresses() error {
+	// The counter is decremented after the lock is released, as the sync callbacks take the lock.
 	defer account.synchronizer.IncRequestsCounter()()
+	defer account.Lock()()
+	if account.closed {
+		return nil
+	}
 
 	dbTx, err := account.db.Begin()
 	if err != nil {
-		// TODO
-		panic(err)
+		return errp.WithMessage(err, "Failed to begin transaction")
 	}
 	defer dbTx.Rollback()
 
-	syncSequence := func(change bool) error {
+	// All new addresses are subscribed even if one fails, so that none of them is missed when the
+	// synchronization is retried. The first error is returned.
+	var firstErr error
+	syncSequence := func(change bool) {
 		for {
 			newAddresses := account.addresses(change).EnsureAddresses()
 			if len(newAddresses) == 0 {
 				break
 			}
 			for _, address := range newAddresses {
-				if err := account.subscribeAddress(dbTx, address); err != nil {
-					return errp.Wrap(err, "Failed to subscribe to address")
+				if err := account.subscribeAddress(dbTx, address); err != nil && firstErr == nil {
+					firstErr = errp.Wrap(err, "Failed to subscribe to address")
 				}
 			}
 		}
-		return nil
-	}
-	if err := syncSequence(false); err != nil {
-		account.log.WithError(err).Panic(err)
-		// TODO
-		panic(err)
-	}
-	if err := syncSequence(true); err != nil {
-		account.log.WithError(err).Panic(err)
-		// TODO
-		panic(err)
 	}
+	syncSequence(false)
+	syncSequence(true)
+	return firstErr
 }
 
+// subscribeAddress subscribes to status changes of the address. The address is subscribed even if
+// the stored history could not be read, in which case the history is fetched from the server and
+// the error is returned. It requires the account lock.
 func (account *Account) subscribeAddress(
 	dbTx transactions.DBTxInterface, address *addresses.AccountAddress) error {
 	addressHistory, err := dbTx.AddressHistory(address.PubkeyScriptHashHex())
-	if err != nil {
-		return err
+	if err == nil {
+		address.HistoryStatus = addressHistory.Status()
 	}
-	address.HistoryStatus = addressHistory.Status()
 
-	account.blockchain.ScriptHashSubscribe(
+	generation := account.generation
+	account.unsubscribeAddresses = append(account.unsubscribeAddresses, account.blockchain.ScriptHashSubscribe(
 		account.synchronizer.IncRequestsCounter,
 		address.PubkeyScriptHashHex(),
-		func(status string) error { account.onAddressStatus(address, status); return nil },
-	)
-	return nil
+		func(status string) error { account.onAddressStatus(address, status, generation); return nil },
+	))
+	return err
 }
 
 // Transactions wraps transaction.Transactions.Transactions()
-func (account *Account) Transactions() []coin.Transaction {
-	transactions := account.transactions.Transactions(
+func (account *Account) Transactions() ([]coin.Transaction, error) {
+	transactions, err := account.transactions.Transactions(
 		func(scriptHashHex blockchain.ScriptHashHex) bool {
 			return account.changeAddresses.LookupByScriptHashHex(scriptHashHex) != nil
 		})
+	if err != nil {
+		return nil, err
+	}
 	cast := make([]coin.Transaction, len(transactions))
 	for index, transaction := range transactions {
 		cast[index] = transaction
 	}
-	return cast
+	return cast, nil
+}
+
+// TransactionLabels implements Interface.
+func (account *Account) TransactionLabels() map[string]string {
+	return account.labels.All()
+}
+
+// SetTransactionLabel implements Interface.
+func (account *Account) SetTransactionLabel(txID string, label string) error {
+	return account.labels.Set(txID, label)
+}
+
+// onDoubleSpend is called when a pending incoming transaction is double-spent.
+func (account *Account) onDoubleSpend(txHash chainhash.Hash) {
+	account.log.WithField("txHash", txHash).Warning("Pending incoming transaction double-spent")
+	account.onEvent(EventDoubleSpend)
+}
+
+// onReorg is called when the blocks from the fork height on were replaced, after the transactions
+// in them were marked as unverified.
+func (account *Account) onReorg(reorg *headers.Reorg) {
+	account.log.WithFields(logrus.Fields{"forkHeight": reorg.ForkHeight, "depth": reorg.Depth}).
+		Warning("Reorg of the chain")
+	func() {
+		defer account.Lock()()
+		account.lastReorg = reorg
+	}()
+	account.onEvent(EventReorg)
+}
+
+// LastReorg implements Interface.
+func (account *Account) LastReorg() *headers.Reorg {
+	defer account.RLock()()
+	return account.lastReorg
+}
+
+// TxDetails are the details of a transaction along with the addresses of the account involved in
+// it.
+type TxDetails struct {
+	*transactions.TxDetails
+	// Addresses are the addresses of the account the inputs spend from and the outputs pay to,
+	// by their script hash.
+	Addresses map[blockchain.ScriptHashHex]*addresses.AccountAddress
+}
+
+// TransactionDetails implements Interface.
+func (account *Account) TransactionDetails(txID string) (*TxDetails, error) {
+	txHash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	details, err := account.transactions.TxDetails(*txHash,
+		func(scriptHashHex blockchain.ScriptHashHex) bool {
+			return account.changeAddresses.LookupByScriptHashHex(scriptHashHex) != nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer account.RLock()()
+	result := &TxDetails{
+		TxDetails: details,
+		Addresses: map[blockchain.ScriptHashHex]*addresses.AccountAddress{},
+	}
+	scriptHashHexes := []blockchain.ScriptHashHex{}
+	for _, input := range details.Inputs {
+		scriptHashHexes = append(scriptHashHexes, input.ScriptHashHex)
+	}
+	for _, output := range details.Outputs {
+		scriptHashHexes = append(scriptHashHexes, output.ScriptHashHex)
+	}
+	for _, scriptHashHex := range scriptHashHexes {
+		if scriptHashHex == "" {
+			continue
+		}
+		for _, change := range []bool{false, true} {
+			if address := account.addresses(change).LookupByScriptHashHex(scriptHashHex); address != nil {
+				result.Addresses[scriptHashHex] = address
+			}
+		}
+	}
+	return result, nil
 }
 
 // GetUnusedReceiveAddresses returns a number of unused addresses.
@@ -552,8 +990,8 @@ func (account *Account) GetUnusedReceiveAddresses() []coin.Address {
 	defer account.RLock()()
 	account.log.Debug("Get unused receive address")
 	addresses := []coin.Address{}
-	// Limit to `gapLimit` receive addresses, even if the actual limit is higher when scanning.
-	for _, address := range account.receiveAddresses.GetUnused()[:gapLimit] {
+	// Limit to the configured receive addresses, even if the actual limit is higher when scanning.
+	for _, address := range account.receiveAddresses.GetUnused()[:account.effectiveGapLimits().Receive] {
 		addresses = append(addresses, address)
 	}
 	return addresses
@@ -618,13 +1056,29 @@ type SpendableOutput struct {
 }
 
 // SpendableOutputs returns the utxo set, sorted by the value descending.
-func (account *Account) SpendableOutputs() []*SpendableOutput {
+func (account *Account) SpendableOutputs() ([]*SpendableOutput, error) {
 	account.synchronizer.WaitSynchronized()
 	defer account.RLock()()
+	utxos, err := account.transactions.SpendableOutputs()
+	if err != nil {
+		return nil, err
+	}
 	result := []*SpendableOutput{}
-	for outPoint, txOut := range account.transactions.SpendableOutputs() {
+	for outPoint, txOut := range utxos {
 		result = append(result, &SpendableOutput{OutPoint: outPoint, SpendableOutput: txOut})
 	}
 	sort.Sort(sort.Reverse(&byValue{result}))
-	return result
+	return result, nil
+}
+
+// SetOutputFrozen implements Interface.
+func (account *Account) SetOutputFrozen(outPoint wire.OutPoint, frozen bool) error {
+	account.synchronizer.WaitSynchronized()
+	if err := account.transactions.SetOutputFrozen(outPoint, frozen); err != nil {
+		return err
+	}
+	account.log.WithField("frozen", frozen).Infof("Changed the frozen flag of %s", outPoint)
+	// The balance and the spendable outputs changed.
+	account.onEvent(EventSyncDone)
+	return nil
 }
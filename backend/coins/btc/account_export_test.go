@@ -0,0 +1,36 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package btc
+
+import (
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
+)
+
+// TstSetBlockchain makes the coin use the given blockchain and headers instead of connecting to
+// its servers.
+func (coin *Coin) TstSetBlockchain(theBlockchain blockchain.Interface, theHeaders *headers.Headers) {
+	coin.initOnce.Do(func() {
+		coin.blockchain = theBlockchain
+		coin.headers = theHeaders
+	})
+}
+
+// TstSetMinRetryDelay sets the delay before the synchronization is first retried after an error.
+func TstSetMinRetryDelay(delay time.Duration) {
+	minRetryDelay = delay
+}
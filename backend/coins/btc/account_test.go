@@ -0,0 +1,241 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package btc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/addresses"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	blockchainMock "github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain/mocks"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/db/headersdb"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// waitFor polls the condition until it is true, failing the test after a timeout.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for start := time.Now(); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			require.FailNow(t, "timeout")
+		}
+	}
+}
+
+// TestAccountSyncError checks that an invalid server response puts the affected account into the
+// AccountError status instead of crashing, that other accounts keep working, and that the
+// synchronization is retried.
+func TestAccountSyncError(t *testing.T) {
+	btc.TstSetMinRetryDelay(10 * time.Millisecond)
+	net := &chaincfg.TestNet3Params
+	log := logging.Get().WithGroup("account_test")
+	dbFolder := test.TstTempDir("account_test")
+
+	xprv, err := hdkeychain.NewMaster(make([]byte, hdkeychain.RecommendedSeedLen), net)
+	require.NoError(t, err)
+	newConfiguration := func(keypath string) *signing.Configuration {
+		accountXprv, err := xprv.Child(hdkeychain.HardenedKeyStart + 84)
+		require.NoError(t, err)
+		accountXprv, err = accountXprv.Child(hdkeychain.HardenedKeyStart + uint32(len(keypath)))
+		require.NoError(t, err)
+		xpub, err := accountXprv.Neuter()
+		require.NoError(t, err)
+		absoluteKeypath, err := signing.NewAbsoluteKeypath(keypath)
+		require.NoError(t, err)
+		return signing.NewSinglesigConfiguration(signing.ScriptTypeP2WPKH, absoluteKeypath, xpub)
+	}
+	brokenConfiguration := newConfiguration("m/84'/1'/0'")
+	healthyConfiguration := newConfiguration("m/84'/1'/10'")
+	brokenAddressConfiguration, err := brokenConfiguration.Derive(
+		signing.NewEmptyRelativeKeypath().Child(0, signing.NonHardened).Child(0, signing.NonHardened))
+	require.NoError(t, err)
+	brokenAddress := addresses.NewAccountAddress(brokenAddressConfiguration, net, log)
+
+	var lock locker.Locker
+	statusCallbacks := map[blockchain.ScriptHashHex]func(string) error{}
+	faulty := true
+	// refetched counts the histories fetched after the server was fixed.
+	refetched := 0
+	txHash := blockchain.TXHash(chainhash.HashH([]byte("tx")))
+
+	theBlockchain := &blockchainMock.Interface{}
+	theBlockchain.On("ConnectionStatus").Return(blockchain.CONNECTED)
+	theBlockchain.On("RegisterOnConnectionStatusChangedEvent", mock.Anything).Return(func() {})
+	theBlockchain.On("HeadersSubscribe", mock.Anything, mock.Anything).Return(func() {})
+	theBlockchain.On("EstimateFee", mock.Anything, mock.Anything, mock.Anything).Return()
+	theBlockchain.On("Close").Return()
+	theBlockchain.On("ScriptHashSubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			defer lock.Lock()()
+			statusCallbacks[args.Get(1).(blockchain.ScriptHashHex)] = args.Get(2).(func(string) error)
+		}).
+		Return(func() {})
+	theBlockchain.On("ScriptHashGetHistory", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			history := blockchain.TxHistory{}
+			func() {
+				defer lock.Lock()()
+				if faulty && args.Get(0).(blockchain.ScriptHashHex) == brokenAddress.PubkeyScriptHashHex() {
+					// The same tx twice is an invalid history.
+					history = blockchain.TxHistory{{TXHash: txHash}, {TXHash: txHash}}
+				}
+			}()
+			require.NoError(t, args.Get(1).(func(blockchain.TxHistory) error)(history))
+			args.Get(2).(func())()
+			defer lock.Lock()()
+			if !faulty {
+				refetched++
+			}
+		}).
+		Return()
+
+	headersDB, err := headersdb.NewDB(test.TstTempFile("account_test_headers"), nil)
+	require.NoError(t, err)
+	coin := btc.NewCoin("tbtc", "TBTC", net, dbFolder, nil, nil, false, "")
+	coin.TstSetBlockchain(theBlockchain, headers.NewHeaders(net, headersDB, theBlockchain, false, log))
+	defer coin.Close()
+
+	newAccount := func(code string, configuration *signing.Configuration) *btc.Account {
+		account := btc.NewAccount(coin, dbFolder, nil, code, code,
+			func() (*signing.Configuration, error) { return configuration, nil },
+			keystore.NewKeystores(), nil, func(btc.Event) {}, log)
+		require.NoError(t, account.Initialize())
+		return account
+	}
+	brokenAccount := newAccount("tbtc-broken", brokenConfiguration)
+	defer brokenAccount.Close()
+	healthyAccount := newAccount("tbtc-healthy", healthyConfiguration)
+	defer healthyAccount.Close()
+
+	statusCallback := func(scriptHashHex blockchain.ScriptHashHex) func(string) error {
+		defer lock.Lock()()
+		return statusCallbacks[scriptHashHex]
+	}
+	// The server announces a new history for the address, but returns an invalid one.
+	require.NoError(t, statusCallback(brokenAddress.PubkeyScriptHashHex())("status"))
+	require.Error(t, brokenAccount.Error())
+	require.NoError(t, healthyAccount.Error())
+	require.True(t, healthyAccount.Initialized())
+
+	// The retry recovers once the server returns a valid history.
+	func() {
+		defer lock.Lock()()
+		faulty = false
+	}()
+	// The retry fetches the history of all 20 receive and 6 change addresses.
+	waitFor(t, func() bool {
+		defer lock.Lock()()
+		return refetched == 26
+	})
+	require.NoError(t, brokenAccount.Error())
+}
+
+// TestRescanIgnoresStaleResponses checks that a history which was requested before a rescan and
+// arrives afterwards is not stored in the new database.
+func TestRescanIgnoresStaleResponses(t *testing.T) {
+	net := &chaincfg.TestNet3Params
+	log := logging.Get().WithGroup("account_test")
+	dbFolder := test.TstTempDir("account_rescan_test")
+
+	xprv, err := hdkeychain.NewMaster(make([]byte, hdkeychain.RecommendedSeedLen), net)
+	require.NoError(t, err)
+	xpub, err := xprv.Neuter()
+	require.NoError(t, err)
+	absoluteKeypath, err := signing.NewAbsoluteKeypath("m/84'/1'/0'")
+	require.NoError(t, err)
+	configuration := signing.NewSinglesigConfiguration(signing.ScriptTypeP2WPKH, absoluteKeypath, xpub)
+	addressConfiguration, err := configuration.Derive(
+		signing.NewEmptyRelativeKeypath().Child(0, signing.NonHardened).Child(0, signing.NonHardened))
+	require.NoError(t, err)
+	address := addresses.NewAccountAddress(addressConfiguration, net, log)
+
+	var lock locker.Locker
+	statusCallbacks := map[blockchain.ScriptHashHex]func(string) error{}
+	// historyCallbacks are the callbacks of the requested histories, which are answered by the test.
+	historyCallbacks := []func(blockchain.TxHistory) error{}
+
+	theBlockchain := &blockchainMock.Interface{}
+	theBlockchain.On("ConnectionStatus").Return(blockchain.CONNECTED)
+	theBlockchain.On("RegisterOnConnectionStatusChangedEvent", mock.Anything).Return(func() {})
+	theBlockchain.On("HeadersSubscribe", mock.Anything, mock.Anything).Return(func() {})
+	theBlockchain.On("EstimateFee", mock.Anything, mock.Anything, mock.Anything).Return()
+	theBlockchain.On("Close").Return()
+	theBlockchain.On("ScriptHashSubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			defer lock.Lock()()
+			statusCallbacks[args.Get(1).(blockchain.ScriptHashHex)] = args.Get(2).(func(string) error)
+		}).
+		Return(func() {})
+	theBlockchain.On("ScriptHashGetHistory", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			func() {
+				defer lock.Lock()()
+				historyCallbacks = append(historyCallbacks, args.Get(1).(func(blockchain.TxHistory) error))
+			}()
+			// The request is counted as done right away, so that the rescan does not wait for it.
+			args.Get(2).(func())()
+		}).
+		Return()
+	theBlockchain.On("TransactionGet", mock.Anything, mock.Anything, mock.Anything).Return()
+
+	headersDB, err := headersdb.NewDB(test.TstTempFile("account_rescan_test_headers"), nil)
+	require.NoError(t, err)
+	coin := btc.NewCoin("tbtc", "TBTC", net, dbFolder, nil, nil, false, "")
+	coin.TstSetBlockchain(theBlockchain, headers.NewHeaders(net, headersDB, theBlockchain, false, log))
+	defer coin.Close()
+	account := btc.NewAccount(coin, dbFolder, nil, "tbtc-rescan", "tbtc-rescan",
+		func() (*signing.Configuration, error) { return configuration, nil },
+		keystore.NewKeystores(), nil, func(btc.Event) {}, log)
+	require.NoError(t, account.Initialize())
+	defer account.Close()
+
+	statusCallback := func() func(string) error {
+		defer lock.Lock()()
+		return statusCallbacks[address.PubkeyScriptHashHex()]
+	}
+	require.NoError(t, statusCallback()("status"))
+	staleHistoryCallback := func() func(blockchain.TxHistory) error {
+		defer lock.Lock()()
+		require.Len(t, historyCallbacks, 1)
+		return historyCallbacks[0]
+	}()
+
+	require.NoError(t, account.Rescan(nil))
+	txHash := blockchain.TXHash(chainhash.HashH([]byte("tx")))
+	require.NoError(t, staleHistoryCallback(blockchain.TxHistory{{TXHash: txHash, Height: 10}}))
+	theBlockchain.AssertNotCalled(t, "TransactionGet", mock.Anything, mock.Anything, mock.Anything)
+
+	// The subscription of the rescan is processed.
+	require.NoError(t, statusCallback()("status"))
+	historyCallback := func() func(blockchain.TxHistory) error {
+		defer lock.Lock()()
+		require.Len(t, historyCallbacks, 2)
+		return historyCallbacks[1]
+	}()
+	require.NoError(t, historyCallback(blockchain.TxHistory{{TXHash: txHash, Height: 10}}))
+	theBlockchain.AssertCalled(t, "TransactionGet", chainhash.Hash(txHash), mock.Anything, mock.Anything)
+}
@@ -99,6 +99,11 @@ func (addresses *AddressChain) unusedTailCount() int {
 	return count
 }
 
+// Addresses returns all addresses of the chain.
+func (addresses *AddressChain) Addresses() []*AccountAddress {
+	return append([]*AccountAddress{}, addresses.addresses...)
+}
+
 // LookupByScriptHashHex returns the address which matches the provided scriptHashHex. Returns nil
 // if not found.
 func (addresses *AddressChain) LookupByScriptHashHex(hashHex blockchain.ScriptHashHex) *AccountAddress {
@@ -101,8 +101,9 @@ const (
 type Interface interface {
 	ScriptHashGetHistory(ScriptHashHex, func(TxHistory) error, func())
 	TransactionGet(chainhash.Hash, func(*wire.MsgTx) error, func())
-	ScriptHashSubscribe(func() func(), ScriptHashHex, func(string) error)
-	HeadersSubscribe(func() func(), func(*Header) error)
+	// ScriptHashSubscribe and HeadersSubscribe return a function to unsubscribe again.
+	ScriptHashSubscribe(func() func(), ScriptHashHex, func(string) error) func()
+	HeadersSubscribe(func() func(), func(*Header) error) func()
 	TransactionBroadcast(*wire.MsgTx) error
 	RelayFee(func(btcutil.Amount) error, func())
 	EstimateFee(int, func(*btcutil.Amount) error, func())
@@ -110,5 +111,6 @@ type Interface interface {
 	GetMerkle(chainhash.Hash, int, func(merkle []TXHash, pos int) error, func())
 	Close()
 	ConnectionStatus() Status
-	RegisterOnConnectionStatusChangedEvent(func(Status))
+	// RegisterOnConnectionStatusChangedEvent returns a function to deregister the callback again.
+	RegisterOnConnectionStatusChangedEvent(func(Status)) func()
 }
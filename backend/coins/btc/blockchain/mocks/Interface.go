@@ -48,13 +48,35 @@ func (_m *Interface) Headers(_a0 int, _a1 int, _a2 func([]*wire.BlockHeader, int
 }
 
 // HeadersSubscribe provides a mock function with given fields: _a0, _a1
-func (_m *Interface) HeadersSubscribe(_a0 func() func(), _a1 func(*blockchain.Header) error) {
-	_m.Called(_a0, _a1)
+func (_m *Interface) HeadersSubscribe(_a0 func() func(), _a1 func(*blockchain.Header) error) func() {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 func()
+	if rf, ok := ret.Get(0).(func(func() func(), func(*blockchain.Header) error) func()); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func())
+		}
+	}
+
+	return r0
 }
 
 // RegisterOnConnectionStatusChangedEvent provides a mock function with given fields: _a0
-func (_m *Interface) RegisterOnConnectionStatusChangedEvent(_a0 func(blockchain.Status)) {
-	_m.Called(_a0)
+func (_m *Interface) RegisterOnConnectionStatusChangedEvent(_a0 func(blockchain.Status)) func() {
+	ret := _m.Called(_a0)
+
+	var r0 func()
+	if rf, ok := ret.Get(0).(func(func(blockchain.Status)) func()); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func())
+		}
+	}
+
+	return r0
 }
 
 // RelayFee provides a mock function with given fields: _a0, _a1
@@ -68,8 +90,19 @@ func (_m *Interface) ScriptHashGetHistory(_a0 blockchain.ScriptHashHex, _a1 func
 }
 
 // ScriptHashSubscribe provides a mock function with given fields: _a0, _a1, _a2
-func (_m *Interface) ScriptHashSubscribe(_a0 func() func(), _a1 blockchain.ScriptHashHex, _a2 func(string) error) {
-	_m.Called(_a0, _a1, _a2)
+func (_m *Interface) ScriptHashSubscribe(_a0 func() func(), _a1 blockchain.ScriptHashHex, _a2 func(string) error) func() {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 func()
+	if rf, ok := ret.Get(0).(func(func() func(), blockchain.ScriptHashHex, func(string) error) func()); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(func())
+		}
+	}
+
+	return r0
 }
 
 // TransactionBroadcast provides a mock function with given fields: _a0
@@ -17,6 +17,7 @@ package btc
 import (
 	"fmt"
 	"math/big"
+	"os"
 	"path"
 	"strings"
 	"sync"
@@ -24,9 +25,12 @@ import (
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/db/headersdb"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/db/headersfile"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/electrum"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
 	coinpkg "github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/observable"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/observable/action"
@@ -37,28 +41,36 @@ import (
 // Coin models a Bitcoin-related coin.
 type Coin struct {
 	initOnce              sync.Once
+	closeOnce             sync.Once
 	code                  string
 	unit                  string
 	net                   *chaincfg.Params
 	dbFolder              string
+	dbKey                 *encryption.Key
 	servers               []*rpc.ServerInfo
+	discoverServers       bool
 	blockExplorerTxPrefix string
 
 	observable.Implementation
 
-	blockchain blockchain.Interface
-	headers    *headers.Headers
+	electrumServers *electrum.Servers
+	blockchain      blockchain.Interface
+	headers         *headers.Headers
 
 	log *logrus.Entry
 }
 
-// NewCoin creates a new coin with the given parameters.
+// NewCoin creates a new coin with the given parameters. The headers and the server list are
+// encrypted with dbKey, unless it is nil. If discoverServers is true, the servers announced by the
+// configured servers are used as well.
 func NewCoin(
 	code string,
 	unit string,
 	net *chaincfg.Params,
 	dbFolder string,
+	dbKey *encryption.Key,
 	servers []*rpc.ServerInfo,
+	discoverServers bool,
 	blockExplorerTxPrefix string,
 ) *Coin {
 	coin := &Coin{
@@ -66,7 +78,9 @@ func NewCoin(
 		unit:                  unit,
 		net:                   net,
 		dbFolder:              dbFolder,
+		dbKey:                 dbKey,
 		servers:               servers,
+		discoverServers:       discoverServers,
 		blockExplorerTxPrefix: blockExplorerTxPrefix,
 
 		log: logging.Get().WithGroup("coin").WithField("code", code),
@@ -78,18 +92,27 @@ func NewCoin(
 func (coin *Coin) Initialize() {
 	coin.initOnce.Do(func() {
 		// Init blockchain
-		coin.blockchain = electrum.NewElectrumConnection(coin.servers, coin.log)
+		coin.electrumServers = electrum.NewServers(
+			path.Join(coin.dbFolder, fmt.Sprintf("electrum-servers-%s.json", coin.code)),
+			coin.dbKey,
+			coin.servers,
+			coin.discoverServers,
+			coin.net,
+			coin.log)
+		coin.blockchain = electrum.NewElectrumConnection(coin.electrumServers, coin.log)
 
 		// Init Headers
-		db, err := headersdb.NewDB(
-			path.Join(coin.dbFolder, fmt.Sprintf("headers-%s.db", coin.code)))
+		db, err := headersfile.NewDB(
+			path.Join(coin.dbFolder, fmt.Sprintf("headers-%s.bin", coin.code)), coin.dbKey)
 		if err != nil {
 			coin.log.WithError(err).Panic("Could not open headers DB")
 		}
+		coin.importLegacyHeaders(db)
 		coin.headers = headers.NewHeaders(
 			coin.net,
 			db,
 			coin.blockchain,
+			len(coin.net.Checkpoints) != 0,
 			coin.log)
 		coin.headers.Initialize()
 		coin.headers.SubscribeEvent(func(event headers.Event) {
@@ -108,6 +131,48 @@ func (coin *Coin) Initialize() {
 	})
 }
 
+// importLegacyHeaders moves the headers of the bolt database, in which they were stored before the
+// headers file, into the headers file. Errors are only logged, as the headers can be downloaded
+// again.
+func (coin *Coin) importLegacyHeaders(db *headersfile.DB) {
+	filename := path.Join(coin.dbFolder, fmt.Sprintf("headers-%s.db", coin.code))
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return
+	}
+	err := func() error {
+		// The database is in plaintext if it was not encrypted when the encryption was enabled.
+		legacyDB, err := headersdb.NewDB(filename, nil)
+		if errp.Cause(err) == encryption.ErrLocked {
+			legacyDB, err = headersdb.NewDB(filename, coin.dbKey)
+		}
+		if err != nil {
+			return err
+		}
+		defer func() { _ = legacyDB.Close() }()
+		return db.Import(legacyDB)
+	}()
+	if err != nil {
+		coin.log.WithError(err).Error("Could not import the legacy headers DB")
+	}
+	if err := os.Remove(filename); err != nil {
+		coin.log.WithError(err).Error("Could not remove the legacy headers DB")
+	}
+}
+
+// Close implements coin.Coin.
+func (coin *Coin) Close() {
+	coin.closeOnce.Do(func() {
+		// Prevents a later initialization.
+		coin.initOnce.Do(func() {})
+		if coin.headers != nil {
+			coin.headers.Close()
+		}
+		if coin.blockchain != nil {
+			coin.blockchain.Close()
+		}
+	})
+}
+
 // Code implements coin.Coin.
 func (coin *Coin) Code() string {
 	return coin.code
@@ -141,6 +206,12 @@ func (coin *Coin) Blockchain() blockchain.Interface {
 	return coin.blockchain
 }
 
+// ElectrumServers returns the Electrum servers known for the coin. It is nil before the coin is
+// initialized.
+func (coin *Coin) ElectrumServers() *electrum.Servers {
+	return coin.electrumServers
+}
+
 // Headers returns the coin headers.
 func (coin *Coin) Headers() *headers.Headers {
 	return coin.headers
@@ -21,24 +21,42 @@ import (
 	"github.com/btcsuite/btcd/wire"
 	bbolt "github.com/coreos/bbolt"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/dbschema"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 )
 
 // DB is a bbolt key/value database.
 type DB struct {
-	db *bbolt.DB
+	db  *bbolt.DB
+	key *encryption.Key
 }
 
-// NewDB creates/opens a new db.
-func NewDB(filename string) (*DB, error) {
-	db, err := bbolt.Open(filename, 0600, nil)
+// migrations are the schema migrations of the database, see dbschema.Migrate. The schema has not
+// changed since the version was introduced.
+var migrations = []dbschema.Migration{}
+
+// NewDB creates/opens a new db. The entries are encrypted with the key, unless it is nil. The
+// database is migrated to the current schema version.
+func NewDB(filename string, key *encryption.Key) (*DB, error) {
+	db, err := encryption.OpenDB(filename, key)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	if err := dbschema.Migrate(db, key, migrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &DB{db: db, key: key}, nil
+}
+
+// Close implements headers.DBInterface.
+func (db *DB) Close() error {
+	return errp.WithStack(db.db.Close())
 }
 
 const (
+	bucketRoot    = "headers"
 	bucketInfo    = "info"
 	bucketHeaders = "headers"
 )
@@ -49,22 +67,22 @@ func (db *DB) Begin() (headers.DBTxInterface, error) {
 	if err != nil {
 		return nil, err
 	}
-	bucket, err := tx.CreateBucketIfNotExists([]byte("headers"))
+	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketRoot))
 	if err != nil {
 		return nil, err
 	}
-	bucketInfo, err := bucket.CreateBucketIfNotExists([]byte(bucketInfo))
+	infoBucket, err := bucket.CreateBucketIfNotExists([]byte(bucketInfo))
 	if err != nil {
 		return nil, err
 	}
-	bucketHeaders, err := bucket.CreateBucketIfNotExists([]byte(bucketHeaders))
+	headersBucket, err := bucket.CreateBucketIfNotExists([]byte(bucketHeaders))
 	if err != nil {
 		return nil, err
 	}
 	return &Tx{
 		tx:            tx,
-		bucketInfo:    bucketInfo,
-		bucketHeaders: bucketHeaders,
+		bucketInfo:    encryption.NewBucket(infoBucket, bucketRoot+"/"+bucketInfo, db.key),
+		bucketHeaders: encryption.NewBucket(headersBucket, bucketRoot+"/"+bucketHeaders, db.key),
 	}, nil
 }
 
@@ -72,8 +90,8 @@ func (db *DB) Begin() (headers.DBTxInterface, error) {
 type Tx struct {
 	tx *bbolt.Tx
 
-	bucketInfo    *bbolt.Bucket
-	bucketHeaders *bbolt.Bucket
+	bucketInfo    *encryption.Bucket
+	bucketHeaders *encryption.Bucket
 }
 
 // Rollback implements headers.DBTxInterface.
@@ -102,7 +120,11 @@ func (tx *Tx) PutTip(tip int) error {
 
 // Tip implements headers.DBTxInterface.
 func (tx *Tx) Tip() (int, error) {
-	if value := tx.bucketInfo.Get([]byte("tip")); value != nil {
+	value, err := tx.bucketInfo.Get([]byte("tip"))
+	if err != nil {
+		return 0, err
+	}
+	if value != nil {
 		var tip int64
 		if err := binary.Read(bytes.NewReader(value), binary.BigEndian, &tip); err != nil {
 			return 0, errp.WithStack(err)
@@ -113,13 +135,46 @@ func (tx *Tx) Tip() (int, error) {
 	return -1, nil
 }
 
-// PutHeader implements headers.DBTxInterface.
-func (tx *Tx) PutHeader(tip int, header *wire.BlockHeader) error {
+// PutBase implements headers.DBTxInterface.
+func (tx *Tx) PutBase(base int) error {
+	return tx.bucketInfo.Put([]byte("base"), serInt(base))
+}
+
+// Base implements headers.DBTxInterface.
+func (tx *Tx) Base() (int, error) {
+	value, err := tx.bucketInfo.Get([]byte("base"))
+	if err != nil {
+		return 0, err
+	}
+	if value != nil {
+		var base int64
+		if err := binary.Read(bytes.NewReader(value), binary.BigEndian, &base); err != nil {
+			return 0, errp.WithStack(err)
+		}
+		return int(base), nil
+	}
+	return 0, nil
+}
+
+func (tx *Tx) putHeader(height int, header *wire.BlockHeader) error {
 	var headerSer bytes.Buffer
 	if err := header.Serialize(&headerSer); err != nil {
 		return errp.WithStack(err)
 	}
-	if err := tx.bucketHeaders.Put(serInt(tip), headerSer.Bytes()); err != nil {
+	return tx.bucketHeaders.Put(serInt(height), headerSer.Bytes())
+}
+
+// PutBaseHeader implements headers.DBTxInterface.
+func (tx *Tx) PutBaseHeader(base int, header *wire.BlockHeader) error {
+	if err := tx.putHeader(base, header); err != nil {
+		return err
+	}
+	return tx.PutBase(base)
+}
+
+// PutHeader implements headers.DBTxInterface.
+func (tx *Tx) PutHeader(tip int, header *wire.BlockHeader) error {
+	if err := tx.putHeader(tip, header); err != nil {
 		return err
 	}
 	return tx.PutTip(tip)
@@ -131,10 +186,18 @@ func (tx *Tx) HeaderByHeight(height int) (*wire.BlockHeader, error) {
 	if err != nil {
 		return nil, err
 	}
-	if tip < height {
+	base, err := tx.Base()
+	if err != nil {
+		return nil, err
+	}
+	if height < base || tip < height {
 		return nil, nil
 	}
-	if value := tx.bucketHeaders.Get(serInt(height)); value != nil {
+	value, err := tx.bucketHeaders.Get(serInt(height))
+	if err != nil {
+		return nil, err
+	}
+	if value != nil {
 		header := &wire.BlockHeader{}
 		if err := header.Deserialize(bytes.NewReader(value)); err != nil {
 			return nil, errp.WithStack(err)
@@ -0,0 +1,419 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package headersfile stores block headers in a flat file.
+package headersfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sort"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+)
+
+// headerSize is the size of a serialized block header.
+const headerSize = 80
+
+// importBatchSize is the number of headers imported per transaction by Import().
+const importBatchSize = 2016
+
+// index holds the range of the stored headers. It is stored next to the headers file.
+type index struct {
+	Base int `json:"base"`
+	Tip  int `json:"tip"`
+	// Encrypted is true if the headers are encrypted.
+	Encrypted bool `json:"encrypted"`
+}
+
+// DB stores the serialized header at height h at offset h*80 of the headers file. Headers are
+// appended at the tip, and written below the base when the headers before a checkpoint are
+// downloaded. The range of the stored headers is kept in an index file, which is replaced after
+// the headers are written, so that an interrupted write does not corrupt the store. If the
+// encryption is enabled, every header is encrypted on its own, so the records still have a fixed
+// size and the header at height h is found at offset h*recordSize.
+type DB struct {
+	lock          locker.Locker
+	file          *os.File
+	indexFilename string
+	index         index
+	key           *encryption.Key
+	// recordSize is the size of a stored header.
+	recordSize int
+}
+
+// NewDB creates/opens the headers file with the given name. The index is stored in the file with
+// the suffix ".index". The headers and the index are encrypted with the key, unless it is nil.
+// Headers which were stored with a different key or without the encryption are discarded, as they
+// can be downloaded again.
+func NewDB(filename string, key *encryption.Key) (*DB, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	db := &DB{
+		file:          file,
+		indexFilename: filename + ".index",
+		index:         index{Base: 0, Tip: -1, Encrypted: key != nil},
+		key:           key,
+		recordSize:    headerSize,
+	}
+	if key != nil {
+		record, err := key.Encrypt(make([]byte, headerSize))
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		db.recordSize = len(record)
+	}
+	if err := db.loadIndex(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) loadIndex() error {
+	jsonBytes, err := encryption.ReadFile(db.indexFilename, db.key)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	switch errp.Cause(err) {
+	case encryption.ErrLocked, encryption.ErrWrongKey, encryption.ErrPlaintext:
+		return db.reset()
+	}
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	var storedIndex index
+	if err := json.Unmarshal(jsonBytes, &storedIndex); err != nil {
+		return errp.WithStack(err)
+	}
+	if storedIndex.Encrypted != (db.key != nil) {
+		return db.reset()
+	}
+	if storedIndex.Base < 0 || storedIndex.Tip < storedIndex.Base-1 {
+		return errp.Newf("invalid headers index %+v", storedIndex)
+	}
+	info, err := db.file.Stat()
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if stored := int(info.Size()/int64(db.recordSize)) - 1; stored < storedIndex.Tip {
+		return errp.Newf("the headers file ends at %d, expected %d", stored, storedIndex.Tip)
+	}
+	db.index = storedIndex
+	return nil
+}
+
+// reset discards the stored headers.
+func (db *DB) reset() error {
+	if err := db.storeIndex(index{Base: 0, Tip: -1, Encrypted: db.key != nil}); err != nil {
+		return err
+	}
+	return errp.WithStack(db.file.Truncate(0))
+}
+
+// storeIndex replaces the index file.
+func (db *DB) storeIndex(newIndex index) error {
+	jsonBytes, err := json.Marshal(newIndex)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	jsonBytes, err = encryption.EncodeFile(jsonBytes, db.key)
+	if err != nil {
+		return err
+	}
+	tmpFilename := db.indexFilename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if _, err := file.Write(jsonBytes); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Close(); err != nil {
+		return errp.WithStack(err)
+	}
+	if err := os.Rename(tmpFilename, db.indexFilename); err != nil {
+		return errp.WithStack(err)
+	}
+	db.index = newIndex
+	return nil
+}
+
+// Begin implements headers.DBInterface.
+func (db *DB) Begin() (headers.DBTxInterface, error) {
+	defer db.lock.RLock()()
+	return &Tx{
+		db:      db,
+		index:   db.index,
+		pending: map[int]*wire.BlockHeader{},
+	}, nil
+}
+
+// record returns the header as it is stored in the headers file.
+func (db *DB) record(header *wire.BlockHeader) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := header.Serialize(&buffer); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if db.key == nil {
+		return buffer.Bytes(), nil
+	}
+	return db.key.Encrypt(buffer.Bytes())
+}
+
+// Import copies the headers of another store, e.g. the bolt database used before the headers file,
+// if no headers are stored yet.
+func (db *DB) Import(source headers.DBInterface) error {
+	sourceTx, err := source.Begin()
+	if err != nil {
+		return err
+	}
+	defer sourceTx.Rollback()
+	base, err := sourceTx.Base()
+	if err != nil {
+		return err
+	}
+	tip, err := sourceTx.Tip()
+	if err != nil {
+		return err
+	}
+	empty := func() bool {
+		defer db.lock.RLock()()
+		return db.index.Tip < db.index.Base
+	}()
+	if tip < base || !empty {
+		return nil
+	}
+	importBatch := func(start int) error {
+		dbTx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer dbTx.Rollback()
+		if start == base {
+			if err := dbTx.PutBase(base); err != nil {
+				return err
+			}
+		}
+		for height := start; height <= tip && height < start+importBatchSize; height++ {
+			header, err := sourceTx.HeaderByHeight(height)
+			if err != nil {
+				return err
+			}
+			if header == nil {
+				return errp.Newf("header %d is missing", height)
+			}
+			if err := dbTx.PutHeader(height, header); err != nil {
+				return err
+			}
+		}
+		return dbTx.Commit()
+	}
+	for start := base; start <= tip; start += importBatchSize {
+		if err := importBatch(start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements headers.DBInterface.
+func (db *DB) Close() error {
+	return errp.WithStack(db.file.Close())
+}
+
+// Tx implements headers.DBTxInterface. The changes are kept in memory until they are committed.
+type Tx struct {
+	db     *DB
+	closed bool
+	index  index
+	// pending are the headers written in this transaction.
+	pending map[int]*wire.BlockHeader
+}
+
+// Rollback implements headers.DBTxInterface.
+func (tx *Tx) Rollback() {
+	tx.closed = true
+}
+
+// runs returns the pending headers, serialized (and encrypted) and grouped by runs of consecutive
+// heights.
+func (tx *Tx) runs() (map[int][]byte, error) {
+	heights := make([]int, 0, len(tx.pending))
+	for height := range tx.pending {
+		heights = append(heights, height)
+	}
+	sort.Ints(heights)
+	runs := map[int][]byte{}
+	start := -1
+	var buffer bytes.Buffer
+	for index, height := range heights {
+		if index == 0 || height != heights[index-1]+1 {
+			if start != -1 {
+				runs[start] = append([]byte{}, buffer.Bytes()...)
+			}
+			start = height
+			buffer.Reset()
+		}
+		record, err := tx.db.record(tx.pending[height])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(record)
+	}
+	if start != -1 {
+		runs[start] = buffer.Bytes()
+	}
+	return runs, nil
+}
+
+// Commit implements headers.DBTxInterface.
+func (tx *Tx) Commit() error {
+	if tx.closed {
+		return errp.New("the transaction is closed")
+	}
+	tx.closed = true
+	db := tx.db
+	defer db.lock.Lock()()
+	if len(tx.pending) == 0 && tx.index == db.index {
+		return nil
+	}
+	runs, err := tx.runs()
+	if err != nil {
+		return err
+	}
+	for start, run := range runs {
+		if _, err := db.file.WriteAt(run, int64(start)*int64(db.recordSize)); err != nil {
+			return errp.WithStack(err)
+		}
+	}
+	if err := db.file.Sync(); err != nil {
+		return errp.WithStack(err)
+	}
+	if err := db.storeIndex(tx.index); err != nil {
+		return err
+	}
+	// Drop the headers above the tip after a reorg. The index is already updated, so the file
+	// is only longer than needed if this fails.
+	if err := db.file.Truncate(int64(tx.index.Tip+1) * int64(db.recordSize)); err != nil {
+		return errp.WithStack(err)
+	}
+	return nil
+}
+
+// PutHeader implements headers.DBTxInterface.
+func (tx *Tx) PutHeader(tip int, header *wire.BlockHeader) error {
+	if tip < tx.index.Base || tip > tx.index.Tip+1 {
+		return errp.Newf("cannot store header %d, the stored headers are %d to %d",
+			tip, tx.index.Base, tx.index.Tip)
+	}
+	tx.pending[tip] = header
+	return tx.PutTip(tip)
+}
+
+// PutBaseHeader implements headers.DBTxInterface.
+func (tx *Tx) PutBaseHeader(base int, header *wire.BlockHeader) error {
+	if base != tx.index.Base-1 {
+		return errp.Newf("cannot store header %d below the base %d", base, tx.index.Base)
+	}
+	tx.pending[base] = header
+	tx.index.Base = base
+	return nil
+}
+
+// HeaderByHeight implements headers.DBTxInterface.
+func (tx *Tx) HeaderByHeight(height int) (*wire.BlockHeader, error) {
+	if height < tx.index.Base || height > tx.index.Tip {
+		return nil, nil
+	}
+	if header, ok := tx.pending[height]; ok {
+		return header, nil
+	}
+	record := make([]byte, tx.db.recordSize)
+	if _, err := tx.db.file.ReadAt(record, int64(height)*int64(tx.db.recordSize)); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	serialized := record
+	if tx.db.key != nil {
+		var err error
+		serialized, err = tx.db.key.Decrypt(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header := &wire.BlockHeader{}
+	if err := header.Deserialize(bytes.NewReader(serialized)); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return header, nil
+}
+
+// PutTip implements headers.DBTxInterface.
+func (tx *Tx) PutTip(tip int) error {
+	if tip < tx.index.Base-1 || tip > tx.index.Tip+1 {
+		return errp.Newf("invalid tip %d, the stored headers are %d to %d",
+			tip, tx.index.Base, tx.index.Tip)
+	}
+	if tip == tx.index.Tip+1 {
+		if _, ok := tx.pending[tip]; !ok {
+			return errp.Newf("the header at the tip %d is not stored", tip)
+		}
+	}
+	if tip < tx.index.Tip {
+		for height := range tx.pending {
+			if height > tip {
+				delete(tx.pending, height)
+			}
+		}
+	}
+	tx.index.Tip = tip
+	return nil
+}
+
+// Tip implements headers.DBTxInterface.
+func (tx *Tx) Tip() (int, error) {
+	return tx.index.Tip, nil
+}
+
+// PutBase implements headers.DBTxInterface. The base can only be moved if no headers are stored.
+func (tx *Tx) PutBase(base int) error {
+	if tx.index.Tip >= tx.index.Base {
+		return errp.New("cannot move the base while headers are stored")
+	}
+	if base < 0 {
+		return errp.Newf("invalid base %d", base)
+	}
+	tx.index.Base = base
+	tx.index.Tip = base - 1
+	tx.pending = map[int]*wire.BlockHeader{}
+	return nil
+}
+
+// Base implements headers.DBTxInterface.
+func (tx *Tx) Base() (int, error) {
+	return tx.index.Base, nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package headersfile_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/db/headersdb"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/db/headersfile"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+// newHeader returns a distinct header for every height.
+func newHeader(height int) *wire.BlockHeader {
+	header := chaincfg.MainNetParams.GenesisBlock.Header
+	header.Nonce = uint32(height)
+	return &header
+}
+
+func requireHeaders(t *testing.T, db headers.DBInterface, base int, tip int) {
+	t.Helper()
+	dbTx, err := db.Begin()
+	require.NoError(t, err)
+	defer dbTx.Rollback()
+	storedBase, err := dbTx.Base()
+	require.NoError(t, err)
+	require.Equal(t, base, storedBase)
+	storedTip, err := dbTx.Tip()
+	require.NoError(t, err)
+	require.Equal(t, tip, storedTip)
+	for height := base - 1; height <= tip+1; height++ {
+		header, err := dbTx.HeaderByHeight(height)
+		require.NoError(t, err)
+		if height < base || height > tip {
+			require.Nil(t, header)
+		} else {
+			require.Equal(t, newHeader(height), header)
+		}
+	}
+}
+
+func TestDB(t *testing.T) {
+	filename := test.TstTempFile("headersfile_test")
+	db, err := headersfile.NewDB(filename, nil)
+	require.NoError(t, err)
+	requireHeaders(t, db, 0, -1)
+
+	// Start at a checkpoint.
+	dbTx, err := db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, dbTx.PutBase(100))
+	for height := 100; height < 150; height++ {
+		require.NoError(t, dbTx.PutHeader(height, newHeader(height)))
+	}
+	require.Error(t, dbTx.PutHeader(160, newHeader(160)))
+	header, err := dbTx.HeaderByHeight(120)
+	require.NoError(t, err)
+	require.Equal(t, newHeader(120), header)
+	require.NoError(t, dbTx.Commit())
+	requireHeaders(t, db, 100, 149)
+
+	// Changes are discarded by a rollback.
+	dbTx, err = db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, dbTx.PutHeader(150, newHeader(150)))
+	dbTx.Rollback()
+	requireHeaders(t, db, 100, 149)
+
+	// Reorg and backfill.
+	dbTx, err = db.Begin()
+	require.NoError(t, err)
+	require.Error(t, dbTx.PutBase(0))
+	require.NoError(t, dbTx.PutTip(139))
+	require.NoError(t, dbTx.PutHeader(140, newHeader(140)))
+	for height := 99; height >= 90; height-- {
+		require.NoError(t, dbTx.PutBaseHeader(height, newHeader(height)))
+	}
+	require.Error(t, dbTx.PutBaseHeader(80, newHeader(80)))
+	require.NoError(t, dbTx.Commit())
+	requireHeaders(t, db, 90, 140)
+	require.NoError(t, db.Close())
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, int64(141*80), info.Size())
+
+	db, err = headersfile.NewDB(filename, nil)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	requireHeaders(t, db, 90, 140)
+}
+
+func putHeaders(t *testing.T, db headers.DBInterface, base int, tip int) {
+	t.Helper()
+	dbTx, err := db.Begin()
+	require.NoError(t, err)
+	defer dbTx.Rollback()
+	require.NoError(t, dbTx.PutBase(base))
+	for height := base; height <= tip; height++ {
+		require.NoError(t, dbTx.PutHeader(height, newHeader(height)))
+	}
+	require.NoError(t, dbTx.Commit())
+}
+
+func TestDBEncrypted(t *testing.T) {
+	filename := test.TstTempFile("headersfile_test")
+	key := encryption.NewKey([]byte("secret"))
+	db, err := headersfile.NewDB(filename, key)
+	require.NoError(t, err)
+	putHeaders(t, db, 100, 149)
+	requireHeaders(t, db, 100, 149)
+	require.NoError(t, db.Close())
+
+	var serialized bytes.Buffer
+	require.NoError(t, newHeader(120).Serialize(&serialized))
+	contents, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(contents, serialized.Bytes()))
+
+	db, err = headersfile.NewDB(filename, key)
+	require.NoError(t, err)
+	requireHeaders(t, db, 100, 149)
+	require.NoError(t, db.Close())
+
+	// The headers are downloaded again if they can't be decrypted.
+	db, err = headersfile.NewDB(filename, encryption.NewKey([]byte("other")))
+	require.NoError(t, err)
+	requireHeaders(t, db, 0, -1)
+	require.NoError(t, db.Close())
+
+	// Plaintext headers are discarded once the encryption is enabled.
+	db, err = headersfile.NewDB(filename, nil)
+	require.NoError(t, err)
+	putHeaders(t, db, 0, 10)
+	require.NoError(t, db.Close())
+	db, err = headersfile.NewDB(filename, key)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	requireHeaders(t, db, 0, -1)
+}
+
+func TestImport(t *testing.T) {
+	key := encryption.NewKey([]byte("secret"))
+	legacyDB, err := headersdb.NewDB(test.TstTempFile("headersfile_test_legacy"), key)
+	require.NoError(t, err)
+	defer func() { _ = legacyDB.Close() }()
+	putHeaders(t, legacyDB, 0, 5000)
+
+	db, err := headersfile.NewDB(test.TstTempFile("headersfile_test"), key)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.NoError(t, db.Import(legacyDB))
+	requireHeaders(t, db, 0, 5000)
+
+	// Stored headers are not replaced.
+	otherDB, err := headersfile.NewDB(test.TstTempFile("headersfile_test"), key)
+	require.NoError(t, err)
+	defer func() { _ = otherDB.Close() }()
+	putHeaders(t, otherDB, 100, 110)
+	require.NoError(t, otherDB.Import(legacyDB))
+	requireHeaders(t, otherDB, 100, 110)
+}
+
+// benchmarkPutHeaders stores the headers in batches, like the sync of the headers does.
+func benchmarkPutHeaders(b *testing.B, newDB func(filename string) (headers.DBInterface, error)) {
+	const batchSize = 2016
+	batch := make([]*wire.BlockHeader, batchSize)
+	for index := range batch {
+		batch[index] = newHeader(index)
+	}
+	db, err := newDB(test.TstTempFile("headersfile_benchmark"))
+	require.NoError(b, err)
+	defer func() { _ = db.Close() }()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dbTx, err := db.Begin()
+		require.NoError(b, err)
+		tip, err := dbTx.Tip()
+		require.NoError(b, err)
+		for _, header := range batch {
+			tip++
+			require.NoError(b, dbTx.PutHeader(tip, header))
+		}
+		require.NoError(b, dbTx.Commit())
+	}
+}
+
+func BenchmarkPutHeadersFile(b *testing.B) {
+	benchmarkPutHeaders(b, func(filename string) (headers.DBInterface, error) {
+		return headersfile.NewDB(filename, nil)
+	})
+}
+
+func BenchmarkPutHeadersBolt(b *testing.B) {
+	benchmarkPutHeaders(b, func(filename string) (headers.DBInterface, error) {
+		return headersdb.NewDB(filename, nil)
+	})
+}
+
+// benchmarkHeaderByHeight reads the headers of a retarget window, like the verification of the
+// difficulty does.
+func benchmarkHeaderByHeight(b *testing.B, newDB func(filename string) (headers.DBInterface, error)) {
+	const count = 2016
+	db, err := newDB(test.TstTempFile("headersfile_benchmark"))
+	require.NoError(b, err)
+	defer func() { _ = db.Close() }()
+	dbTx, err := db.Begin()
+	require.NoError(b, err)
+	for height := 0; height < count; height++ {
+		require.NoError(b, dbTx.PutHeader(height, newHeader(height)))
+	}
+	require.NoError(b, dbTx.Commit())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dbTx, err := db.Begin()
+		require.NoError(b, err)
+		for height := 0; height < count; height++ {
+			if _, err := dbTx.HeaderByHeight(height); err != nil {
+				b.Fatal(err)
+			}
+		}
+		dbTx.Rollback()
+	}
+}
+
+func BenchmarkHeaderByHeightFile(b *testing.B) {
+	benchmarkHeaderByHeight(b, func(filename string) (headers.DBInterface, error) {
+		return headersfile.NewDB(filename, nil)
+	})
+}
+
+func BenchmarkHeaderByHeightBolt(b *testing.B) {
+	benchmarkHeaderByHeight(b, func(filename string) (headers.DBInterface, error) {
+		return headersdb.NewDB(filename, nil)
+	})
+}
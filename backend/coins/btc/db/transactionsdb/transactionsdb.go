@@ -24,6 +24,8 @@ import (
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/transactions"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/util"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/dbschema"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 )
 
@@ -33,20 +35,37 @@ const (
 	bucketInputs                 = "inputs"
 	bucketOutputs                = "outputs"
 	bucketAddressHistories       = "addressHistories"
+	bucketFrozenOutputs          = "frozenOutputs"
 )
 
 // DB is a bbolt key/value database.
 type DB struct {
-	db *bbolt.DB
+	db  *bbolt.DB
+	key *encryption.Key
 }
 
-// NewDB creates/opens a new db.
-func NewDB(filename string) (*DB, error) {
-	db, err := bbolt.Open(filename, 0600, nil)
+// NewDB creates/opens a new db. The entries are encrypted with the key, unless it is nil. The
+// database is migrated to the current schema version.
+func NewDB(filename string, key *encryption.Key) (*DB, error) {
+	db, err := encryption.OpenDB(filename, key)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	transactionsDB := &DB{db: db, key: key}
+	if err := dbschema.Migrate(db, key, transactionsDB.migrations()); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return transactionsDB, nil
+}
+
+// migrations are the schema migrations of the database, see dbschema.Migrate.
+func (db *DB) migrations() []dbschema.Migration {
+	return []dbschema.Migration{
+		// Version 1: the inputs index stores all transactions spending an outpoint instead of
+		// only the last one processed.
+		db.reindex,
+	}
 }
 
 // Begin implements transactions.Begin.
@@ -55,36 +74,56 @@ func (db *DB) Begin() (transactions.DBTxInterface, error) {
 	if err != nil {
 		return nil, err
 	}
-	bucketTransactions, err := tx.CreateBucketIfNotExists([]byte(bucketTransactions))
-	if err != nil {
-		return nil, err
-	}
-	bucketUnverifiedTransactions, err := tx.CreateBucketIfNotExists([]byte(bucketUnverifiedTransactions))
-	if err != nil {
-		return nil, err
-	}
-	bucketInputs, err := tx.CreateBucketIfNotExists([]byte(bucketInputs))
-	if err != nil {
-		return nil, err
-	}
-	bucketOutputs, err := tx.CreateBucketIfNotExists([]byte(bucketOutputs))
+	wrappedTx, err := db.wrapTx(tx)
 	if err != nil {
+		_ = tx.Rollback()
 		return nil, err
 	}
-	bucketAddressHistories, err := tx.CreateBucketIfNotExists([]byte(bucketAddressHistories))
-	if err != nil {
-		return nil, err
+	return wrappedTx, nil
+}
+
+// wrapTx creates the buckets if they do not exist yet and wraps the db transaction.
+func (db *DB) wrapTx(tx *bbolt.Tx) (*Tx, error) {
+	buckets := map[string]*encryption.Bucket{}
+	for _, name := range []string{
+		bucketTransactions,
+		bucketUnverifiedTransactions,
+		bucketInputs,
+		bucketOutputs,
+		bucketAddressHistories,
+		bucketFrozenOutputs,
+	} {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return nil, err
+		}
+		buckets[name] = encryption.NewBucket(bucket, name, db.key)
 	}
 	return &Tx{
 		tx:                           tx,
-		bucketTransactions:           bucketTransactions,
-		bucketUnverifiedTransactions: bucketUnverifiedTransactions,
-		bucketInputs:                 bucketInputs,
-		bucketOutputs:                bucketOutputs,
-		bucketAddressHistories:       bucketAddressHistories,
+		bucketTransactions:           buckets[bucketTransactions],
+		bucketUnverifiedTransactions: buckets[bucketUnverifiedTransactions],
+		bucketInputs:                 buckets[bucketInputs],
+		bucketOutputs:                buckets[bucketOutputs],
+		bucketAddressHistories:       buckets[bucketAddressHistories],
+		bucketFrozenOutputs:          buckets[bucketFrozenOutputs],
 	}, nil
 }
 
+// Reindex rebuilds the inputs and outputs indexes from the stored raw transactions, without
+// fetching anything from the network.
+func (db *DB) Reindex() error {
+	return errp.WithStack(db.db.Update(db.reindex))
+}
+
+func (db *DB) reindex(boltTx *bbolt.Tx) error {
+	tx, err := db.wrapTx(boltTx)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	return tx.reindex()
+}
+
 // Close implements transactions.Close.
 func (db *DB) Close() error {
 	return errp.WithStack(db.db.Close())
@@ -94,11 +133,12 @@ func (db *DB) Close() error {
 type Tx struct {
 	tx *bbolt.Tx
 
-	bucketTransactions           *bbolt.Bucket
-	bucketUnverifiedTransactions *bbolt.Bucket
-	bucketInputs                 *bbolt.Bucket
-	bucketOutputs                *bbolt.Bucket
-	bucketAddressHistories       *bbolt.Bucket
+	bucketTransactions           *encryption.Bucket
+	bucketUnverifiedTransactions *encryption.Bucket
+	bucketInputs                 *encryption.Bucket
+	bucketOutputs                *encryption.Bucket
+	bucketAddressHistories       *encryption.Bucket
+	bucketFrozenOutputs          *encryption.Bucket
 }
 
 // Rollback implements transactions.DBTxInterface.
@@ -128,14 +168,18 @@ func newWalletTransaction() *walletTransaction {
 	}
 }
 
-func readJSON(bucket *bbolt.Bucket, key []byte, value interface{}) (bool, error) {
-	if jsonBytes := bucket.Get(key); jsonBytes != nil {
+func readJSON(bucket *encryption.Bucket, key []byte, value interface{}) (bool, error) {
+	jsonBytes, err := bucket.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if jsonBytes != nil {
 		return true, errp.WithStack(json.Unmarshal(jsonBytes, value))
 	}
 	return false, nil
 }
 
-func writeJSON(bucket *bbolt.Bucket, key []byte, value interface{}) error {
+func writeJSON(bucket *encryption.Bucket, key []byte, value interface{}) error {
 	jsonBytes, err := json.Marshal(value)
 	if err != nil {
 		return err
@@ -152,6 +196,77 @@ func (tx *Tx) modifyTx(key []byte, f func(value *walletTransaction)) error {
 	return writeJSON(tx.bucketTransactions, key, walletTx)
 }
 
+// clearBucket deletes all entries of the bucket.
+func clearBucket(bucket *encryption.Bucket) error {
+	keys := [][]byte{}
+	err := bucket.ForEach(func(key []byte, _ []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return errp.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// reindex rebuilds the inputs and outputs indexes from the stored transactions. All inputs of a
+// transaction are indexed, and the outputs paying to the addresses the transaction was stored for.
+func (tx *Tx) reindex() error {
+	if err := clearBucket(tx.bucketInputs); err != nil {
+		return err
+	}
+	if err := clearBucket(tx.bucketOutputs); err != nil {
+		return err
+	}
+	type entry struct {
+		txHash   chainhash.Hash
+		walletTx *walletTransaction
+	}
+	entries := []entry{}
+	err := tx.bucketTransactions.ForEach(func(txHashBytes []byte, jsonBytes []byte) error {
+		var txHash chainhash.Hash
+		if err := txHash.SetBytes(txHashBytes); err != nil {
+			return errp.WithStack(err)
+		}
+		walletTx := newWalletTransaction()
+		if err := json.Unmarshal(jsonBytes, walletTx); err != nil {
+			return errp.WithStack(err)
+		}
+		entries = append(entries, entry{txHash: txHash, walletTx: walletTx})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		txHash, walletTx := entry.txHash, entry.walletTx
+		if walletTx.Tx == nil {
+			// Not downloaded yet.
+			continue
+		}
+		for _, txIn := range walletTx.Tx.TxIn {
+			if err := tx.PutInput(txIn.PreviousOutPoint, txHash); err != nil {
+				return err
+			}
+		}
+		for index, txOut := range walletTx.Tx.TxOut {
+			scriptHashHex := chainhash.HashH(txOut.PkScript).String()
+			if !walletTx.Addresses[scriptHashHex] {
+				continue
+			}
+			if err := tx.PutOutput(wire.OutPoint{Hash: txHash, Index: uint32(index)}, txOut); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // TxInfo implements transactions.DBTxInterface.
 func (tx *Tx) TxInfo(txHash chainhash.Hash) (*wire.MsgTx, []string, int, *time.Time, error) {
 	walletTx := newWalletTransaction()
@@ -169,6 +284,11 @@ func (tx *Tx) TxInfo(txHash chainhash.Hash) (*wire.MsgTx, []string, int, *time.T
 func (tx *Tx) PutTx(txHash chainhash.Hash, msgTx *wire.MsgTx, height int) error {
 	var verified *bool
 	err := tx.modifyTx(txHash[:], func(walletTx *walletTransaction) {
+		if walletTx.Height != height {
+			// The tx moved to another block, e.g. after a reorg.
+			walletTx.Verified = nil
+			walletTx.HeaderTimestamp = nil
+		}
 		verified = walletTx.Verified
 		walletTx.Tx = msgTx
 		walletTx.Height = height
@@ -207,15 +327,18 @@ func (tx *Tx) RemoveAddressFromTx(txHash chainhash.Hash, scriptHashHex blockchai
 	return empty, err
 }
 
-func getTransactions(bucket *bbolt.Bucket) ([]chainhash.Hash, error) {
+func getTransactions(bucket *encryption.Bucket) ([]chainhash.Hash, error) {
 	result := []chainhash.Hash{}
-	cursor := bucket.Cursor()
-	for txHashBytes, _ := cursor.First(); txHashBytes != nil; txHashBytes, _ = cursor.Next() {
+	err := bucket.ForEach(func(txHashBytes []byte, _ []byte) error {
 		var txHash chainhash.Hash
 		if err := txHash.SetBytes(txHashBytes); err != nil {
-			return nil, errp.WithStack(err)
+			return errp.WithStack(err)
 		}
 		result = append(result, txHash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return result, nil
 }
@@ -242,23 +365,77 @@ func (tx *Tx) MarkTxVerified(txHash chainhash.Hash, headerTimestamp time.Time) e
 	})
 }
 
-// PutInput implements transactions.DBTxInterface.
+// MarkTxUnverified implements transactions.DBTxInterface.
+func (tx *Tx) MarkTxUnverified(txHash chainhash.Hash) error {
+	if err := tx.modifyTx(txHash[:], func(walletTx *walletTransaction) {
+		walletTx.Verified = nil
+		walletTx.HeaderTimestamp = nil
+	}); err != nil {
+		return err
+	}
+	return tx.bucketUnverifiedTransactions.Put(txHash[:], nil)
+}
+
+// PutInput implements transactions.DBTxInterface. The spending transactions of an outpoint are
+// stored as the concatenation of their hashes.
 func (tx *Tx) PutInput(outPoint wire.OutPoint, txHash chainhash.Hash) error {
-	return tx.bucketInputs.Put([]byte(outPoint.String()), txHash[:])
+	spenders, err := tx.Inputs(outPoint)
+	if err != nil {
+		return err
+	}
+	for _, spender := range spenders {
+		if spender == txHash {
+			return nil
+		}
+	}
+	return tx.putInputs(outPoint, append(spenders, txHash))
 }
 
-// Input implements transactions.DBTxInterface.
-func (tx *Tx) Input(outPoint wire.OutPoint) (*chainhash.Hash, error) {
-	if value := tx.bucketInputs.Get([]byte(outPoint.String())); value != nil {
-		return chainhash.NewHash(value)
+// Inputs implements transactions.DBTxInterface.
+func (tx *Tx) Inputs(outPoint wire.OutPoint) ([]chainhash.Hash, error) {
+	value, err := tx.bucketInputs.Get([]byte(outPoint.String()))
+	if err != nil {
+		return nil, err
+	}
+	if len(value)%chainhash.HashSize != 0 {
+		return nil, errp.Newf("invalid inputs entry for %s", outPoint)
+	}
+	spenders := []chainhash.Hash{}
+	for len(value) != 0 {
+		var spender chainhash.Hash
+		copy(spender[:], value[:chainhash.HashSize])
+		spenders = append(spenders, spender)
+		value = value[chainhash.HashSize:]
 	}
-	return nil, nil
+	return spenders, nil
+}
+
+func (tx *Tx) putInputs(outPoint wire.OutPoint, spenders []chainhash.Hash) error {
+	key := []byte(outPoint.String())
+	if len(spenders) == 0 {
+		return tx.bucketInputs.Delete(key)
+	}
+	value := make([]byte, 0, len(spenders)*chainhash.HashSize)
+	for _, spender := range spenders {
+		value = append(value, spender[:]...)
+	}
+	return tx.bucketInputs.Put(key, value)
 }
 
 // DeleteInput implements transactions.DBTxInterface. It panics if called from a read-only db
 // transaction.
-func (tx *Tx) DeleteInput(outPoint wire.OutPoint) {
-	if err := tx.bucketInputs.Delete([]byte(outPoint.String())); err != nil {
+func (tx *Tx) DeleteInput(outPoint wire.OutPoint, txHash chainhash.Hash) {
+	spenders, err := tx.Inputs(outPoint)
+	if err != nil {
+		panic(err)
+	}
+	remaining := []chainhash.Hash{}
+	for _, spender := range spenders {
+		if spender != txHash {
+			remaining = append(remaining, spender)
+		}
+	}
+	if err := tx.putInputs(outPoint, remaining); err != nil {
 		panic(errp.WithStack(err))
 	}
 }
@@ -284,17 +461,20 @@ func (tx *Tx) Output(outPoint wire.OutPoint) (*wire.TxOut, error) {
 // Outputs implements transactions.DBTxInterface.
 func (tx *Tx) Outputs() (map[wire.OutPoint]*wire.TxOut, error) {
 	outputs := map[wire.OutPoint]*wire.TxOut{}
-	cursor := tx.bucketOutputs.Cursor()
-	for outPointBytes, txOutJSONBytes := cursor.First(); outPointBytes != nil; outPointBytes, txOutJSONBytes = cursor.Next() {
+	err := tx.bucketOutputs.ForEach(func(outPointBytes []byte, txOutJSONBytes []byte) error {
 		txOut := &wire.TxOut{}
 		if err := json.Unmarshal(txOutJSONBytes, txOut); err != nil {
-			return nil, errp.WithStack(err)
+			return errp.WithStack(err)
 		}
 		outPoint, err := util.ParseOutPoint(outPointBytes)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		outputs[*outPoint] = txOut
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return outputs, nil
 }
@@ -318,3 +498,33 @@ func (tx *Tx) AddressHistory(scriptHashHex blockchain.ScriptHashHex) (blockchain
 	_, err := readJSON(tx.bucketAddressHistories, []byte(string(scriptHashHex)), &history)
 	return history, err
 }
+
+// FreezeOutput implements transactions.DBTxInterface.
+func (tx *Tx) FreezeOutput(outPoint wire.OutPoint) error {
+	return tx.bucketFrozenOutputs.Put([]byte(outPoint.String()), nil)
+}
+
+// UnfreezeOutput implements transactions.DBTxInterface. It panics if called from a read-only db
+// transaction.
+func (tx *Tx) UnfreezeOutput(outPoint wire.OutPoint) {
+	if err := tx.bucketFrozenOutputs.Delete([]byte(outPoint.String())); err != nil {
+		panic(errp.WithStack(err))
+	}
+}
+
+// FrozenOutputs implements transactions.DBTxInterface.
+func (tx *Tx) FrozenOutputs() (map[wire.OutPoint]struct{}, error) {
+	outPoints := map[wire.OutPoint]struct{}{}
+	err := tx.bucketFrozenOutputs.ForEach(func(outPointBytes []byte, _ []byte) error {
+		outPoint, err := util.ParseOutPoint(outPointBytes)
+		if err != nil {
+			return err
+		}
+		outPoints[*outPoint] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return outPoints, nil
+}
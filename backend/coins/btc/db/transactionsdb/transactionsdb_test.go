@@ -0,0 +1,124 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transactionsdb_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	bbolt "github.com/coreos/bbolt"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/db/transactionsdb"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newTx(spent wire.OutPoint, pkScript []byte) *wire.MsgTx {
+	return &wire.MsgTx{
+		Version: wire.TxVersion,
+		TxIn:    []*wire.TxIn{wire.NewTxIn(&spent, nil, nil)},
+		TxOut: []*wire.TxOut{
+			wire.NewTxOut(1000, pkScript),
+			wire.NewTxOut(2000, []byte("other")),
+		},
+	}
+}
+
+// TestMigrateVersion0 checks that the indexes of a database written before the schema version was
+// introduced, which only kept the last spending transaction of an outpoint, are rebuilt from the
+// stored transactions.
+func TestMigrateVersion0(t *testing.T) {
+	filename := test.TstTempFile("transactionsdb_test")
+	spent := wire.OutPoint{Hash: chainhash.HashH([]byte("funding")), Index: 0}
+	pkScript := []byte("ours")
+	scriptHashHex := chainhash.HashH(pkScript).String()
+	tx1 := newTx(spent, pkScript)
+	tx2 := newTx(spent, []byte("double spend"))
+	tx2.LockTime = 1
+
+	boltDB, err := bbolt.Open(filename, 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, boltDB.Update(func(tx *bbolt.Tx) error {
+		transactions, err := tx.CreateBucket([]byte("transactions"))
+		require.NoError(t, err)
+		for _, msgTx := range []*wire.MsgTx{tx1, tx2} {
+			txHash := msgTx.TxHash()
+			jsonBytes, err := json.Marshal(map[string]interface{}{
+				"Tx":        msgTx,
+				"Height":    10,
+				"addresses": map[string]bool{scriptHashHex: true},
+			})
+			require.NoError(t, err)
+			require.NoError(t, transactions.Put(txHash[:], jsonBytes))
+		}
+		inputs, err := tx.CreateBucket([]byte("inputs"))
+		require.NoError(t, err)
+		tx2Hash := tx2.TxHash()
+		return inputs.Put([]byte(spent.String()), tx2Hash[:])
+	}))
+	require.NoError(t, boltDB.Close())
+
+	db, err := transactionsdb.NewDB(filename, nil)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	dbTx, err := db.Begin()
+	require.NoError(t, err)
+	defer dbTx.Rollback()
+	spenders, err := dbTx.Inputs(spent)
+	require.NoError(t, err)
+	require.Len(t, spenders, 2)
+	require.Contains(t, spenders, tx1.TxHash())
+	require.Contains(t, spenders, tx2.TxHash())
+	outputs, err := dbTx.Outputs()
+	require.NoError(t, err)
+	require.Equal(t, map[wire.OutPoint]*wire.TxOut{
+		{Hash: tx1.TxHash(), Index: 0}: tx1.TxOut[0],
+	}, outputs)
+}
+
+func TestReindex(t *testing.T) {
+	db, err := transactionsdb.NewDB(test.TstTempFile("transactionsdb_test"), nil)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	pkScript := []byte("ours")
+	msgTx := newTx(wire.OutPoint{Hash: chainhash.HashH([]byte("funding"))}, pkScript)
+	txHash := msgTx.TxHash()
+	dbTx, err := db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, dbTx.PutTx(txHash, msgTx, 10))
+	require.NoError(t, dbTx.AddAddressToTx(txHash, blockchain.ScriptHashHex(chainhash.HashH(pkScript).String())))
+	// The indexes are only filled when the transactions are processed. The entry of an input
+	// which is not in the stored transactions is removed by the reindex.
+	require.NoError(t, dbTx.PutInput(wire.OutPoint{Hash: chainhash.HashH([]byte("stale"))}, txHash))
+	require.NoError(t, dbTx.Commit())
+
+	require.NoError(t, db.Reindex())
+
+	dbTx, err = db.Begin()
+	require.NoError(t, err)
+	defer dbTx.Rollback()
+	spenders, err := dbTx.Inputs(wire.OutPoint{Hash: chainhash.HashH([]byte("stale"))})
+	require.NoError(t, err)
+	require.Empty(t, spenders)
+	spenders, err = dbTx.Inputs(msgTx.TxIn[0].PreviousOutPoint)
+	require.NoError(t, err)
+	require.Equal(t, []chainhash.Hash{txHash}, spenders)
+	outputs, err := dbTx.Outputs()
+	require.NoError(t, err)
+	require.Equal(t, map[wire.OutPoint]*wire.TxOut{{Hash: txHash, Index: 0}: msgTx.TxOut[0]}, outputs)
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package btc
+
+import (
+	"context"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/addresses"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/sirupsen/logrus"
+)
+
+// DiscoveryGapLimit is the number of receive addresses which are scanned to determine whether an
+// account has been used.
+const DiscoveryGapLimit = gapLimit
+
+// discoveryTimeout limits how long AccountUsed waits for the blockchain backend, if it neither
+// answers nor fails the requests.
+var discoveryTimeout = time.Minute
+
+// AccountUsed returns whether any of the first gapLimit receive addresses of the account with the
+// given signing configuration has a transaction history. It returns an error if the history of an
+// address could not be fetched, and aborts when ctx is cancelled.
+func AccountUsed(
+	ctx context.Context,
+	theBlockchain blockchain.Interface,
+	configuration *signing.Configuration,
+	net *chaincfg.Params,
+	gapLimit int,
+	log *logrus.Entry,
+) (bool, error) {
+	receiveConfiguration, err := configuration.Derive(
+		signing.NewEmptyRelativeKeypath().Child(0, signing.NonHardened))
+	if err != nil {
+		return false, err
+	}
+	// Every request reports its result when it finished, nil if there was no response.
+	results := make(chan *bool, gapLimit)
+	for index := 0; index < gapLimit; index++ {
+		addressConfiguration, err := receiveConfiguration.Derive(
+			signing.NewEmptyRelativeKeypath().Child(uint32(index), signing.NonHardened))
+		if err != nil {
+			return false, err
+		}
+		address := addresses.NewAccountAddress(addressConfiguration, net, log)
+		var addressUsed *bool
+		theBlockchain.ScriptHashGetHistory(
+			address.PubkeyScriptHashHex(),
+			func(history blockchain.TxHistory) error {
+				used := len(history) > 0
+				addressUsed = &used
+				return nil
+			},
+			func() { results <- addressUsed },
+		)
+	}
+	timeout := time.After(discoveryTimeout)
+	for index := 0; index < gapLimit; index++ {
+		select {
+		case addressUsed := <-results:
+			if addressUsed == nil {
+				return false, errp.New("could not fetch the history of an address")
+			}
+			if *addressUsed {
+				return true, nil
+			}
+		case <-timeout:
+			return false, errp.New("timeout while scanning the account history")
+		case <-ctx.Done():
+			return false, errp.WithStack(ctx.Err())
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package btc_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/addresses"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/stretchr/testify/require"
+)
+
+// historyBlockchain answers history requests with a non-empty history for the used script hashes.
+// The requests for the failing script hashes finish without a response.
+type historyBlockchain struct {
+	blockchain.Interface
+	lock      locker.Locker
+	used      map[blockchain.ScriptHashHex]bool
+	failing   map[blockchain.ScriptHashHex]bool
+	requested int
+}
+
+func (b *historyBlockchain) ScriptHashGetHistory(
+	scriptHashHex blockchain.ScriptHashHex,
+	success func(blockchain.TxHistory) error,
+	cleanup func(),
+) {
+	defer cleanup()
+	history := blockchain.TxHistory{}
+	failing := func() bool {
+		defer b.lock.Lock()()
+		b.requested++
+		if b.used[scriptHashHex] {
+			history = append(history, &blockchain.TxInfo{Height: 1})
+		}
+		return b.failing[scriptHashHex]
+	}()
+	if failing {
+		return
+	}
+	if err := success(history); err != nil {
+		panic(err)
+	}
+}
+
+func TestAccountUsed(t *testing.T) {
+	net := &chaincfg.TestNet3Params
+	log := logging.Get().WithGroup("discovery_test")
+	xprv, err := hdkeychain.NewMaster(make([]byte, hdkeychain.RecommendedSeedLen), net)
+	require.NoError(t, err)
+	xpub, err := xprv.Neuter()
+	require.NoError(t, err)
+	keypath, err := signing.NewAbsoluteKeypath("m/84'/1'/1'")
+	require.NoError(t, err)
+	configuration := signing.NewSinglesigConfiguration(signing.ScriptTypeP2WPKH, keypath, xpub)
+
+	theBlockchain := &historyBlockchain{
+		used:    map[blockchain.ScriptHashHex]bool{},
+		failing: map[blockchain.ScriptHashHex]bool{},
+	}
+	used, err := btc.AccountUsed(context.Background(), theBlockchain, configuration, net, btc.DiscoveryGapLimit, log)
+	require.NoError(t, err)
+	require.False(t, used)
+	require.Equal(t, btc.DiscoveryGapLimit, theBlockchain.requested)
+
+	// The last scanned receive address has a history.
+	relativeKeypath, err := signing.NewRelativeKeypath("0/19")
+	require.NoError(t, err)
+	addressConfiguration, err := configuration.Derive(relativeKeypath)
+	require.NoError(t, err)
+	address := addresses.NewAccountAddress(addressConfiguration, net, log)
+	theBlockchain.used[address.PubkeyScriptHashHex()] = true
+	used, err = btc.AccountUsed(context.Background(), theBlockchain, configuration, net, btc.DiscoveryGapLimit, log)
+	require.NoError(t, err)
+	require.True(t, used)
+
+	// Addresses beyond the gap limit are not scanned.
+	used, err = btc.AccountUsed(context.Background(), theBlockchain, configuration, net, 19, log)
+	require.NoError(t, err)
+	require.False(t, used)
+
+	// A request which finished without a response fails the scan right away.
+	delete(theBlockchain.used, address.PubkeyScriptHashHex())
+	theBlockchain.failing[address.PubkeyScriptHashHex()] = true
+	_, err = btc.AccountUsed(context.Background(), theBlockchain, configuration, net, btc.DiscoveryGapLimit, log)
+	require.Error(t, err)
+}
@@ -0,0 +1,444 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package btc_test
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/addresses"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/electrum"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/electrum/electrumtest"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore/software"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+// e2eAccount is an account of a software keystore, synchronized through the electrum client with
+// fake Electrum servers.
+type e2eAccount struct {
+	*btc.Account
+	coin *btc.Coin
+
+	eventsLock sync.Mutex
+	events     []btc.Event
+}
+
+func newE2EAccount(t *testing.T, servers ...*electrumtest.Server) *e2eAccount {
+	t.Helper()
+	// The chain of the fake servers starts at the genesis block, so the headers must not be
+	// synced starting at a checkpoint.
+	net := chaincfg.TestNet3Params
+	net.Checkpoints = nil
+	log := logging.Get().WithGroup("e2e_test")
+	dbFolder := test.TstTempDir("e2e_test")
+
+	serverInfos := []*rpc.ServerInfo{}
+	for _, server := range servers {
+		serverInfos = append(serverInfos, server.ServerInfo())
+	}
+	coin := btc.NewCoin("tbtc", "TBTC", &net, dbFolder, nil, serverInfos, true, "")
+
+	softwareKeystore := software.NewKeystoreFromPIN(0, "1234")
+	keypath, err := signing.NewAbsoluteKeypath("m/84'/1'/0'")
+	require.NoError(t, err)
+	xpub, err := softwareKeystore.ExtendedPublicKey(keypath)
+	require.NoError(t, err)
+	configuration := signing.NewSinglesigConfiguration(signing.ScriptTypeP2WPKH, keypath, xpub)
+
+	e2e := &e2eAccount{coin: coin}
+	e2e.Account = btc.NewAccount(coin, dbFolder, nil, "tbtc-e2e", "Bitcoin Testnet",
+		func() (*signing.Configuration, error) { return configuration, nil },
+		keystore.NewKeystores(softwareKeystore), nil, e2e.onEvent, log)
+	require.NoError(t, e2e.Initialize())
+	waitFor(t, e2e.Initialized)
+	return e2e
+}
+
+func (account *e2eAccount) onEvent(event btc.Event) {
+	account.eventsLock.Lock()
+	defer account.eventsLock.Unlock()
+	account.events = append(account.events, event)
+}
+
+// fired returns whether the account fired the event.
+func (account *e2eAccount) fired(event btc.Event) bool {
+	account.eventsLock.Lock()
+	defer account.eventsLock.Unlock()
+	for _, fired := range account.events {
+		if fired == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (account *e2eAccount) close() {
+	account.Close()
+	account.coin.Close()
+}
+
+// receivePkScript returns the pkScript of the first unused receive address.
+func (account *e2eAccount) receivePkScript() []byte {
+	return account.GetUnusedReceiveAddresses()[0].(*addresses.AccountAddress).PubkeyScript()
+}
+
+func (account *e2eAccount) balance(t *testing.T) *coin.Balance {
+	t.Helper()
+	balance, err := account.Balance()
+	require.NoError(t, err)
+	return balance
+}
+
+func (account *e2eAccount) transaction(txHash string) coin.Transaction {
+	transactions, err := account.Transactions()
+	if err != nil {
+		return nil
+	}
+	for _, transaction := range transactions {
+		if transaction.ID() == txHash {
+			return transaction
+		}
+	}
+	return nil
+}
+
+// waitForConfirmations waits until the transaction has the given number of confirmations.
+func (account *e2eAccount) waitForConfirmations(t *testing.T, tx *wire.MsgTx, confirmations int) {
+	t.Helper()
+	waitFor(t, func() bool {
+		transaction := account.transaction(tx.TxHash().String())
+		return transaction != nil && transaction.NumConfirmations() == confirmations
+	})
+}
+
+func amount(t *testing.T, amount coin.Amount) int64 {
+	t.Helper()
+	result, err := amount.Int64()
+	require.NoError(t, err)
+	return result
+}
+
+func newE2EServer(t *testing.T, chain *electrumtest.Chain) *electrumtest.Server {
+	t.Helper()
+	server, err := electrumtest.NewServer(chain, true)
+	require.NoError(t, err)
+	return server
+}
+
+// TestE2ESendReceive receives coins, waits for the confirmation and the verification, and sends
+// them again.
+func TestE2ESendReceive(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.TestNet3Params)
+	chain.SetFeeRate(20000)
+	chain.Mine(1)
+	server := newE2EServer(t, chain)
+	defer server.Close()
+	account := newE2EAccount(t, server)
+	defer account.close()
+
+	// The addresses are subscribed in batches.
+	require.True(t, server.Batches() != 0)
+	require.True(t, server.Batches() < server.Requests("blockchain.scripthash.subscribe"))
+
+	funding := chain.Fund(account.receivePkScript(), btcutil.SatoshiPerBitcoin)
+	waitFor(t, func() bool {
+		return amount(t, account.balance(t).Incoming()) == btcutil.SatoshiPerBitcoin
+	})
+	require.Equal(t, coin.TxTypeReceive, account.transaction(funding.TxHash().String()).Type())
+	require.Equal(t, int64(0), amount(t, account.balance(t).Available()))
+
+	chain.Mine(1)
+	account.waitForConfirmations(t, funding, 1)
+	require.Equal(t, int64(btcutil.SatoshiPerBitcoin), amount(t, account.balance(t).Available()))
+	// The merkle proof is checked against the synced header.
+	waitFor(t, func() bool {
+		details, err := account.TransactionDetails(funding.TxHash().String())
+		require.NoError(t, err)
+		return details.Verified
+	})
+	details, err := account.TransactionDetails(funding.TxHash().String())
+	require.NoError(t, err)
+	require.Equal(t, chain.Header(2).BlockHash(), *details.BlockHash)
+	require.Equal(t, chain.Header(2).Timestamp.Unix(), details.Timestamp().Unix())
+
+	waitFor(t, func() bool {
+		feeTargets, _ := account.FeeTargets()
+		return len(feeTargets) != 0
+	})
+	recipient, err := btcutil.NewAddressWitnessPubKeyHash(make([]byte, 20), &chaincfg.TestNet3Params)
+	require.NoError(t, err)
+	require.NoError(t, account.SendTx(
+		recipient.EncodeAddress(), coin.NewSendAmount("0.4"), btc.FeeTargetCodeNormal, nil, nil))
+	require.Len(t, chain.Mempool(), 1)
+	spending := chain.Mempool()[0]
+	waitFor(t, func() bool { return account.transaction(spending.TxHash().String()) != nil })
+	transaction := account.transaction(spending.TxHash().String())
+	require.Equal(t, coin.TxTypeSend, transaction.Type())
+	require.Equal(t, int64(40000000), amount(t, transaction.Amount()))
+	fee := amount(t, *transaction.Fee())
+	require.True(t, fee > 0)
+
+	chain.Mine(1)
+	account.waitForConfirmations(t, spending, 1)
+	account.waitForConfirmations(t, funding, 2)
+	waitFor(t, func() bool {
+		return amount(t, account.balance(t).Available()) == 60000000-fee
+	})
+	require.Equal(t, int64(0), amount(t, account.balance(t).Incoming()))
+}
+
+// TestE2EReorg checks that a transaction which is confirmed again in a different block after a
+// reorg is updated, and that the headers follow the new chain.
+func TestE2EReorg(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.TestNet3Params)
+	chain.Mine(1)
+	server := newE2EServer(t, chain)
+	defer server.Close()
+	account := newE2EAccount(t, server)
+	defer account.close()
+
+	funding := chain.Fund(account.receivePkScript(), btcutil.SatoshiPerBitcoin)
+	chain.Mine(1)
+	account.waitForConfirmations(t, funding, 1)
+	// The server replies with an error if the merkle proof is requested for the removed block,
+	// which the client does not survive.
+	waitFor(t, func() bool {
+		details, err := account.TransactionDetails(funding.TxHash().String())
+		require.NoError(t, err)
+		return details.Verified
+	})
+	staleHeader := chain.Header(2)
+
+	// The funding transaction moves from block 2 to block 1.
+	chain.Reorg(2)
+	chain.Mine(3)
+	account.waitForConfirmations(t, funding, 3)
+	waitFor(t, func() bool {
+		header, err := account.coin.Headers().HeaderByHeight(3)
+		require.NoError(t, err)
+		return header != nil && header.BlockHash() == chain.Header(3).BlockHash()
+	})
+	details, err := account.TransactionDetails(funding.TxHash().String())
+	require.NoError(t, err)
+	require.Equal(t, 1, details.Height)
+	require.Equal(t, chain.Header(1).BlockHash(), *details.BlockHash)
+	require.NotEqual(t, staleHeader.BlockHash(), chain.Header(2).BlockHash())
+	require.Equal(t, int64(btcutil.SatoshiPerBitcoin), amount(t, account.balance(t).Available()))
+}
+
+// TestE2EDeepReorg checks that a verified transaction whose block is replaced by a reorg, while it
+// stays at the same height, is verified again against the new block, and that the reorg is
+// reported with its depth.
+func TestE2EDeepReorg(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.TestNet3Params)
+	chain.Mine(1)
+	server := newE2EServer(t, chain)
+	defer server.Close()
+	account := newE2EAccount(t, server)
+	defer account.close()
+
+	funding := chain.Fund(account.receivePkScript(), btcutil.SatoshiPerBitcoin)
+	chain.Mine(6)
+	account.waitForConfirmations(t, funding, 6)
+	waitFor(t, func() bool {
+		details, err := account.TransactionDetails(funding.TxHash().String())
+		require.NoError(t, err)
+		return details.Verified
+	})
+	staleHeader := chain.Header(2)
+
+	// Blocks 2 to 7 are replaced. The funding transaction is confirmed again at height 2.
+	chain.Reorg(6)
+	chain.Mine(7)
+	waitFor(t, func() bool { return account.LastReorg() != nil })
+	require.Equal(t, &headers.Reorg{ForkHeight: 2, Depth: 6}, account.LastReorg())
+	waitFor(t, func() bool { return account.fired(btc.EventReorg) })
+	account.waitForConfirmations(t, funding, 7)
+	waitFor(t, func() bool {
+		details, err := account.TransactionDetails(funding.TxHash().String())
+		require.NoError(t, err)
+		return details.Verified && *details.BlockHash == chain.Header(2).BlockHash()
+	})
+	require.NotEqual(t, staleHeader.BlockHash(), chain.Header(2).BlockHash())
+	details, err := account.TransactionDetails(funding.TxHash().String())
+	require.NoError(t, err)
+	require.Equal(t, chain.Header(2).Timestamp.Unix(), details.Timestamp().Unix())
+}
+
+// TestE2EFailover checks that the account keeps syncing if the connection drops, and if the
+// server goes down and another one has to be used.
+func TestE2EFailover(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.TestNet3Params)
+	chain.Mine(1)
+	server1 := newE2EServer(t, chain)
+	defer server1.Close()
+	server2 := newE2EServer(t, chain)
+	defer server2.Close()
+	account := newE2EAccount(t, server1, server2)
+	defer account.close()
+
+	funding := chain.Fund(account.receivePkScript(), btcutil.SatoshiPerBitcoin)
+	chain.Mine(1)
+	account.waitForConfirmations(t, funding, 1)
+
+	connected := func() *electrumtest.Server {
+		if server1.Connections() != 0 {
+			return server1
+		}
+		return server2
+	}
+
+	// The client reconnects and subscribes again.
+	connected().Disconnect()
+	waitFor(t, func() bool { return server1.Connections()+server2.Connections() != 0 })
+	chain.Mine(1)
+	account.waitForConfirmations(t, funding, 2)
+
+	// The client fails over to the other server.
+	down := connected()
+	down.Close()
+	chain.Mine(1)
+	account.waitForConfirmations(t, funding, 3)
+	require.Equal(t, 0, down.Connections())
+
+	// New transactions are still seen.
+	second := chain.Fund(account.receivePkScript(), btcutil.SatoshiPerBitcoin)
+	waitFor(t, func() bool {
+		return amount(t, account.balance(t).Incoming()) == btcutil.SatoshiPerBitcoin
+	})
+	require.NotNil(t, account.transaction(second.TxHash().String()))
+}
+
+// connectedServer returns the Electrum server the coin is connected to, or nil.
+func (account *e2eAccount) connectedServer() *electrum.ServerStatus {
+	for _, server := range account.coin.ElectrumServers().List() {
+		if server.Connected {
+			return server
+		}
+	}
+	return nil
+}
+
+// TestE2EServerDiscovery checks that the servers announced by a server are added to the list, and
+// that the client moves to another server if the user bans the current one.
+func TestE2EServerDiscovery(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.TestNet3Params)
+	chain.Mine(1)
+	server1 := newE2EServer(t, chain)
+	defer server1.Close()
+	server2 := newE2EServer(t, chain)
+	defer server2.Close()
+	_, port, err := net.SplitHostPort(server2.ServerInfo().Server)
+	require.NoError(t, err)
+	server1.Override("server.peers.subscribe",
+		func([]json.RawMessage, interface{}) (interface{}, error) {
+			return []interface{}{
+				[]interface{}{"127.0.0.1", "127.0.0.1", []string{"v1.4", "s" + port}},
+				// Not reachable over TLS.
+				[]interface{}{"127.0.0.1", "127.0.0.1", []string{"v1.4", "t50001"}},
+			}, nil
+		})
+	account := newE2EAccount(t, server1)
+	defer account.close()
+
+	waitFor(t, func() bool { return len(account.coin.ElectrumServers().List()) == 2 })
+	require.Equal(t, server1.ServerInfo().Server, account.connectedServer().Server.Server)
+
+	require.NoError(t, account.coin.ElectrumServers().Ban(server1.ServerInfo().Server, true))
+	waitFor(t, func() bool { return server2.Connections() != 0 })
+	funding := chain.Fund(account.receivePkScript(), btcutil.SatoshiPerBitcoin)
+	chain.Mine(1)
+	account.waitForConfirmations(t, funding, 1)
+	require.Equal(t, 0, server1.Connections())
+
+	// The certificate of the discovered server was trusted on first use.
+	connected := account.connectedServer()
+	require.Equal(t, server2.ServerInfo().Server, connected.Server.Server)
+	require.True(t, connected.Discovered)
+	require.Equal(t, server2.ServerInfo().PEMCert, connected.PEMCert)
+	require.Equal(t, 1, connected.Connects)
+}
+
+// TestE2EIncompatibleServer checks that a server of another network is not used.
+func TestE2EIncompatibleServer(t *testing.T) {
+	chain := electrumtest.NewChain(&chaincfg.TestNet3Params)
+	server1 := newE2EServer(t, chain)
+	defer server1.Close()
+	server2 := newE2EServer(t, chain)
+	defer server2.Close()
+	server2.Override("server.features",
+		func(_ []json.RawMessage, result interface{}) (interface{}, error) {
+			features := result.(map[string]interface{})
+			features["genesis_hash"] = chaincfg.MainNetParams.GenesisHash.String()
+			return features, nil
+		})
+	account := newE2EAccount(t, server1, server2)
+	defer account.close()
+
+	// server2 is only tried once server1 is banned.
+	require.NoError(t, account.coin.ElectrumServers().Ban(server1.ServerInfo().Server, true))
+	waitFor(t, func() bool {
+		for _, server := range account.coin.ElectrumServers().List() {
+			if server.Server.Server == server2.ServerInfo().Server {
+				return server.Incompatible != ""
+			}
+		}
+		return false
+	})
+	waitFor(t, func() bool { return server2.Connections() == 0 })
+	require.Nil(t, account.connectedServer())
+}
+
+// TestE2EBadResponse checks that an invalid address history from the server moves the account
+// into the error state, and that it recovers once the server responds correctly.
+func TestE2EBadResponse(t *testing.T) {
+	btc.TstSetMinRetryDelay(10 * time.Millisecond)
+	chain := electrumtest.NewChain(&chaincfg.TestNet3Params)
+	chain.Mine(1)
+	server := newE2EServer(t, chain)
+	defer server.Close()
+	account := newE2EAccount(t, server)
+	defer account.close()
+
+	// The same transaction twice is an invalid history.
+	server.Override("blockchain.scripthash.get_history",
+		func(params []json.RawMessage, result interface{}) (interface{}, error) {
+			history := result.(blockchain.TxHistory)
+			return append(history, history...), nil
+		})
+	chain.Fund(account.receivePkScript(), btcutil.SatoshiPerBitcoin)
+	waitFor(t, func() bool { return account.Error() != nil })
+
+	server.Override("blockchain.scripthash.get_history", nil)
+	waitFor(t, func() bool {
+		return account.Error() == nil &&
+			amount(t, account.balance(t).Incoming()) == btcutil.SatoshiPerBitcoin
+	})
+}
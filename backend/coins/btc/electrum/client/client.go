@@ -22,14 +22,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
 	"github.com/sirupsen/logrus"
 )
@@ -37,6 +40,12 @@ import (
 const (
 	clientVersion         = "0.0.1"
 	clientProtocolVersion = "1.2"
+
+	// batchSize is the maximum number of requests sent in one batch.
+	batchSize = 100
+	// batchDelay is how long requests are queued before they are sent, so that the requests made
+	// in a row, e.g. for all addresses of an account, are sent together.
+	batchDelay = 10 * time.Millisecond
 )
 
 // ElectrumClient is a high level API access to an ElectrumX server.
@@ -44,18 +53,45 @@ const (
 type ElectrumClient struct {
 	rpc rpc.Client
 
-	scriptHashNotificationCallbacks     map[string]func(string) error
+	scriptHashNotificationCallbacks     map[string]*scriptHashSubscription
 	scriptHashNotificationCallbacksLock sync.RWMutex
 
+	// batch holds the requests queued for the next batch, which is sent by batchTimer unless it
+	// fills up before.
+	batch      []*rpc.Request
+	batchTimer *time.Timer
+	batchLock  locker.Locker
+
+	// txGets are the running blockchain.transaction.get requests, so that concurrent requests for
+	// the same transaction, e.g. by several accounts of the coin, share one.
+	txGets     map[chainhash.Hash]*txGet
+	txGetsLock locker.Locker
+
+	// onConnect is called when a connection to a server is established, see OnConnect().
+	onConnect func() error
+
 	close bool
 	log   *logrus.Entry
 }
 
+// scriptHashSubscription is the callback registered by ScriptHashSubscribe(). Pointer identity
+// distinguishes a subscription from a later one for the same script hash.
+type scriptHashSubscription struct {
+	callback func(string) error
+}
+
+// txGet holds the callbacks of the callers of TransactionGet() waiting for the same transaction.
+type txGet struct {
+	successes []func(*wire.MsgTx) error
+	cleanups  []func()
+}
+
 // NewElectrumClient creates a new Electrum client.
 func NewElectrumClient(rpcClient rpc.Client, log *logrus.Entry) *ElectrumClient {
 	electrumClient := &ElectrumClient{
 		rpc:                             rpcClient,
-		scriptHashNotificationCallbacks: map[string]func(string) error{},
+		scriptHashNotificationCallbacks: map[string]*scriptHashSubscription{},
+		txGets:                          map[chainhash.Hash]*txGet{},
 		log:                             log.WithField("group", "client"),
 	}
 	// Install a callback for the scripthash notifications, which directs the response to callbacks
@@ -77,10 +113,10 @@ func NewElectrumClient(rpcClient rpc.Client, log *logrus.Entry) *ElectrumClient
 			scriptHash := response[0]
 			status := response[1]
 			electrumClient.scriptHashNotificationCallbacksLock.RLock()
-			callback, ok := electrumClient.scriptHashNotificationCallbacks[scriptHash]
+			subscription, ok := electrumClient.scriptHashNotificationCallbacks[scriptHash]
 			electrumClient.scriptHashNotificationCallbacksLock.RUnlock()
 			if ok {
-				if err := callback(status); err != nil {
+				if err := subscription.callback(status); err != nil {
 					electrumClient.log.WithError(err).Error("Failed to execute callback")
 					return
 				}
@@ -96,6 +132,9 @@ func NewElectrumClient(rpcClient rpc.Client, log *logrus.Entry) *ElectrumClient
 			return err
 		}
 		log.WithField("server-version", version).Debug("electrumx server version")
+		if electrumClient.onConnect != nil {
+			return electrumClient.onConnect()
+		}
 		return nil
 	})
 	rpcClient.RegisterHeartbeat("server.version", clientVersion, clientProtocolVersion)
@@ -103,6 +142,67 @@ func NewElectrumClient(rpcClient rpc.Client, log *logrus.Entry) *ElectrumClient
 	return electrumClient
 }
 
+// OnConnect installs a callback which is called whenever a connection to a server is established,
+// after the protocol version has been negotiated. If it returns an error, the server is not used.
+func (client *ElectrumClient) OnConnect(callback func() error) {
+	client.onConnect = callback
+}
+
+// queue adds the request to the next batch. The batch is sent once it is full, or batchDelay after
+// the first request was queued.
+func (client *ElectrumClient) queue(request *rpc.Request) {
+	unlock := client.batchLock.Lock()
+	client.batch = append(client.batch, request)
+	if len(client.batch) >= batchSize {
+		batch := client.takeBatch()
+		unlock()
+		client.rpc.Batch(batch)
+		return
+	}
+	if client.batchTimer == nil {
+		client.batchTimer = time.AfterFunc(batchDelay, client.flush)
+	}
+	unlock()
+}
+
+// takeBatch empties the queue and returns the requests. Requires the batch lock.
+func (client *ElectrumClient) takeBatch() []*rpc.Request {
+	batch := client.batch
+	client.batch = nil
+	if client.batchTimer != nil {
+		client.batchTimer.Stop()
+		client.batchTimer = nil
+	}
+	return batch
+}
+
+// flush sends the queued requests.
+func (client *ElectrumClient) flush() {
+	unlock := client.batchLock.Lock()
+	batch := client.takeBatch()
+	unlock()
+	client.rpc.Batch(batch)
+}
+
+// setupNow calls setupAndTeardown right away, so that a request waiting in the queue is already
+// accounted for. The returned function hands out the resulting teardown the first time it is
+// called, and sets up again afterwards, e.g. when a subscription is renewed after a reconnect.
+func setupNow(setupAndTeardown func() func()) func() func() {
+	if setupAndTeardown == nil {
+		return nil
+	}
+	teardown := setupAndTeardown()
+	var once sync.Once
+	return func() func() {
+		var first func()
+		once.Do(func() { first = teardown })
+		if first != nil {
+			return first
+		}
+		return setupAndTeardown()
+	}
+}
+
 // ConnectionStatus returns the current connection status of the backend.
 func (client *ElectrumClient) ConnectionStatus() blockchain.Status {
 	switch client.rpc.ConnectionStatus() {
@@ -115,9 +215,10 @@ func (client *ElectrumClient) ConnectionStatus() blockchain.Status {
 }
 
 // RegisterOnConnectionStatusChangedEvent registers an event that forwards the connection status from
-// the underlying client to the given callback.
-func (client *ElectrumClient) RegisterOnConnectionStatusChangedEvent(onConnectionStatusChanged func(blockchain.Status)) {
-	client.rpc.RegisterOnConnectionStatusChangedEvent(func(status rpc.Status) {
+// the underlying client to the given callback. The returned function deregisters it again.
+func (client *ElectrumClient) RegisterOnConnectionStatusChangedEvent(
+	onConnectionStatusChanged func(blockchain.Status)) func() {
+	return client.rpc.RegisterOnConnectionStatusChangedEvent(func(status rpc.Status) {
 		switch status {
 		case rpc.CONNECTED:
 			onConnectionStatusChanged(blockchain.CONNECTED)
@@ -162,6 +263,50 @@ func (client *ElectrumClient) ServerVersion() (*ServerVersion, error) {
 // ServerFeatures is returned by ServerFeatures().
 type ServerFeatures struct {
 	GenesisHash string `json:"genesis_hash"`
+	ProtocolMin string `json:"protocol_min"`
+	ProtocolMax string `json:"protocol_max"`
+	// Pruning is the history pruning limit of the server, nil if it keeps the full history.
+	Pruning *int `json:"pruning"`
+}
+
+// Check returns an error if the server cannot be used by this client for the network with the
+// given genesis block.
+func (features *ServerFeatures) Check(genesisHash *chainhash.Hash) error {
+	if features.GenesisHash != genesisHash.String() {
+		return errp.Newf("The server serves another network (genesis block %s)", features.GenesisHash)
+	}
+	if compareVersions(features.ProtocolMin, clientProtocolVersion) > 0 ||
+		compareVersions(features.ProtocolMax, clientProtocolVersion) < 0 {
+		return errp.Newf("The server does not support protocol version %s (supports %s to %s)",
+			clientProtocolVersion, features.ProtocolMin, features.ProtocolMax)
+	}
+	if features.Pruning != nil {
+		return errp.Newf("The server prunes the history (limit %d)", *features.Pruning)
+	}
+	return nil
+}
+
+// compareVersions compares two dotted version strings like "1.4.2" and returns -1, 0 or 1.
+// Missing or invalid parts count as 0.
+func compareVersions(version1, version2 string) int {
+	parts1 := strings.Split(version1, ".")
+	parts2 := strings.Split(version2, ".")
+	for i := 0; i < len(parts1) || i < len(parts2); i++ {
+		var part1, part2 int
+		if i < len(parts1) {
+			part1, _ = strconv.Atoi(parts1[i])
+		}
+		if i < len(parts2) {
+			part2, _ = strconv.Atoi(parts2[i])
+		}
+		switch {
+		case part1 < part2:
+			return -1
+		case part1 > part2:
+			return 1
+		}
+	}
+	return 0
 }
 
 // ServerFeatures does the server.features() RPC call.
@@ -172,6 +317,61 @@ func (client *ElectrumClient) ServerFeatures() (*ServerFeatures, error) {
 	return response, err
 }
 
+// ServerPeer is a server announced by server.peers.subscribe.
+type ServerPeer struct {
+	IP   string
+	Host string
+	// Features are e.g. "v1.4" for the maximum protocol version, "s50002" for the TLS port and
+	// "t50001" for the TCP port. The port is omitted if it is the default port.
+	Features []string
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (peer *ServerPeer) UnmarshalJSON(b []byte) error {
+	var ip, host string
+	slice := []interface{}{&ip, &host, &peer.Features}
+	if err := json.Unmarshal(b, &slice); err != nil {
+		return errp.WithContext(errp.Wrap(err, "Failed to unmarshal JSON"), errp.Context{"raw": string(b)})
+	}
+	if len(slice) != 3 {
+		return errp.WithContext(errp.New("Unexpected reply"), errp.Context{"raw": string(b)})
+	}
+	peer.IP = ip
+	peer.Host = host
+	return nil
+}
+
+// ServerPeersSubscribe does the server.peers.subscribe() RPC call. The server does not send
+// notifications for it. Invalid peers are skipped.
+// https://github.com/kyuupichan/electrumx/blob/159db3f8e70b2b2cbb8e8cd01d1e9df3fe83828f/docs/PROTOCOL.rst#serverpeerssubscribe
+func (client *ElectrumClient) ServerPeersSubscribe(
+	success func([]*ServerPeer) error,
+	cleanup func(),
+) {
+	client.rpc.Method(
+		func(responseBytes []byte) error {
+			rawPeers := []json.RawMessage{}
+			if err := json.Unmarshal(responseBytes, &rawPeers); err != nil {
+				client.log.WithError(err).Error("Failed to unmarshal JSON response")
+				return errp.WithStack(err)
+			}
+			peers := []*ServerPeer{}
+			for _, rawPeer := range rawPeers {
+				peer := &ServerPeer{}
+				if err := json.Unmarshal(rawPeer, peer); err != nil {
+					client.log.WithError(err).Warning("Skipping invalid peer")
+					continue
+				}
+				peers = append(peers, peer)
+			}
+			return success(peers)
+		},
+		func() func() {
+			return cleanup
+		},
+		"server.peers.subscribe")
+}
+
 // Balance is returned by ScriptHashGetBalance().
 type Balance struct {
 	Confirmed   int64 `json:"confirmed"`
@@ -207,8 +407,8 @@ func (client *ElectrumClient) ScriptHashGetHistory(
 	success func(blockchain.TxHistory) error,
 	cleanup func(),
 ) {
-	client.rpc.Method(
-		func(responseBytes []byte) error {
+	client.queue(&rpc.Request{
+		Success: func(responseBytes []byte) error {
 			txs := blockchain.TxHistory{}
 			if err := json.Unmarshal(responseBytes, &txs); err != nil {
 				client.log.WithError(err).Error("Failed to unmarshal JSON response")
@@ -216,25 +416,38 @@ func (client *ElectrumClient) ScriptHashGetHistory(
 			}
 			return success(txs)
 		},
-		func() func() {
+		SetupAndTeardown: func() func() {
 			return cleanup
 		},
-		"blockchain.scripthash.get_history",
-		string(scriptHashHex))
+		Method: "blockchain.scripthash.get_history",
+		Params: []interface{}{string(scriptHashHex)},
+	})
 }
 
-// ScriptHashSubscribe does the blockchain.scripthash.subscribe() RPC call.
+// ScriptHashSubscribe does the blockchain.scripthash.subscribe() RPC call. The returned function
+// stops forwarding notifications to the callback. The protocol has no way to unsubscribe on the
+// server, so notifications are dropped by the client.
 // https://github.com/kyuupichan/electrumx/blob/159db3f8e70b2b2cbb8e8cd01d1e9df3fe83828f/docs/PROTOCOL.rst#blockchainscripthashsubscribe
 func (client *ElectrumClient) ScriptHashSubscribe(
 	setupAndTeardown func() func(),
 	scriptHashHex blockchain.ScriptHashHex,
 	success func(string) error,
-) {
+) func() {
+	key := string(scriptHashHex)
+	subscription := &scriptHashSubscription{callback: success}
 	client.scriptHashNotificationCallbacksLock.Lock()
-	client.scriptHashNotificationCallbacks[string(scriptHashHex)] = success
+	client.scriptHashNotificationCallbacks[key] = subscription
 	client.scriptHashNotificationCallbacksLock.Unlock()
-	client.rpc.Method(
-		func(responseBytes []byte) error {
+	subscribed := func() bool {
+		client.scriptHashNotificationCallbacksLock.RLock()
+		defer client.scriptHashNotificationCallbacksLock.RUnlock()
+		return client.scriptHashNotificationCallbacks[key] == subscription
+	}
+	client.queue(&rpc.Request{
+		Success: func(responseBytes []byte) error {
+			if !subscribed() {
+				return nil
+			}
 			var response *string
 			if err := json.Unmarshal(responseBytes, &response); err != nil {
 				client.log.WithError(err).Error("Failed to unmarshal JSON response")
@@ -245,9 +458,17 @@ func (client *ElectrumClient) ScriptHashSubscribe(
 			}
 			return success(*response)
 		},
-		setupAndTeardown,
-		"blockchain.scripthash.subscribe",
-		string(scriptHashHex))
+		SetupAndTeardown: setupNow(setupAndTeardown),
+		Method:           "blockchain.scripthash.subscribe",
+		Params:           []interface{}{key},
+	})
+	return func() {
+		client.scriptHashNotificationCallbacksLock.Lock()
+		defer client.scriptHashNotificationCallbacksLock.Unlock()
+		if client.scriptHashNotificationCallbacks[key] == subscription {
+			delete(client.scriptHashNotificationCallbacks, key)
+		}
+	}
 }
 
 func parseTX(rawTXHex string) (*wire.MsgTx, error) {
@@ -262,15 +483,38 @@ func parseTX(rawTXHex string) (*wire.MsgTx, error) {
 	return tx, nil
 }
 
-// TransactionGet downloads a transaction.
+// TransactionGet downloads a transaction. If the same transaction is already being downloaded, the
+// callbacks are called with the response of the running request.
 // See https://github.com/kyuupichan/electrumx/blob/159db3f8e70b2b2cbb8e8cd01d1e9df3fe83828f/docs/PROTOCOL.rst#blockchaintransactionget
 func (client *ElectrumClient) TransactionGet(
 	txHash chainhash.Hash,
 	success func(*wire.MsgTx) error,
 	cleanup func(),
 ) {
-	client.rpc.Method(
-		func(responseBytes []byte) error {
+	unlock := client.txGetsLock.Lock()
+	if running, ok := client.txGets[txHash]; ok {
+		running.successes = append(running.successes, success)
+		running.cleanups = append(running.cleanups, cleanup)
+		unlock()
+		return
+	}
+	running := &txGet{
+		successes: []func(*wire.MsgTx) error{success},
+		cleanups:  []func(){cleanup},
+	}
+	client.txGets[txHash] = running
+	unlock()
+	// finish removes the request, so that later calls send a new one, and returns the callbacks of
+	// its callers.
+	finish := func() txGet {
+		defer client.txGetsLock.Lock()()
+		if client.txGets[txHash] == running {
+			delete(client.txGets, txHash)
+		}
+		return *running
+	}
+	client.queue(&rpc.Request{
+		Success: func(responseBytes []byte) error {
 			var rawTXHex string
 			if err := json.Unmarshal(responseBytes, &rawTXHex); err != nil {
 				return errp.WithStack(err)
@@ -279,13 +523,24 @@ func (client *ElectrumClient) TransactionGet(
 			if err != nil {
 				return err
 			}
-			return success(tx)
+			var firstErr error
+			for _, success := range finish().successes {
+				if err := success(tx); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+			return firstErr
 		},
-		func() func() {
-			return cleanup
+		SetupAndTeardown: func() func() {
+			return func() {
+				for _, cleanup := range finish().cleanups {
+					cleanup()
+				}
+			}
 		},
-		"blockchain.transaction.get",
-		txHash.String())
+		Method: "blockchain.transaction.get",
+		Params: []interface{}{txHash.String()},
+	})
 }
 
 // Header is returned by HeadersSubscribe().
@@ -293,13 +548,23 @@ type Header struct {
 	BlockHeight int `json:"block_height"`
 }
 
-// HeadersSubscribe does the blockchain.headers.subscribe() RPC call.
+// HeadersSubscribe does the blockchain.headers.subscribe() RPC call. The returned function stops
+// forwarding new headers to the callback.
 // https://github.com/kyuupichan/electrumx/blob/159db3f8e70b2b2cbb8e8cd01d1e9df3fe83828f/docs/PROTOCOL.rst#blockchainheaderssubscribe
 func (client *ElectrumClient) HeadersSubscribe(
 	setupAndTeardown func() func(),
 	success func(*blockchain.Header) error,
-) {
-	client.rpc.SubscribeNotifications("blockchain.headers.subscribe", func(responseBytes []byte) {
+) func() {
+	var unsubscribed bool
+	var unsubscribedLock locker.Locker
+	subscribed := func() bool {
+		defer unsubscribedLock.RLock()()
+		return !unsubscribed
+	}
+	unsubscribeNotifications := client.rpc.SubscribeNotifications("blockchain.headers.subscribe", func(responseBytes []byte) {
+		if !subscribed() {
+			return
+		}
 		response := []*blockchain.Header{}
 		if err := json.Unmarshal(responseBytes, &response); err != nil {
 			client.log.WithError(err).Error("could not handle header notification")
@@ -316,6 +581,9 @@ func (client *ElectrumClient) HeadersSubscribe(
 	})
 	client.rpc.Method(
 		func(responseBytes []byte) error {
+			if !subscribed() {
+				return nil
+			}
 			response := &blockchain.Header{}
 			if err := json.Unmarshal(responseBytes, response); err != nil {
 				return errp.WithStack(err)
@@ -324,6 +592,11 @@ func (client *ElectrumClient) HeadersSubscribe(
 		},
 		setupAndTeardown,
 		"blockchain.headers.subscribe")
+	return func() {
+		defer unsubscribedLock.Lock()()
+		unsubscribed = true
+		unsubscribeNotifications()
+	}
 }
 
 // TXHash wraps chainhash.Hash for json deserialization.
@@ -521,8 +794,13 @@ func (client *ElectrumClient) GetMerkle(
 		txHash.String(), height)
 }
 
-// Close closes the connection.
+// Close closes the connection and stops all its goroutines. It is safe to call it more than once.
 func (client *ElectrumClient) Close() {
 	client.close = true
+	func() {
+		defer client.batchLock.Lock()()
+		// The queued requests are dropped.
+		client.takeBatch()
+	}()
 	client.rpc.Close()
 }
@@ -15,13 +15,49 @@
 package client_test
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"testing"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/electrum/client"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
 	"github.com/stretchr/testify/require"
 )
 
+// rpcClient records the batches sent by the electrum client.
+type rpcClient struct {
+	batches chan []*rpc.Request
+}
+
+func newRPCClient() *rpcClient {
+	return &rpcClient{batches: make(chan []*rpc.Request, 10)}
+}
+
+func (rpcClient *rpcClient) Method(func([]byte) error, func() func(), string, ...interface{}) {}
+func (rpcClient *rpcClient) MethodSync(interface{}, string, ...interface{}) error {
+	return nil
+}
+func (rpcClient *rpcClient) Batch(requests []*rpc.Request) {
+	rpcClient.batches <- requests
+}
+func (rpcClient *rpcClient) SubscribeNotifications(string, func([]byte)) func() {
+	return func() {}
+}
+func (rpcClient *rpcClient) Close()                                   {}
+func (rpcClient *rpcClient) IsClosed() bool                           { return false }
+func (rpcClient *rpcClient) RegisterHeartbeat(string, ...interface{}) {}
+func (rpcClient *rpcClient) OnConnect(func() error)                   {}
+func (rpcClient *rpcClient) ConnectionStatus() rpc.Status             { return rpc.CONNECTED }
+func (rpcClient *rpcClient) RegisterOnConnectionStatusChangedEvent(func(rpc.Status)) func() {
+	return func() {}
+}
+
 func TestStatus(t *testing.T) {
 	history := blockchain.TxHistory{}
 	require.Equal(t, "", history.Status())
@@ -47,3 +83,79 @@ func TestStatus(t *testing.T) {
 		"9783fa8a2f1c89652022e0bb435f302ee8b856961dd979ee083435c65384f314",
 		history.Status())
 }
+
+func TestBatch(t *testing.T) {
+	rpcClient := newRPCClient()
+	electrumClient := client.NewElectrumClient(rpcClient, logging.Get().WithGroup("client_test"))
+	defer electrumClient.Close()
+
+	// The requests are sent in full batches right away, the rest after a delay.
+	for i := 0; i < 150; i++ {
+		electrumClient.ScriptHashGetHistory(
+			blockchain.ScriptHashHex(chainhash.HashH([]byte{byte(i)}).String()),
+			func(blockchain.TxHistory) error { return nil }, func() {})
+	}
+	require.Len(t, <-rpcClient.batches, 100)
+	batch := <-rpcClient.batches
+	require.Len(t, batch, 50)
+	require.Equal(t, "blockchain.scripthash.get_history", batch[0].Method)
+	require.Equal(t, []interface{}{chainhash.HashH([]byte{100}).String()}, batch[0].Params)
+}
+
+func TestTransactionGetShared(t *testing.T) {
+	rpcClient := newRPCClient()
+	electrumClient := client.NewElectrumClient(rpcClient, logging.Get().WithGroup("client_test"))
+	defer electrumClient.Close()
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte("pkScript")))
+	received := 0
+	cleanups := 0
+	for i := 0; i < 2; i++ {
+		electrumClient.TransactionGet(tx.TxHash(),
+			func(receivedTx *wire.MsgTx) error {
+				require.Equal(t, tx.TxHash(), receivedTx.TxHash())
+				received++
+				return nil
+			},
+			func() { cleanups++ })
+	}
+	batch := <-rpcClient.batches
+	require.Len(t, batch, 1)
+	require.Equal(t, "blockchain.transaction.get", batch[0].Method)
+
+	rawTx := &bytes.Buffer{}
+	require.NoError(t, tx.Serialize(rawTx))
+	response, err := json.Marshal(hex.EncodeToString(rawTx.Bytes()))
+	require.NoError(t, err)
+	cleanup := batch[0].SetupAndTeardown()
+	require.NoError(t, batch[0].Success(response))
+	cleanup()
+	require.Equal(t, 2, received)
+	require.Equal(t, 2, cleanups)
+
+	// A later request is sent again.
+	electrumClient.TransactionGet(tx.TxHash(), func(*wire.MsgTx) error { return nil }, func() {})
+	require.Len(t, <-rpcClient.batches, 1)
+}
+
+func TestServerFeaturesCheck(t *testing.T) {
+	genesisHash := chaincfg.TestNet3Params.GenesisHash
+	features := func(genesisHash, protocolMin, protocolMax string, pruning *int) *client.ServerFeatures {
+		return &client.ServerFeatures{
+			GenesisHash: genesisHash,
+			ProtocolMin: protocolMin,
+			ProtocolMax: protocolMax,
+			Pruning:     pruning,
+		}
+	}
+	require.NoError(t, features(genesisHash.String(), "1.2", "1.4.2", nil).Check(genesisHash))
+	require.NoError(t, features(genesisHash.String(), "1.1", "1.2", nil).Check(genesisHash))
+	require.Error(t, features(chaincfg.MainNetParams.GenesisHash.String(), "1.2", "1.4", nil).
+		Check(genesisHash))
+	require.Error(t, features(genesisHash.String(), "1.3", "1.4", nil).Check(genesisHash))
+	require.Error(t, features(genesisHash.String(), "1.0", "1.1.9", nil).Check(genesisHash))
+	pruning := 10000
+	require.Error(t, features(genesisHash.String(), "1.2", "1.4", &pruning).Check(genesisHash))
+}
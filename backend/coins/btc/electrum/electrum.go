@@ -15,8 +15,10 @@
 package electrum
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"net"
 	"time"
@@ -29,6 +31,10 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// connectTimeout is the maximum time it may take to establish a connection, so that an unreachable
+// server does not hold up the failover to the next one.
+const connectTimeout = 10 * time.Second
+
 // ConnectionError indicates an error when establishing a network connection.
 type ConnectionError error
 
@@ -73,7 +79,7 @@ func newTLSConnection(address string, rootCert string) (*tls.Conn, error) {
 	if ok := caCertPool.AppendCertsFromPEM([]byte(rootCert)); !ok {
 		return nil, errp.New("Failed to append CA cert as trusted cert")
 	}
-	conn, err := tls.Dial("tcp", address, &tls.Config{
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: connectTimeout}, "tcp", address, &tls.Config{
 		RootCAs:            caCertPool,
 		InsecureSkipVerify: true, // Not actually skipping, we check the cert in VerifyPeerCertificate
 		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
@@ -116,30 +122,66 @@ func newTLSConnection(address string, rootCert string) (*tls.Conn, error) {
 }
 
 func newTCPConnection(address string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", address)
+	conn, err := net.DialTimeout("tcp", address, connectTimeout)
 	if err != nil {
 		return nil, errp.WithStack(err)
 	}
 	return conn, nil
 }
 
-// NewElectrumConnection connects to an Electrum server and returns a ElectrumClient instance to
-// communicate with it.
-func NewElectrumConnection(servers []*rpc.ServerInfo, log *logrus.Entry) blockchain.Interface {
-	var serverList string
-	for _, serverInfo := range servers {
-		if serverList != "" {
-			serverList += ", "
-		}
-		serverList += serverInfo.Server
+// DownloadCert downloads the first element of the remote certificate chain.
+func DownloadCert(server string) (string, error) {
+	var pemCert []byte
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: connectTimeout}, "tcp", server, &tls.Config{
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errp.New("no remote certs")
+			}
+
+			certificatePEM := &pem.Block{Type: "CERTIFICATE", Bytes: rawCerts[0]}
+			certificatePEMBytes := &bytes.Buffer{}
+			if err := pem.Encode(certificatePEMBytes, certificatePEM); err != nil {
+				panic(err)
+			}
+			pemCert = certificatePEMBytes.Bytes()
+			return nil
+		},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return "", errp.WithStack(err)
 	}
-	log = log.WithFields(logrus.Fields{"group": "electrum", "server-type": "electrumx", "servers": serverList})
+	_ = conn.Close()
+	return string(pemCert), nil
+}
+
+// NewElectrumConnection connects to the Electrum servers of the list, the healthiest first, and
+// returns a ElectrumClient instance to communicate with them. Each new server is checked for
+// compatibility and, if the discovery is enabled, asked for its peers, which are added to the list.
+func NewElectrumConnection(servers *Servers, log *logrus.Entry) blockchain.Interface {
+	log = log.WithFields(logrus.Fields{"group": "electrum", "server-type": "electrumx"})
 	log.Debug("Connecting to Electrum server")
 
-	backends := []rpc.Backend{}
-	for _, serverInfo := range servers {
-		backends = append(backends, &Electrum{log, serverInfo})
-	}
-	jsonrpcClient := jsonrpc.NewRPCClient(backends, log)
-	return client.NewElectrumClient(jsonrpcClient, log)
+	jsonrpcClient := jsonrpc.NewRPCClientWithBackends(servers.backends, log)
+	electrumClient := client.NewElectrumClient(jsonrpcClient, log)
+	electrumClient.OnConnect(func() error {
+		features, err := electrumClient.ServerFeatures()
+		if err != nil {
+			return err
+		}
+		if err := servers.check(features); err != nil {
+			return err
+		}
+		if !servers.discover {
+			return nil
+		}
+		electrumClient.ServerPeersSubscribe(
+			func(peers []*client.ServerPeer) error {
+				servers.addPeers(peers)
+				return nil
+			},
+			func() {})
+		return nil
+	})
+	return electrumClient
 }
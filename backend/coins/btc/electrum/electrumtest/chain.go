@@ -0,0 +1,379 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package electrumtest provides an in-process Electrum server backed by a scripted blockchain, so
+// that the electrum client, the headers, the transactions and the accounts can be tested together.
+package electrumtest
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+)
+
+// blockReward is the value of the coinbase output of the mined blocks.
+const blockReward = 50 * btcutil.SatoshiPerBitcoin
+
+type block struct {
+	header *wire.BlockHeader
+	txs    []*wire.MsgTx
+}
+
+// Chain is a blockchain which only grows when the test mines blocks, similar to regtest. It
+// starts with the genesis block of the given network. The blocks have no valid proof of work, so
+// the network must be one whose difficulty is not checked by the headers, like testnet.
+type Chain struct {
+	lock locker.Locker
+
+	net     *chaincfg.Params
+	blocks  []*block
+	mempool []*wire.MsgTx
+	// feeRate is returned as fee estimate for all targets. 0 if the fee cannot be estimated.
+	feeRate  btcutil.Amount
+	relayFee btcutil.Amount
+	// branch is increased with every reorg, so that the new blocks differ from the replaced ones.
+	branch uint32
+	// fundings makes the funding transactions unique.
+	fundings uint32
+
+	observers   map[int]func()
+	observersID int
+}
+
+// NewChain creates a chain containing only the genesis block of the network.
+func NewChain(net *chaincfg.Params) *Chain {
+	genesisHeader := net.GenesisBlock.Header
+	return &Chain{
+		net: net,
+		blocks: []*block{{
+			header: &genesisHeader,
+			txs:    net.GenesisBlock.Transactions,
+		}},
+		mempool:   []*wire.MsgTx{},
+		relayFee:  1000,
+		observers: map[int]func(){},
+	}
+}
+
+// Net returns the network of the chain.
+func (chain *Chain) Net() *chaincfg.Params {
+	return chain.net
+}
+
+// SetFeeRate sets the fee rate per kB returned by the fee estimates. 0 means that the fee cannot
+// be estimated, in which case clients fall back to the relay fee.
+func (chain *Chain) SetFeeRate(feeRatePerKb btcutil.Amount) {
+	defer chain.lock.Lock()()
+	chain.feeRate = feeRatePerKb
+}
+
+// TipHeight returns the height of the last block.
+func (chain *Chain) TipHeight() int {
+	defer chain.lock.RLock()()
+	return len(chain.blocks) - 1
+}
+
+// Header returns the header of the block at the given height, or nil if there is no such block.
+func (chain *Chain) Header(height int) *wire.BlockHeader {
+	defer chain.lock.RLock()()
+	if height < 0 || height >= len(chain.blocks) {
+		return nil
+	}
+	return chain.blocks[height].header
+}
+
+// Mempool returns the unconfirmed transactions.
+func (chain *Chain) Mempool() []*wire.MsgTx {
+	defer chain.lock.RLock()()
+	return append([]*wire.MsgTx{}, chain.mempool...)
+}
+
+// Fund adds a transaction to the mempool which pays the amount to the pkScript. Its input spends
+// an output which is not part of the chain, like a transaction received from a third party.
+func (chain *Chain) Fund(pkScript []byte, amount btcutil.Amount) *wire.MsgTx {
+	tx := func() *wire.MsgTx {
+		defer chain.lock.Lock()()
+		chain.fundings++
+		prevHash := chainhash.HashH(uint32Bytes(chain.fundings))
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, nil))
+		tx.AddTxOut(wire.NewTxOut(int64(amount), pkScript))
+		chain.mempool = append(chain.mempool, tx)
+		return tx
+	}()
+	chain.notify()
+	return tx
+}
+
+// Broadcast adds the transaction to the mempool. Like a node, it rejects transactions which are
+// already known, which spend unknown outputs or which double spend an output.
+func (chain *Chain) Broadcast(tx *wire.MsgTx) error {
+	if err := chain.broadcast(tx); err != nil {
+		return err
+	}
+	chain.notify()
+	return nil
+}
+
+// broadcast is Broadcast() without notifying the observers.
+func (chain *Chain) broadcast(tx *wire.MsgTx) error {
+	defer chain.lock.Lock()()
+	txHash := tx.TxHash()
+	if chain.lookupTx(txHash) != nil {
+		return errp.Newf("transaction %s already known", txHash)
+	}
+	spent := chain.spentOutPoints()
+	for _, txIn := range tx.TxIn {
+		prevTx := chain.lookupTx(txIn.PreviousOutPoint.Hash)
+		if prevTx == nil || int(txIn.PreviousOutPoint.Index) >= len(prevTx.TxOut) {
+			return errp.Newf("missing input %s", txIn.PreviousOutPoint)
+		}
+		if _, ok := spent[txIn.PreviousOutPoint]; ok {
+			return errp.Newf("input %s already spent", txIn.PreviousOutPoint)
+		}
+	}
+	chain.mempool = append(chain.mempool, tx)
+	return nil
+}
+
+// Mine appends the given number of blocks. The first one confirms all transactions of the mempool.
+func (chain *Chain) Mine(count int) {
+	func() {
+		defer chain.lock.Lock()()
+		for i := 0; i < count; i++ {
+			tip := chain.blocks[len(chain.blocks)-1].header
+			height := len(chain.blocks)
+			txs := append([]*wire.MsgTx{chain.coinbase(height)}, chain.mempool...)
+			chain.mempool = []*wire.MsgTx{}
+			txHashes := make([]chainhash.Hash, len(txs))
+			for index, tx := range txs {
+				txHashes[index] = tx.TxHash()
+			}
+			merkleRoot, _ := merkleBranch(txHashes, 0)
+			chain.blocks = append(chain.blocks, &block{
+				header: &wire.BlockHeader{
+					Version:    tip.Version,
+					PrevBlock:  tip.BlockHash(),
+					MerkleRoot: merkleRoot,
+					Timestamp:  tip.Timestamp.Add(10 * time.Minute),
+					Bits:       chain.net.PowLimitBits,
+					Nonce:      chain.branch,
+				},
+				txs: txs,
+			})
+		}
+	}()
+	chain.notify()
+}
+
+// Reorg removes the given number of blocks from the tip. Their transactions go back to the
+// mempool, so that they are confirmed again by the next mined block, at a different height. The
+// blocks mined afterwards differ from the removed ones. The genesis block cannot be removed.
+func (chain *Chain) Reorg(depth int) {
+	func() {
+		defer chain.lock.Lock()()
+		if depth > len(chain.blocks)-1 {
+			depth = len(chain.blocks) - 1
+		}
+		removed := chain.blocks[len(chain.blocks)-depth:]
+		chain.blocks = chain.blocks[:len(chain.blocks)-depth]
+		txs := []*wire.MsgTx{}
+		for _, block := range removed {
+			// Skip the coinbase.
+			txs = append(txs, block.txs[1:]...)
+		}
+		chain.mempool = append(txs, chain.mempool...)
+		chain.branch++
+	}()
+	chain.notify()
+}
+
+// coinbase returns the coinbase transaction of a new block. Requires the chain lock.
+func (chain *Chain) coinbase(height int) *wire.MsgTx {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		append(uint32Bytes(uint32(height)), uint32Bytes(chain.branch)...),
+		nil))
+	tx.AddTxOut(wire.NewTxOut(blockReward, []byte{txscript.OP_TRUE}))
+	return tx
+}
+
+// subscribe registers a function which is called after every change of the chain or the mempool.
+// The returned function unsubscribes.
+func (chain *Chain) subscribe(observer func()) func() {
+	defer chain.lock.Lock()()
+	id := chain.observersID
+	chain.observersID++
+	chain.observers[id] = observer
+	return func() {
+		defer chain.lock.Lock()()
+		delete(chain.observers, id)
+	}
+}
+
+func (chain *Chain) notify() {
+	observers := []func(){}
+	func() {
+		defer chain.lock.RLock()()
+		for _, observer := range chain.observers {
+			observers = append(observers, observer)
+		}
+	}()
+	for _, observer := range observers {
+		observer()
+	}
+}
+
+// lookupTx returns the confirmed or unconfirmed transaction, or nil if it is unknown. Requires the
+// chain lock.
+func (chain *Chain) lookupTx(txHash chainhash.Hash) *wire.MsgTx {
+	tx, _, _ := chain.findTx(txHash)
+	return tx
+}
+
+// findTx returns the transaction, the height of its block and its position in the block. The
+// height is 0 for transactions in the mempool. Requires the chain lock.
+func (chain *Chain) findTx(txHash chainhash.Hash) (*wire.MsgTx, int, int) {
+	for height, block := range chain.blocks {
+		for pos, tx := range block.txs {
+			if tx.TxHash() == txHash {
+				return tx, height, pos
+			}
+		}
+	}
+	for _, tx := range chain.mempool {
+		if tx.TxHash() == txHash {
+			return tx, 0, 0
+		}
+	}
+	return nil, 0, 0
+}
+
+// spentOutPoints returns all outputs spent by confirmed or unconfirmed transactions. Requires the
+// chain lock.
+func (chain *Chain) spentOutPoints() map[wire.OutPoint]struct{} {
+	spent := map[wire.OutPoint]struct{}{}
+	chain.forEachTx(func(tx *wire.MsgTx, height int) {
+		for _, txIn := range tx.TxIn {
+			spent[txIn.PreviousOutPoint] = struct{}{}
+		}
+	})
+	return spent
+}
+
+// forEachTx calls f for every transaction in the order of the blocks, followed by the mempool.
+// The height is 0 for unconfirmed transactions. Requires the chain lock.
+func (chain *Chain) forEachTx(f func(tx *wire.MsgTx, height int)) {
+	for height, block := range chain.blocks {
+		for _, tx := range block.txs {
+			f(tx, height)
+		}
+	}
+	for _, tx := range chain.mempool {
+		f(tx, 0)
+	}
+}
+
+// history returns the history of the script hash as returned by
+// blockchain.scripthash.get_history: the confirmed transactions ordered by height, followed by
+// the unconfirmed ones. Unconfirmed transactions spending unconfirmed outputs have the height -1.
+func (chain *Chain) history(scriptHashHex blockchain.ScriptHashHex) blockchain.TxHistory {
+	defer chain.lock.RLock()()
+	unconfirmed := map[chainhash.Hash]struct{}{}
+	for _, tx := range chain.mempool {
+		unconfirmed[tx.TxHash()] = struct{}{}
+	}
+	history := blockchain.TxHistory{}
+	chain.forEachTx(func(tx *wire.MsgTx, height int) {
+		touches := false
+		for _, txOut := range tx.TxOut {
+			touches = touches || scriptHash(txOut.PkScript) == scriptHashHex
+		}
+		spendsUnconfirmed := false
+		for _, txIn := range tx.TxIn {
+			prevTx := chain.lookupTx(txIn.PreviousOutPoint.Hash)
+			if prevTx == nil || int(txIn.PreviousOutPoint.Index) >= len(prevTx.TxOut) {
+				continue
+			}
+			prevOut := prevTx.TxOut[txIn.PreviousOutPoint.Index]
+			touches = touches || scriptHash(prevOut.PkScript) == scriptHashHex
+			if _, ok := unconfirmed[txIn.PreviousOutPoint.Hash]; ok {
+				spendsUnconfirmed = true
+			}
+		}
+		if !touches {
+			return
+		}
+		if height == 0 && spendsUnconfirmed {
+			height = -1
+		}
+		history = append(history, &blockchain.TxInfo{Height: height, TXHash: blockchain.TXHash(tx.TxHash())})
+	})
+	return history
+}
+
+// merkle returns the merkle branch of the transaction in the block at the given height and its
+// position in the block.
+func (chain *Chain) merkle(txHash chainhash.Hash, height int) ([]chainhash.Hash, int, error) {
+	defer chain.lock.RLock()()
+	tx, txHeight, pos := chain.findTx(txHash)
+	if tx == nil || txHeight == 0 || txHeight != height {
+		return nil, 0, errp.Newf("transaction %s not in block %d", txHash, height)
+	}
+	txHashes := []chainhash.Hash{}
+	for _, tx := range chain.blocks[height].txs {
+		txHashes = append(txHashes, tx.TxHash())
+	}
+	_, branch := merkleBranch(txHashes, pos)
+	return branch, pos, nil
+}
+
+// merkleBranch returns the merkle root of the hashes and the branch proving the inclusion of the
+// hash at the given position.
+func merkleBranch(hashes []chainhash.Hash, pos int) (chainhash.Hash, []chainhash.Hash) {
+	branch := []chainhash.Hash{}
+	level := append([]chainhash.Hash{}, hashes...)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		branch = append(branch, level[pos^1])
+		next := make([]chainhash.Hash, len(level)/2)
+		for i := range next {
+			next[i] = chainhash.DoubleHashH(append(level[2*i][:], level[2*i+1][:]...))
+		}
+		level = next
+		pos /= 2
+	}
+	return level[0], branch
+}
+
+func scriptHash(pkScript []byte) blockchain.ScriptHashHex {
+	return blockchain.ScriptHashHex(chainhash.HashH(pkScript).String())
+}
+
+func uint32Bytes(value uint32) []byte {
+	result := make([]byte, 4)
+	binary.LittleEndian.PutUint32(result, value)
+	return result
+}
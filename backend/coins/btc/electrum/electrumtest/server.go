@@ -0,0 +1,546 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package electrumtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/jsonp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+	"github.com/sirupsen/logrus"
+)
+
+// maxHeaders is the maximum number of headers returned by blockchain.block.headers.
+const maxHeaders = 2016
+
+// Override replaces the result of a method, to simulate bad responses. It is called with the
+// params of the request and the result the server would return. If it returns an error, the
+// server replies with a JSON-RPC error.
+type Override func(params []json.RawMessage, result interface{}) (interface{}, error)
+
+// Server is an Electrum server serving a Chain over TCP or TLS on a random local port. The
+// connected clients are notified of new headers and of status changes of their subscribed script
+// hashes whenever the chain changes. Multiple servers can serve the same chain, to test a failover.
+type Server struct {
+	chain    *Chain
+	listener net.Listener
+	// pemCert is the certificate of the server if it uses TLS.
+	pemCert string
+
+	lock        locker.Locker
+	connections map[*connection]struct{}
+	overrides   map[string]Override
+	closed      bool
+	// requests counts the received requests by method, batches the received batch requests.
+	requests map[string]int
+	batches  int
+
+	unsubscribe func()
+	// goroutines tracks the accept loop and the connections, so that Close can wait for them.
+	goroutines sync.WaitGroup
+	log        *logrus.Entry
+}
+
+// NewServer starts a server for the chain. If useTLS is true, it uses a new self-signed
+// certificate, which is part of the ServerInfo().
+func NewServer(chain *Chain, useTLS bool) (*Server, error) {
+	server := &Server{
+		chain:       chain,
+		connections: map[*connection]struct{}{},
+		overrides:   map[string]Override{},
+		requests:    map[string]int{},
+		log:         logging.Get().WithGroup("electrumtest"),
+	}
+	if useTLS {
+		certificate, pemCert, err := newCertificate()
+		if err != nil {
+			return nil, err
+		}
+		server.pemCert = pemCert
+		server.listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{*certificate},
+		})
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+	} else {
+		var err error
+		server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+	}
+	server.log = server.log.WithField("server", server.listener.Addr().String())
+	server.unsubscribe = chain.subscribe(server.notify)
+	server.goroutines.Add(1)
+	go server.accept()
+	return server, nil
+}
+
+// newCertificate creates a self-signed certificate for 127.0.0.1.
+func newCertificate() (*tls.Certificate, string, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", errp.WithStack(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"electrumtest"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, "", errp.WithStack(err)
+	}
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	return &tls.Certificate{Certificate: [][]byte{derBytes}, PrivateKey: privateKey}, string(pemCert), nil
+}
+
+// ServerInfo returns the info needed by clients to connect to the server.
+func (server *Server) ServerInfo() *rpc.ServerInfo {
+	return &rpc.ServerInfo{
+		Server:  server.listener.Addr().String(),
+		TLS:     server.pemCert != "",
+		PEMCert: server.pemCert,
+	}
+}
+
+// Connections returns the number of connected clients.
+func (server *Server) Connections() int {
+	defer server.lock.RLock()()
+	return len(server.connections)
+}
+
+// Requests returns the number of requests of the method the server received.
+func (server *Server) Requests(method string) int {
+	defer server.lock.RLock()()
+	return server.requests[method]
+}
+
+// Batches returns the number of batch requests the server received.
+func (server *Server) Batches() int {
+	defer server.lock.RLock()()
+	return server.batches
+}
+
+// Override replaces the results of the given method. A nil override restores the normal
+// behavior.
+func (server *Server) Override(method string, override Override) {
+	defer server.lock.Lock()()
+	if override == nil {
+		delete(server.overrides, method)
+		return
+	}
+	server.overrides[method] = override
+}
+
+// Disconnect closes the connections to all clients. New connections are still accepted.
+func (server *Server) Disconnect() {
+	defer server.lock.RLock()()
+	for connection := range server.connections {
+		_ = connection.conn.Close()
+	}
+}
+
+// Close stops the server, so that the clients have to fail over to another one, and waits until
+// all connections are closed. It is safe to call it more than once.
+func (server *Server) Close() {
+	func() {
+		defer server.lock.Lock()()
+		if server.closed {
+			return
+		}
+		server.closed = true
+		server.unsubscribe()
+		_ = server.listener.Close()
+		for connection := range server.connections {
+			_ = connection.conn.Close()
+		}
+	}()
+	server.goroutines.Wait()
+}
+
+func (server *Server) accept() {
+	defer server.goroutines.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		connection := &connection{
+			server:       server,
+			conn:         conn,
+			tipHeight:    -1,
+			scriptHashes: map[blockchain.ScriptHashHex]*string{},
+		}
+		func() {
+			defer server.lock.Lock()()
+			if server.closed {
+				_ = conn.Close()
+				return
+			}
+			server.connections[connection] = struct{}{}
+			server.goroutines.Add(1)
+			go connection.serve()
+		}()
+	}
+}
+
+// notify sends the notifications caused by a change of the chain to all clients.
+func (server *Server) notify() {
+	connections := []*connection{}
+	func() {
+		defer server.lock.RLock()()
+		for connection := range server.connections {
+			connections = append(connections, connection)
+		}
+	}()
+	for _, connection := range connections {
+		connection.notify()
+	}
+}
+
+func (server *Server) override(method string) Override {
+	defer server.lock.RLock()()
+	return server.overrides[method]
+}
+
+// connection is a connected client.
+type connection struct {
+	server *Server
+	conn   net.Conn
+
+	// lock guards the subscriptions and the writes, so that a notification cannot overtake the
+	// response to the subscription.
+	lock              locker.Locker
+	headersSubscribed bool
+	// tipHeight and tipHash identify the last tip sent to the client.
+	tipHeight int
+	tipHash   chainhash.Hash
+	// scriptHashes are the subscribed script hashes with the last status sent to the client.
+	scriptHashes map[blockchain.ScriptHashHex]*string
+}
+
+// serve handles the requests of the client until the connection is closed.
+func (connection *connection) serve() {
+	defer connection.server.goroutines.Done()
+	defer func() {
+		_ = connection.conn.Close()
+		defer connection.server.lock.Lock()()
+		delete(connection.server.connections, connection)
+	}()
+	reader := bufio.NewReader(connection.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		batch := bytes.HasPrefix(bytes.TrimSpace(line), []byte("["))
+		requests := []*request{}
+		if batch {
+			err = json.Unmarshal(line, &requests)
+		} else {
+			single := &request{}
+			err = json.Unmarshal(line, single)
+			requests = append(requests, single)
+		}
+		if err != nil {
+			connection.server.log.WithError(err).Error("Invalid request")
+			return
+		}
+		if err := connection.handle(requests, batch); err != nil {
+			return
+		}
+	}
+}
+
+type request struct {
+	ID     int               `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// handle answers the requests. The responses to a batch are sent together in an array. An error is
+// returned if the responses could not be sent.
+func (connection *connection) handle(requests []*request, batch bool) error {
+	func() {
+		defer connection.server.lock.Lock()()
+		if batch {
+			connection.server.batches++
+		}
+		for _, request := range requests {
+			connection.server.requests[request.Method]++
+		}
+	}()
+	unlock := connection.lock.Lock()
+	responses := []interface{}{}
+	broadcast := false
+	for _, request := range requests {
+		result, err := connection.result(request.Method, request.Params)
+		if err == nil {
+			if override := connection.server.override(request.Method); override != nil {
+				result, err = override(request.Params, result)
+			}
+		}
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+		if err != nil {
+			response["error"] = map[string]interface{}{"code": 1, "message": err.Error()}
+		} else {
+			response["result"] = result
+		}
+		responses = append(responses, response)
+		if request.Method == "blockchain.transaction.broadcast" && err == nil {
+			broadcast = true
+		}
+	}
+	var writeErr error
+	if batch {
+		writeErr = connection.write(responses)
+	} else {
+		writeErr = connection.write(responses[0])
+	}
+	unlock()
+	if broadcast {
+		connection.server.chain.notify()
+	}
+	return writeErr
+}
+
+// result computes the result of a method. Requires the connection lock.
+func (connection *connection) result(method string, params []json.RawMessage) (interface{}, error) {
+	chain := connection.server.chain
+	switch method {
+	case "server.version":
+		return []string{"electrumtest", "1.2"}, nil
+	case "server.features":
+		return map[string]interface{}{
+			"genesis_hash": chain.net.GenesisHash.String(),
+			"protocol_min": "1.2",
+			"protocol_max": "1.4",
+			"pruning":      nil,
+		}, nil
+	case "server.peers.subscribe":
+		// The server knows no peers, unless overridden.
+		return []interface{}{}, nil
+	case "server.ping":
+		return nil, nil
+	case "blockchain.headers.subscribe":
+		connection.headersSubscribed = true
+		height, header := connection.tip()
+		return headerResult(height, header), nil
+	case "blockchain.block.headers":
+		var startHeight, count int
+		if err := parseParams(params, &startHeight, &count); err != nil {
+			return nil, err
+		}
+		if count > maxHeaders {
+			count = maxHeaders
+		}
+		headersHex := &bytes.Buffer{}
+		headersCount := 0
+		for height := startHeight; height < startHeight+count; height++ {
+			header := chain.Header(height)
+			if header == nil {
+				break
+			}
+			if err := header.BtcEncode(hex.NewEncoder(headersHex), 0, wire.BaseEncoding); err != nil {
+				return nil, errp.WithStack(err)
+			}
+			headersCount++
+		}
+		return map[string]interface{}{
+			"hex":   headersHex.String(),
+			"count": headersCount,
+			"max":   maxHeaders,
+		}, nil
+	case "blockchain.scripthash.subscribe":
+		var scriptHashHex blockchain.ScriptHashHex
+		if err := parseParams(params, &scriptHashHex); err != nil {
+			return nil, err
+		}
+		status := statusOf(chain.history(scriptHashHex))
+		connection.scriptHashes[scriptHashHex] = status
+		return status, nil
+	case "blockchain.scripthash.get_history":
+		var scriptHashHex blockchain.ScriptHashHex
+		if err := parseParams(params, &scriptHashHex); err != nil {
+			return nil, err
+		}
+		return chain.history(scriptHashHex), nil
+	case "blockchain.transaction.get":
+		var txHash blockchain.TXHash
+		if err := parseParams(params, &txHash); err != nil {
+			return nil, err
+		}
+		tx := func() *wire.MsgTx {
+			defer chain.lock.RLock()()
+			return chain.lookupTx(txHash.Hash())
+		}()
+		if tx == nil {
+			return nil, errp.Newf("unknown transaction %s", txHash.Hash())
+		}
+		rawTx := &bytes.Buffer{}
+		if err := tx.BtcEncode(rawTx, 0, wire.WitnessEncoding); err != nil {
+			return nil, errp.WithStack(err)
+		}
+		return hex.EncodeToString(rawTx.Bytes()), nil
+	case "blockchain.transaction.get_merkle":
+		var txHash blockchain.TXHash
+		var height int
+		if err := parseParams(params, &txHash, &height); err != nil {
+			return nil, err
+		}
+		branch, pos, err := chain.merkle(txHash.Hash(), height)
+		if err != nil {
+			return nil, err
+		}
+		merkle := []string{}
+		for _, hash := range branch {
+			merkle = append(merkle, hash.String())
+		}
+		return map[string]interface{}{"merkle": merkle, "pos": pos, "block_height": height}, nil
+	case "blockchain.transaction.broadcast":
+		var rawTxHex string
+		if err := parseParams(params, &rawTxHex); err != nil {
+			return nil, err
+		}
+		rawTx, err := hex.DecodeString(rawTxHex)
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+		tx := &wire.MsgTx{}
+		if err := tx.BtcDecode(bytes.NewReader(rawTx), 0, wire.WitnessEncoding); err != nil {
+			return nil, errp.WithStack(err)
+		}
+		// The clients are notified by handle() once the connection lock is released.
+		if err := chain.broadcast(tx); err != nil {
+			return nil, err
+		}
+		return tx.TxHash().String(), nil
+	case "blockchain.estimatefee":
+		defer chain.lock.RLock()()
+		if chain.feeRate == 0 {
+			return -1, nil
+		}
+		return chain.feeRate.ToBTC(), nil
+	case "blockchain.relayfee":
+		defer chain.lock.RLock()()
+		return chain.relayFee.ToBTC(), nil
+	}
+	return nil, errp.Newf("unknown method %s", method)
+}
+
+// notify sends a notification for a new tip and for every subscribed script hash whose status
+// changed.
+func (connection *connection) notify() {
+	defer connection.lock.Lock()()
+	if connection.headersSubscribed {
+		previousHeight, previousHash := connection.tipHeight, connection.tipHash
+		height, header := connection.tip()
+		if height != previousHeight || header.BlockHash() != previousHash {
+			notification := notification("blockchain.headers.subscribe", headerResult(height, header))
+			if err := connection.write(notification); err != nil {
+				return
+			}
+		}
+	}
+	for scriptHashHex, previousStatus := range connection.scriptHashes {
+		status := statusOf(connection.server.chain.history(scriptHashHex))
+		if (status == nil) == (previousStatus == nil) && (status == nil || *status == *previousStatus) {
+			continue
+		}
+		connection.scriptHashes[scriptHashHex] = status
+		if err := connection.write(notification("blockchain.scripthash.subscribe", scriptHashHex, status)); err != nil {
+			return
+		}
+	}
+}
+
+// tip returns the current tip and remembers it as sent to the client. Requires the connection
+// lock.
+func (connection *connection) tip() (int, *wire.BlockHeader) {
+	chain := connection.server.chain
+	defer chain.lock.RLock()()
+	height := len(chain.blocks) - 1
+	header := chain.blocks[height].header
+	connection.tipHeight = height
+	connection.tipHash = header.BlockHash()
+	return height, header
+}
+
+// write sends a message to the client. Requires the connection lock.
+func (connection *connection) write(message interface{}) error {
+	_, err := connection.conn.Write(append(jsonp.MustMarshal(message), '\n'))
+	return errp.WithStack(err)
+}
+
+func notification(method string, params ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+}
+
+func headerResult(height int, header *wire.BlockHeader) map[string]interface{} {
+	headerHex := &bytes.Buffer{}
+	if err := header.BtcEncode(hex.NewEncoder(headerHex), 0, wire.BaseEncoding); err != nil {
+		panic(errp.WithStack(err))
+	}
+	return map[string]interface{}{"block_height": height, "hex": headerHex.String()}
+}
+
+// statusOf returns the status of the history, or nil if it is empty.
+func statusOf(history blockchain.TxHistory) *string {
+	if len(history) == 0 {
+		return nil
+	}
+	status := history.Status()
+	return &status
+}
+
+func parseParams(params []json.RawMessage, values ...interface{}) error {
+	if len(params) != len(values) {
+		return errp.Newf("expected %d params, got %d", len(values), len(params))
+	}
+	for index, value := range values {
+		if err := json.Unmarshal(params[index], value); err != nil {
+			return errp.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,531 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package electrum
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/electrum/client"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxDiscoveredServers is the maximum number of discovered servers kept in the list. The least
+	// healthy ones are dropped.
+	maxDiscoveredServers = 50
+	// latencySmoothing is the weight of a new latency measurement in the moving average.
+	latencySmoothing = 0.3
+	// unknownLatency is assumed for servers which were never connected to.
+	unknownLatency = 500 * time.Millisecond
+)
+
+// Server is an Electrum server known to the app, with statistics about its health.
+type Server struct {
+	rpc.ServerInfo
+	// Discovered is true if the server was announced by another server instead of being
+	// configured. The certificate of a discovered server is trusted on first use.
+	Discovered bool `json:"discovered"`
+	// Pinned servers are used exclusively if there are any.
+	Pinned bool `json:"pinned"`
+	// Banned servers are never used.
+	Banned bool `json:"banned"`
+	// Incompatible is the reason why the server cannot be used, e.g. because it serves another
+	// network, or empty if it can be used.
+	Incompatible string `json:"incompatible,omitempty"`
+
+	// Connects is the number of successful connections, Errors the number of failed or lost
+	// connections.
+	Connects  int    `json:"connects"`
+	Errors    int    `json:"errors"`
+	LastError string `json:"lastError,omitempty"`
+	// LatencyMS is the moving average of the time it takes to connect to the server.
+	LatencyMS int64 `json:"latencyMs"`
+	// UptimeSeconds is the total time we were connected to the server.
+	UptimeSeconds int64 `json:"uptimeSeconds"`
+}
+
+// score rates the health of the server between 0 and 1 from the share of successful connections
+// and the latency. Discovered servers are trusted less than the configured ones.
+func (server *Server) score() float64 {
+	reliability := float64(server.Connects+1) / float64(server.Connects+server.Errors+2)
+	latency := unknownLatency
+	if server.LatencyMS != 0 {
+		latency = time.Duration(server.LatencyMS) * time.Millisecond
+	}
+	score := reliability / (1 + latency.Seconds())
+	if server.Discovered {
+		score /= 2
+	}
+	return score
+}
+
+func (server *Server) usable() bool {
+	return !server.Banned && server.Incompatible == ""
+}
+
+// ServerStatus is a server as returned by Servers.List().
+type ServerStatus struct {
+	Server
+	// Connected is true if this is the server we are currently connected to.
+	Connected bool    `json:"connected"`
+	Score     float64 `json:"score"`
+}
+
+// Servers is the list of the known Electrum servers of a coin. It consists of the configured
+// servers and, if the discovery is enabled, the servers they announce. It is persisted with the
+// health statistics of every server, which are used to choose the server to connect to.
+type Servers struct {
+	filename string
+	// key encrypts the persisted list, which reveals when the user was online and which servers
+	// were used. It may be nil.
+	key *encryption.Key
+	// discover is true if the servers announced by the connected server are added to the list.
+	discover bool
+	net      *chaincfg.Params
+
+	servers []*Server
+	// connection is the current connection, nil if there is none.
+	connection *serverConnection
+	lock       locker.Locker
+
+	log *logrus.Entry
+}
+
+// NewServers loads the server list of a coin from the given file and merges it with the configured
+// servers. Servers which are no longer configured are removed, and so are the discovered servers if
+// the discovery is disabled. The file is encrypted with the key, unless it is nil.
+func NewServers(
+	filename string,
+	key *encryption.Key,
+	configured []*rpc.ServerInfo,
+	discover bool,
+	net *chaincfg.Params,
+	log *logrus.Entry,
+) *Servers {
+	servers := &Servers{
+		filename: filename,
+		key:      key,
+		discover: discover,
+		net:      net,
+		log:      log.WithFields(logrus.Fields{"group": "electrum", "servers": filename}),
+	}
+	saved := []*Server{}
+	jsonBytes, err := encryption.ReadFile(filename, key)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		servers.log.WithError(err).Error("Could not read the server list")
+	default:
+		if err := json.Unmarshal(jsonBytes, &saved); err != nil {
+			servers.log.WithError(err).Error("Could not parse the server list")
+			saved = nil
+		}
+	}
+	savedByAddress := map[string]*Server{}
+	for _, server := range saved {
+		savedByAddress[server.Server] = server
+	}
+	for _, serverInfo := range configured {
+		server, ok := savedByAddress[serverInfo.Server]
+		if !ok {
+			server = &Server{}
+		}
+		server.ServerInfo = *serverInfo
+		server.Discovered = false
+		// The server might have been fixed since it was found to be incompatible.
+		server.Incompatible = ""
+		delete(savedByAddress, serverInfo.Server)
+		servers.servers = append(servers.servers, server)
+	}
+	for _, server := range saved {
+		if _, ok := savedByAddress[server.Server]; ok && server.Discovered && discover {
+			servers.servers = append(servers.servers, server)
+		}
+	}
+	return servers
+}
+
+// List returns the known servers, the preferred ones first.
+func (servers *Servers) List() []*ServerStatus {
+	defer servers.lock.RLock()()
+	list := []*ServerStatus{}
+	for _, server := range servers.sorted() {
+		list = append(list, &ServerStatus{
+			Server:    *server,
+			Connected: servers.connection != nil && servers.connection.server == server,
+			Score:     server.score(),
+		})
+	}
+	return list
+}
+
+// sorted returns the servers by health, with random order among equally healthy ones, so that the
+// load is balanced between them. Pinned servers come first. Requires the lock.
+func (servers *Servers) sorted() []*Server {
+	sorted := make([]*Server, len(servers.servers))
+	for index, permuted := range rand.Perm(len(servers.servers)) {
+		sorted[index] = servers.servers[permuted]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Pinned != sorted[j].Pinned {
+			return sorted[i].Pinned
+		}
+		return sorted[i].score() > sorted[j].score()
+	})
+	return sorted
+}
+
+// find returns the server with the given address. Requires the lock.
+func (servers *Servers) find(address string) (*Server, error) {
+	for _, server := range servers.servers {
+		if server.Server == address {
+			return server, nil
+		}
+	}
+	return nil, errp.Newf("Unknown server %s", address)
+}
+
+// Pin pins or unpins a server. If any servers are pinned, only they are used. The connection is
+// moved to a pinned server.
+func (servers *Servers) Pin(address string, pinned bool) error {
+	unlock := servers.lock.Lock()
+	server, err := servers.find(address)
+	if err != nil {
+		unlock()
+		return err
+	}
+	server.Pinned = pinned
+	servers.save()
+	connection := servers.connection
+	reconnect := connection != nil && !servers.allowed(connection.server)
+	unlock()
+	if reconnect {
+		_ = connection.Close()
+	}
+	return nil
+}
+
+// Ban bans or unbans a server. A banned server is never used, and the connection to it is closed.
+// Unbanning also allows to retry a server which was found to be incompatible.
+func (servers *Servers) Ban(address string, banned bool) error {
+	unlock := servers.lock.Lock()
+	server, err := servers.find(address)
+	if err != nil {
+		unlock()
+		return err
+	}
+	server.Banned = banned
+	if !banned {
+		server.Incompatible = ""
+	}
+	servers.save()
+	connection := servers.connection
+	reconnect := connection != nil && !servers.allowed(connection.server)
+	unlock()
+	if reconnect {
+		_ = connection.Close()
+	}
+	return nil
+}
+
+// allowed returns whether the server may be used, considering the pinned servers. Requires the
+// lock.
+func (servers *Servers) allowed(server *Server) bool {
+	if !server.usable() {
+		return false
+	}
+	if server.Pinned {
+		return true
+	}
+	for _, other := range servers.servers {
+		if other.Pinned && other.usable() {
+			return false
+		}
+	}
+	return true
+}
+
+// backends returns the servers which may be used, the preferred ones first.
+func (servers *Servers) backends() []rpc.Backend {
+	defer servers.lock.RLock()()
+	backends := []rpc.Backend{}
+	for _, server := range servers.sorted() {
+		if servers.allowed(server) {
+			backends = append(backends, &serverBackend{servers: servers, server: server})
+		}
+	}
+	return backends
+}
+
+// check marks the currently connected server as incompatible and returns an error if it does not
+// fit the features required by the client.
+func (servers *Servers) check(features *client.ServerFeatures) error {
+	defer servers.lock.Lock()()
+	err := features.Check(servers.net.GenesisHash)
+	if err != nil && servers.connection != nil {
+		server := servers.connection.server
+		servers.log.WithError(err).WithField("server", server.Server).Info("Incompatible server")
+		server.Incompatible = err.Error()
+		server.Errors++
+		server.LastError = err.Error()
+		servers.save()
+	}
+	return err
+}
+
+// defaultTLSPort returns the TLS port used by servers of the network if they do not announce one,
+// or the empty string if there is no default.
+func (servers *Servers) defaultTLSPort() string {
+	switch servers.net.Name {
+	case "mainnet":
+		return "50002"
+	case "testnet3", "testnet4":
+		return "51002"
+	}
+	return ""
+}
+
+// addPeers adds the peers announced by a server to the list. Only peers reachable over TLS are
+// added, as the connection to a server is not otherwise authenticated. Tor hidden services are
+// skipped.
+func (servers *Servers) addPeers(peers []*client.ServerPeer) {
+	defer servers.lock.Lock()()
+	added := 0
+	for _, peer := range peers {
+		host := peer.Host
+		if host == "" {
+			host = peer.IP
+		}
+		if host == "" || strings.HasSuffix(host, ".onion") {
+			continue
+		}
+		port := ""
+		for _, feature := range peer.Features {
+			if strings.HasPrefix(feature, "s") {
+				port = strings.TrimPrefix(feature, "s")
+				if port == "" {
+					port = servers.defaultTLSPort()
+				}
+			}
+		}
+		if port == "" {
+			continue
+		}
+		address := net.JoinHostPort(host, port)
+		if _, err := servers.find(address); err == nil {
+			continue
+		}
+		servers.servers = append(servers.servers, &Server{
+			ServerInfo: rpc.ServerInfo{Server: address, TLS: true},
+			Discovered: true,
+		})
+		added++
+	}
+	if added == 0 {
+		return
+	}
+	servers.log.WithField("added", added).Debug("Discovered servers")
+	servers.prune()
+	servers.save()
+}
+
+// prune drops the least healthy discovered servers which exceed maxDiscoveredServers. Pinned and
+// banned servers are kept, so that the choice of the user is not lost. Requires the lock.
+func (servers *Servers) prune() {
+	discovered := 0
+	for _, server := range servers.servers {
+		if server.Discovered {
+			discovered++
+		}
+	}
+	if discovered <= maxDiscoveredServers {
+		return
+	}
+	drop := map[*Server]bool{}
+	sorted := servers.sorted()
+	for index := len(sorted) - 1; index >= 0 && discovered > maxDiscoveredServers; index-- {
+		server := sorted[index]
+		connected := servers.connection != nil && servers.connection.server == server
+		if server.Discovered && !server.Pinned && !server.Banned && !connected {
+			drop[server] = true
+			discovered--
+		}
+	}
+	kept := []*Server{}
+	for _, server := range servers.servers {
+		if !drop[server] {
+			kept = append(kept, server)
+		}
+	}
+	servers.servers = kept
+}
+
+// save writes the server list to a temporary file and renames it, so that a crash while writing
+// cannot corrupt it. The file is only readable by the user. Errors are only logged, as the list is
+// rebuilt from the config and the discovery. Requires the lock.
+func (servers *Servers) save() {
+	jsonBytes, err := json.Marshal(servers.servers)
+	if err != nil {
+		servers.log.WithError(err).Error("Could not encode the server list")
+		return
+	}
+	tmpFilename := servers.filename + ".tmp"
+	if err := encryption.WriteFile(tmpFilename, jsonBytes, 0600, servers.key); err != nil {
+		servers.log.WithError(err).Error("Could not write the server list")
+		return
+	}
+	if err := os.Rename(tmpFilename, servers.filename); err != nil {
+		servers.log.WithError(err).Error("Could not write the server list")
+	}
+}
+
+// serverInfo returns the info needed to connect to the server. The certificate of a discovered
+// server is downloaded and stored when connecting to it the first time.
+func (servers *Servers) serverInfo(server *Server) (*rpc.ServerInfo, error) {
+	unlock := servers.lock.RLock()
+	serverInfo := server.ServerInfo
+	unlock()
+	if !serverInfo.TLS || serverInfo.PEMCert != "" {
+		return &serverInfo, nil
+	}
+	pemCert, err := DownloadCert(serverInfo.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer servers.lock.Lock()()
+	server.PEMCert = pemCert
+	serverInfo.PEMCert = pemCert
+	servers.save()
+	return &serverInfo, nil
+}
+
+// failed records a failed connection attempt.
+func (servers *Servers) failed(server *Server, err error) {
+	defer servers.lock.Lock()()
+	server.Errors++
+	server.LastError = err.Error()
+	servers.save()
+}
+
+// connected records a new connection to the server and returns it wrapped, so that its end is
+// recorded as well.
+func (servers *Servers) connected(
+	server *Server, conn io.ReadWriteCloser, latency time.Duration) *serverConnection {
+	defer servers.lock.Lock()()
+	server.Connects++
+	latencyMS := latency.Nanoseconds() / int64(time.Millisecond)
+	if server.LatencyMS == 0 {
+		server.LatencyMS = latencyMS
+	} else {
+		server.LatencyMS = int64(
+			latencySmoothing*float64(latencyMS) + (1-latencySmoothing)*float64(server.LatencyMS))
+	}
+	connection := &serverConnection{
+		ReadWriteCloser: conn,
+		servers:         servers,
+		server:          server,
+		since:           time.Now(),
+	}
+	servers.connection = connection
+	servers.save()
+	return connection
+}
+
+// disconnected records the end of the connection. err is nil if the connection was closed on
+// purpose.
+func (servers *Servers) disconnected(connection *serverConnection, err error) {
+	defer servers.lock.Lock()()
+	if servers.connection == connection {
+		servers.connection = nil
+	}
+	server := connection.server
+	server.UptimeSeconds += int64(time.Since(connection.since).Seconds())
+	if err != nil {
+		server.Errors++
+		server.LastError = err.Error()
+	}
+	servers.save()
+}
+
+// serverBackend implements rpc.Backend for a server of the list.
+type serverBackend struct {
+	servers *Servers
+	server  *Server
+}
+
+// ServerInfo implements rpc.Backend.
+func (backend *serverBackend) ServerInfo() *rpc.ServerInfo {
+	defer backend.servers.lock.RLock()()
+	serverInfo := backend.server.ServerInfo
+	return &serverInfo
+}
+
+// EstablishConnection implements rpc.Backend.
+func (backend *serverBackend) EstablishConnection() (io.ReadWriteCloser, error) {
+	serverInfo, err := backend.servers.serverInfo(backend.server)
+	if err != nil {
+		backend.servers.failed(backend.server, err)
+		return nil, ConnectionError(err)
+	}
+	start := time.Now()
+	conn, err := NewElectrum(backend.servers.log, serverInfo).EstablishConnection()
+	if err != nil {
+		backend.servers.failed(backend.server, err)
+		return nil, err
+	}
+	return backend.servers.connected(backend.server, conn, time.Since(start)), nil
+}
+
+// serverConnection is a connection to a server of the list, which records when it ends.
+type serverConnection struct {
+	io.ReadWriteCloser
+	servers *Servers
+	server  *Server
+	since   time.Time
+	endOnce sync.Once
+}
+
+func (connection *serverConnection) end(err error) {
+	connection.endOnce.Do(func() { connection.servers.disconnected(connection, err) })
+}
+
+// Read implements io.Reader. A failed read means the connection was lost, unless it was closed
+// before.
+func (connection *serverConnection) Read(p []byte) (int, error) {
+	n, err := connection.ReadWriteCloser.Read(p)
+	if err != nil {
+		connection.end(err)
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (connection *serverConnection) Close() error {
+	connection.end(nil)
+	return connection.ReadWriteCloser.Close()
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package electrum_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/electrum"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func addresses(list []*electrum.ServerStatus) []string {
+	result := []string{}
+	for _, server := range list {
+		result = append(result, server.Server.Server)
+	}
+	return result
+}
+
+func TestServersPinAndBan(t *testing.T) {
+	filename := path.Join(test.TstTempDir("servers_test"), "servers.json")
+	log := logging.Get().WithGroup("servers_test")
+	configured := []*rpc.ServerInfo{
+		{Server: "s1.example.com:50002", TLS: true, PEMCert: "cert1"},
+		{Server: "s2.example.com:50002", TLS: true, PEMCert: "cert2"},
+	}
+	servers := electrum.NewServers(filename, nil, configured, false, &chaincfg.TestNet3Params, log)
+	require.Len(t, servers.List(), 2)
+
+	// Pinned servers come first.
+	require.NoError(t, servers.Pin("s2.example.com:50002", true))
+	list := servers.List()
+	require.Equal(t, []string{"s2.example.com:50002", "s1.example.com:50002"}, addresses(list))
+	require.True(t, list[0].Pinned)
+	require.False(t, list[0].Connected)
+
+	require.NoError(t, servers.Ban("s1.example.com:50002", true))
+	require.Error(t, servers.Ban("unknown.example.com:50002", true))
+
+	// The choices are persisted. Servers which are no longer configured are dropped.
+	configured = append(configured[1:], &rpc.ServerInfo{Server: "s3.example.com:50002", TLS: true})
+	servers = electrum.NewServers(filename, nil, configured, false, &chaincfg.TestNet3Params, log)
+	list = servers.List()
+	require.Equal(t, []string{"s2.example.com:50002", "s3.example.com:50002"}, addresses(list))
+	require.True(t, list[0].Pinned)
+	require.Equal(t, "cert2", list[0].PEMCert)
+
+	configured = append(configured, &rpc.ServerInfo{Server: "s1.example.com:50002", TLS: true})
+	servers = electrum.NewServers(filename, nil, configured, false, &chaincfg.TestNet3Params, log)
+	for _, server := range servers.List() {
+		require.Equal(t, server.Server.Server == "s1.example.com:50002", server.Banned)
+	}
+}
+
+func TestServersEncrypted(t *testing.T) {
+	filename := path.Join(test.TstTempDir("servers_test"), "servers.json")
+	log := logging.Get().WithGroup("servers_test")
+	configured := []*rpc.ServerInfo{{Server: "s1.example.com:50002", TLS: true}}
+	key := encryption.NewKey([]byte("secret"))
+	servers := electrum.NewServers(filename, key, configured, false, &chaincfg.TestNet3Params, log)
+	require.NoError(t, servers.Pin("s1.example.com:50002", true))
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.True(t, encryption.IsEncrypted(data))
+
+	servers = electrum.NewServers(filename, key, configured, false, &chaincfg.TestNet3Params, log)
+	require.True(t, servers.List()[0].Pinned)
+}
+
+func TestServersDiscoveryOptIn(t *testing.T) {
+	filename := path.Join(test.TstTempDir("servers_test"), "servers.json")
+	log := logging.Get().WithGroup("servers_test")
+	configured := []*rpc.ServerInfo{{Server: "s1.example.com:50002", TLS: true}}
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`[
+		{"server": "s1.example.com:50002", "tls": true},
+		{"server": "s2.example.com:50002", "tls": true, "discovered": true}
+	]`), 0600))
+
+	servers := electrum.NewServers(filename, nil, configured, true, &chaincfg.TestNet3Params, log)
+	require.Len(t, servers.List(), 2)
+
+	// The discovered servers are dropped if the discovery is disabled.
+	servers = electrum.NewServers(filename, nil, configured, false, &chaincfg.TestNet3Params, log)
+	require.Equal(t, []string{"s1.example.com:50002"}, addresses(servers.List()))
+}
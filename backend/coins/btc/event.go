@@ -29,9 +29,25 @@ const (
 	// EventSyncDone follows EventSyncStarted.
 	EventSyncDone Event = "syncdone"
 
+	// EventSyncError is fired when the synchronization failed. Check the error using Error(). The
+	// synchronization is retried automatically.
+	EventSyncError Event = "syncError"
+
 	// EventHeadersSynced is fired when the headers finished syncing.
 	EventHeadersSynced Event = "headersSynced"
 
 	// EventFeeTargetsChanged is fired when the fee targets change.
 	EventFeeTargetsChanged Event = "feeTargetsChanged"
+
+	// EventRescanProgress is fired during a rescan whenever a request finished. Check the progress
+	// using RescanProgress().
+	EventRescanProgress Event = "rescanProgress"
+
+	// EventDoubleSpend is fired when a pending incoming transaction is double-spent. Check which
+	// transactions conflict using Transactions().
+	EventDoubleSpend Event = "doubleSpend"
+
+	// EventReorg is fired when blocks were replaced by a reorganization of the chain. The
+	// transactions in them are verified again. Check the depth using LastReorg().
+	EventReorg Event = "reorg"
 )
@@ -15,12 +15,13 @@
 package handlers
 
 import (
-	"encoding/csv"
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"io"
+	"math/big"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -29,10 +30,12 @@ import (
 	"github.com/btcsuite/btcutil"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/transactions"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/util"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/eth/types"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/export"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/config"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
@@ -53,10 +56,15 @@ func NewHandlers(
 
 	handleFunc("/init", handlers.postInit).Methods("POST")
 	handleFunc("/status", handlers.getAccountStatus).Methods("GET")
+	handleFunc("/sync-error", handlers.getSyncError).Methods("GET")
 	handleFunc("/transactions", handlers.ensureAccountInitialized(handlers.getAccountTransactions)).Methods("GET")
+	handleFunc("/transaction/{txid}", handlers.ensureAccountInitialized(handlers.getAccountTransaction)).Methods("GET")
+	handleFunc("/transaction/{txid}/label", handlers.ensureAccountInitialized(handlers.postTransactionLabel)).Methods("POST")
 	handleFunc("/export", handlers.ensureAccountInitialized(handlers.postExportTransactions)).Methods("POST")
 	handleFunc("/info", handlers.ensureAccountInitialized(handlers.getAccountInfo)).Methods("GET")
 	handleFunc("/utxos", handlers.ensureAccountInitialized(handlers.getUTXOs)).Methods("GET")
+	handleFunc("/utxos/freeze", handlers.ensureAccountInitialized(handlers.postSetUTXOFrozen(true))).Methods("POST")
+	handleFunc("/utxos/unfreeze", handlers.ensureAccountInitialized(handlers.postSetUTXOFrozen(false))).Methods("POST")
 	handleFunc("/balance", handlers.ensureAccountInitialized(handlers.getAccountBalance)).Methods("GET")
 	handleFunc("/sendtx", handlers.ensureAccountInitialized(handlers.postAccountSendTx)).Methods("POST")
 	handleFunc("/fee-targets", handlers.ensureAccountInitialized(handlers.getAccountFeeTargets)).Methods("GET")
@@ -64,6 +72,9 @@ func NewHandlers(
 	handleFunc("/receive-addresses", handlers.ensureAccountInitialized(handlers.getReceiveAddresses)).Methods("GET")
 	handleFunc("/verify-address", handlers.ensureAccountInitialized(handlers.postVerifyAddress)).Methods("POST")
 	handleFunc("/convert-to-legacy-address", handlers.ensureAccountInitialized(handlers.postConvertToLegacyAddress)).Methods("POST")
+	handleFunc("/rescan", handlers.ensureAccountInitialized(handlers.getRescan)).Methods("GET")
+	handleFunc("/rescan", handlers.ensureAccountInitialized(handlers.postRescan)).Methods("POST")
+	handleFunc("/reorg", handlers.ensureAccountInitialized(handlers.getReorg)).Methods("GET")
 	return handlers
 }
 
@@ -135,12 +146,18 @@ type Transaction struct {
 	Fee              formattedAmount `json:"fee"`
 	Time             *string         `json:"time"`
 	Addresses        []string        `json:"addresses"`
+	// Label is the label which the user gave to the transaction. Empty if there is none.
+	Label string `json:"label"`
 
 	// BTC specific fields.
 	VSize        int64           `json:"vsize"`
 	Size         int64           `json:"size"`
 	Weight       int64           `json:"weight"`
 	FeeRatePerKb formattedAmount `json:"feeRatePerKb"`
+	// Conflicts are the IDs of the transactions spending the same outputs.
+	Conflicts []string `json:"conflicts"`
+	// Conflicted is true if a conflicting transaction is confirmed, so this one never will be.
+	Conflicted bool `json:"conflicted"`
 
 	// ETH specific fields
 	Gas uint64 `json:"gas"`
@@ -155,113 +172,278 @@ func (handlers *Handlers) ensureAccountInitialized(h func(*http.Request) (interf
 	}
 }
 
-func (handlers *Handlers) getAccountTransactions(_ *http.Request) (interface{}, error) {
-	result := []Transaction{}
-	txs := handlers.account.Transactions()
-	for _, txInfo := range txs {
-		var feeString formattedAmount
-		fee := txInfo.Fee()
-		if fee != nil {
-			feeString = handlers.formatAmountAsJSON(*fee)
+// txTypes maps the transaction types to their names in the API.
+var txTypes = map[coin.TxType]string{
+	coin.TxTypeReceive:  "receive",
+	coin.TxTypeSend:     "send",
+	coin.TxTypeSendSelf: "send_to_self",
+}
+
+// parseTransactionsQuery parses the query parameters of the /transactions endpoint. Amounts are
+// given in the smallest coin unit, dates as "2006-01-02" or in RFC3339.
+func parseTransactionsQuery(values url.Values) (*coin.TransactionsQuery, error) {
+	query := &coin.TransactionsQuery{
+		Cursor:  values.Get("cursor"),
+		Address: values.Get("address"),
+		Search:  strings.TrimSpace(values.Get("search")),
+		Label:   strings.TrimSpace(values.Get("label")),
+	}
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 0 {
+			return nil, errp.Newf("invalid limit %q", limit)
 		}
-		var formattedTime *string
-		timestamp := txInfo.Timestamp()
-		if timestamp != nil {
-			t := timestamp.Format(time.RFC3339)
-			formattedTime = &t
+		query.Limit = parsed
+	}
+	for _, name := range values["type"] {
+		found := false
+		for txType, txTypeName := range txTypes {
+			if txTypeName == name {
+				query.Types = append(query.Types, txType)
+				found = true
+			}
 		}
-		txInfoJSON := Transaction{
-			ID:               txInfo.ID(),
-			NumConfirmations: txInfo.NumConfirmations(),
-			Type: map[coin.TxType]string{
-				coin.TxTypeReceive:  "receive",
-				coin.TxTypeSend:     "send",
-				coin.TxTypeSendSelf: "send_to_self",
-			}[txInfo.Type()],
-			Amount:    handlers.formatAmountAsJSON(txInfo.Amount()),
-			Fee:       feeString,
-			Time:      formattedTime,
-			Addresses: txInfo.Addresses(),
+		if !found {
+			return nil, errp.Newf("unknown transaction type %q", name)
 		}
-		switch specificInfo := txInfo.(type) {
-		case *transactions.TxInfo:
-			txInfoJSON.VSize = specificInfo.VSize
-			txInfoJSON.Size = specificInfo.Size
-			txInfoJSON.Weight = specificInfo.Weight
-			feeRatePerKb := specificInfo.FeeRatePerKb()
-			if feeRatePerKb != nil {
-				txInfoJSON.FeeRatePerKb = handlers.formatBTCAmountAsJSON(*feeRatePerKb)
-			}
-		case types.EthereumTransaction:
-			txInfoJSON.Gas = specificInfo.Gas()
+	}
+	var err error
+	if query.From, err = export.ParseDate(values.Get("from")); err != nil {
+		return nil, err
+	}
+	if query.To, err = export.ParseDate(values.Get("to")); err != nil {
+		return nil, err
+	}
+	parseAmount := func(key string) (*coin.Amount, error) {
+		value := values.Get(key)
+		if value == "" {
+			return nil, nil
+		}
+		parsed, ok := new(big.Int).SetString(value, 10)
+		if !ok || parsed.Sign() < 0 {
+			return nil, errp.Newf("invalid %s %q", key, value)
 		}
-		result = append(result, txInfoJSON)
+		amount := coin.NewAmount(parsed)
+		return &amount, nil
 	}
-	return result, nil
+	if query.MinAmount, err = parseAmount("minAmount"); err != nil {
+		return nil, err
+	}
+	if query.MaxAmount, err = parseAmount("maxAmount"); err != nil {
+		return nil, err
+	}
+	if confirmed := values.Get("confirmed"); confirmed != "" {
+		parsed, err := strconv.ParseBool(confirmed)
+		if err != nil {
+			return nil, errp.Newf("invalid confirmed %q", confirmed)
+		}
+		query.Confirmed = &parsed
+	}
+	return query, nil
 }
 
-func (handlers *Handlers) postExportTransactions(_ *http.Request) (interface{}, error) {
-	name := time.Now().Format("2006-01-02-at-15-04-05-") + handlers.account.Code() + "-export.csv"
-	downloadsDir, err := config.DownloadsDir()
+func (handlers *Handlers) formatTransaction(txInfo coin.Transaction, labels map[string]string) Transaction {
+	var feeString formattedAmount
+	fee := txInfo.Fee()
+	if fee != nil {
+		feeString = handlers.formatAmountAsJSON(*fee)
+	}
+	var formattedTime *string
+	timestamp := txInfo.Timestamp()
+	if timestamp != nil {
+		t := timestamp.Format(time.RFC3339)
+		formattedTime = &t
+	}
+	txInfoJSON := Transaction{
+		ID:               txInfo.ID(),
+		NumConfirmations: txInfo.NumConfirmations(),
+		Type:             txTypes[txInfo.Type()],
+		Amount:           handlers.formatAmountAsJSON(txInfo.Amount()),
+		Fee:              feeString,
+		Time:             formattedTime,
+		Addresses:        txInfo.Addresses(),
+		Label:            labels[txInfo.ID()],
+	}
+	switch specificInfo := txInfo.(type) {
+	case *transactions.TxInfo:
+		txInfoJSON.VSize = specificInfo.VSize
+		txInfoJSON.Size = specificInfo.Size
+		txInfoJSON.Weight = specificInfo.Weight
+		feeRatePerKb := specificInfo.FeeRatePerKb()
+		if feeRatePerKb != nil {
+			txInfoJSON.FeeRatePerKb = handlers.formatBTCAmountAsJSON(*feeRatePerKb)
+		}
+		txInfoJSON.Conflicts = []string{}
+		for _, conflict := range specificInfo.Conflicts {
+			txInfoJSON.Conflicts = append(txInfoJSON.Conflicts, conflict.String())
+		}
+		txInfoJSON.Conflicted = specificInfo.Conflicted()
+	case types.EthereumTransaction:
+		txInfoJSON.Gas = specificInfo.Gas()
+	}
+	return txInfoJSON
+}
+
+// getAccountTransactions returns a page of the transactions, the newest first, along with the
+// cursor of the next page (see parseTransactionsQuery for the parameters). Without parameters, all
+// transactions are returned.
+func (handlers *Handlers) getAccountTransactions(r *http.Request) (interface{}, error) {
+	query, err := parseTransactionsQuery(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	transactions, err := handlers.account.Transactions()
 	if err != nil {
 		return nil, err
 	}
-	path := filepath.Join(downloadsDir, name)
-	handlers.log.Infof("Export transactions to %s.", path)
+	query.Labels = handlers.account.TransactionLabels()
+	page, err := query.Apply(transactions)
+	if err != nil {
+		return nil, err
+	}
+	result := []Transaction{}
+	for _, txInfo := range page.Transactions {
+		result = append(result, handlers.formatTransaction(txInfo, query.Labels))
+	}
+	return map[string]interface{}{
+		"transactions": result,
+		"next":         page.Next,
+	}, nil
+}
+
+// TransactionInput is an input returned by the /transaction/{txid} endpoint.
+type TransactionInput struct {
+	// PrevOut is the spent output as `"<txid>:<index>"`.
+	PrevOut  string `json:"prevOut"`
+	Sequence uint32 `json:"sequence"`
+	// Amount and address are nil if the spent output is unknown.
+	Amount  *formattedAmount `json:"amount"`
+	Address *string          `json:"address"`
+	Ours    bool             `json:"ours"`
+	// Keypath is the keypath of the spent output if it is ours.
+	Keypath *string `json:"keypath"`
+}
+
+// TransactionOutput is an output returned by the /transaction/{txid} endpoint.
+type TransactionOutput struct {
+	Amount  formattedAmount `json:"amount"`
+	Address string          `json:"address"`
+	Ours    bool            `json:"ours"`
+	Change  bool            `json:"change"`
+	// Keypath is the keypath of the output if it is ours.
+	Keypath *string `json:"keypath"`
+	// SpentBy is the ID of the transaction of the account spending the output, if any.
+	SpentBy *string `json:"spentBy"`
+}
+
+// TransactionDetails is the info returned by the /transaction/{txid} endpoint.
+type TransactionDetails struct {
+	Transaction
+	Inputs   []TransactionInput  `json:"inputs"`
+	Outputs  []TransactionOutput `json:"outputs"`
+	RBF      bool                `json:"rbf"`
+	LockTime uint32              `json:"lockTime"`
+	// Height is 0 for unconfirmed transactions.
+	Height    int     `json:"height"`
+	BlockHash *string `json:"blockHash"`
+	Verified  bool    `json:"verified"`
+	RawHex    string  `json:"rawHex"`
+}
 
-	file, err := os.Create(path)
+// getAccountTransaction returns all details of a transaction, including the raw transaction, so
+// that it can be audited without looking it up in a block explorer.
+func (handlers *Handlers) getAccountTransaction(r *http.Request) (interface{}, error) {
+	details, err := handlers.account.TransactionDetails(mux.Vars(r)["txid"])
 	if err != nil {
-		return nil, errp.WithStack(err)
+		return nil, err
 	}
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			handlers.log.WithError(err).Error("Could not close the exported transactions file.")
+	keypath := func(scriptHashHex blockchain.ScriptHashHex) *string {
+		address, ok := details.Addresses[scriptHashHex]
+		if !ok {
+			return nil
 		}
-	}()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	err = writer.Write([]string{
-		"Time",
-		"Type",
-		"Amount",
-		"Fee",
-		"Address",
-		"Transaction ID",
-	})
-	if err != nil {
+		keypath := address.Configuration.AbsoluteKeypath().Encode()
+		return &keypath
+	}
+	var rawTx bytes.Buffer
+	if err := details.Tx.Serialize(&rawTx); err != nil {
 		return nil, errp.WithStack(err)
 	}
-
-	for _, transaction := range handlers.account.Transactions() {
-		transactionType := map[coin.TxType]string{
-			coin.TxTypeReceive:  "received",
-			coin.TxTypeSend:     "sent",
-			coin.TxTypeSendSelf: "sent_to_yourself",
-		}[transaction.Type()]
-		feeString := ""
-		fee := transaction.Fee()
-		if fee != nil {
-			feeString = fee.BigInt().String()
+	result := TransactionDetails{
+		Transaction: handlers.formatTransaction(details.TxInfo, handlers.account.TransactionLabels()),
+		Inputs:      []TransactionInput{},
+		Outputs:     []TransactionOutput{},
+		RBF:         details.RBF(),
+		LockTime:    details.Tx.LockTime,
+		Verified:    details.Verified,
+		RawHex:      hex.EncodeToString(rawTx.Bytes()),
+	}
+	if details.Height > 0 {
+		result.Height = details.Height
+	}
+	if details.BlockHash != nil {
+		blockHash := details.BlockHash.String()
+		result.BlockHash = &blockHash
+	}
+	for _, input := range details.Inputs {
+		inputJSON := TransactionInput{
+			PrevOut:  input.PreviousOutPoint.String(),
+			Sequence: input.Sequence,
+			Ours:     input.ScriptHashHex != "",
+			Keypath:  keypath(input.ScriptHashHex),
 		}
-		timeString := ""
-		if transaction.Timestamp() != nil {
-			timeString = transaction.Timestamp().Format(time.RFC3339)
+		if input.PrevOut != nil {
+			amount := handlers.formatBTCAmountAsJSON(btcutil.Amount(input.PrevOut.Value))
+			inputJSON.Amount = &amount
+			inputJSON.Address = &input.Address
 		}
-		err := writer.Write([]string{
-			timeString,
-			transactionType,
-			transaction.Amount().BigInt().String(),
-			feeString,
-			strings.Join(transaction.Addresses(), "; "),
-			transaction.ID(),
-		})
-		if err != nil {
-			return nil, errp.WithStack(err)
+		result.Inputs = append(result.Inputs, inputJSON)
+	}
+	for _, output := range details.Outputs {
+		outputJSON := TransactionOutput{
+			Amount:  handlers.formatBTCAmountAsJSON(btcutil.Amount(output.Value)),
+			Address: output.Address,
+			Ours:    output.ScriptHashHex != "",
+			Change:  output.Change,
+			Keypath: keypath(output.ScriptHashHex),
+		}
+		if output.SpentBy != nil {
+			spentBy := output.SpentBy.String()
+			outputJSON.SpentBy = &spentBy
 		}
+		result.Outputs = append(result.Outputs, outputJSON)
+	}
+	return result, nil
+}
+
+// postExportTransactions exports the account's transactions. Without a request body, the original
+// CSV layout is written to the downloads folder and its path is returned. Otherwise, the body
+// contains the export options (see export.Options) and the exported files are returned.
+func (handlers *Handlers) postExportTransactions(r *http.Request) (interface{}, error) {
+	options := &export.Options{Format: export.FormatCSV}
+	withOptions := true
+	if err := json.NewDecoder(r.Body).Decode(options); err == io.EOF {
+		withOptions = false
+	} else if err != nil {
+		return nil, err
+	}
+	options.Rates = backend.GetRatesUpdaterInstance()
+	result, err := export.Export(r.Context(), []export.Account{handlers.account}, options)
+	if err != nil {
+		return nil, err
+	}
+	if withOptions {
+		return result, nil
+	}
+	downloadsDir, err := config.DownloadsDir()
+	if err != nil {
+		return nil, err
 	}
+	path, err := result.Transactions.WriteToDir(downloadsDir)
+	if err != nil {
+		return nil, err
+	}
+	handlers.log.Infof("Exported transactions to %s.", path)
 	return path, nil
 }
 
@@ -270,24 +452,67 @@ func (handlers *Handlers) getAccountInfo(_ *http.Request) (interface{}, error) {
 }
 
 func (handlers *Handlers) getUTXOs(_ *http.Request) (interface{}, error) {
+	spendableOutputs, err := handlers.account.SpendableOutputs()
+	if err != nil {
+		return nil, err
+	}
 	result := []map[string]interface{}{}
-	for _, output := range handlers.account.SpendableOutputs() {
+	for _, output := range spendableOutputs {
 		result = append(result,
 			map[string]interface{}{
 				"outPoint": output.OutPoint.String(),
 				"amount":   handlers.formatBTCAmountAsJSON(btcutil.Amount(output.TxOut.Value)),
 				"address":  output.Address,
+				"frozen":   output.Frozen,
 			})
 	}
 	return result, nil
 }
 
+// postTransactionLabel sets the label of the transaction to the string in the request body. An
+// empty string removes the label.
+func (handlers *Handlers) postTransactionLabel(r *http.Request) (interface{}, error) {
+	var label string
+	if err := json.NewDecoder(r.Body).Decode(&label); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if err := handlers.account.SetTransactionLabel(
+		mux.Vars(r)["txid"], strings.TrimSpace(label)); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// postSetUTXOFrozen freezes or unfreezes the output given in the request body, e.g.
+// `"<txid>:<index>"`.
+func (handlers *Handlers) postSetUTXOFrozen(frozen bool) func(*http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		var outPointString string
+		if err := json.NewDecoder(r.Body).Decode(&outPointString); err != nil {
+			return nil, errp.WithStack(err)
+		}
+		outPoint, err := util.ParseOutPoint([]byte(outPointString))
+		if err != nil {
+			return nil, err
+		}
+		if err := handlers.account.SetOutputFrozen(*outPoint, frozen); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}
+}
+
 func (handlers *Handlers) getAccountBalance(_ *http.Request) (interface{}, error) {
-	balance := handlers.account.Balance()
+	balance, err := handlers.account.Balance()
+	if err != nil {
+		return nil, err
+	}
 	return map[string]interface{}{
 		"available":   handlers.formatAmountAsJSON(balance.Available()),
 		"incoming":    handlers.formatAmountAsJSON(balance.Incoming()),
 		"hasIncoming": balance.Incoming().BigInt().Sign() > 0,
+		"frozen":      handlers.formatAmountAsJSON(balance.Frozen()),
+		"hasFrozen":   balance.Frozen().BigInt().Sign() > 0,
 	}, nil
 }
 
@@ -430,10 +655,26 @@ func (handlers *Handlers) getAccountStatus(_ *http.Request) (interface{}, error)
 		if handlers.account.Offline() {
 			status = append(status, btc.OfflineMode)
 		}
+
+		if handlers.account.Error() != nil {
+			status = append(status, btc.AccountError)
+		}
 	}
 	return status, nil
 }
 
+// getSyncError returns the message of the error which stopped the synchronization of the account,
+// or null.
+func (handlers *Handlers) getSyncError(_ *http.Request) (interface{}, error) {
+	if handlers.account == nil {
+		return nil, nil
+	}
+	if err := handlers.account.Error(); err != nil {
+		return err.Error(), nil
+	}
+	return nil, nil
+}
+
 func (handlers *Handlers) getReceiveAddresses(_ *http.Request) (interface{}, error) {
 	addresses := []interface{}{}
 	for _, address := range handlers.account.GetUnusedReceiveAddresses() {
@@ -467,3 +708,36 @@ func (handlers *Handlers) postConvertToLegacyAddress(r *http.Request) (interface
 	}
 	return address.EncodeAddress(), nil
 }
+
+func (handlers *Handlers) getRescan(_ *http.Request) (interface{}, error) {
+	rescanning, done, total := handlers.account.RescanProgress()
+	return map[string]interface{}{
+		"rescanning": rescanning,
+		"done":       done,
+		"total":      total,
+	}, nil
+}
+
+// postRescan starts a rescan of the account. The optional request body holds a temporarily larger
+// lookahead, e.g. `{"gapLimit": 200, "changeGapLimit": 50}`.
+func (handlers *Handlers) postRescan(r *http.Request) (interface{}, error) {
+	jsonBody := struct {
+		GapLimit       int `json:"gapLimit"`
+		ChangeGapLimit int `json:"changeGapLimit"`
+	}{}
+	var lookahead *btc.GapLimits
+	if err := json.NewDecoder(r.Body).Decode(&jsonBody); err == nil {
+		lookahead = &btc.GapLimits{Receive: jsonBody.GapLimit, Change: jsonBody.ChangeGapLimit}
+	} else if err != io.EOF {
+		return nil, errp.WithStack(err)
+	}
+	if err := handlers.account.Rescan(lookahead); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// getReorg returns the last reorganization of the chain since the account was loaded, or null.
+func (handlers *Handlers) getReorg(_ *http.Request) (interface{}, error) {
+	return handlers.account.LastReorg(), nil
+}
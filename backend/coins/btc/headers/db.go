@@ -24,9 +24,19 @@ type DBTxInterface interface {
 	Rollback()
 	// PutHeader stores a header at a new tip.
 	PutHeader(tip int, header *wire.BlockHeader) error
+	// HeaderByHeight returns the header at the given height, or nil if it is not stored, i.e. if
+	// the height is below the base or above the tip.
 	HeaderByHeight(height int) (*wire.BlockHeader, error)
 	PutTip(tip int) error
+	// Tip returns the height of the highest stored header. It is smaller than the base if no
+	// headers are stored.
 	Tip() (int, error)
+	// PutBaseHeader stores a header at a new base, one below the current base.
+	PutBaseHeader(base int, header *wire.BlockHeader) error
+	PutBase(base int) error
+	// Base returns the height of the lowest stored header. It is 0 unless the sync started at a
+	// checkpoint.
+	Base() (int, error)
 }
 
 // DBInterface can be implemented by database backends to open database transactions.
@@ -34,4 +44,5 @@ type DBInterface interface {
 	// Begin starts a DB transaction. Apply `defer tx.Rollback()` in any case after. Use
 	// `tx.Commit()` to commit the write operations.
 	Begin() (DBTxInterface, error)
+	Close() error
 }
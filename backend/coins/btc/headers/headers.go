@@ -16,9 +16,11 @@ package headers
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math/big"
+	"sync"
 	"time"
 
 	btcdBlockchain "github.com/btcsuite/btcd/blockchain"
@@ -46,8 +48,19 @@ const (
 	EventSynced Event = "synced"
 	// EventNewTip is fired when a new tip is known.
 	EventNewTip Event = "newTip"
+	// EventReorg is fired when stored headers were replaced by the headers of another branch. Check
+	// which headers were replaced using LastReorg().
+	EventReorg Event = "reorg"
 )
 
+// Reorg describes a reorganization of the chain.
+type Reorg struct {
+	// ForkHeight is the height of the first replaced header.
+	ForkHeight int `json:"forkHeight"`
+	// Depth is the number of replaced headers.
+	Depth int `json:"depth"`
+}
+
 // Interface represents the public API of this package.
 //go:generate mockery -name Interface
 type Interface interface {
@@ -56,6 +69,9 @@ type Interface interface {
 	HeaderByHeight(int) (*wire.BlockHeader, error)
 	TipHeight() int
 	Status() (*Status, error)
+	// LastReorg returns the last reorganization of the chain since the headers were loaded, or nil
+	// if there was none.
+	LastReorg() *Reorg
 }
 
 // Headers manages syncing blockchain headers.
@@ -66,16 +82,35 @@ type Headers struct {
 	db              DBInterface
 	blockchain      blockchain.Interface
 	headersPerBatch int
-	lock            locker.Locker
-	// targetHeight is the potential tip height we are syncing up to.
-	targetHeight int
+	// startAtCheckpoint is set if an empty database is synced starting shortly before the last
+	// checkpoint of the network. The headers before are downloaded afterwards.
+	startAtCheckpoint bool
+	// synced is set if the last batch of headers reached the tip of the server.
+	synced bool
+	lock   locker.Locker
+	// targetHeight is the potential tip height we are syncing up to. It is guarded by its own lock,
+	// as it is updated by the server while the headers are downloaded under lock.
+	targetHeight     int
+	targetHeightLock locker.Locker
 	// tipAtInitTime is the tip at init time, i.e. the last tip known, loaded from the DB. It is
 	// used to show the sync progress since the last time (catch up).
 	tipAtInitTime int
 	kickChan      chan struct{}
+	// replaced holds the hashes of the headers removed by reorg(), by height. They are compared to
+	// the headers downloaded again to find the height at which the chain forked.
+	replaced  map[int]chainhash.Hash
+	lastReorg *Reorg
 
 	eventCallbacks []func(Event)
 	events         chan Event
+
+	// ctx is cancelled by Close().
+	ctx    context.Context
+	cancel context.CancelFunc
+	// goroutines tracks the download loop and the event notifications.
+	goroutines         sync.WaitGroup
+	unsubscribeHeaders func()
+	closeOnce          sync.Once
 }
 
 // Status represents the syncing status.
@@ -87,12 +122,16 @@ type Status struct {
 	TargetHeight int               `json:"targetHeight"`
 }
 
-// NewHeaders creates a new Headers instance.
+// NewHeaders creates a new Headers instance. If startAtCheckpoint is set, the sync of an empty
+// database starts shortly before the last checkpoint of the network instead of at the genesis
+// block. The network must have checkpoints then.
 func NewHeaders(
 	net *chaincfg.Params,
 	db DBInterface,
 	blockchain blockchain.Interface,
+	startAtCheckpoint bool,
 	log *logrus.Entry) *Headers {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Headers{
 		log: log,
 
@@ -101,13 +140,19 @@ func NewHeaders(
 		blockchain: blockchain,
 		// We start with a small batch size and increase to the maximum allowed one with the first
 		// response.
-		headersPerBatch: 10,
-		targetHeight:    0,
-		tipAtInitTime:   0,
-		kickChan:        make(chan struct{}, 1),
+		headersPerBatch:   10,
+		startAtCheckpoint: startAtCheckpoint,
+		targetHeight:      0,
+		tipAtInitTime:     0,
+		kickChan:          make(chan struct{}, 1),
+		replaced:          map[int]chainhash.Hash{},
 
 		eventCallbacks: []func(Event){},
 		events:         make(chan Event),
+
+		ctx:                ctx,
+		cancel:             cancel,
+		unsubscribeHeaders: func() {},
 	}
 }
 
@@ -124,6 +169,7 @@ func (headers *Headers) SubscribeEvent(f func(event Event)) func() {
 
 // TipHeight returns the height of the tip.
 func (headers *Headers) TipHeight() int {
+	defer headers.targetHeightLock.RLock()()
 	return headers.targetHeight
 }
 
@@ -131,8 +177,9 @@ func (headers *Headers) TipHeight() int {
 func (headers *Headers) Initialize() {
 	headers.tipAtInitTime = headers.tip()
 	headers.log.Infof("last tip loaded: %d", headers.tipAtInitTime)
+	headers.goroutines.Add(1)
 	go headers.download()
-	headers.blockchain.HeadersSubscribe(
+	headers.unsubscribeHeaders = headers.blockchain.HeadersSubscribe(
 		nil,
 		func(header *blockchain.Header) error {
 			return headers.update(header.BlockHeight)
@@ -144,57 +191,184 @@ func (headers *Headers) Initialize() {
 type batchInfo struct {
 	blockHeaders []*wire.BlockHeader
 	max          int
+	// result receives the outcome of processing the batch.
+	result chan error
+}
+
+// Close stops syncing, waits until the download loop and the event callbacks returned and closes
+// the database. It is safe to call it more than once.
+func (headers *Headers) Close() {
+	headers.closeOnce.Do(func() {
+		headers.unsubscribeHeaders()
+		headers.cancel()
+		headers.goroutines.Wait()
+		if err := headers.db.Close(); err != nil {
+			headers.log.WithError(err).Error("Could not close the headers database")
+		}
+	})
 }
 
 func (headers *Headers) download() {
-	for range headers.kickChan {
+	defer headers.goroutines.Done()
+	for {
+		select {
+		case <-headers.ctx.Done():
+			return
+		case <-headers.kickChan:
+		}
 		func() {
 			defer headers.lock.Lock()()
+			// On database errors, the download is retried with the next kick, e.g. when a new block
+			// arrives.
 			dbTx, err := headers.db.Begin()
 			if err != nil {
-				// TODO
-				panic(err)
+				headers.log.WithError(err).Error("Could not open the headers database transaction")
+				return
 			}
-			defer func() {
-				_ = dbTx.Commit()
-			}()
+			defer dbTx.Rollback()
 			tip, err := dbTx.Tip()
 			if err != nil {
-				// TODO
-				panic(err)
+				headers.log.WithError(err).Error("Could not read the tip of the headers")
+				return
+			}
+			base, err := dbTx.Base()
+			if err != nil {
+				headers.log.WithError(err).Error("Could not read the base of the headers")
+				return
+			}
+			if tip < base {
+				// No headers are stored yet.
+				base = headers.bootstrapHeight()
+				if err := dbTx.PutBase(base); err != nil {
+					headers.log.WithError(err).Error("Could not store the base of the headers")
+					return
+				}
+				tip = base - 1
+			}
+			backfill := headers.needsBackfill(base, tip)
+			startHeight, count := tip+1, headers.headersPerBatch
+			if backfill {
+				startHeight = base - headers.headersPerBatch
+				if startHeight < 0 {
+					startHeight = 0
+				}
+				count = base - startHeight
 			}
 			batchChan := make(chan batchInfo)
+			// done is closed when the batch is no longer awaited. The request is sent again after a
+			// failover, and the response to it is then ignored.
+			done := make(chan struct{})
+			defer close(done)
 			headers.blockchain.Headers(
-				tip+1, headers.headersPerBatch,
+				startHeight, count,
 				func(blockHeaders []*wire.BlockHeader, max int) error {
-					batchChan <- batchInfo{blockHeaders, max}
-					return nil
+					batch := batchInfo{blockHeaders, max, make(chan error, 1)}
+					select {
+					case batchChan <- batch:
+					case <-done:
+						return nil
+					case <-headers.ctx.Done():
+						return nil
+					}
+					// An invalid batch is treated like a server error, so that the client fails
+					// over to another server.
+					return <-batch.result
 				}, func() {})
-			batch := <-batchChan
-			if err := headers.processBatch(dbTx, tip, batch.blockHeaders, batch.max); err != nil {
-				headers.log.WithError(err).Panic("processBatch")
+			var batch batchInfo
+			select {
+			case batch = <-batchChan:
+			case <-headers.ctx.Done():
+				return
+			}
+			if backfill {
+				err = headers.processBackfillBatch(dbTx, base, count, batch.blockHeaders, batch.max)
+			} else {
+				err = headers.processBatch(dbTx, base, tip, batch.blockHeaders, batch.max)
+			}
+			batch.result <- err
+			if err != nil {
+				// The batch is dropped and downloaded again, from another server.
+				headers.log.WithError(err).Error("Could not process the batch of headers")
+				headers.kick()
+				return
+			}
+			if err := dbTx.Commit(); err != nil {
+				headers.log.WithError(err).Error("Could not store the batch of headers")
 			}
 		}()
 	}
 }
 
-var errPrevHash = errors.New("header prevhash does not match")
+// checkpointHeight returns the height of the last checkpoint of the network, or -1 if there is
+// none.
+func (headers *Headers) checkpointHeight() int {
+	if len(headers.net.Checkpoints) == 0 {
+		return -1
+	}
+	return int(headers.net.Checkpoints[len(headers.net.Checkpoints)-1].Height)
+}
 
-func (headers *Headers) getTarget(dbTx DBTxInterface, index int) (*big.Int, error) {
+func (headers *Headers) blocksPerRetarget() int {
 	targetTimespan := int64(headers.net.TargetTimespan / time.Second)
 	targetTimePerBlock := int64(headers.net.TargetTimePerBlock / time.Second)
-	blocksPerRetarget := int(targetTimespan / targetTimePerBlock)
+	return int(targetTimespan / targetTimePerBlock)
+}
+
+// bootstrapHeight returns the height at which the sync of an empty database starts. Starting at a
+// checkpoint, it is the first header of the retarget window before the one containing the
+// checkpoint, so that the difficulty of the headers after the checkpoint can be checked. Litecoin
+// also needs the last header of the window before that, see getTarget().
+func (headers *Headers) bootstrapHeight() int {
+	if !headers.startAtCheckpoint {
+		return 0
+	}
+	blocksPerRetarget := headers.blocksPerRetarget()
+	height := (headers.checkpointHeight()/blocksPerRetarget-1)*blocksPerRetarget - 1
+	if height < 0 {
+		return 0
+	}
+	return height
+}
+
+// authenticated returns whether the stored headers can be trusted. If the sync started at a
+// checkpoint, the headers are only authenticated by the hash of the checkpoint once it is reached.
+func (headers *Headers) authenticated(base int, tip int) bool {
+	return base == 0 || tip >= headers.checkpointHeight()
+}
+
+// needsBackfill returns whether the headers before the base should be downloaded next, which is
+// the case once the headers are synced to the tip of the server.
+func (headers *Headers) needsBackfill(base int, tip int) bool {
+	return base > 0 && headers.synced && headers.authenticated(base, tip) && tip >= headers.TipHeight()
+}
+
+var errPrevHash = errors.New("header prevhash does not match")
+
+// targetFirstIndex returns the height of the lowest header getTarget() needs for the header at the
+// given index, or -1 if it needs none.
+func (headers *Headers) targetFirstIndex(index int) int {
+	blocksPerRetarget := headers.blocksPerRetarget()
 	chunkIndex := (index / blocksPerRetarget) - 1
 	if chunkIndex == -1 {
-		return btcdBlockchain.CompactToBig(headers.net.GenesisBlock.Header.Bits), nil
+		return -1
 	}
-
 	firstIndex := chunkIndex * blocksPerRetarget
 	if headers.net.Net == ltc.MainNetParams.Net && chunkIndex > 0 {
 		// Litecoin includes the last block of the previous window to fix a time warp attack:
 		// https://litecoin.info/index.php/Time_warp_attack#cite_note-2
 		firstIndex--
 	}
+	return firstIndex
+}
+
+func (headers *Headers) getTarget(dbTx DBTxInterface, index int) (*big.Int, error) {
+	targetTimespan := int64(headers.net.TargetTimespan / time.Second)
+	blocksPerRetarget := headers.blocksPerRetarget()
+	chunkIndex := (index / blocksPerRetarget) - 1
+	firstIndex := headers.targetFirstIndex(index)
+	if firstIndex == -1 {
+		return btcdBlockchain.CompactToBig(headers.net.GenesisBlock.Header.Bits), nil
+	}
 	first, err := dbTx.HeaderByHeight(firstIndex)
 	if err != nil {
 		return nil, err
@@ -221,6 +395,25 @@ func (headers *Headers) getTarget(dbTx DBTxInterface, index int) (*big.Int, erro
 	return newTarget, nil
 }
 
+// checksDifficulty returns whether the difficulty and proof of work of the headers are checked,
+// which is only done for the main networks.
+func (headers *Headers) checksDifficulty() bool {
+	return headers.net.Net == chaincfg.MainNetParams.Net || headers.net.Net == ltc.MainNetParams.Net
+}
+
+// checkDifficulty checks that the header at the given index has the difficulty which follows from
+// the headers of the previous retarget window. They have to be stored.
+func (headers *Headers) checkDifficulty(dbTx DBTxInterface, index int, header *wire.BlockHeader) error {
+	newTarget, err := headers.getTarget(dbTx, index)
+	if err != nil {
+		return err
+	}
+	if header.Bits != btcdBlockchain.BigToCompact(newTarget) {
+		return errp.Newf("header %d has an unexpected difficulty", index)
+	}
+	return nil
+}
+
 func (headers *Headers) powHash(msg []byte) chainhash.Hash {
 	switch headers.net.Net {
 	case chaincfg.MainNetParams.Net:
@@ -245,13 +438,15 @@ func (headers *Headers) powHash(msg []byte) chainhash.Hash {
 	}
 }
 
-func (headers *Headers) canConnect(dbTx DBTxInterface, tip int, header *wire.BlockHeader) error {
+func (headers *Headers) canConnect(dbTx DBTxInterface, base int, tip int, header *wire.BlockHeader) error {
 	if tip == 0 {
 		if header.BlockHash() != *headers.net.GenesisHash {
 			return errp.Newf("wrong genesis hash, got %s, expected %s",
 				header.BlockHash(), *headers.net.GenesisHash)
 		}
-	} else {
+	} else if tip != base {
+		// The first header of a sync started at a checkpoint has no predecessor. Like the
+		// following ones, it is authenticated by the hash of the checkpoint.
 		previousHeader, err := dbTx.HeaderByHeight(tip - 1)
 		if err != nil {
 			return err
@@ -263,32 +458,30 @@ func (headers *Headers) canConnect(dbTx DBTxInterface, tip int, header *wire.Blo
 					header.PrevBlock, tip, prevBlock, tip-1))
 		}
 
-		lastCheckpoint := headers.net.Checkpoints[len(headers.net.Checkpoints)-1]
-		if tip == int(lastCheckpoint.Height) {
+		checkpointHeight := headers.checkpointHeight()
+		if tip == checkpointHeight {
+			lastCheckpoint := headers.net.Checkpoints[len(headers.net.Checkpoints)-1]
 			if *lastCheckpoint.Hash != header.BlockHash() {
 				return errp.Newf("checkpoint mismatch at %d. Expected %s, got %s",
 					tip, lastCheckpoint.Hash, header.BlockHash())
 			}
 			headers.log.Infof("checkpoint at %d matches", tip)
 		}
-		// Check Difficulty, PoW.
-		if headers.net.Net == chaincfg.MainNetParams.Net || headers.net.Net == ltc.MainNetParams.Net {
-			newTarget, err := headers.getTarget(dbTx, tip)
-			if err != nil {
+		// Check Difficulty, PoW. The difficulty of the headers at the start of a sync at a
+		// checkpoint depends on headers below the base, and is checked once they are backfilled.
+		if headers.checksDifficulty() && (base == 0 || headers.targetFirstIndex(tip) >= base) {
+			if err := headers.checkDifficulty(dbTx, tip, header); err != nil {
 				return err
 			}
-			if header.Bits != btcdBlockchain.BigToCompact(newTarget) {
-				return errp.Newf("header %d has an unexpected difficulty", tip)
-			}
-			headerSerialized := &bytes.Buffer{}
-			if err := header.BtcEncode(headerSerialized, 0, wire.BaseEncoding); err != nil {
-				panic(errp.WithStack(err))
-			}
 			// Skip PoW check before the checkpoint for performance.
-			if tip > int(lastCheckpoint.Height) {
+			if tip > checkpointHeight {
+				headerSerialized := &bytes.Buffer{}
+				if err := header.BtcEncode(headerSerialized, 0, wire.BaseEncoding); err != nil {
+					panic(errp.WithStack(err))
+				}
 				powHash := headers.powHash(headerSerialized.Bytes())
 				proofOfWork := btcdBlockchain.HashToBig(&powHash)
-				if proofOfWork.Cmp(newTarget) > 0 {
+				if proofOfWork.Cmp(btcdBlockchain.CompactToBig(header.Bits)) > 0 {
 					return errp.Newf("header %d, %s has insufficient proof of work.", tip, powHash)
 				}
 			}
@@ -304,36 +497,85 @@ func min(a, b int) int {
 	return b
 }
 
-func (headers *Headers) reorg(dbTx DBTxInterface, tip int) {
+func (headers *Headers) reorg(dbTx DBTxInterface, base int, tip int) error {
 	// Simple reorg method: re-fetch headers up to the maximum reorg limit. The server can shorten
 	// our chain by sending a fake header and set us back by `reorgLimit` blocks, but it needs to
-	// contain the correct PoW to do so.
+	// contain the correct PoW to do so. If the fork is deeper, the next batch does not connect
+	// either and we go back further.
 	newTip := tip - reorgLimit
-	if newTip < -1 {
-		newTip = -1
+	if newTip < base-1 {
+		newTip = base - 1
+	}
+	for height := newTip + 1; height <= tip; height++ {
+		if _, ok := headers.replaced[height]; ok {
+			continue
+		}
+		header, err := dbTx.HeaderByHeight(height)
+		if err != nil {
+			return err
+		}
+		headers.replaced[height] = header.BlockHash()
 	}
 	if err := dbTx.PutTip(newTip); err != nil {
-		panic(err)
+		return err
 	}
 	headers.kick()
+	return nil
+}
+
+// checkReplaced compares a newly stored header to the header removed by reorg() at the same
+// height. The headers are stored in ascending order, so the first one which differs is where the
+// chain forked.
+func (headers *Headers) checkReplaced(height int, header *wire.BlockHeader) {
+	replacedHash, ok := headers.replaced[height]
+	if !ok {
+		return
+	}
+	if replacedHash == header.BlockHash() {
+		delete(headers.replaced, height)
+		return
+	}
+	headers.reportReorg(height)
+}
+
+// reportReorg fires EventReorg for the headers replaced from forkHeight on.
+func (headers *Headers) reportReorg(forkHeight int) {
+	reorg := &Reorg{ForkHeight: forkHeight, Depth: len(headers.replaced)}
+	headers.replaced = map[int]chainhash.Hash{}
+	headers.lastReorg = reorg
+	headers.log.Infof("Reorg of depth %d at height %d", reorg.Depth, reorg.ForkHeight)
+	headers.notifyEvent(EventReorg)
+}
+
+// LastReorg implements Interface.
+func (headers *Headers) LastReorg() *Reorg {
+	defer headers.lock.RLock()()
+	return headers.lastReorg
 }
 
 func (headers *Headers) notifyEvent(event Event) {
+	if headers.ctx.Err() != nil {
+		return
+	}
 	for _, f := range headers.eventCallbacks {
 		if f != nil {
-			go f(event)
+			f := f
+			headers.goroutines.Add(1)
+			go func() {
+				defer headers.goroutines.Done()
+				f(event)
+			}()
 		}
 	}
 }
 
 func (headers *Headers) processBatch(
-	dbTx DBTxInterface, tip int, blockHeaders []*wire.BlockHeader, max int) error {
+	dbTx DBTxInterface, base int, tip int, blockHeaders []*wire.BlockHeader, max int) error {
 	for _, header := range blockHeaders {
-		err := headers.canConnect(dbTx, tip+1, header)
+		err := headers.canConnect(dbTx, base, tip+1, header)
 		if errp.Cause(err) == errPrevHash {
 			headers.log.WithError(err).Infof("Reorg detected at height %d", tip+1)
-			headers.reorg(dbTx, tip)
-			return nil
+			return headers.reorg(dbTx, base, tip)
 		}
 		if err != nil {
 			return errp.WithMessage(err, "can't connect header, unexpected blockchain reply")
@@ -342,8 +584,14 @@ func (headers *Headers) processBatch(
 		if err := dbTx.PutHeader(tip, header); err != nil {
 			return err
 		}
+		headers.checkReplaced(tip, header)
+	}
+	headers.synced = len(blockHeaders) != min(max, headers.headersPerBatch)
+	if headers.synced && len(headers.replaced) != 0 {
+		// The new branch is shorter than the replaced headers and did not differ so far.
+		headers.reportReorg(tip + 1)
 	}
-	if len(blockHeaders) == min(max, headers.headersPerBatch) {
+	if !headers.synced {
 		// Received max number of headers per batch, so there might be more.
 		headers.kick()
 		headers.log.Debugf("Syncing headers; tip: %d", tip)
@@ -353,11 +601,94 @@ func (headers *Headers) processBatch(
 		headers.notifyEvent(EventSynced)
 	}
 	headers.headersPerBatch = max
+	if headers.needsBackfill(base, tip) {
+		headers.kick()
+	}
+	return nil
+}
+
+// processBackfillBatch stores the headers below the base. They are authenticated by the header at
+// the base, which they have to lead to through their hashes.
+func (headers *Headers) processBackfillBatch(
+	dbTx DBTxInterface, base int, count int, blockHeaders []*wire.BlockHeader, max int) error {
+	if len(blockHeaders) != count {
+		return errp.Newf("expected %d headers below %d, got %d", count, base, len(blockHeaders))
+	}
+	next, err := dbTx.HeaderByHeight(base)
+	if err != nil {
+		return err
+	}
+	for index := len(blockHeaders) - 1; index >= 0; index-- {
+		header := blockHeaders[index]
+		if header.BlockHash() != next.PrevBlock {
+			return errp.Newf("header %d does not connect to %d", base-1, base)
+		}
+		base--
+		if base == 0 && header.BlockHash() != *headers.net.GenesisHash {
+			return errp.Newf("wrong genesis hash, got %s, expected %s",
+				header.BlockHash(), *headers.net.GenesisHash)
+		}
+		if err := dbTx.PutBaseHeader(base, header); err != nil {
+			return err
+		}
+		if err := headers.checkBackfilledDifficulty(dbTx, base); err != nil {
+			return err
+		}
+		next = header
+	}
+	headers.headersPerBatch = max
+	if base > 0 {
+		headers.log.Debugf("Syncing headers before the checkpoint; base: %d", base)
+		headers.kick()
+		return nil
+	}
+	headers.log.Info("Synced the headers before the checkpoint")
+	// The transactions waiting for the headers can be verified now.
+	headers.notifyEvent(EventSynced)
+	return nil
+}
+
+// checkBackfilledDifficulty checks the difficulty of the headers whose target is known once the
+// header at the given index has been backfilled: the headers of the window following the one in
+// which the target calculation starts. The windows are checked as a whole, as the headers at the
+// start of a sync at a checkpoint could not be checked before.
+func (headers *Headers) checkBackfilledDifficulty(dbTx DBTxInterface, index int) error {
+	if !headers.checksDifficulty() {
+		return nil
+	}
+	blocksPerRetarget := headers.blocksPerRetarget()
+	tip, err := dbTx.Tip()
+	if err != nil {
+		return err
+	}
+	windowStarts := []int{}
+	if index == 0 {
+		// The difficulty of the first window is the one of the genesis block.
+		windowStarts = append(windowStarts, 0)
+	}
+	windowStart := (index/blocksPerRetarget + 1) * blocksPerRetarget
+	if headers.net.Net == ltc.MainNetParams.Net {
+		windowStart = ((index+1)/blocksPerRetarget + 1) * blocksPerRetarget
+	}
+	if headers.targetFirstIndex(windowStart) == index {
+		windowStarts = append(windowStarts, windowStart)
+	}
+	for _, windowStart := range windowStarts {
+		for height := windowStart; height < windowStart+blocksPerRetarget && height <= tip; height++ {
+			header, err := dbTx.HeaderByHeight(height)
+			if err != nil {
+				return err
+			}
+			if err := headers.checkDifficulty(dbTx, height, header); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 // HeaderByHeight returns the header at the given height. Returns nil if the headers are not synced
-// up to this height yet.
+// up to this height yet, or not down to this height if the sync started at a checkpoint.
 func (headers *Headers) HeaderByHeight(height int) (*wire.BlockHeader, error) {
 	defer headers.lock.RLock()()
 	dbTx, err := headers.db.Begin()
@@ -365,6 +696,17 @@ func (headers *Headers) HeaderByHeight(height int) (*wire.BlockHeader, error) {
 		return nil, err
 	}
 	defer dbTx.Rollback()
+	base, err := dbTx.Base()
+	if err != nil {
+		return nil, err
+	}
+	tip, err := dbTx.Tip()
+	if err != nil {
+		return nil, err
+	}
+	if !headers.authenticated(base, tip) {
+		return nil, nil
+	}
 	return dbTx.HeaderByHeight(height)
 }
 
@@ -379,7 +721,10 @@ func (headers *Headers) kick() {
 func (headers *Headers) update(blockHeight int) error {
 	headers.log.Debugf("new target %d", blockHeight)
 	headers.kick()
-	headers.targetHeight = blockHeight
+	func() {
+		defer headers.targetHeightLock.Lock()()
+		headers.targetHeight = blockHeight
+	}()
 	headers.notifyEvent(EventNewTip)
 	return nil
 }
@@ -421,7 +766,7 @@ func (headers *Headers) Status() (*Status, error) {
 	return &Status{
 		TipAtInitTime: headers.tipAtInitTime,
 		Tip:           tip,
-		TargetHeight:  headers.targetHeight,
+		TargetHeight:  headers.TipHeight(),
 		TipHashHex:    tipHashHex,
 	}, nil
 }
@@ -39,6 +39,22 @@ func (_m *Interface) Initialize() {
 	_m.Called()
 }
 
+// LastReorg provides a mock function with given fields:
+func (_m *Interface) LastReorg() *headers.Reorg {
+	ret := _m.Called()
+
+	var r0 *headers.Reorg
+	if rf, ok := ret.Get(0).(func() *headers.Reorg); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*headers.Reorg)
+		}
+	}
+
+	return r0
+}
+
 // Status provides a mock function with given fields:
 func (_m *Interface) Status() (*headers.Status, error) {
 	ret := _m.Called()
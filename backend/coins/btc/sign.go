@@ -74,7 +74,8 @@ func SignTransaction(
 	// Sanity check: see if the created transaction is valid.
 	if err := txValidityCheck(txProposal.Transaction, previousOutputs,
 		proposedTransaction.SigHashes); err != nil {
-		log.WithError(err).Panic("Failed to pass transaction validity check.")
+		log.WithError(err).Error("Failed to pass transaction validity check.")
+		return errp.WithMessage(err, "the signed transaction is invalid")
 	}
 
 	return nil
@@ -23,11 +23,15 @@ import (
 // that run in goroutines.
 type Synchronizer struct {
 	requestsCounter int32
-	onSyncStarted   func()
-	onSyncFinished  func()
-	wait            chan struct{}
-	waitLock        locker.Locker
-	log             *logrus.Entry
+	// total and done count the requests since the current sync started.
+	total          int
+	done           int
+	onSyncStarted  func()
+	onSyncFinished func()
+	onProgress     func(done, total int)
+	wait           chan struct{}
+	waitLock       locker.Locker
+	log            *logrus.Entry
 }
 
 // NewSynchronizer creates a new Synchronizer. onSyncStarted is called when the counter is first
@@ -48,35 +52,66 @@ func NewSynchronizer(onSyncStarted func(), onSyncFinished func(), log *logrus.En
 func (synchronizer *Synchronizer) IncRequestsCounter() func() {
 	defer synchronizer.waitLock.Lock()()
 	synchronizer.requestsCounter++
+	synchronizer.total++
 	if synchronizer.requestsCounter == 1 {
+		synchronizer.total = 1
+		synchronizer.done = 0
 		synchronizer.onSyncStarted()
 		synchronizer.wait = make(chan struct{})
 	}
 	return synchronizer.decRequestsCounter
 }
 
-func (synchronizer *Synchronizer) decRequestsCounter() {
+// OnProgress installs a callback which is called whenever a task has finished, with the number of
+// finished tasks and the total number of tasks since the current sync started.
+func (synchronizer *Synchronizer) OnProgress(f func(done, total int)) {
 	defer synchronizer.waitLock.Lock()()
-	synchronizer.requestsCounter--
-	if synchronizer.requestsCounter == 0 {
+	synchronizer.onProgress = f
+}
+
+// Progress returns the number of finished tasks and the total number of tasks since the current
+// sync started.
+func (synchronizer *Synchronizer) Progress() (int, int) {
+	defer synchronizer.waitLock.RLock()()
+	return synchronizer.done, synchronizer.total
+}
+
+// decRequestsCounter decrements the counter. The callbacks are called after the lock is released,
+// so that they can take locks which are held while the counter is incremented.
+func (synchronizer *Synchronizer) decRequestsCounter() {
+	var wait chan struct{}
+	onProgress, done, total := func() (func(int, int), int, int) {
+		defer synchronizer.waitLock.Lock()()
+		synchronizer.requestsCounter--
+		synchronizer.done++
+		if synchronizer.requestsCounter == 0 {
+			wait = synchronizer.wait
+			synchronizer.wait = nil
+		} else if synchronizer.requestsCounter < 0 {
+			panic("request counter cannot be negative")
+		}
+		return synchronizer.onProgress, synchronizer.done, synchronizer.total
+	}()
+	if onProgress != nil {
+		onProgress(done, total)
+	}
+	if wait != nil {
 		synchronizer.onSyncFinished()
 		// Everyone waiting will be notified by this.
-		close(synchronizer.wait)
-		synchronizer.wait = nil
-	} else if synchronizer.requestsCounter < 0 {
-		panic("request counter cannot be negative")
+		close(wait)
 	}
 }
 
 // WaitSynchronized blocks until all pending synchronization tasks are finished.
 func (synchronizer *Synchronizer) WaitSynchronized() {
-	synchronizer.log.WithFields(logrus.Fields{"requestCounter": synchronizer.requestsCounter}).
-		Debug("wait synchronized")
-	if func() int32 {
+	requestsCounter, wait := func() (int32, chan struct{}) {
 		defer synchronizer.waitLock.RLock()()
-		return synchronizer.requestsCounter
-	}() == 0 {
+		return synchronizer.requestsCounter, synchronizer.wait
+	}()
+	synchronizer.log.WithFields(logrus.Fields{"requestCounter": requestsCounter}).
+		Debug("wait synchronized")
+	if requestsCounter == 0 {
 		return
 	}
-	<-synchronizer.wait
+	<-wait
 }
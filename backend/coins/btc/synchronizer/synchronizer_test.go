@@ -0,0 +1,75 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package synchronizer_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/synchronizer"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	started, finished := 0, 0
+	theSynchronizer := synchronizer.NewSynchronizer(
+		func() { started++ },
+		func() { finished++ },
+		logging.Get().WithGroup("synchronizer_test"),
+	)
+	progress := [][2]int{}
+	theSynchronizer.OnProgress(func(done, total int) {
+		progress = append(progress, [2]int{done, total})
+	})
+
+	done1 := theSynchronizer.IncRequestsCounter()
+	done2 := theSynchronizer.IncRequestsCounter()
+	done1()
+	done3 := theSynchronizer.IncRequestsCounter()
+	done, total := theSynchronizer.Progress()
+	require.Equal(t, 1, done)
+	require.Equal(t, 3, total)
+	done2()
+	done3()
+	theSynchronizer.WaitSynchronized()
+	require.Equal(t, 1, started)
+	require.Equal(t, 1, finished)
+	require.Equal(t, [][2]int{{1, 2}, {2, 3}, {3, 3}}, progress)
+
+	// A new sync starts counting from zero.
+	theSynchronizer.IncRequestsCounter()()
+	require.Equal(t, 2, started)
+	require.Equal(t, [2]int{1, 1}, progress[len(progress)-1])
+}
+
+func TestCallbacksWithoutLock(t *testing.T) {
+	var theSynchronizer *synchronizer.Synchronizer
+	calls := []string{}
+	// The callbacks can use the synchronizer.
+	record := func(name string) {
+		done, total := theSynchronizer.Progress()
+		calls = append(calls, fmt.Sprintf("%s %d/%d", name, done, total))
+	}
+	theSynchronizer = synchronizer.NewSynchronizer(
+		func() {},
+		func() { record("finished") },
+		logging.Get().WithGroup("synchronizer_test"),
+	)
+	theSynchronizer.OnProgress(func(int, int) { record("progress") })
+	theSynchronizer.IncRequestsCounter()()
+	theSynchronizer.WaitSynchronized()
+	require.Equal(t, []string{"progress 1/1", "finished 1/1"}, calls)
+}
@@ -34,7 +34,7 @@ const unitSatoshi = 1e8
 // newTx creates a new tx to the given recipient address. It also returns a set of used account
 // outputs, which contains all outputs that spent in the tx. Those are needed to be able to sign the
 // transaction. selectedUTXOs restricts the available coins; if empty, no restriction is applied and
-// all unspent coins can be used.
+// all unspent coins which are not frozen can be used.
 func (account *Account) newTx(
 	recipientAddress string,
 	amount coin.SendAmount,
@@ -68,7 +68,10 @@ func (account *Account) newTx(
 	if err != nil {
 		return nil, nil, errp.WithStack(err)
 	}
-	utxo := account.transactions.SpendableOutputs()
+	utxo, err := account.transactions.SpendableOutputs()
+	if err != nil {
+		return nil, nil, err
+	}
 	wireUTXO := make(map[wire.OutPoint]*wire.TxOut, len(utxo))
 	for outPoint, txOut := range utxo {
 		// Apply coin control.
@@ -76,6 +79,8 @@ func (account *Account) newTx(
 			if _, ok := selectedUTXOs[outPoint]; !ok {
 				continue
 			}
+		} else if txOut.Frozen {
+			continue
 		}
 		wireUTXO[outPoint] = txOut.TxOut
 	}
@@ -32,6 +32,7 @@ type DBTxInterface interface {
 
 	// PutTx stores a transaction and it's height (according to
 	// https://github.com/kyuupichan/electrumx/blob/46f245891cb62845f9eec0f9549526a7e569eb03/docs/protocol-basics.rst#status).
+	// If the height changed, the tx has to be verified again.
 	PutTx(txHash chainhash.Hash, tx *wire.MsgTx, height int) error
 
 	// DeleteTx deletes a transaction (nothing happens if not found).
@@ -55,16 +56,21 @@ type DBTxInterface interface {
 	// MarkTxVerified marks a tx as verified. Stores timestamp of the header this tx appears in.
 	MarkTxVerified(txHash chainhash.Hash, headerTimestamp time.Time) error
 
+	// MarkTxUnverified reverts MarkTxVerified, e.g. if the block of the tx was replaced by a reorg.
+	MarkTxUnverified(txHash chainhash.Hash) error
+
 	// PutInput stores a transaction input. It is referenced by output it spends. The transaction
-	// hash of the transaction this input was found in is recorded. TODO: store slice of inputs
-	// along with the txhash they appear in. If there are more than one, a double spend is detected.
+	// hash of the transaction this input was found in is recorded. All transactions spending the
+	// same output are recorded. If there are more than one, a double spend is detected.
 	PutInput(wire.OutPoint, chainhash.Hash) error
 
-	// Input retrieves an input. `nil, nil` is returned if not found.
-	Input(wire.OutPoint) (*chainhash.Hash, error)
+	// Inputs retrieves the hashes of the transactions spending an output. An empty slice is
+	// returned if not found.
+	Inputs(wire.OutPoint) ([]chainhash.Hash, error)
 
-	// DeleteInput deletes an input (nothing happens if not found).
-	DeleteInput(wire.OutPoint)
+	// DeleteInput deletes the input of the given transaction spending the output (nothing happens
+	// if not found).
+	DeleteInput(wire.OutPoint, chainhash.Hash)
 
 	// PutOutput stores an Output.
 	PutOutput(wire.OutPoint, *wire.TxOut) error
@@ -76,6 +82,15 @@ type DBTxInterface interface {
 	// DeleteOutput deletes an output (nothing happens if not found).
 	DeleteOutput(wire.OutPoint)
 
+	// FreezeOutput marks an output as frozen, so it is not spent unless selected explicitly.
+	FreezeOutput(wire.OutPoint) error
+
+	// UnfreezeOutput removes the frozen mark of an output (nothing happens if not frozen).
+	UnfreezeOutput(wire.OutPoint)
+
+	// FrozenOutputs retrieves all outputs marked as frozen.
+	FrozenOutputs() (map[wire.OutPoint]struct{}, error)
+
 	// PutAddressHistory stores an address history.
 	PutAddressHistory(blockchain.ScriptHashHex, blockchain.TxHistory) error
 
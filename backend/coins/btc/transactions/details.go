@@ -0,0 +1,166 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transactions
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// maxRBFSequence is the largest input sequence number signaling replaceability (BIP125).
+const maxRBFSequence = wire.MaxTxInSequenceNum - 2
+
+// TxDetails contains everything known about a transaction of the account, so that it can be
+// audited without asking a block explorer.
+type TxDetails struct {
+	*TxInfo
+	Inputs  []*TxDetailsInput
+	Outputs []*TxDetailsOutput
+	// BlockHash is the hash of the block the tx was confirmed in. nil for unconfirmed
+	// transactions, or when the headers are not synced up to the height of the tx yet.
+	BlockHash *chainhash.Hash
+	// Verified is true if the merkle proof of the tx was checked against the block header.
+	Verified bool
+}
+
+// RBF returns true if the transaction signals replaceability (BIP125).
+func (details *TxDetails) RBF() bool {
+	for _, txIn := range details.Tx.TxIn {
+		if txIn.Sequence <= maxRBFSequence {
+			return true
+		}
+	}
+	return false
+}
+
+// TxDetailsInput is an input of a transaction.
+type TxDetailsInput struct {
+	*wire.TxIn
+	// PrevOut is the spent output. nil if it is unknown, which is the case if the previous
+	// transaction does not belong to the account.
+	PrevOut *wire.TxOut
+	// Address is the address of the spent output. Empty if it is unknown.
+	Address string
+	// ScriptHashHex is the script hash of the spent output if it belongs to the account, and empty
+	// otherwise.
+	ScriptHashHex blockchain.ScriptHashHex
+}
+
+// TxDetailsOutput is an output of a transaction.
+type TxDetailsOutput struct {
+	*wire.TxOut
+	Address string
+	// ScriptHashHex is the script hash of the output if it belongs to the account, and empty
+	// otherwise.
+	ScriptHashHex blockchain.ScriptHashHex
+	// Change is true if the output pays to a change address of the account.
+	Change bool
+	// SpentBy is the hash of the transaction of the account spending this output which is not
+	// conflicted. nil if it is unspent, or if it is not known to the account.
+	SpentBy *chainhash.Hash
+}
+
+// TxDetails returns the details of a transaction of the account. isChange must not change during
+// the lifetime of this instance (see Transactions()).
+func (transactions *Transactions) TxDetails(
+	txHash chainhash.Hash, isChange func(blockchain.ScriptHashHex) bool) (*TxDetails, error) {
+	transactions.synchronizer.WaitSynchronized()
+	details, err := func() (*TxDetails, error) {
+		defer transactions.RLock()()
+		dbTx, err := transactions.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer dbTx.Rollback()
+		tx, _, height, timestamp, err := dbTx.TxInfo(txHash)
+		if err != nil {
+			return nil, err
+		}
+		if tx == nil {
+			return nil, errp.Newf("unknown transaction %s", txHash)
+		}
+		txInfo, err := transactions.txInfo(dbTx, tx, height, timestamp, isChange)
+		if err != nil {
+			return nil, err
+		}
+		details := &TxDetails{
+			TxInfo: txInfo,
+			// Only verified transactions have a timestamp, see MarkTxVerified().
+			Verified: timestamp != nil,
+		}
+		for _, txIn := range tx.TxIn {
+			input := &TxDetailsInput{TxIn: txIn}
+			ourPrevOut, err := dbTx.Output(txIn.PreviousOutPoint)
+			if err != nil {
+				return nil, err
+			}
+			if ourPrevOut != nil {
+				input.PrevOut = ourPrevOut
+				input.ScriptHashHex = getScriptHashHex(ourPrevOut)
+			} else {
+				// The previous transaction might still be known, e.g. if it had an output to
+				// the account, or if it spent from it.
+				prevTx, _, _, _, err := dbTx.TxInfo(txIn.PreviousOutPoint.Hash)
+				if err != nil {
+					return nil, err
+				}
+				if prevTx != nil && int(txIn.PreviousOutPoint.Index) < len(prevTx.TxOut) {
+					input.PrevOut = prevTx.TxOut[txIn.PreviousOutPoint.Index]
+				}
+			}
+			if input.PrevOut != nil {
+				input.Address = transactions.outputToAddress(input.PrevOut.PkScript)
+			}
+			details.Inputs = append(details.Inputs, input)
+		}
+		for index, txOut := range tx.TxOut {
+			outPoint := wire.OutPoint{Hash: txHash, Index: uint32(index)}
+			output := &TxDetailsOutput{
+				TxOut:   txOut,
+				Address: transactions.outputToAddress(txOut.PkScript),
+			}
+			ourOutput, err := dbTx.Output(outPoint)
+			if err != nil {
+				return nil, err
+			}
+			if ourOutput != nil {
+				output.ScriptHashHex = getScriptHashHex(ourOutput)
+				output.Change = isChange(output.ScriptHashHex)
+			}
+			output.SpentBy, err = transactions.spentBy(dbTx, outPoint)
+			if err != nil {
+				return nil, err
+			}
+			details.Outputs = append(details.Outputs, output)
+		}
+		return details, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if details.Height > 0 {
+		header, err := transactions.headers.HeaderByHeight(details.Height)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			blockHash := header.BlockHash()
+			details.BlockHash = &blockHash
+		}
+	}
+	return details, nil
+}
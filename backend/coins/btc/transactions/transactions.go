@@ -16,6 +16,7 @@ package transactions
 
 import (
 	"sort"
+	"sync"
 	"time"
 
 	btcdBlockchain "github.com/btcsuite/btcd/blockchain"
@@ -29,6 +30,7 @@ import (
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/synchronizer"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/sirupsen/logrus"
 )
@@ -37,6 +39,8 @@ import (
 type SpendableOutput struct {
 	*wire.TxOut
 	Address string
+	// Frozen outputs are only spent if selected explicitly.
+	Frozen bool
 }
 
 // ScriptHashHex returns the hash of the PkScript of the output, in hex format.
@@ -56,17 +60,45 @@ type Transactions struct {
 	net          *chaincfg.Params
 	db           DBInterface
 	headers      headers.Interface
-	requestedTXs map[chainhash.Hash][]func(DBTxInterface, *wire.MsgTx)
+	requestedTXs map[chainhash.Hash][]func(DBTxInterface, *wire.MsgTx) error
 
 	// headersTipHeight is the current chain tip height, so we can compute the number of
 	// confirmations of a transaction.
 	headersTipHeight int
 
 	unsubscribeHeadersEvent func()
+	// closed is set by Close(). Server responses arriving afterwards are ignored, as the database
+	// might be closed already.
+	closed bool
+	// verifications tracks the running transaction verifications.
+	verifications sync.WaitGroup
 
 	synchronizer *synchronizer.Synchronizer
 	blockchain   blockchain.Interface
+	// onError is called when processing a server response in the background failed.
+	onError func(error)
+	// onDoubleSpend is called when a pending incoming transaction is found to be double-spent.
+	onDoubleSpend func(chainhash.Hash)
+	// onReorg is called after the transactions in the blocks replaced by a reorg were marked as
+	// unverified.
+	onReorg func(*headers.Reorg)
+	// doubleSpends collects the double-spent transactions found while processing, which are
+	// reported to onDoubleSpend after the lock is released.
+	doubleSpends []chainhash.Hash
 	log          *logrus.Entry
+
+	// txInfosLock guards txInfos. It can be acquired while holding the transactions lock, but not
+	// the other way around.
+	txInfosLock locker.Locker
+	// txInfos caches the result of Transactions(). nil if it has to be computed again, which is
+	// the case after the transactions in the database or the chain tip changed.
+	txInfos []*TxInfo
+	// conflictsLock guards conflicts. It can be acquired while holding the transactions lock and
+	// txInfosLock.
+	conflictsLock locker.Locker
+	// conflicts caches the result of conflictedBy() per transaction. It is cleared together with
+	// txInfos.
+	conflicts map[chainhash.Hash]*chainhash.Hash
 }
 
 // NewTransactions creates a new instance of Transactions.
@@ -76,71 +108,95 @@ func NewTransactions(
 	headers headers.Interface,
 	synchronizer *synchronizer.Synchronizer,
 	blockchain blockchain.Interface,
+	onError func(error),
+	onDoubleSpend func(chainhash.Hash),
+	onReorg func(*headers.Reorg),
 	log *logrus.Entry,
 ) *Transactions {
 	transactions := &Transactions{
 		net:          net,
 		db:           db,
 		headers:      headers,
-		requestedTXs: map[chainhash.Hash][]func(DBTxInterface, *wire.MsgTx){},
+		requestedTXs: map[chainhash.Hash][]func(DBTxInterface, *wire.MsgTx) error{},
 
 		headersTipHeight: headers.TipHeight(),
 
-		synchronizer: synchronizer,
-		blockchain:   blockchain,
-		log:          log.WithFields(logrus.Fields{"group": "transactions", "net": net.Name}),
+		synchronizer:  synchronizer,
+		blockchain:    blockchain,
+		onError:       onError,
+		onDoubleSpend: onDoubleSpend,
+		onReorg:       onReorg,
+		log:           log.WithFields(logrus.Fields{"group": "transactions", "net": net.Name}),
 	}
 	transactions.unsubscribeHeadersEvent = headers.SubscribeEvent(transactions.onHeadersEvent)
 	return transactions
 }
 
-// Close cleans up when finished using.
+// Close cleans up when finished using and waits for running verifications. It is safe to call it
+// more than once.
 func (transactions *Transactions) Close() {
 	transactions.unsubscribeHeadersEvent()
+	func() {
+		defer transactions.Lock()()
+		transactions.closed = true
+	}()
+	transactions.verifications.Wait()
 }
 
 func (transactions *Transactions) txInHistory(
-	dbTx DBTxInterface, scriptHashHex blockchain.ScriptHashHex, txHash chainhash.Hash) bool {
+	dbTx DBTxInterface, scriptHashHex blockchain.ScriptHashHex, txHash chainhash.Hash) (bool, error) {
 	history, err := dbTx.AddressHistory(scriptHashHex)
 	if err != nil {
-		// TODO
-		panic(err)
+		return false, errp.WithMessage(err, "Failed to get address history")
 	}
 	for _, entry := range history {
 		if txHash == entry.TXHash.Hash() {
-			return true
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
 func (transactions *Transactions) processTxForAddress(
-	dbTx DBTxInterface, scriptHashHex blockchain.ScriptHashHex, txHash chainhash.Hash, tx *wire.MsgTx, height int) {
+	dbTx DBTxInterface, scriptHashHex blockchain.ScriptHashHex, txHash chainhash.Hash, tx *wire.MsgTx, height int) error {
+	if tx.TxHash() != txHash {
+		return errp.Newf("the server returned the wrong transaction for %s", txHash)
+	}
 	// Don't process the tx if it is not found in the address history. It could have been removed
 	// from the history before this function was called.
-	if !transactions.txInHistory(dbTx, scriptHashHex, txHash) {
-		return
+	inHistory, err := transactions.txInHistory(dbTx, scriptHashHex, txHash)
+	if err != nil {
+		return err
+	}
+	if !inHistory {
+		return nil
 	}
 
 	_, _, previousHeight, _, err := dbTx.TxInfo(txHash)
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to retrieve tx info")
+		return errp.WithMessage(err, "Failed to retrieve tx info")
 	}
 
 	if err := dbTx.PutTx(txHash, tx, height); err != nil {
-		transactions.log.WithError(err).Panic("Failed to put tx")
+		return errp.WithMessage(err, "Failed to put tx")
 	}
 
-	// Newly confirmed tx. Try to verify it.
-	if previousHeight <= 0 && height > 0 {
+	// Newly confirmed tx, or moved to another block by a reorg. Try to verify it.
+	if height > 0 && height != previousHeight {
 		transactions.log.Debug("Try to verify newly confirmed tx")
-		go transactions.verifyTransaction(txHash, height)
+		transactions.verifications.Add(1)
+		go func() {
+			defer transactions.verifications.Done()
+			if err := transactions.verifyTransaction(txHash, height); err != nil {
+				transactions.onError(err)
+			}
+		}()
 	}
 
 	if err := dbTx.AddAddressToTx(txHash, scriptHashHex); err != nil {
-		transactions.log.WithError(err).Panic("Failed to add address to tx")
+		return errp.WithMessage(err, "Failed to add address to tx")
 	}
-	transactions.processInputsAndOutputsForAddress(dbTx, scriptHashHex, txHash, tx)
+	return transactions.processInputsAndOutputsForAddress(dbTx, scriptHashHex, txHash, tx)
 }
 
 // Go through the tx and extract all inputs and outputs which touch the address.
@@ -148,24 +204,33 @@ func (transactions *Transactions) processInputsAndOutputsForAddress(
 	dbTx DBTxInterface,
 	scriptHashHex blockchain.ScriptHashHex,
 	txHash chainhash.Hash,
-	tx *wire.MsgTx) {
+	tx *wire.MsgTx) error {
 	// Gather transaction inputs that spend outputs of the given address.
 	for _, txIn := range tx.TxIn {
 		// Since transactions can be processed in any order, and we might process the same tx
 		// multiple times for different addresses, we index all inputs, even those that didn't
 		// originate from our wallet. At this stage we don't know if it is one of our own inputs,
 		// since the output that it spends might be indexed later.
-		txInTxHash, err := dbTx.Input(txIn.PreviousOutPoint)
+		spenders, err := dbTx.Inputs(txIn.PreviousOutPoint)
 		if err != nil {
-			transactions.log.WithError(err).Panic("Failed to retrieve input from previous outpoint")
+			return errp.WithMessage(err, "Failed to retrieve input from previous outpoint")
 		}
-		if txInTxHash != nil && *txInTxHash != txHash {
+		if containsHash(spenders, txHash) {
+			// Already indexed, the double spend (if any) was already detected.
+			continue
+		}
+		for _, spender := range spenders {
 			transactions.log.WithFields(logrus.Fields{"txIn.PreviousOutPoint": txIn.PreviousOutPoint,
-				"txInTxHash": txInTxHash, "txHash": txHash}).
+				"txInTxHash": spender, "txHash": txHash}).
 				Warning("Double spend detected")
+			for _, conflictingTxHash := range []chainhash.Hash{spender, txHash} {
+				if err := transactions.checkDoubleSpentIncoming(dbTx, conflictingTxHash); err != nil {
+					return err
+				}
+			}
 		}
 		if err := dbTx.PutInput(txIn.PreviousOutPoint, txHash); err != nil {
-			transactions.log.WithError(err).Panic("Failed to store the transaction input")
+			return errp.WithMessage(err, "Failed to store the transaction input")
 		}
 	}
 	// Gather transaction outputs that belong to us.
@@ -177,93 +242,302 @@ func (transactions *Transactions) processInputsAndOutputsForAddress(
 				txOut,
 			)
 			if err != nil {
-				transactions.log.WithError(err).Panic("Failed to store the transaction output")
+				return errp.WithMessage(err, "Failed to store the transaction output")
+			}
+		}
+	}
+	return nil
+}
+
+func containsHash(hashes []chainhash.Hash, hash chainhash.Hash) bool {
+	for _, candidate := range hashes {
+		if candidate == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDoubleSpentIncoming records the tx to be reported to onDoubleSpend if it is a pending
+// incoming transaction. Requires the transactions lock.
+func (transactions *Transactions) checkDoubleSpentIncoming(
+	dbTx DBTxInterface, txHash chainhash.Hash) error {
+	tx, _, height, _, err := dbTx.TxInfo(txHash)
+	if err != nil {
+		return errp.WithMessage(err, "Failed to retrieve tx info")
+	}
+	if tx == nil || height > 0 {
+		return nil
+	}
+	allInputsOurs, err := transactions.allInputsOurs(dbTx, tx)
+	if err != nil {
+		return err
+	}
+	if allInputsOurs {
+		return nil
+	}
+	if containsHash(transactions.doubleSpends, txHash) {
+		return nil
+	}
+	transactions.doubleSpends = append(transactions.doubleSpends, txHash)
+	return nil
+}
+
+// hasKnownConflicts returns true if another transaction of the account spends one of the outputs
+// spent by the given tx. The double spend was reported already when it was indexed.
+func (transactions *Transactions) hasKnownConflicts(
+	dbTx DBTxInterface, txHash chainhash.Hash, tx *wire.MsgTx) (bool, error) {
+	for _, txIn := range tx.TxIn {
+		spenders, err := dbTx.Inputs(txIn.PreviousOutPoint)
+		if err != nil {
+			return false, errp.WithMessage(err, "Failed to retrieve input from previous outpoint")
+		}
+		for _, spender := range spenders {
+			if spender != txHash {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// reportDoubleSpends calls onDoubleSpend for the double spends found while processing, if the
+// changes were committed. It must be called without holding the transactions lock.
+func (transactions *Transactions) reportDoubleSpends(committed bool) {
+	doubleSpends := func() []chainhash.Hash {
+		defer transactions.Lock()()
+		doubleSpends := transactions.doubleSpends
+		transactions.doubleSpends = nil
+		return doubleSpends
+	}()
+	if !committed {
+		return
+	}
+	for _, txHash := range doubleSpends {
+		transactions.onDoubleSpend(txHash)
+	}
+}
+
+// conflictedBy returns the confirmed transaction spending the same output as the given
+// unconfirmed transaction, or as one of the unconfirmed transactions it spends from. nil is
+// returned if there is none, in which case the transaction can still confirm. The results are
+// cached until the transactions change, so that the parents are not walked again for every
+// output. Requires the transactions lock.
+func (transactions *Transactions) conflictedBy(
+	dbTx DBTxInterface, txHash chainhash.Hash) (*chainhash.Hash, error) {
+	defer transactions.conflictsLock.Lock()()
+	if transactions.conflicts == nil {
+		transactions.conflicts = map[chainhash.Hash]*chainhash.Hash{}
+	}
+	return transactions.computeConflictedBy(dbTx, txHash)
+}
+
+// computeConflictedBy requires the transactions lock and conflictsLock.
+func (transactions *Transactions) computeConflictedBy(
+	dbTx DBTxInterface, txHash chainhash.Hash) (*chainhash.Hash, error) {
+	if conflictedBy, ok := transactions.conflicts[txHash]; ok {
+		return conflictedBy, nil
+	}
+	conflictedBy, err := transactions.findConflictedBy(dbTx, txHash)
+	if err != nil {
+		return nil, err
+	}
+	transactions.conflicts[txHash] = conflictedBy
+	return conflictedBy, nil
+}
+
+// findConflictedBy requires the transactions lock and conflictsLock.
+func (transactions *Transactions) findConflictedBy(
+	dbTx DBTxInterface, txHash chainhash.Hash) (*chainhash.Hash, error) {
+	tx, _, height, _, err := dbTx.TxInfo(txHash)
+	if err != nil {
+		return nil, errp.WithMessage(err, "Failed to retrieve tx info")
+	}
+	if tx == nil || height > 0 {
+		return nil, nil
+	}
+	for _, txIn := range tx.TxIn {
+		spenders, err := dbTx.Inputs(txIn.PreviousOutPoint)
+		if err != nil {
+			return nil, errp.WithMessage(err, "Failed to retrieve input from previous outpoint")
+		}
+		for _, spender := range spenders {
+			if spender == txHash {
+				continue
+			}
+			_, _, spenderHeight, _, err := dbTx.TxInfo(spender)
+			if err != nil {
+				return nil, errp.WithMessage(err, "Failed to retrieve tx info")
+			}
+			if spenderHeight > 0 {
+				return &spender, nil
 			}
 		}
+		// Spending an output of a conflicted tx makes this tx conflicted, too.
+		parentConflictedBy, err := transactions.computeConflictedBy(dbTx, txIn.PreviousOutPoint.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if parentConflictedBy != nil {
+			return parentConflictedBy, nil
+		}
 	}
+	return nil, nil
 }
 
-func (transactions *Transactions) allInputsOurs(dbTx DBTxInterface, transaction *wire.MsgTx) bool {
+// isConflicted returns true if the tx can never confirm, see conflictedBy().
+func (transactions *Transactions) isConflicted(dbTx DBTxInterface, txHash chainhash.Hash) (bool, error) {
+	conflictedBy, err := transactions.conflictedBy(dbTx, txHash)
+	if err != nil {
+		return false, errp.WithMessage(err, "Failed to check for conflicts")
+	}
+	return conflictedBy != nil, nil
+}
+
+func (transactions *Transactions) allInputsOurs(
+	dbTx DBTxInterface, transaction *wire.MsgTx) (bool, error) {
 	for _, txIn := range transaction.TxIn {
 		txOut, err := dbTx.Output(txIn.PreviousOutPoint)
 		if err != nil {
-			transactions.log.WithError(err).Panic("Failed to retrieve output")
+			return false, errp.WithMessage(err, "Failed to retrieve output")
 		}
 		if txOut == nil {
-			return false
+			return false, nil
 		}
 	}
-	return true
+	return true, nil
 }
 
 // SpendableOutputs returns all unspent outputs of the wallet which are eligible to be spent. Those
 // include all unspent outputs of confirmed transactions, and unconfirmed outputs that we created
 // ourselves.
-func (transactions *Transactions) SpendableOutputs() map[wire.OutPoint]*SpendableOutput {
+func (transactions *Transactions) SpendableOutputs() (map[wire.OutPoint]*SpendableOutput, error) {
 	transactions.synchronizer.WaitSynchronized()
 	defer transactions.RLock()()
 
 	dbTx, err := transactions.db.Begin()
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to begin transaction")
+		return nil, errp.WithMessage(err, "Failed to begin transaction")
 	}
 	defer dbTx.Rollback()
 
 	outputs, err := dbTx.Outputs()
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to retrieve outputs")
+		return nil, errp.WithMessage(err, "Failed to retrieve outputs")
+	}
+	frozenOutputs, err := dbTx.FrozenOutputs()
+	if err != nil {
+		return nil, errp.WithMessage(err, "Failed to retrieve frozen outputs")
 	}
 	result := map[wire.OutPoint]*SpendableOutput{}
 	for outPoint, txOut := range outputs {
+		unspent, err := transactions.isUnspent(dbTx, outPoint)
+		if err != nil {
+			return nil, err
+		}
+		if !unspent {
+			continue
+		}
 		tx, _, height, _, err := dbTx.TxInfo(outPoint.Hash)
 		if err != nil {
-			transactions.log.WithError(err).Panic("Failed to retrieve tx info")
+			return nil, errp.WithMessage(err, "Failed to retrieve tx info")
 		}
 		confirmed := height > 0
-
-		spent := transactions.isInputSpent(dbTx, outPoint)
-		if !spent && (confirmed || transactions.allInputsOurs(dbTx, tx)) {
+		allInputsOurs, err := transactions.allInputsOurs(dbTx, tx)
+		if err != nil {
+			return nil, err
+		}
+		if confirmed || allInputsOurs {
+			_, frozen := frozenOutputs[outPoint]
 			result[outPoint] = &SpendableOutput{
 				TxOut:   txOut,
 				Address: transactions.outputToAddress(txOut.PkScript),
+				Frozen:  frozen,
 			}
 		}
 	}
-	return result
+	return result, nil
+}
+
+// isUnspent returns true if the output is not spent, and if its transaction is not conflicted.
+func (transactions *Transactions) isUnspent(dbTx DBTxInterface, outPoint wire.OutPoint) (bool, error) {
+	spent, err := transactions.isInputSpent(dbTx, outPoint)
+	if err != nil || spent {
+		return false, err
+	}
+	conflicted, err := transactions.isConflicted(dbTx, outPoint.Hash)
+	if err != nil {
+		return false, err
+	}
+	return !conflicted, nil
 }
 
-func (transactions *Transactions) isInputSpent(dbTx DBTxInterface, outPoint wire.OutPoint) bool {
-	input, err := dbTx.Input(outPoint)
+// isInputSpent returns true if the output is spent by a transaction which is not conflicted.
+func (transactions *Transactions) isInputSpent(dbTx DBTxInterface, outPoint wire.OutPoint) (bool, error) {
+	spentBy, err := transactions.spentBy(dbTx, outPoint)
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to retrieve input for outPoint")
+		return false, err
+	}
+	return spentBy != nil, nil
+}
+
+// spentBy returns the transaction spending the output which is not conflicted, or nil if there is
+// none.
+func (transactions *Transactions) spentBy(
+	dbTx DBTxInterface, outPoint wire.OutPoint) (*chainhash.Hash, error) {
+	spenders, err := dbTx.Inputs(outPoint)
+	if err != nil {
+		return nil, errp.WithMessage(err, "Failed to retrieve input for outPoint")
+	}
+	for _, spender := range spenders {
+		conflicted, err := transactions.isConflicted(dbTx, spender)
+		if err != nil {
+			return nil, err
+		}
+		if !conflicted {
+			return &spender, nil
+		}
 	}
-	return input != nil
+	return nil, nil
 }
 
 func (transactions *Transactions) removeTxForAddress(
-	dbTx DBTxInterface, scriptHashHex blockchain.ScriptHashHex, txHash chainhash.Hash) {
+	dbTx DBTxInterface, scriptHashHex blockchain.ScriptHashHex, txHash chainhash.Hash) error {
 	transactions.log.Debug("Remove transaction for address")
 	tx, _, _, _, err := dbTx.TxInfo(txHash)
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to retrieve tx info")
+		return errp.WithMessage(err, "Failed to retrieve tx info")
 	}
 	if tx == nil {
 		// Not yet indexed.
 		transactions.log.Debug("Transaction hash not listed")
-		return
+		return nil
 	}
 
 	transactions.log.Debug("Deleting transaction address")
 	empty, err := dbTx.RemoveAddressFromTx(txHash, scriptHashHex)
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to remove address from tx")
+		return errp.WithMessage(err, "Failed to remove address from tx")
 	}
 	if empty {
 		// Tx is not touching any of our outputs anymore. Remove.
 
+		// A pending tx vanishing from the history was dropped from the mempool, usually because a
+		// conflicting tx confirmed. The conflicting tx is not known if it does not touch the
+		// account, e.g. if the sender of a payment to a merchant double-spends it.
+		knownConflicts, err := transactions.hasKnownConflicts(dbTx, txHash, tx)
+		if err != nil {
+			return err
+		}
+		if !knownConflicts {
+			if err := transactions.checkDoubleSpentIncoming(dbTx, txHash); err != nil {
+				return err
+			}
+		}
+
 		for _, txIn := range tx.TxIn {
 			transactions.log.Debug("Deleting transaction iput")
-			dbTx.DeleteInput(txIn.PreviousOutPoint)
+			dbTx.DeleteInput(txIn.PreviousOutPoint, txHash)
 		}
 
 		// Remove the outputs added by this tx.
@@ -276,28 +550,40 @@ func (transactions *Transactions) removeTxForAddress(
 
 		dbTx.DeleteTx(txHash)
 	}
+	return nil
 }
 
 // UpdateAddressHistory should be called when initializing a wallet address, or when the history of
 // an address changes (a new transaction that touches it appears or disappears). The transactions
-// are downloaded and indexed.
-func (transactions *Transactions) UpdateAddressHistory(scriptHashHex blockchain.ScriptHashHex, txs []*blockchain.TxInfo) {
+// are downloaded and indexed. An error is returned if the history could not be stored, or if the
+// server returned an invalid history. Errors happening while processing the downloaded
+// transactions are reported to the onError callback.
+func (transactions *Transactions) UpdateAddressHistory(scriptHashHex blockchain.ScriptHashHex, txs []*blockchain.TxInfo) error {
+	err := transactions.updateAddressHistory(scriptHashHex, txs)
+	transactions.reportDoubleSpends(err == nil)
+	return err
+}
+
+func (transactions *Transactions) updateAddressHistory(scriptHashHex blockchain.ScriptHashHex, txs []*blockchain.TxInfo) error {
 	defer transactions.Lock()()
+	if transactions.closed {
+		return nil
+	}
 	dbTx, err := transactions.db.Begin()
-	defer dbTx.Rollback()
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to begin transaction")
+		return errp.WithMessage(err, "Failed to begin transaction")
 	}
+	defer dbTx.Rollback()
 	txsSet := map[chainhash.Hash]struct{}{}
 	for _, txInfo := range txs {
 		txsSet[txInfo.TXHash.Hash()] = struct{}{}
 	}
 	if len(txsSet) != len(txs) {
-		transactions.log.WithError(err).Panic("duplicate tx ids in address history returned by server")
+		return errp.New("duplicate tx ids in address history returned by server")
 	}
 	previousHistory, err := dbTx.AddressHistory(scriptHashHex)
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to get address history")
+		return errp.WithMessage(err, "Failed to get address history")
 	}
 	for _, entry := range previousHistory {
 		if _, txOK := txsSet[entry.TXHash.Hash()]; txOK {
@@ -306,114 +592,224 @@ func (transactions *Transactions) UpdateAddressHistory(scriptHashHex blockchain.
 		// A tx was previously in the address history but is not anymore.  If the tx was already
 		// downloaded and indexed, it will be removed.  If it is currently downloading (enqueued for
 		// indexing), it will not be processed.
-		transactions.removeTxForAddress(dbTx, scriptHashHex, entry.TXHash.Hash())
+		if err := transactions.removeTxForAddress(dbTx, scriptHashHex, entry.TXHash.Hash()); err != nil {
+			return err
+		}
 	}
 
 	if err := dbTx.PutAddressHistory(scriptHashHex, txs); err != nil {
-		transactions.log.WithError(err).Panic("Failed to store address history")
+		return errp.WithMessage(err, "Failed to store address history")
 	}
 
 	for _, txInfo := range txs {
-		func(txHash chainhash.Hash, height int) {
-			transactions.doForTransaction(dbTx, txHash, func(innerDBTx DBTxInterface, tx *wire.MsgTx) {
-				transactions.processTxForAddress(innerDBTx, scriptHashHex, txHash, tx, height)
+		err := func(txHash chainhash.Hash, height int) error {
+			return transactions.doForTransaction(dbTx, txHash, func(innerDBTx DBTxInterface, tx *wire.MsgTx) error {
+				return transactions.processTxForAddress(innerDBTx, scriptHashHex, txHash, tx, height)
 			})
 		}(txInfo.TXHash.Hash(), txInfo.Height)
+		if err != nil {
+			return err
+		}
 	}
 	if err := dbTx.Commit(); err != nil {
-		transactions.log.WithError(err).Panic("Failed to commit transaction")
+		return errp.WithMessage(err, "Failed to commit transaction")
 	}
+	transactions.invalidateTxInfos()
+	return nil
 }
 
 // requires transactions lock
 func (transactions *Transactions) doForTransaction(
 	dbTx DBTxInterface,
 	txHash chainhash.Hash,
-	callback func(DBTxInterface, *wire.MsgTx),
-) {
+	callback func(DBTxInterface, *wire.MsgTx) error,
+) error {
 	tx, _, _, _, err := dbTx.TxInfo(txHash)
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to retrieve transaction info")
+		return errp.WithMessage(err, "Failed to retrieve transaction info")
 	}
 	if tx != nil {
-		callback(dbTx, tx)
-		return
+		return callback(dbTx, tx)
 	}
 	if transactions.requestedTXs[txHash] == nil {
-		transactions.requestedTXs[txHash] = []func(DBTxInterface, *wire.MsgTx){}
+		transactions.requestedTXs[txHash] = []func(DBTxInterface, *wire.MsgTx) error{}
 	}
 	alreadyDownloading := len(transactions.requestedTXs[txHash]) != 0
 	transactions.requestedTXs[txHash] = append(transactions.requestedTXs[txHash], callback)
 	if alreadyDownloading {
-		return
+		return nil
 	}
 	done := transactions.synchronizer.IncRequestsCounter()
 	transactions.blockchain.TransactionGet(
 		txHash,
 		func(tx *wire.MsgTx) error {
-			defer transactions.Lock()()
-			dbTx, err := transactions.db.Begin()
-			if err != nil {
-				transactions.log.WithError(err).Panic("Failed to begin transaction")
-			}
-			defer dbTx.Rollback()
+			// The error is reported to onError instead of being returned, so that a bad response
+			// does not take down the connection to the server. onError is called without holding
+			// the lock.
+			err := func() error {
+				defer transactions.Lock()()
+				if transactions.closed {
+					return nil
+				}
+				callbacks := transactions.requestedTXs[txHash]
+				delete(transactions.requestedTXs, txHash)
+				dbTx, err := transactions.db.Begin()
+				if err != nil {
+					return errp.WithMessage(err, "Failed to begin transaction")
+				}
+				defer dbTx.Rollback()
 
-			for _, callback := range transactions.requestedTXs[txHash] {
-				callback(dbTx, tx)
+				for _, callback := range callbacks {
+					if err := callback(dbTx, tx); err != nil {
+						return err
+					}
+				}
+				if err := dbTx.Commit(); err != nil {
+					return err
+				}
+				transactions.invalidateTxInfos()
+				return nil
+			}()
+			transactions.reportDoubleSpends(err == nil)
+			if err != nil {
+				transactions.onError(err)
 			}
-			delete(transactions.requestedTXs, txHash)
-			return dbTx.Commit()
+			return nil
 		},
 		func() { done() },
 	)
+	return nil
 }
 
 // Balance computes the confirmed and unconfirmed balance of the account.
-func (transactions *Transactions) Balance() *coin.Balance {
+func (transactions *Transactions) Balance() (*coin.Balance, error) {
 	transactions.synchronizer.WaitSynchronized()
 	defer transactions.RLock()()
 	dbTx, err := transactions.db.Begin()
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to begin transaction")
+		return nil, errp.WithMessage(err, "Failed to begin transaction")
 	}
+	defer dbTx.Rollback()
 	outputs, err := dbTx.Outputs()
 	if err != nil {
-		transactions.log.WithError(err).Panic("Failed to retrieve outputs")
+		return nil, errp.WithMessage(err, "Failed to retrieve outputs")
 	}
-	defer dbTx.Rollback()
-	var available, incoming int64
+	frozenOutputs, err := dbTx.FrozenOutputs()
+	if err != nil {
+		return nil, errp.WithMessage(err, "Failed to retrieve frozen outputs")
+	}
+	var available, incoming, frozen int64
 	for outPoint, txOut := range outputs {
-		// What is spent can not be available nor incoming.
-		if spent := transactions.isInputSpent(dbTx, outPoint); spent {
+		// What is spent can not be available nor incoming, and outputs of conflicted transactions
+		// will never exist.
+		unspent, err := transactions.isUnspent(dbTx, outPoint)
+		if err != nil {
+			return nil, err
+		}
+		if !unspent {
+			continue
+		}
+		if _, ok := frozenOutputs[outPoint]; ok {
+			frozen += txOut.Value
 			continue
 		}
 		tx, _, height, _, err := dbTx.TxInfo(outPoint.Hash)
 		if err != nil {
-			transactions.log.WithError(err).Panic("Failed to retrieve tx info")
+			return nil, errp.WithMessage(err, "Failed to retrieve tx info")
 		}
 		confirmed := height > 0
-		if confirmed || transactions.allInputsOurs(dbTx, tx) {
+		allInputsOurs, err := transactions.allInputsOurs(dbTx, tx)
+		if err != nil {
+			return nil, err
+		}
+		if confirmed || allInputsOurs {
 			available += txOut.Value
 		} else {
 			incoming += txOut.Value
 		}
 	}
-	return coin.NewBalance(coin.NewAmountFromInt64(available), coin.NewAmountFromInt64(incoming))
+	return coin.NewBalanceWithFrozen(
+		coin.NewAmountFromInt64(available),
+		coin.NewAmountFromInt64(incoming),
+		coin.NewAmountFromInt64(frozen),
+	), nil
+}
+
+// SetOutputFrozen freezes or unfreezes an unspent output of the account. Frozen outputs are
+// excluded from the available balance and from the automatic coin selection.
+func (transactions *Transactions) SetOutputFrozen(outPoint wire.OutPoint, frozen bool) error {
+	defer transactions.Lock()()
+	dbTx, err := transactions.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+	if frozen {
+		txOut, err := dbTx.Output(outPoint)
+		if err != nil {
+			return err
+		}
+		if txOut == nil {
+			return errp.Newf("%s is not an unspent output of the account", outPoint)
+		}
+		spent, err := transactions.isInputSpent(dbTx, outPoint)
+		if err != nil {
+			return err
+		}
+		if spent {
+			return errp.Newf("%s is not an unspent output of the account", outPoint)
+		}
+		if err := dbTx.FreezeOutput(outPoint); err != nil {
+			return err
+		}
+	} else {
+		dbTx.UnfreezeOutput(outPoint)
+	}
+	return dbTx.Commit()
+}
+
+// FrozenOutputs returns the outputs which are marked as frozen.
+func (transactions *Transactions) FrozenOutputs() (map[wire.OutPoint]struct{}, error) {
+	defer transactions.RLock()()
+	dbTx, err := transactions.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer dbTx.Rollback()
+	return dbTx.FrozenOutputs()
+}
+
+// RestoreFrozenOutputs marks the given outputs as frozen, e.g. after the history was rescanned.
+func (transactions *Transactions) RestoreFrozenOutputs(outPoints map[wire.OutPoint]struct{}) error {
+	defer transactions.Lock()()
+	dbTx, err := transactions.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+	for outPoint := range outPoints {
+		if err := dbTx.FreezeOutput(outPoint); err != nil {
+			return err
+		}
+	}
+	return dbTx.Commit()
 }
 
 // byHeight defines the methods needed to satisify sort.Interface to sort transactions by their
-// height. Special case for unconfirmed transactions (height <=0), which come last.
+// height. Special case for unconfirmed transactions (height <=0), which come last. Transactions
+// with the same height are ordered by their ID, so that the order is stable across calls.
 type byHeight []*TxInfo
 
 func (s byHeight) Len() int { return len(s) }
 func (s byHeight) Less(i, j int) bool {
-	if s[j].Height <= 0 {
-		return true
+	confirmedI, confirmedJ := s[i].Height > 0, s[j].Height > 0
+	if confirmedI != confirmedJ {
+		return confirmedI
 	}
-	if s[i].Height <= 0 {
-		return false
+	if confirmedI && s[i].Height != s[j].Height {
+		return s[i].Height < s[j].Height
 	}
-	return s[i].Height < s[j].Height
+	return s[i].ID() < s[j].ID()
 }
 func (s byHeight) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
@@ -437,6 +833,18 @@ type TxInfo struct {
 	timestamp *time.Time
 	// addresses money was sent to / received on (without change addresses).
 	addresses []string
+	// Conflicts are the other transactions of the account spending one of the outputs spent by
+	// this tx. At most one of them can confirm.
+	Conflicts []chainhash.Hash
+	// ReplacedBy is the confirmed transaction conflicting with this unconfirmed tx, or with one of
+	// the unconfirmed transactions it spends from. nil if there is none. A replaced tx is
+	// conflicted: it can never confirm, and its outputs do not count towards the balance.
+	ReplacedBy *chainhash.Hash
+}
+
+// Conflicted returns true if the tx can never confirm because of a confirmed double spend.
+func (txInfo *TxInfo) Conflicted() bool {
+	return txInfo.ReplacedBy != nil
 }
 
 // Fee implements coin.Transaction.
@@ -472,6 +880,14 @@ func (txInfo *TxInfo) NumConfirmations() int {
 	return txInfo.numConfirmations
 }
 
+// BlockHeight implements coin.Transaction.
+func (txInfo *TxInfo) BlockHeight() int {
+	if txInfo.Height <= 0 {
+		return 0
+	}
+	return txInfo.Height
+}
+
 // Type implements coin.Transaction.
 func (txInfo *TxInfo) Type() coin.TxType {
 	return txInfo.txType
@@ -497,21 +913,20 @@ func (transactions *Transactions) outputToAddress(pkScript []byte) string {
 }
 
 // txInfo computes additional information to display to the user (type of tx, fee paid, etc.).
+// Requires the transactions lock.
 func (transactions *Transactions) txInfo(
 	dbTx DBTxInterface,
 	tx *wire.MsgTx,
 	height int,
 	timestamp *time.Time,
-	isChange func(blockchain.ScriptHashHex) bool) *TxInfo {
-	defer transactions.RLock()()
+	isChange func(blockchain.ScriptHashHex) bool) (*TxInfo, error) {
 	var sumOurInputs btcutil.Amount
 	var result btcutil.Amount
 	allInputsOurs := true
 	for _, txIn := range tx.TxIn {
 		spentOut, err := dbTx.Output(txIn.PreviousOutPoint)
 		if err != nil {
-			// TODO
-			panic(err)
+			return nil, errp.WithMessage(err, "Failed to retrieve output")
 		}
 		if spentOut != nil {
 			sumOurInputs += btcutil.Amount(spentOut.Value)
@@ -530,8 +945,7 @@ func (transactions *Transactions) txInfo(
 			Index: uint32(index),
 		})
 		if err != nil {
-			// TODO
-			panic(err)
+			return nil, errp.WithMessage(err, "Failed to retrieve output")
 		}
 		address := transactions.outputToAddress(txOut.PkScript)
 		if output != nil {
@@ -569,6 +983,23 @@ func (transactions *Transactions) txInfo(
 		addresses = receiveAddresses
 		result = sumOurReceive + sumOurChange - sumOurInputs
 	}
+	txHash := tx.TxHash()
+	conflicts := []chainhash.Hash{}
+	for _, txIn := range tx.TxIn {
+		spenders, err := dbTx.Inputs(txIn.PreviousOutPoint)
+		if err != nil {
+			return nil, errp.WithMessage(err, "Failed to retrieve input from previous outpoint")
+		}
+		for _, spender := range spenders {
+			if spender != txHash {
+				conflicts = append(conflicts, spender)
+			}
+		}
+	}
+	replacedBy, err := transactions.conflictedBy(dbTx, txHash)
+	if err != nil {
+		return nil, err
+	}
 	numConfirmations := 0
 	if height > 0 && transactions.headersTipHeight > 0 {
 		numConfirmations = transactions.headersTipHeight - height + 1
@@ -586,34 +1017,64 @@ func (transactions *Transactions) txInfo(
 		fee:              feeP,
 		timestamp:        timestamp,
 		addresses:        addresses,
-	}
+		Conflicts:        conflicts,
+		ReplacedBy:       replacedBy,
+	}, nil
+}
+
+// invalidateTxInfos clears the cache of Transactions() and of the conflicts. It has to be called
+// after the transactions in the database changed.
+func (transactions *Transactions) invalidateTxInfos() {
+	defer transactions.txInfosLock.Lock()()
+	transactions.txInfos = nil
+	defer transactions.conflictsLock.Lock()()
+	transactions.conflicts = nil
 }
 
-// Transactions returns an ordered list of transactions.
+// Transactions returns an ordered list of transactions, the newest first like
+// coin.SortTransactions. The result is cached until the transactions or the chain tip change.
+// isChange must not change during the lifetime of this instance.
 func (transactions *Transactions) Transactions(
-	isChange func(blockchain.ScriptHashHex) bool) []*TxInfo {
+	isChange func(blockchain.ScriptHashHex) bool) ([]*TxInfo, error) {
 	transactions.synchronizer.WaitSynchronized()
 	defer transactions.RLock()()
+	// The cache is filled while holding the transactions lock, so it can't be invalidated by a
+	// concurrent database update before it is stored.
+	defer transactions.txInfosLock.Lock()()
+	if transactions.txInfos == nil {
+		txInfos, err := transactions.computeTxInfos(isChange)
+		if err != nil {
+			return nil, err
+		}
+		transactions.txInfos = txInfos
+	}
+	return append([]*TxInfo{}, transactions.txInfos...), nil
+}
+
+// computeTxInfos requires the transactions lock.
+func (transactions *Transactions) computeTxInfos(
+	isChange func(blockchain.ScriptHashHex) bool) ([]*TxInfo, error) {
 	dbTx, err := transactions.db.Begin()
 	if err != nil {
-		// TODO
-		panic(err)
+		return nil, errp.WithMessage(err, "Failed to begin transaction")
 	}
 	defer dbTx.Rollback()
 	txs := []*TxInfo{}
 	txHashes, err := dbTx.Transactions()
 	if err != nil {
-		// TODO
-		panic(err)
+		return nil, errp.WithMessage(err, "Failed to retrieve transactions")
 	}
 	for _, txHash := range txHashes {
 		tx, _, height, timestamp, err := dbTx.TxInfo(txHash)
 		if err != nil {
-			// TODO
-			panic(err)
+			return nil, errp.WithMessage(err, "Failed to retrieve tx info")
+		}
+		txInfo, err := transactions.txInfo(dbTx, tx, height, timestamp, isChange)
+		if err != nil {
+			return nil, err
 		}
-		txs = append(txs, transactions.txInfo(dbTx, tx, height, timestamp, isChange))
+		txs = append(txs, txInfo)
 	}
 	sort.Sort(sort.Reverse(byHeight(txs)))
-	return txs
+	return txs, nil
 }
@@ -16,6 +16,7 @@ package transactions_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -26,6 +27,7 @@ import (
 	blockchainpkg "github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
 	blockchainMock "github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain/mocks"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/db/transactionsdb"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
 	headersMock "github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers/mocks"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/synchronizer"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/transactions"
@@ -108,6 +110,14 @@ type transactionsSuite struct {
 	blockchainMock *BlockchainMock
 	headersMock    *headersMock.Interface
 	transactions   *transactions.Transactions
+	// errors collects the errors reported to the onError callback.
+	errors []error
+	// doubleSpends collects the txs reported to the onDoubleSpend callback.
+	doubleSpends []chainhash.Hash
+	// reorgs collects the reorgs reported to the onReorg callback.
+	reorgs []*headers.Reorg
+	// onHeadersEvent is the callback subscribed to the headers events.
+	onHeadersEvent func(headers.Event)
 
 	log *logrus.Entry
 }
@@ -119,19 +129,28 @@ func (s *transactionsSuite) SetupTest() {
 	_, s.addressChain = addressesTest.NewAddressChain()
 	s.synchronizer = synchronizer.NewSynchronizer(func() {}, func() {}, s.log)
 	s.blockchainMock = NewBlockchainMock()
-	db, err := transactionsdb.NewDB(test.TstTempFile("bitbox-wallet-db-"))
+	db, err := transactionsdb.NewDB(test.TstTempFile("bitbox-wallet-db-"), nil)
 	if err != nil {
 		panic(err)
 	}
 	s.headersMock = &headersMock.Interface{}
-	s.headersMock.On("SubscribeEvent", mock.AnythingOfType("func(headers.Event)")).Return(func() {})
+	s.headersMock.On("SubscribeEvent", mock.AnythingOfType("func(headers.Event)")).Run(
+		func(args mock.Arguments) {
+			s.onHeadersEvent = args.Get(0).(func(headers.Event))
+		}).Return(func() {})
 	s.headersMock.On("TipHeight").Return(15).Once()
+	s.errors = nil
+	s.doubleSpends = nil
+	s.reorgs = nil
 	s.transactions = transactions.NewTransactions(
 		s.net,
 		db,
 		s.headersMock,
 		s.synchronizer,
 		s.blockchainMock,
+		func(err error) { s.errors = append(s.errors, err) },
+		func(txHash chainhash.Hash) { s.doubleSpends = append(s.doubleSpends, txHash) },
+		func(reorg *headers.Reorg) { s.reorgs = append(s.reorgs, reorg) },
 		s.log,
 	)
 }
@@ -142,8 +161,27 @@ func TestTransactionsSuite(t *testing.T) {
 
 func (s *transactionsSuite) updateAddressHistory(
 	address *addresses.AccountAddress, txs []*blockchainpkg.TxInfo) {
-	s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), txs)
+	s.Require().NoError(s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), txs))
 	s.blockchainMock.CallAllTransactionGetCallbacks()
+	s.Require().Empty(s.errors)
+}
+
+func (s *transactionsSuite) balance() *coin.Balance {
+	balance, err := s.transactions.Balance()
+	s.Require().NoError(err)
+	return balance
+}
+
+func (s *transactionsSuite) spendableOutputs() map[wire.OutPoint]*transactions.SpendableOutput {
+	spendableOutputs, err := s.transactions.SpendableOutputs()
+	s.Require().NoError(err)
+	return spendableOutputs
+}
+
+func (s *transactionsSuite) txInfos(isChange func(blockchainpkg.ScriptHashHex) bool) []*transactions.TxInfo {
+	txInfos, err := s.transactions.Transactions(isChange)
+	s.Require().NoError(err)
+	return txInfos
 }
 
 func newTx(
@@ -185,10 +223,10 @@ func (s *transactionsSuite) TestUpdateAddressHistorySyncStatus() {
 		syncFinished = true
 	}
 	*s.synchronizer = *synchronizer.NewSynchronizer(onSyncStarted, onSyncFinished, s.log)
-	s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
+	s.Require().NoError(s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
 		{TXHash: blockchainpkg.TXHash(tx1.TxHash()), Height: 10},
 		{TXHash: blockchainpkg.TXHash(tx2.TxHash()), Height: 10},
-	})
+	}))
 	require.True(s.T(), syncStarted)
 	require.False(s.T(), syncFinished)
 	s.headersMock.On("HeaderByHeight", 10).Return(nil, nil).Once()
@@ -222,7 +260,7 @@ func (s *transactionsSuite) TestUpdateAddressHistorySingleTxReceive() {
 	})
 	require.Equal(s.T(),
 		newBalance(expectedAmount, 0),
-		s.transactions.Balance(),
+		s.balance(),
 	)
 	utxo := &transactions.SpendableOutput{
 		TxOut:   wire.NewTxOut(int64(expectedAmount), address.PubkeyScript()),
@@ -232,9 +270,9 @@ func (s *transactionsSuite) TestUpdateAddressHistorySingleTxReceive() {
 		map[wire.OutPoint]*transactions.SpendableOutput{
 			{Hash: tx1.TxHash(), Index: 0}: utxo,
 		},
-		s.transactions.SpendableOutputs(),
+		s.spendableOutputs(),
 	)
-	transactions := s.transactions.Transactions(func(blockchainpkg.ScriptHashHex) bool { return false })
+	transactions := s.txInfos(func(blockchainpkg.ScriptHashHex) bool { return false })
 	require.Len(s.T(), transactions, 1)
 	require.Equal(s.T(), tx1, transactions[0].Tx)
 	require.Equal(s.T(), expectedHeight, transactions[0].Height)
@@ -251,17 +289,17 @@ func (s *transactionsSuite) TestUpdateAddressHistoryOppositeOrder() {
 	tx1 := newTx(chainhash.HashH(nil), 0, address, 123)
 	tx2 := newTx(tx1.TxHash(), 0, address2, 123)
 	s.blockchainMock.RegisterTxs(tx1, tx2)
-	s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
+	s.Require().NoError(s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
 		{TXHash: blockchainpkg.TXHash(tx1.TxHash()), Height: 0},
 		{TXHash: blockchainpkg.TXHash(tx2.TxHash()), Height: 0},
-	})
+	}))
 	// Process tx2 (the spend) before tx1 (the funding). This should result in a zero balance, as
 	// the received funds are spent.
 	s.blockchainMock.CallTransactionGetCallbacks(tx2.TxHash())
 	s.blockchainMock.CallTransactionGetCallbacks(tx1.TxHash())
 	require.Equal(s.T(),
 		newBalance(0, 0),
-		s.transactions.Balance(),
+		s.balance(),
 	)
 }
 
@@ -269,7 +307,7 @@ func (s *transactionsSuite) TestUpdateAddressHistoryOppositeOrder() {
 // we own) outputs can be spent.
 func (s *transactionsSuite) TestSpendableOutputs() {
 	// Starts out empty.
-	require.Empty(s.T(), s.transactions.SpendableOutputs())
+	require.Empty(s.T(), s.spendableOutputs())
 	addresses := s.addressChain.EnsureAddresses()
 	address1 := addresses[0]
 	address2 := addresses[1]
@@ -292,7 +330,7 @@ func (s *transactionsSuite) TestSpendableOutputs() {
 		{TXHash: blockchainpkg.TXHash(tx22.TxHash()), Height: 10},
 	})
 
-	spendableOutputs := s.transactions.SpendableOutputs()
+	spendableOutputs := s.spendableOutputs()
 	// Two confirmed txs.
 	require.Len(s.T(), spendableOutputs, 2)
 	require.Contains(s.T(), spendableOutputs, wire.OutPoint{Hash: tx12.TxHash(), Index: 0})
@@ -306,7 +344,7 @@ func (s *transactionsSuite) TestSpendableOutputs() {
 		{TXHash: blockchainpkg.TXHash(tx12.TxHash()), Height: 10},
 		{TXHash: blockchainpkg.TXHash(tx12Spend.TxHash()), Height: 0},
 	})
-	spendableOutputs = s.transactions.SpendableOutputs()
+	spendableOutputs = s.spendableOutputs()
 	require.Len(s.T(), spendableOutputs, 1)
 	require.NotContains(s.T(), spendableOutputs, wire.OutPoint{Hash: tx12.TxHash(), Index: 0})
 	require.Contains(s.T(), spendableOutputs, wire.OutPoint{Hash: tx22.TxHash(), Index: 0})
@@ -319,7 +357,7 @@ func (s *transactionsSuite) TestSpendableOutputs() {
 		{TXHash: blockchainpkg.TXHash(tx22.TxHash()), Height: 10},
 		{TXHash: blockchainpkg.TXHash(tx22Spend.TxHash()), Height: 0},
 	})
-	spendableOutputs = s.transactions.SpendableOutputs()
+	spendableOutputs = s.spendableOutputs()
 	require.Len(s.T(), spendableOutputs, 1)
 	// tx22 spent, not available anymore
 	require.NotContains(s.T(), spendableOutputs, wire.OutPoint{Hash: tx22.TxHash(), Index: 0})
@@ -328,7 +366,7 @@ func (s *transactionsSuite) TestSpendableOutputs() {
 }
 
 func (s *transactionsSuite) TestBalance() {
-	require.Equal(s.T(), newBalance(0, 0), s.transactions.Balance())
+	require.Equal(s.T(), newBalance(0, 0), s.balance())
 	addresses := s.addressChain.EnsureAddresses()
 	address1 := addresses[0]
 	otherAddress := addresses[2]
@@ -345,7 +383,7 @@ func (s *transactionsSuite) TestBalance() {
 	})
 	require.Equal(s.T(),
 		newBalance(0, expectedAmount),
-		s.transactions.Balance())
+		s.balance())
 	// Confirm it, plus another one incoming.
 	s.headersMock.On("HeaderByHeight", 10).Return(nil, nil).Once()
 	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{
@@ -354,7 +392,7 @@ func (s *transactionsSuite) TestBalance() {
 	})
 	require.Equal(s.T(),
 		newBalance(expectedAmount, expectedAmount2),
-		s.transactions.Balance())
+		s.balance())
 	// Spend funds that came from tx1, first unconfirmed. Available balance decreases.
 	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{
 		{TXHash: blockchainpkg.TXHash(tx1.TxHash()), Height: 10},
@@ -363,7 +401,7 @@ func (s *transactionsSuite) TestBalance() {
 	})
 	require.Equal(s.T(),
 		newBalance(0, expectedAmount2),
-		s.transactions.Balance())
+		s.balance())
 	// Confirm it.
 	s.headersMock.On("HeaderByHeight", 10).Return(nil, nil).Once()
 	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{
@@ -373,7 +411,7 @@ func (s *transactionsSuite) TestBalance() {
 	})
 	require.Equal(s.T(),
 		newBalance(0, expectedAmount2),
-		s.transactions.Balance())
+		s.balance())
 	// Spend the unconfirmed incoming tx to an internal address, unconfirmed (can't confirm until
 	// the first one is). The funds are still available as we own the unconfirmed output.
 	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{
@@ -384,7 +422,39 @@ func (s *transactionsSuite) TestBalance() {
 	})
 	require.Equal(s.T(),
 		newBalance(expectedAmount2, 0),
-		s.transactions.Balance())
+		s.balance())
+}
+
+func (s *transactionsSuite) TestFrozenOutputs() {
+	addresses := s.addressChain.EnsureAddresses()
+	address := addresses[0]
+	tx1 := newTx(chainhash.HashH(nil), 0, address, 123)
+	tx2 := newTx(chainhash.HashH(nil), 1, address, 456)
+	s.blockchainMock.RegisterTxs(tx1, tx2)
+	s.headersMock.On("HeaderByHeight", 10).Return(nil, nil)
+	s.updateAddressHistory(address, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(tx1.TxHash()), Height: 10},
+		{TXHash: blockchainpkg.TXHash(tx2.TxHash()), Height: 10},
+	})
+	outPoint := wire.OutPoint{Hash: tx1.TxHash(), Index: 0}
+	require.NoError(s.T(), s.transactions.SetOutputFrozen(outPoint, true))
+	require.Equal(s.T(),
+		coin.NewBalanceWithFrozen(
+			coin.NewAmountFromInt64(456), coin.NewAmountFromInt64(0), coin.NewAmountFromInt64(123)),
+		s.balance())
+	spendableOutputs := s.spendableOutputs()
+	require.True(s.T(), spendableOutputs[outPoint].Frozen)
+	require.False(s.T(), spendableOutputs[wire.OutPoint{Hash: tx2.TxHash(), Index: 0}].Frozen)
+	frozenOutputs, err := s.transactions.FrozenOutputs()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), map[wire.OutPoint]struct{}{outPoint: {}}, frozenOutputs)
+
+	// Unknown outputs can't be frozen.
+	require.Error(s.T(), s.transactions.SetOutputFrozen(wire.OutPoint{Hash: tx1.TxHash(), Index: 1}, true))
+
+	require.NoError(s.T(), s.transactions.SetOutputFrozen(outPoint, false))
+	require.Equal(s.T(), newBalance(579, 0), s.balance())
+	require.False(s.T(), s.spendableOutputs()[outPoint].Frozen)
 }
 
 func (s *transactionsSuite) TestRemoveTransaction() {
@@ -409,7 +479,7 @@ func (s *transactionsSuite) TestRemoveTransaction() {
 	})
 	require.Equal(s.T(),
 		newBalance(2+10+34, 0),
-		s.transactions.Balance())
+		s.balance())
 	// Remove tx3 from the history of address1. It is still referenced by address2, so the index
 	// does not change.
 	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{
@@ -417,9 +487,9 @@ func (s *transactionsSuite) TestRemoveTransaction() {
 	})
 	require.Equal(s.T(),
 		newBalance(2+10+34, 0),
-		s.transactions.Balance())
+		s.balance())
 	require.Len(s.T(),
-		s.transactions.Transactions(func(blockchainpkg.ScriptHashHex) bool { return false }),
+		s.txInfos(func(blockchainpkg.ScriptHashHex) bool { return false }),
 		3)
 	// Remove tx3 from the history of address2. Now it's not referenced anymore and disappears.
 	s.updateAddressHistory(address2, []*blockchainpkg.TxInfo{
@@ -427,9 +497,9 @@ func (s *transactionsSuite) TestRemoveTransaction() {
 	})
 	require.Equal(s.T(),
 		newBalance(12+34, 0),
-		s.transactions.Balance())
+		s.balance())
 	require.Len(s.T(),
-		s.transactions.Transactions(func(blockchainpkg.ScriptHashHex) bool { return false }),
+		s.txInfos(func(blockchainpkg.ScriptHashHex) bool { return false }),
 		2)
 }
 
@@ -439,16 +509,273 @@ func (s *transactionsSuite) TestRemoveTransactionPendingDownload() {
 	address := s.addressChain.EnsureAddresses()[0]
 	tx := newTx(chainhash.HashH(nil), 0, address, 123)
 	s.blockchainMock.RegisterTxs(tx)
-	s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
+	s.Require().NoError(s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
 		{TXHash: blockchainpkg.TXHash(tx.TxHash()), Height: 0},
-	})
+	}))
 	// Callback for processing the tx is not called yet. We remove the tx.
-	s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{})
+	s.Require().NoError(s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{}))
 	// Process the tx now. It should not be indexed anymore.
 	s.blockchainMock.CallAllTransactionGetCallbacks()
 	require.Equal(s.T(),
 		newBalance(0, 0),
-		s.transactions.Balance())
+		s.balance())
 	require.Empty(s.T(),
-		s.transactions.Transactions(func(blockchainpkg.ScriptHashHex) bool { return false }))
+		s.txInfos(func(blockchainpkg.ScriptHashHex) bool { return false }))
+}
+
+// TestUpdateAddressHistoryDuplicateTxs checks that an invalid history returned by the server is
+// rejected without changing the index.
+func (s *transactionsSuite) TestUpdateAddressHistoryDuplicateTxs() {
+	address := s.addressChain.EnsureAddresses()[0]
+	tx := newTx(chainhash.HashH(nil), 0, address, 123)
+	s.blockchainMock.RegisterTxs(tx)
+	err := s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(tx.TxHash()), Height: 0},
+		{TXHash: blockchainpkg.TXHash(tx.TxHash()), Height: 0},
+	})
+	require.Error(s.T(), err)
+	s.blockchainMock.CallAllTransactionGetCallbacks()
+	require.Empty(s.T(),
+		s.txInfos(func(blockchainpkg.ScriptHashHex) bool { return false }))
+}
+
+// TestUpdateAddressHistoryWrongTx checks that a tx returned by the server which does not match the
+// requested tx hash is reported to the error callback instead of being indexed.
+func (s *transactionsSuite) TestUpdateAddressHistoryWrongTx() {
+	address := s.addressChain.EnsureAddresses()[0]
+	tx := newTx(chainhash.HashH(nil), 0, address, 123)
+	otherTx := newTx(chainhash.HashH(nil), 1, address, 456)
+	s.blockchainMock.transactions[tx.TxHash()] = otherTx
+	require.NoError(s.T(), s.transactions.UpdateAddressHistory(address.PubkeyScriptHashHex(), []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(tx.TxHash()), Height: 0},
+	}))
+	s.blockchainMock.CallAllTransactionGetCallbacks()
+	require.Len(s.T(), s.errors, 1)
+	require.Equal(s.T(),
+		newBalance(0, 0),
+		s.balance())
+}
+
+func (s *transactionsSuite) TestTxDetails() {
+	addresses := s.addressChain.EnsureAddresses()
+	address := addresses[0]
+	// address not belonging to the wallet.
+	otherAddress := addresses[1]
+	fundingTx := newTx(chainhash.HashH(nil), 0, address, 1000)
+	// The spending tx signals replaceability and pays 100 sat fee.
+	spendTx := newTx(fundingTx.TxHash(), 0, otherAddress, 900)
+	spendTx.TxIn[0].Sequence = 0
+	spendTx.LockTime = 9
+	s.blockchainMock.RegisterTxs(fundingTx, spendTx)
+	// The funding tx is the only tx in its block, so the merkle root is its hash.
+	header := &wire.BlockHeader{Version: 1, MerkleRoot: fundingTx.TxHash()}
+	s.headersMock.On("HeaderByHeight", 10).Return(header, nil)
+	verified := make(chan struct{})
+	s.blockchainMock.On("GetMerkle", fundingTx.TxHash(), 10, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			defer close(verified)
+			defer args.Get(3).(func())()
+			// Errors are reported to onError.
+			_ = args.Get(2).(func([]blockchainpkg.TXHash, int) error)(nil, 0)
+		}).Return().Once()
+	s.updateAddressHistory(address, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(fundingTx.TxHash()), Height: 10},
+		{TXHash: blockchainpkg.TXHash(spendTx.TxHash()), Height: 0},
+	})
+	// The newly confirmed tx is verified in the background.
+	<-verified
+	s.Require().Empty(s.errors)
+	isChange := func(blockchainpkg.ScriptHashHex) bool { return false }
+
+	details, err := s.transactions.TxDetails(fundingTx.TxHash(), isChange)
+	s.Require().NoError(err)
+	s.Require().Equal(fundingTx, details.Tx)
+	s.Require().Equal(10, details.Height)
+	blockHash := header.BlockHash()
+	s.Require().Equal(&blockHash, details.BlockHash)
+	s.Require().True(details.Verified)
+	s.Require().False(details.RBF())
+	s.Require().Len(details.Inputs, 1)
+	s.Require().Nil(details.Inputs[0].PrevOut)
+	s.Require().Equal(blockchainpkg.ScriptHashHex(""), details.Inputs[0].ScriptHashHex)
+	s.Require().Len(details.Outputs, 1)
+	s.Require().Equal(address.PubkeyScriptHashHex(), details.Outputs[0].ScriptHashHex)
+	s.Require().Equal(address.EncodeAddress(), details.Outputs[0].Address)
+	spendTxHash := spendTx.TxHash()
+	s.Require().Equal(&spendTxHash, details.Outputs[0].SpentBy)
+
+	details, err = s.transactions.TxDetails(spendTx.TxHash(), isChange)
+	s.Require().NoError(err)
+	s.Require().Nil(details.BlockHash)
+	s.Require().False(details.Verified)
+	s.Require().True(details.RBF())
+	s.Require().Equal(uint32(9), details.Tx.LockTime)
+	s.Require().Equal(coin.NewAmountFromInt64(100), *details.Fee())
+	s.Require().Len(details.Inputs, 1)
+	s.Require().Equal(fundingTx.TxOut[0], details.Inputs[0].PrevOut)
+	s.Require().Equal(address.PubkeyScriptHashHex(), details.Inputs[0].ScriptHashHex)
+	s.Require().Equal(address.EncodeAddress(), details.Inputs[0].Address)
+	s.Require().Len(details.Outputs, 1)
+	s.Require().Equal(blockchainpkg.ScriptHashHex(""), details.Outputs[0].ScriptHashHex)
+	s.Require().Nil(details.Outputs[0].SpentBy)
+
+	_, err = s.transactions.TxDetails(chainhash.HashH([]byte("unknown")), isChange)
+	s.Require().Error(err)
+}
+
+// TestDoubleSpend checks that a pending incoming tx which is double-spent is reported, and that it
+// and the txs spending from it are conflicted once the double spend confirms.
+func (s *transactionsSuite) TestDoubleSpend() {
+	addresses := s.addressChain.EnsureAddresses()
+	address1 := addresses[0]
+	address2 := addresses[1]
+	isChange := func(blockchainpkg.ScriptHashHex) bool { return false }
+	// Two payments spending the same external output.
+	payment1 := newTx(chainhash.HashH([]byte("external")), 0, address1, 1000)
+	payment2 := newTx(chainhash.HashH([]byte("external")), 0, address2, 900)
+	// A tx spending the output of payment1.
+	child := newTx(payment1.TxHash(), 0, address1, 800)
+	s.blockchainMock.RegisterTxs(payment1, payment2, child)
+	s.headersMock.On("HeaderByHeight", 10).Return(nil, nil)
+
+	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(payment1.TxHash()), Height: 0},
+		{TXHash: blockchainpkg.TXHash(child.TxHash()), Height: 0},
+	})
+	s.Require().Empty(s.doubleSpends)
+	s.updateAddressHistory(address2, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(payment2.TxHash()), Height: 0},
+	})
+	s.Require().Equal([]chainhash.Hash{payment1.TxHash(), payment2.TxHash()}, s.doubleSpends)
+	// Both payments can still confirm.
+	s.Require().Equal(newBalance(800, 900), s.balance())
+	for _, txInfo := range s.txInfos(isChange) {
+		s.Require().False(txInfo.Conflicted())
+		if txInfo.Tx.TxHash() == payment1.TxHash() {
+			s.Require().Equal([]chainhash.Hash{payment2.TxHash()}, txInfo.Conflicts)
+		}
+	}
+
+	// payment2 confirms, so payment1 and the child can never confirm.
+	s.doubleSpends = nil
+	s.updateAddressHistory(address2, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(payment2.TxHash()), Height: 10},
+	})
+	s.Require().Empty(s.doubleSpends)
+	s.Require().Equal(newBalance(900, 0), s.balance())
+	spendableOutputs := s.spendableOutputs()
+	s.Require().Len(spendableOutputs, 1)
+	s.Require().Contains(spendableOutputs, wire.OutPoint{Hash: payment2.TxHash(), Index: 0})
+	txInfos := s.txInfos(isChange)
+	s.Require().Len(txInfos, 3)
+	for _, txInfo := range txInfos {
+		if txInfo.Tx.TxHash() == payment2.TxHash() {
+			s.Require().False(txInfo.Conflicted())
+		} else {
+			s.Require().True(txInfo.Conflicted())
+			s.Require().Equal(payment2.TxHash(), *txInfo.ReplacedBy)
+		}
+	}
+
+	// Removing payment1 from the history removes the conflict.
+	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{})
+	txInfos = s.txInfos(isChange)
+	s.Require().Len(txInfos, 1)
+	s.Require().Empty(txInfos[0].Conflicts)
+}
+
+// TestDoubleSpendVanished checks that a pending incoming tx is reported as double-spent if it
+// disappears from the history, as the double spend does not have to touch the account.
+func (s *transactionsSuite) TestDoubleSpendVanished() {
+	addresses := s.addressChain.EnsureAddresses()
+	address1 := addresses[0]
+	address2 := addresses[1]
+	payment := newTx(chainhash.HashH([]byte("external")), 0, address1, 1000)
+	// A pending tx sending from the account to itself.
+	selfSend := newTx(payment.TxHash(), 0, address2, 900)
+	s.blockchainMock.RegisterTxs(payment, selfSend)
+
+	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(payment.TxHash()), Height: 0},
+	})
+	s.updateAddressHistory(address2, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(selfSend.TxHash()), Height: 0},
+	})
+	s.updateAddressHistory(address2, []*blockchainpkg.TxInfo{})
+	s.Require().Empty(s.doubleSpends)
+
+	s.updateAddressHistory(address1, []*blockchainpkg.TxInfo{})
+	s.Require().Equal([]chainhash.Hash{payment.TxHash()}, s.doubleSpends)
+	s.Require().Equal(newBalance(0, 0), s.balance())
+}
+
+// TestReorg checks that a verified tx in a block replaced by a reorg is verified again against the
+// header of the new block.
+func (s *transactionsSuite) TestReorg() {
+	address := s.addressChain.EnsureAddresses()[0]
+	fundingTx := newTx(chainhash.HashH(nil), 0, address, 1000)
+	s.blockchainMock.RegisterTxs(fundingTx)
+	isChange := func(blockchainpkg.ScriptHashHex) bool { return false }
+	// The funding tx is the only tx in its block, so the merkle root is its hash.
+	staleHeader := &wire.BlockHeader{Version: 1, MerkleRoot: fundingTx.TxHash()}
+	newHeader := &wire.BlockHeader{
+		Version: 2, MerkleRoot: fundingTx.TxHash(), Timestamp: time.Unix(1500000000, 0)}
+	header := staleHeader
+	s.headersMock.On("HeaderByHeight", 10).Return(
+		func(int) *wire.BlockHeader { return header }, nil)
+	verified := make(chan struct{}, 2)
+	s.blockchainMock.On("GetMerkle", fundingTx.TxHash(), 10, mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			defer func() { verified <- struct{}{} }()
+			defer args.Get(3).(func())()
+			_ = args.Get(2).(func([]blockchainpkg.TXHash, int) error)(nil, 0)
+		}).Return()
+	s.updateAddressHistory(address, []*blockchainpkg.TxInfo{
+		{TXHash: blockchainpkg.TXHash(fundingTx.TxHash()), Height: 10},
+	})
+	<-verified
+	details, err := s.transactions.TxDetails(fundingTx.TxHash(), isChange)
+	s.Require().NoError(err)
+	s.Require().True(details.Verified)
+
+	// Blocks from 9 on are replaced, the funding tx stays at the same height.
+	reorg := &headers.Reorg{ForkHeight: 9, Depth: 3}
+	s.headersMock.On("LastReorg").Return(reorg)
+	s.headersMock.On("TipHeight").Return(16)
+	header = newHeader
+	// The refreshed history confirms the height of the funding tx.
+	s.blockchainMock.On("ScriptHashGetHistory", address.PubkeyScriptHashHex(), mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			defer args.Get(2).(func())()
+			_ = args.Get(1).(func(blockchainpkg.TxHistory) error)(blockchainpkg.TxHistory{
+				{TXHash: blockchainpkg.TXHash(fundingTx.TxHash()), Height: 10},
+			})
+		}).Return().Once()
+	s.onHeadersEvent(headers.EventReorg)
+	<-verified
+	s.Require().Empty(s.errors)
+	s.Require().Equal([]*headers.Reorg{reorg}, s.reorgs)
+	details, err = s.transactions.TxDetails(fundingTx.TxHash(), isChange)
+	s.Require().NoError(err)
+	s.Require().True(details.Verified)
+	blockHash := newHeader.BlockHash()
+	s.Require().Equal(&blockHash, details.BlockHash)
+	s.Require().Equal(newHeader.Timestamp.Unix(), details.Timestamp().Unix())
+	s.Require().Equal(7, s.txInfos(isChange)[0].NumConfirmations())
+
+	// Another reorg moves the funding tx to block 11, which the stored history does not know yet.
+	// The proof is not requested for block 10.
+	refreshed := make(chan struct{})
+	s.blockchainMock.On("ScriptHashGetHistory", address.PubkeyScriptHashHex(), mock.Anything, mock.Anything).Run(
+		func(args mock.Arguments) {
+			defer close(refreshed)
+			defer args.Get(2).(func())()
+			_ = args.Get(1).(func(blockchainpkg.TxHistory) error)(blockchainpkg.TxHistory{
+				{TXHash: blockchainpkg.TXHash(fundingTx.TxHash()), Height: 11},
+			})
+		}).Return().Once()
+	s.onHeadersEvent(headers.EventReorg)
+	<-refreshed
+	s.Require().Empty(s.errors)
+	s.blockchainMock.AssertNumberOfCalls(s.T(), "GetMerkle", 2)
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/blockchain"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 )
 
 func (transactions *Transactions) onHeadersEvent(event headers.Event) {
@@ -28,34 +29,157 @@ func (transactions *Transactions) onHeadersEvent(event headers.Event) {
 		transactions.verifyTransactions()
 	case headers.EventNewTip:
 		done := transactions.synchronizer.IncRequestsCounter()
-		transactions.headersTipHeight = transactions.headers.TipHeight()
+		func() {
+			defer transactions.Lock()()
+			transactions.headersTipHeight = transactions.headers.TipHeight()
+			// The number of confirmations changed.
+			transactions.invalidateTxInfos()
+		}()
 		done()
+	case headers.EventReorg:
+		transactions.processReorg()
+	}
+}
+
+// processReorg marks the transactions in the blocks replaced by the last reorg as unverified and
+// verifies them again against the new headers. The transactions in blocks which are not synced yet
+// are verified when the headers are synced.
+//
+// The verification waits until the pending requests are finished, as the address histories changed
+// by the reorg, which update the heights of the transactions, might not have arrived yet. See
+// verifyTransactions() for how stale heights are handled.
+func (transactions *Transactions) processReorg() {
+	reorg := transactions.headers.LastReorg()
+	if reorg == nil {
+		return
+	}
+	err := func() error {
+		defer transactions.Lock()()
+		if transactions.closed {
+			return nil
+		}
+		dbTx, err := transactions.db.Begin()
+		if err != nil {
+			return errp.WithMessage(err, "Failed to begin transaction")
+		}
+		defer dbTx.Rollback()
+		txHashes, err := dbTx.Transactions()
+		if err != nil {
+			return err
+		}
+		for _, txHash := range txHashes {
+			_, _, height, _, err := dbTx.TxInfo(txHash)
+			if err != nil {
+				return errp.WithMessage(err, "Failed to retrieve tx info")
+			}
+			if height < reorg.ForkHeight {
+				continue
+			}
+			if err := dbTx.MarkTxUnverified(txHash); err != nil {
+				return errp.WithMessage(err, "Failed to mark the transaction as unverified")
+			}
+		}
+		if err := dbTx.Commit(); err != nil {
+			return err
+		}
+		transactions.headersTipHeight = transactions.headers.TipHeight()
+		// The timestamps and the number of confirmations changed.
+		transactions.invalidateTxInfos()
+		return nil
+	}()
+	if err != nil {
+		transactions.onError(err)
+		return
+	}
+	transactions.onReorg(reorg)
+	// Not tracked by verifications, as the pending requests never finish if the connection is
+	// closed before. verifyTransactions() does nothing once the transactions are closed.
+	go func() {
+		transactions.synchronizer.WaitSynchronized()
+		transactions.verifyTransactions()
+	}()
+}
+
+// verifyReorgedTransaction requests the history of an address of the transaction again, and
+// verifies the transaction if it is still at the stored height. A transaction which moved to
+// another height is verified when the changed history is processed (see processTxForAddress()).
+func (transactions *Transactions) verifyReorgedTransaction(txHash chainhash.Hash, tx *unverifiedTx) {
+	done := transactions.synchronizer.IncRequestsCounter()
+	transactions.blockchain.ScriptHashGetHistory(
+		tx.scriptHashHex,
+		func(history blockchain.TxHistory) error {
+			height, err := transactions.txHeight(txHash)
+			if err != nil {
+				transactions.onError(err)
+				return nil
+			}
+			for _, entry := range history {
+				if entry.TXHash.Hash() != txHash || entry.Height != height {
+					continue
+				}
+				if err := transactions.verifyTransaction(txHash, height); err != nil {
+					transactions.onError(err)
+				}
+			}
+			return nil
+		},
+		func() { done() },
+	)
+}
+
+// txHeight returns the stored height of the transaction, or 0 if it is unknown or if the
+// transactions are closed.
+func (transactions *Transactions) txHeight(txHash chainhash.Hash) (int, error) {
+	defer transactions.RLock()()
+	if transactions.closed {
+		return 0, nil
 	}
+	dbTx, err := transactions.db.Begin()
+	if err != nil {
+		return 0, errp.WithMessage(err, "Failed to begin transaction")
+	}
+	defer dbTx.Rollback()
+	_, _, height, _, err := dbTx.TxInfo(txHash)
+	if err != nil {
+		return 0, errp.WithMessage(err, "Failed to retrieve tx info")
+	}
+	return height, nil
+}
+
+// unverifiedTx is a transaction which has not been verified yet.
+type unverifiedTx struct {
+	height int
+	// scriptHashHex is one of the addresses of the transaction.
+	scriptHashHex blockchain.ScriptHashHex
 }
 
-func (transactions *Transactions) unverifiedTransactions() map[chainhash.Hash]int {
+func (transactions *Transactions) unverifiedTransactions() (map[chainhash.Hash]*unverifiedTx, error) {
 	defer transactions.RLock()()
+	if transactions.closed {
+		return map[chainhash.Hash]*unverifiedTx{}, nil
+	}
 	dbTx, err := transactions.db.Begin()
 	if err != nil {
-		// TODO
-		panic(err)
+		return nil, errp.WithMessage(err, "Failed to begin transaction")
 	}
 	defer dbTx.Rollback()
 	unverifiedTransactions, err := dbTx.UnverifiedTransactions()
 	if err != nil {
-		// TODO
-		panic(err)
+		return nil, errp.WithMessage(err, "Failed to retrieve the unverified transactions")
 	}
-	result := map[chainhash.Hash]int{}
+	result := map[chainhash.Hash]*unverifiedTx{}
 	for _, txHash := range unverifiedTransactions {
-		_, _, height, _, err := dbTx.TxInfo(txHash)
+		_, addresses, height, _, err := dbTx.TxInfo(txHash)
 		if err != nil {
-			// TODO
-			panic(err)
+			return nil, errp.WithMessage(err, "Failed to retrieve tx info")
 		}
-		result[txHash] = height
+		tx := &unverifiedTx{height: height}
+		if len(addresses) != 0 {
+			tx.scriptHashHex = blockchain.ScriptHashHex(addresses[0])
+		}
+		result[txHash] = tx
 	}
-	return result
+	return result, nil
 }
 
 func hashMerkleRoot(merkle []blockchain.TXHash, start chainhash.Hash, pos int) chainhash.Hash {
@@ -69,26 +193,46 @@ func hashMerkleRoot(merkle []blockchain.TXHash, start chainhash.Hash, pos int) c
 	return start
 }
 
+// verifyTransactions verifies all unverified transactions. Errors are reported to onError.
+//
+// The stored height of a transaction in a block replaced by the last reorg might be stale, as the
+// changed address history might not have arrived yet. The merkle proof of such a transaction is
+// only requested if a refreshed history confirms the height (see verifyReorgedTransaction()), so
+// it is not requested for a block which does not contain the transaction anymore.
 func (transactions *Transactions) verifyTransactions() {
-	unverifiedTransactions := transactions.unverifiedTransactions()
+	unverifiedTransactions, err := transactions.unverifiedTransactions()
+	if err != nil {
+		transactions.onError(err)
+		return
+	}
 	transactions.log.Debugf("verifying %d transactions", len(unverifiedTransactions))
-	for txHash, height := range unverifiedTransactions {
-		transactions.verifyTransaction(txHash, height)
+	reorg := transactions.headers.LastReorg()
+	for txHash, tx := range unverifiedTransactions {
+		if reorg != nil && tx.height >= reorg.ForkHeight && tx.scriptHashHex != "" {
+			transactions.verifyReorgedTransaction(txHash, tx)
+			continue
+		}
+		if err := transactions.verifyTransaction(txHash, tx.height); err != nil {
+			transactions.onError(err)
+			return
+		}
 	}
 }
 
-func (transactions *Transactions) verifyTransaction(txHash chainhash.Hash, height int) {
+// verifyTransaction fetches the merkle proof of the transaction and marks the transaction as
+// verified if it matches the header at the given height. Errors happening after the proof arrived
+// are reported to onError.
+func (transactions *Transactions) verifyTransaction(txHash chainhash.Hash, height int) error {
 	if height <= 0 {
-		return
+		return nil
 	}
 	header, err := transactions.headers.HeaderByHeight(height)
 	if err != nil {
-		// TODO
-		panic(err)
+		return errp.WithMessage(err, "Failed to retrieve the header")
 	}
 	if header == nil {
 		transactions.log.Warningf("Header not yet synced to %d, couldn't verify tx", height)
-		return
+		return nil
 	}
 	done := transactions.synchronizer.IncRequestsCounter()
 	transactions.blockchain.GetMerkle(
@@ -102,17 +246,31 @@ func (transactions *Transactions) verifyTransaction(txHash chainhash.Hash, heigh
 			}
 			transactions.log.Debugf("Merkle root verification succeeded for %s", txHash)
 
-			defer transactions.Lock()()
-			dbTx, err := transactions.db.Begin()
+			err := func() error {
+				defer transactions.Lock()()
+				if transactions.closed {
+					return nil
+				}
+				dbTx, err := transactions.db.Begin()
+				if err != nil {
+					return errp.WithMessage(err, "Failed to begin transaction")
+				}
+				defer dbTx.Rollback()
+				if err := dbTx.MarkTxVerified(txHash, header.Timestamp); err != nil {
+					return errp.WithMessage(err, "Failed to mark the transaction as verified")
+				}
+				if err := dbTx.Commit(); err != nil {
+					return err
+				}
+				// The timestamp of the transaction is now known.
+				transactions.invalidateTxInfos()
+				return nil
+			}()
 			if err != nil {
-				// TODO
-				panic(err)
-			}
-			defer dbTx.Rollback()
-			if err := dbTx.MarkTxVerified(txHash, header.Timestamp); err != nil {
-				return err
+				transactions.onError(err)
 			}
-			return dbTx.Commit()
+			return nil
 		},
 		func() { done() })
+	return nil
 }
@@ -14,21 +14,28 @@
 
 package coin
 
-// Balance contains the available and incoming balance of an account.
+// Balance contains the available, incoming and frozen balance of an account.
 type Balance struct {
 	available Amount
 	incoming  Amount
+	frozen    Amount
 }
 
-// NewBalance creates a new balance with the given amounts.
+// NewBalance creates a new balance with the given amounts and no frozen coins.
 func NewBalance(available Amount, incoming Amount) *Balance {
+	return NewBalanceWithFrozen(available, incoming, NewAmountFromInt64(0))
+}
+
+// NewBalanceWithFrozen creates a new balance with the given amounts.
+func NewBalanceWithFrozen(available Amount, incoming Amount, frozen Amount) *Balance {
 	return &Balance{
 		available: available,
 		incoming:  incoming,
+		frozen:    frozen,
 	}
 }
 
-// Available returns the sum of all unspent coins in the account.
+// Available returns the sum of all unspent coins in the account, excluding frozen coins.
 // The amounts of unconfirmed outgoing transfers are no longer included (but their change is).
 func (balance *Balance) Available() Amount {
 	return balance.available
@@ -38,3 +45,9 @@ func (balance *Balance) Available() Amount {
 func (balance *Balance) Incoming() Amount {
 	return balance.incoming
 }
+
+// Frozen returns the sum of all unspent coins which are frozen and only spent if selected
+// explicitly.
+func (balance *Balance) Frozen() Amount {
+	return balance.frozen
+}
@@ -51,4 +51,8 @@ type Coin interface {
 
 	// Initialize initializes the coin by connecting to a full node, downloading the headers, etc.
 	Initialize()
+
+	// Close disconnects from the full node and stops all goroutines of the coin. The coin cannot be
+	// initialized again afterwards. It is safe to call it more than once.
+	Close()
 }
@@ -0,0 +1,76 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coin
+
+import (
+	"github.com/digitalbitbox/bitbox-wallet-app/util/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+)
+
+// Labels stores the labels which the user gave to the transactions of an account. They are kept in
+// a file of their own instead of the database of the account, so that they survive a rescan.
+type Labels struct {
+	lock   locker.Locker
+	file   *config.File
+	labels map[string]string
+}
+
+// NewLabels loads the labels from the file with the given name in the given directory, which is
+// encrypted with the key unless it is nil. A missing file holds no labels.
+func NewLabels(dir, name string, key *encryption.Key) (*Labels, error) {
+	labels := &Labels{
+		file:   config.NewEncryptedFile(dir, name, key),
+		labels: map[string]string{},
+	}
+	if labels.file.Exists() {
+		if err := labels.file.ReadJSON(&labels.labels); err != nil {
+			return nil, errp.WithMessage(err, "could not read the transaction labels")
+		}
+	}
+	return labels, nil
+}
+
+// All returns the labels by transaction ID.
+func (labels *Labels) All() map[string]string {
+	defer labels.lock.RLock()()
+	return labels.copy()
+}
+
+func (labels *Labels) copy() map[string]string {
+	result := make(map[string]string, len(labels.labels))
+	for txID, label := range labels.labels {
+		result[txID] = label
+	}
+	return result
+}
+
+// Set sets the label of the transaction with the given ID and stores the labels. An empty label
+// removes it.
+func (labels *Labels) Set(txID string, label string) error {
+	defer labels.lock.Lock()()
+	updated := labels.copy()
+	if label == "" {
+		delete(updated, txID)
+	} else {
+		updated[txID] = label
+	}
+	if err := labels.file.WriteJSON(updated); err != nil {
+		return errp.WithStack(err)
+	}
+	labels.labels = updated
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coin_test
+
+import (
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	dir := test.TstTempDir("labels_test")
+	key := encryption.NewKey([]byte("secret"))
+
+	labels, err := coin.NewLabels(dir, "labels.json", key)
+	require.NoError(t, err)
+	require.Empty(t, labels.All())
+	require.NoError(t, labels.Set("aa01", "Rent"))
+	require.NoError(t, labels.Set("aa02", "Salary"))
+	require.NoError(t, labels.Set("aa02", ""))
+	require.Equal(t, map[string]string{"aa01": "Rent"}, labels.All())
+
+	// The labels are persisted encrypted.
+	labels, err = coin.NewLabels(dir, "labels.json", key)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"aa01": "Rent"}, labels.All())
+	_, err = coin.NewLabels(dir, "labels.json", nil)
+	require.Error(t, err)
+}
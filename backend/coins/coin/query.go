@@ -0,0 +1,213 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// TransactionsQuery selects a page of the transactions of an account. The zero value selects all
+// transactions.
+type TransactionsQuery struct {
+	// Cursor is the position after the last transaction of the previous page, see Cursor(). Empty
+	// for the first page.
+	Cursor string
+	// Limit is the maximum number of transactions of a page. 0 for no limit.
+	Limit int
+
+	// Types restricts the transactions to the given types. All types match if it is empty.
+	Types []TxType
+	// From is the inclusive start of the date range. nil for no lower bound.
+	From *time.Time
+	// To is the exclusive end of the date range. nil for no upper bound.
+	To *time.Time
+	// MinAmount is the inclusive lower bound of the amount. nil for no lower bound.
+	MinAmount *Amount
+	// MaxAmount is the inclusive upper bound of the amount. nil for no upper bound.
+	MaxAmount *Amount
+	// Confirmed restricts the transactions to the confirmed (true) or the unconfirmed (false)
+	// ones. nil for both.
+	Confirmed *bool
+	// Address restricts the transactions to those sending to or receiving on this address.
+	Address string
+	// Search restricts the transactions to those whose ID or one of whose addresses contains
+	// the search string, ignoring the case.
+	Search string
+	// Label restricts the transactions to those whose label contains the label string, ignoring
+	// the case.
+	Label string
+	// Labels are the labels of the transactions by their ID, which the label filter applies to.
+	Labels map[string]string
+}
+
+// TransactionsPage is a page of transactions selected by a TransactionsQuery.
+type TransactionsPage struct {
+	Transactions []Transaction
+	// Next is the cursor of the next page. Empty if this is the last page.
+	Next string
+}
+
+// Matches returns true if the transaction passes all filters of the query.
+func (query *TransactionsQuery) Matches(transaction Transaction) bool {
+	if len(query.Types) != 0 && !containsTxType(query.Types, transaction.Type()) {
+		return false
+	}
+	if query.From != nil || query.To != nil {
+		// Transactions without a timestamp (unconfirmed, or headers not synced yet) are not in
+		// any date range.
+		timestamp := transaction.Timestamp()
+		if timestamp == nil {
+			return false
+		}
+		if query.From != nil && timestamp.Before(*query.From) {
+			return false
+		}
+		if query.To != nil && !timestamp.Before(*query.To) {
+			return false
+		}
+	}
+	amount := transaction.Amount().BigInt()
+	if query.MinAmount != nil && amount.Cmp(query.MinAmount.BigInt()) < 0 {
+		return false
+	}
+	if query.MaxAmount != nil && amount.Cmp(query.MaxAmount.BigInt()) > 0 {
+		return false
+	}
+	if query.Confirmed != nil && (transaction.NumConfirmations() > 0) != *query.Confirmed {
+		return false
+	}
+	if query.Address != "" && !containsString(transaction.Addresses(), query.Address) {
+		return false
+	}
+	if query.Search != "" {
+		search := strings.ToLower(query.Search)
+		found := strings.Contains(strings.ToLower(transaction.ID()), search)
+		for _, address := range transaction.Addresses() {
+			found = found || strings.Contains(strings.ToLower(address), search)
+		}
+		if !found {
+			return false
+		}
+	}
+	if query.Label != "" && !strings.Contains(
+		strings.ToLower(query.Labels[transaction.ID()]), strings.ToLower(query.Label)) {
+		return false
+	}
+	return true
+}
+
+// Cursor returns the position after the transaction, as "<height>:<ID>" with the height 0 for
+// unconfirmed transactions. It stays valid when the transaction disappears, e.g. when it is
+// replaced.
+func Cursor(transaction Transaction) string {
+	return fmt.Sprintf("%d:%s", transaction.BlockHeight(), transaction.ID())
+}
+
+// transactionKey is the position of a transaction in the order expected by Apply.
+type transactionKey struct {
+	height int
+	id     string
+}
+
+func newTransactionKey(transaction Transaction) transactionKey {
+	return transactionKey{height: transaction.BlockHeight(), id: transaction.ID()}
+}
+
+func parseCursor(cursor string) (transactionKey, error) {
+	parts := strings.SplitN(cursor, ":", 2)
+	if len(parts) != 2 {
+		return transactionKey{}, errp.Newf("invalid cursor %q", cursor)
+	}
+	height, err := strconv.Atoi(parts[0])
+	if err != nil || height < 0 {
+		return transactionKey{}, errp.Newf("invalid cursor %q", cursor)
+	}
+	return transactionKey{height: height, id: parts[1]}, nil
+}
+
+// before returns whether the transaction of the key comes before the other one, the newest first:
+// the unconfirmed transactions, then the confirmed ones by descending height, and transactions
+// with the same height by descending ID.
+func (key transactionKey) before(other transactionKey) bool {
+	rank := func(height int) int {
+		if height <= 0 {
+			return math.MaxInt64
+		}
+		return height
+	}
+	if rank(key.height) != rank(other.height) {
+		return rank(key.height) > rank(other.height)
+	}
+	return key.id > other.id
+}
+
+// SortTransactions sorts the transactions in the order expected by Apply, the newest first.
+func SortTransactions(transactions []Transaction) {
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return newTransactionKey(transactions[i]).before(newTransactionKey(transactions[j]))
+	})
+}
+
+// Apply selects the page of the given transactions, which have to be sorted like
+// SortTransactions does. The transactions after the cursor are found by a binary search, so the
+// cursor stays valid if the transaction it was taken from is gone.
+func (query *TransactionsQuery) Apply(transactions []Transaction) (*TransactionsPage, error) {
+	if query.Cursor != "" {
+		cursor, err := parseCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		transactions = transactions[sort.Search(len(transactions), func(index int) bool {
+			return cursor.before(newTransactionKey(transactions[index]))
+		}):]
+	}
+	page := &TransactionsPage{Transactions: []Transaction{}}
+	for _, transaction := range transactions {
+		if !query.Matches(transaction) {
+			continue
+		}
+		if query.Limit > 0 && len(page.Transactions) == query.Limit {
+			page.Next = Cursor(page.Transactions[len(page.Transactions)-1])
+			break
+		}
+		page.Transactions = append(page.Transactions, transaction)
+	}
+	return page, nil
+}
+
+func containsTxType(types []TxType, txType TxType) bool {
+	for _, candidate := range types {
+		if candidate == txType {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
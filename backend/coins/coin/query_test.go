@@ -0,0 +1,150 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/stretchr/testify/require"
+)
+
+type transaction struct {
+	id               string
+	txType           coin.TxType
+	amount           int64
+	timestamp        *time.Time
+	numConfirmations int
+	height           int
+	addresses        []string
+}
+
+func (tx *transaction) Fee() *coin.Amount     { return nil }
+func (tx *transaction) Timestamp() *time.Time { return tx.timestamp }
+func (tx *transaction) ID() string            { return tx.id }
+func (tx *transaction) NumConfirmations() int { return tx.numConfirmations }
+func (tx *transaction) BlockHeight() int      { return tx.height }
+func (tx *transaction) Type() coin.TxType     { return tx.txType }
+func (tx *transaction) Amount() coin.Amount   { return coin.NewAmountFromInt64(tx.amount) }
+func (tx *transaction) Addresses() []string   { return tx.addresses }
+
+func date(day int) *time.Time {
+	t := time.Date(2018, 1, day, 12, 0, 0, 0, time.UTC)
+	return &t
+}
+
+func ids(page *coin.TransactionsPage) []string {
+	result := []string{}
+	for _, tx := range page.Transactions {
+		result = append(result, tx.ID())
+	}
+	return result
+}
+
+var testTransactions = []coin.Transaction{
+	&transaction{id: "aa01", txType: coin.TxTypeReceive, amount: 100, addresses: []string{"addr1"}},
+	&transaction{id: "aa02", txType: coin.TxTypeSend, amount: 200, timestamp: date(3),
+		numConfirmations: 1, height: 100, addresses: []string{"addr2", "Addr3"}},
+	&transaction{id: "bb03", txType: coin.TxTypeSendSelf, amount: 300, timestamp: date(2),
+		numConfirmations: 2, height: 99, addresses: []string{"addr1"}},
+	&transaction{id: "bb04", txType: coin.TxTypeReceive, amount: 400, timestamp: date(1),
+		numConfirmations: 3, height: 98, addresses: []string{"addr4"}},
+}
+
+var testLabels = map[string]string{"aa02": "Rent", "bb04": "Salary March"}
+
+func TestTransactionsQueryFilters(t *testing.T) {
+	confirmed := true
+	unconfirmed := false
+	minAmount := coin.NewAmountFromInt64(200)
+	maxAmount := coin.NewAmountFromInt64(300)
+	for _, test := range []struct {
+		name     string
+		query    coin.TransactionsQuery
+		expected []string
+	}{
+		{"all", coin.TransactionsQuery{}, []string{"aa01", "aa02", "bb03", "bb04"}},
+		{"type", coin.TransactionsQuery{Types: []coin.TxType{coin.TxTypeReceive, coin.TxTypeSendSelf}},
+			[]string{"aa01", "bb03", "bb04"}},
+		{"from", coin.TransactionsQuery{From: date(2)}, []string{"aa02", "bb03"}},
+		{"to", coin.TransactionsQuery{To: date(2)}, []string{"bb04"}},
+		{"amount", coin.TransactionsQuery{MinAmount: &minAmount, MaxAmount: &maxAmount},
+			[]string{"aa02", "bb03"}},
+		{"confirmed", coin.TransactionsQuery{Confirmed: &confirmed}, []string{"aa02", "bb03", "bb04"}},
+		{"unconfirmed", coin.TransactionsQuery{Confirmed: &unconfirmed}, []string{"aa01"}},
+		{"address", coin.TransactionsQuery{Address: "addr1"}, []string{"aa01", "bb03"}},
+		{"search id", coin.TransactionsQuery{Search: "BB"}, []string{"bb03", "bb04"}},
+		{"search address", coin.TransactionsQuery{Search: "addr3"}, []string{"aa02"}},
+		{"combined", coin.TransactionsQuery{Search: "addr1", Confirmed: &confirmed}, []string{"bb03"}},
+		{"label", coin.TransactionsQuery{Label: "salary", Labels: testLabels}, []string{"bb04"}},
+		{"label missing", coin.TransactionsQuery{Label: "rent"}, []string{}},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			page, err := test.query.Apply(testTransactions)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, ids(page))
+			require.Empty(t, page.Next)
+		})
+	}
+}
+
+func TestTransactionsQueryPagination(t *testing.T) {
+	query := coin.TransactionsQuery{Limit: 2}
+	page, err := query.Apply(testTransactions)
+	require.NoError(t, err)
+	require.Equal(t, []string{"aa01", "aa02"}, ids(page))
+	require.Equal(t, "100:aa02", page.Next)
+
+	query.Cursor = page.Next
+	page, err = query.Apply(testTransactions)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bb03", "bb04"}, ids(page))
+	require.Empty(t, page.Next)
+
+	// The filters apply before the limit.
+	query = coin.TransactionsQuery{Limit: 1, Types: []coin.TxType{coin.TxTypeReceive}}
+	page, err = query.Apply(testTransactions)
+	require.NoError(t, err)
+	require.Equal(t, []string{"aa01"}, ids(page))
+	require.Equal(t, "0:aa01", page.Next)
+	query.Cursor = page.Next
+	page, err = query.Apply(testTransactions)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bb04"}, ids(page))
+	require.Empty(t, page.Next)
+
+	// The cursor stays valid if its transaction is gone.
+	page, err = (&coin.TransactionsQuery{Cursor: "99:cc05"}).Apply(testTransactions)
+	require.NoError(t, err)
+	require.Equal(t, []string{"bb03", "bb04"}, ids(page))
+	page, err = (&coin.TransactionsQuery{Cursor: "0:a"}).Apply(testTransactions)
+	require.NoError(t, err)
+	require.Equal(t, []string{"aa02", "bb03", "bb04"}, ids(page))
+
+	for _, cursor := range []string{"cc05", "x:cc05", "-1:cc05"} {
+		_, err = (&coin.TransactionsQuery{Cursor: cursor}).Apply(testTransactions)
+		require.Error(t, err, cursor)
+	}
+}
+
+func TestSortTransactions(t *testing.T) {
+	transactions := []coin.Transaction{
+		testTransactions[3], testTransactions[1], testTransactions[0], testTransactions[2],
+	}
+	coin.SortTransactions(transactions)
+	require.Equal(t, testTransactions, transactions)
+}
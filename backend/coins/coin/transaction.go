@@ -43,6 +43,9 @@ type Transaction interface {
 	// NumConfirmations is the number of confirmations. 0 for unconfirmed.
 	NumConfirmations() int
 
+	// BlockHeight is the height of the block which confirms the tx. 0 for unconfirmed.
+	BlockHeight() int
+
 	// Type returns the type of the transaction.
 	Type() TxType
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/big"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
@@ -12,11 +13,13 @@ import (
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/headers"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/synchronizer"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/eth/db"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/ethereum/go-ethereum/common"
@@ -38,9 +41,11 @@ type Account struct {
 	synchronizer            *synchronizer.Synchronizer
 	coin                    *Coin
 	dbFolder                string
+	dbKey                   *encryption.Key
 	code                    string
 	name                    string
 	db                      db.Interface
+	labels                  *coin.Labels
 	getSigningConfiguration func() (*signing.Configuration, error)
 	signingConfiguration    *signing.Configuration
 	keystores               keystore.Keystores
@@ -51,6 +56,11 @@ type Account struct {
 	// enqueueUpdateCh is used to invoke an account update outside of the regular poll update
 	// interval.
 	enqueueUpdateCh chan struct{}
+	// ctx is cancelled by Close(), which stops the polling.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	polling   sync.WaitGroup
+	closeOnce sync.Once
 
 	address     Address
 	balance     coin.Amount
@@ -62,10 +72,11 @@ type Account struct {
 	log *logrus.Entry
 }
 
-// NewAccount creates a new account.
+// NewAccount creates a new account. Its database is encrypted with dbKey, unless it is nil.
 func NewAccount(
 	accountCoin *Coin,
 	dbFolder string,
+	dbKey *encryption.Key,
 	code string,
 	name string,
 	getSigningConfiguration func() (*signing.Configuration, error),
@@ -73,9 +84,11 @@ func NewAccount(
 	onEvent func(Event),
 	log *logrus.Entry,
 ) *Account {
+	ctx, cancel := context.WithCancel(context.Background())
 	account := &Account{
 		coin:                    accountCoin,
 		dbFolder:                dbFolder,
+		dbKey:                   dbKey,
 		code:                    code,
 		name:                    name,
 		getSigningConfiguration: getSigningConfiguration,
@@ -86,6 +99,8 @@ func NewAccount(
 
 		initialized:     false,
 		enqueueUpdateCh: make(chan struct{}),
+		ctx:             ctx,
+		cancel:          cancel,
 
 		log: log,
 	}
@@ -127,6 +142,9 @@ func (account *Account) Coin() coin.Coin {
 func (account *Account) Initialize() error {
 	alreadyInitialized, err := func() (bool, error) {
 		defer account.Lock()()
+		if account.ctx.Err() != nil {
+			return false, errp.New("the account is closed")
+		}
 		if account.signingConfiguration != nil {
 			// Already initialized.
 			return true, nil
@@ -148,30 +166,45 @@ func (account *Account) Initialize() error {
 
 	dbName := fmt.Sprintf("account-%s-%s.db", account.signingConfiguration.Hash(), account.code)
 	account.log.Debugf("Opening the database '%s' to persist the transactions.", dbName)
-	db, err := db.NewDB(path.Join(account.dbFolder, dbName))
+	db, err := db.NewDB(path.Join(account.dbFolder, dbName), account.dbKey)
 	if err != nil {
 		return err
 	}
 	account.db = db
 	account.log.Debugf("Opened the database '%s' to persist the transactions.", dbName)
+	labels, err := coin.NewLabels(account.dbFolder,
+		fmt.Sprintf("labels-%s-%s.json", account.signingConfiguration.Hash(), account.code),
+		account.dbKey)
+	if err != nil {
+		return err
+	}
+	account.labels = labels
 
 	account.address = Address{
 		Address: crypto.PubkeyToAddress(*account.signingConfiguration.PublicKeys()[0].ToECDSA()),
 	}
 	account.coin.Initialize()
+	account.polling.Add(1)
 	go account.poll()
 	return nil
 }
 
 func (account *Account) poll() {
+	defer account.polling.Done()
 	timer := time.After(0)
 	for {
 		select {
+		case <-account.ctx.Done():
+			return
 		case <-timer:
 		case <-account.enqueueUpdateCh:
 			account.log.Info("extraordinary account update invoked")
 		}
-		if err := account.update(); err != nil {
+		err := account.update()
+		if account.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
 			account.log.WithError(err).Error("error updating account")
 			if !account.offline {
 				account.offline = true
@@ -222,7 +255,7 @@ func (account *Account) pendingOutgoingTransactions(confirmedTxs []coin.Transact
 func (account *Account) update() error {
 	defer account.synchronizer.IncRequestsCounter()()
 
-	header, err := account.coin.client.HeaderByNumber(context.TODO(), nil)
+	header, err := account.coin.client.HeaderByNumber(account.ctx, nil)
 	if err != nil {
 		return errp.WithStack(err)
 	}
@@ -243,7 +276,7 @@ func (account *Account) update() error {
 
 	// Nonce to be used for the next tx, fetched from the ETH node. It might be out of date due to
 	// latency, which is addressed below by using the locally stored nonce.
-	nodeNonce, err := account.coin.client.PendingNonceAt(context.TODO(), account.address.Address)
+	nodeNonce, err := account.coin.client.PendingNonceAt(account.ctx, account.address.Address)
 	if err != nil {
 		return err
 	}
@@ -257,9 +290,11 @@ func (account *Account) update() error {
 			account.nextNonce = localNonce
 		}
 	}
-	account.transactions = append(pendingOutgoingTransactions, confirmedTansactions...)
+	transactions := append(pendingOutgoingTransactions, confirmedTansactions...)
+	coin.SortTransactions(transactions)
+	account.transactions = transactions
 
-	balance, err := account.coin.client.BalanceAt(context.TODO(),
+	balance, err := account.coin.client.BalanceAt(account.ctx,
 		account.address.Address, account.blockNumber)
 	if err != nil {
 		return errp.WithStack(err)
@@ -279,20 +314,39 @@ func (account *Account) Offline() bool {
 	return account.offline
 }
 
-// Close implements btc.Interface.
+// Close implements btc.Interface. It stops the polling and closes the database.
 func (account *Account) Close() {
-
+	account.closeOnce.Do(func() {
+		account.cancel()
+		account.polling.Wait()
+		if account.db != nil {
+			if err := account.db.Close(); err != nil {
+				account.log.WithError(err).Error("couldn't close db")
+			}
+		}
+		account.log.Info("Closed account")
+	})
 }
 
 // Transactions implements btc.Interface.
-func (account *Account) Transactions() []coin.Transaction {
-	return account.transactions
+func (account *Account) Transactions() ([]coin.Transaction, error) {
+	return account.transactions, nil
+}
+
+// TransactionLabels implements btc.Interface.
+func (account *Account) TransactionLabels() map[string]string {
+	return account.labels.All()
+}
+
+// SetTransactionLabel implements btc.Interface.
+func (account *Account) SetTransactionLabel(txID string, label string) error {
+	return account.labels.Set(txID, label)
 }
 
 // Balance implements btc.Interface.
-func (account *Account) Balance() *coin.Balance {
+func (account *Account) Balance() (*coin.Balance, error) {
 	account.synchronizer.WaitSynchronized()
-	return coin.NewBalance(account.balance, coin.NewAmountFromInt64(0))
+	return coin.NewBalance(account.balance, coin.NewAmountFromInt64(0)), nil
 }
 
 // TxProposal holds all info needed to create and sign a transacstion.
@@ -409,7 +463,10 @@ func (account *Account) SendTx(
 	if err := account.storePendingOutgoingTransaction(txProposal.Tx); err != nil {
 		return err
 	}
-	account.enqueueUpdateCh <- struct{}{}
+	select {
+	case account.enqueueUpdateCh <- struct{}{}:
+	case <-account.ctx.Done():
+	}
 	return nil
 }
 
@@ -457,6 +514,36 @@ func (account *Account) Keystores() keystore.Keystores {
 }
 
 // SpendableOutputs implements btc.Interface.
-func (account *Account) SpendableOutputs() []*btc.SpendableOutput {
+func (account *Account) SpendableOutputs() ([]*btc.SpendableOutput, error) {
+	return nil, nil
+}
+
+// TransactionDetails implements btc.Interface.
+func (account *Account) TransactionDetails(string) (*btc.TxDetails, error) {
+	return nil, errp.New("transaction details are not supported for Ethereum accounts")
+}
+
+// Rescan implements btc.Interface.
+func (account *Account) Rescan(*btc.GapLimits) error {
+	return errp.New("rescanning is not supported for Ethereum accounts")
+}
+
+// RescanProgress implements btc.Interface.
+func (account *Account) RescanProgress() (bool, int, int) {
+	return false, 0, 0
+}
+
+// Error implements btc.Interface. Synchronization errors are not tracked for Ethereum accounts.
+func (account *Account) Error() error {
+	return nil
+}
+
+// LastReorg implements btc.Interface. Reorgs are not tracked for Ethereum accounts.
+func (account *Account) LastReorg() *headers.Reorg {
 	return nil
 }
+
+// SetOutputFrozen implements btc.Interface.
+func (account *Account) SetOutputFrozen(wire.OutPoint, bool) error {
+	return errp.New("Ethereum accounts have no outputs to freeze")
+}
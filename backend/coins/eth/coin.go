@@ -18,6 +18,7 @@ import (
 type Coin struct {
 	observable.Implementation
 	initOnce              sync.Once
+	closeOnce             sync.Once
 	client                *ethclient.Client
 	code                  string
 	net                   *params.ChainConfig
@@ -67,6 +68,17 @@ func (coin *Coin) Initialize() {
 	})
 }
 
+// Close implements coin.Coin.
+func (coin *Coin) Close() {
+	coin.closeOnce.Do(func() {
+		// Prevents a later initialization.
+		coin.initOnce.Do(func() {})
+		if coin.client != nil {
+			coin.client.Close()
+		}
+	})
+}
+
 // Code implements coin.Coin.
 func (coin *Coin) Code() string {
 	return coin.code
@@ -19,6 +19,8 @@ import (
 	"sort"
 
 	bbolt "github.com/coreos/bbolt"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/dbschema"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -30,16 +32,26 @@ const (
 
 // DB is a bbolt key/value database.
 type DB struct {
-	db *bbolt.DB
+	db  *bbolt.DB
+	key *encryption.Key
 }
 
-// NewDB creates/opens a new db.
-func NewDB(filename string) (*DB, error) {
-	db, err := bbolt.Open(filename, 0600, nil)
+// migrations are the schema migrations of the database, see dbschema.Migrate. The schema has not
+// changed since the version was introduced.
+var migrations = []dbschema.Migration{}
+
+// NewDB creates/opens a new db. The entries are encrypted with the key, unless it is nil. The
+// database is migrated to the current schema version.
+func NewDB(filename string, key *encryption.Key) (*DB, error) {
+	db, err := encryption.OpenDB(filename, key)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	if err := dbschema.Migrate(db, key, migrations); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &DB{db: db, key: key}, nil
 }
 
 // Begin implements transactions.Begin.
@@ -48,13 +60,14 @@ func (db *DB) Begin() (TxInterface, error) {
 	if err != nil {
 		return nil, err
 	}
-	bucketPendingOutgoingTransactions, err := tx.CreateBucketIfNotExists([]byte(bucketPendingOutgoingTransactions))
+	pendingOutgoingTransactions, err := tx.CreateBucketIfNotExists([]byte(bucketPendingOutgoingTransactions))
 	if err != nil {
 		return nil, err
 	}
 	return &Tx{
-		tx:                                tx,
-		bucketPendingOutgoingTransactions: bucketPendingOutgoingTransactions,
+		tx: tx,
+		bucketPendingOutgoingTransactions: encryption.NewBucket(
+			pendingOutgoingTransactions, bucketPendingOutgoingTransactions, db.key),
 	}, nil
 }
 
@@ -67,7 +80,7 @@ func (db *DB) Close() error {
 type Tx struct {
 	tx *bbolt.Tx
 
-	bucketPendingOutgoingTransactions *bbolt.Bucket
+	bucketPendingOutgoingTransactions *encryption.Bucket
 }
 
 // Rollback implements DBTxInterface.
@@ -99,16 +112,19 @@ func (txs byNonce) Swap(i, j int)      { txs[i], txs[j] = txs[j], txs[i] }
 // PendingOutgoingTransactions implements DBTxInterface.
 func (tx *Tx) PendingOutgoingTransactions() ([]*types.Transaction, error) {
 	transactions := []*types.Transaction{}
-	cursor := tx.bucketPendingOutgoingTransactions.Cursor()
-	for txHash, txSerialized := cursor.First(); txSerialized != nil; txHash, txSerialized = cursor.Next() {
+	err := tx.bucketPendingOutgoingTransactions.ForEach(func(txHash []byte, txSerialized []byte) error {
 		transaction := new(types.Transaction)
 		if err := rlp.DecodeBytes(txSerialized, transaction); err != nil {
-			return nil, errp.WithStack(err)
+			return errp.WithStack(err)
 		}
 		if !bytes.Equal(transaction.Hash().Bytes(), txHash) {
-			return nil, errp.Newf("deserialized tx hash does not match serialized tx hash")
+			return errp.Newf("deserialized tx hash does not match serialized tx hash")
 		}
 		transactions = append(transactions, transaction)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	sort.Sort(sort.Reverse(byNonce(transactions)))
 	return transactions, nil
@@ -91,6 +91,7 @@ type jsonTransaction struct {
 	Hash          common.Hash    `json:"hash"`
 	Timestamp     timestamp      `json:"timeStamp"`
 	Confirmations jsonBigInt     `json:"confirmations"`
+	BlockNumber   jsonBigInt     `json:"blockNumber"`
 	From          common.Address `json:"from"`
 	To            common.Address `json:"to"`
 	Value         jsonBigInt     `json:"value"`
@@ -133,6 +134,11 @@ func (tx *Transaction) NumConfirmations() int {
 	return int(tx.jsonTransaction.Confirmations.BigInt().Int64())
 }
 
+// BlockHeight implements coin.Transaction.
+func (tx *Transaction) BlockHeight() int {
+	return int(tx.jsonTransaction.BlockNumber.BigInt().Int64())
+}
+
 // Type implements coin.Transaction.
 func (tx *Transaction) Type() coin.TxType {
 	return tx.txType
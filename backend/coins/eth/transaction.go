@@ -53,6 +53,11 @@ func (tx wrappedTransaction) NumConfirmations() int {
 	return 0
 }
 
+// BlockHeight implements coin.Transaction.
+func (tx wrappedTransaction) BlockHeight() int {
+	return 0
+}
+
 // Type implements coin.Transaction.
 func (tx wrappedTransaction) Type() coin.TxType {
 	return coin.TxTypeSend
@@ -0,0 +1,289 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// Account is an entry of the persisted account registry.
+type Account struct {
+	// Code identifies the account in databases, apis, etc. It must be unique.
+	Code     string `json:"code"`
+	CoinCode string `json:"coinCode"`
+	// ScriptType is one of the signing.ScriptType values. Unused for Ethereum accounts.
+	ScriptType   string `json:"scriptType"`
+	AccountIndex uint32 `json:"accountIndex"`
+	Keypath      string `json:"keypath"`
+	Name         string `json:"name"`
+	// Hidden accounts are kept in the registry, but not loaded.
+	Hidden bool `json:"hidden"`
+	// ExtendedPublicKey is set for watch-only accounts, which are not derived from a keystore.
+	ExtendedPublicKey string `json:"extendedPublicKey,omitempty"`
+	// Keystore is the identifier of the keystore the account belongs to (see
+	// keystore.Keystore.Identifier()). Accounts without it are loaded for every keystore.
+	Keystore string `json:"keystore,omitempty"`
+	// GapLimit and ChangeGapLimit are the numbers of unused addresses scanned at the end of the
+	// receive and change address chains. Zero selects the default.
+	GapLimit       int `json:"gapLimit,omitempty"`
+	ChangeGapLimit int `json:"changeGapLimit,omitempty"`
+}
+
+// maxGapLimit limits the configurable gap limits, as every address is subscribed at the server.
+const maxGapLimit = 1000
+
+func (account *Account) validate() error {
+	if account.Code == "" {
+		return errp.New("the account code must not be empty")
+	}
+	for _, limit := range []int{account.GapLimit, account.ChangeGapLimit} {
+		if limit < 0 || limit > maxGapLimit {
+			return errp.Newf("gap limits must be between 0 and %d", maxGapLimit)
+		}
+	}
+	return nil
+}
+
+// WatchOnly returns true if the account is not derived from a keystore.
+func (account *Account) WatchOnly() bool {
+	return account.ExtendedPublicKey != ""
+}
+
+// ForKeystore returns true if the account is loaded for the keystore with the given identifier.
+func (account *Account) ForKeystore(identifier string) bool {
+	return !account.WatchOnly() && (account.Keystore == "" || account.Keystore == identifier)
+}
+
+var purposes = map[string]uint32{
+	"p2pkh":       44,
+	"p2wpkh-p2sh": 49,
+	"p2wpkh":      84,
+}
+
+var coinTypes = map[string]uint32{
+	"btc":  0,
+	"tbtc": 1,
+	"rbtc": 1,
+	"ltc":  2,
+	"tltc": 1,
+	"eth":  60,
+	"teth": 1,
+}
+
+// IsEthereum returns true if the coin code belongs to an Ethereum coin.
+func IsEthereum(coinCode string) bool {
+	return coinCode == "eth" || coinCode == "teth"
+}
+
+// AccountKeypath returns the BIP44 style keypath of an account. For Ethereum, the account index
+// selects the address.
+func AccountKeypath(coinCode string, scriptType string, accountIndex uint32) (string, error) {
+	coinType, ok := coinTypes[coinCode]
+	if !ok {
+		return "", errp.Newf("unknown coin %s", coinCode)
+	}
+	if IsEthereum(coinCode) {
+		return fmt.Sprintf("m/44'/%d'/0'/0/%d", coinType, accountIndex), nil
+	}
+	purpose, ok := purposes[scriptType]
+	if !ok {
+		return "", errp.Newf("unknown script type %s", scriptType)
+	}
+	return fmt.Sprintf("m/%d'/%d'/%d'", purpose, coinType, accountIndex), nil
+}
+
+// AccountCode returns the default code of an account. The first account of a script type keeps the
+// code used before the account registry existed, so that the cached data can be reused.
+func AccountCode(coinCode string, scriptType string, accountIndex uint32) string {
+	code := coinCode
+	if !IsEthereum(coinCode) {
+		code = fmt.Sprintf("%s-%s", coinCode, scriptType)
+	}
+	if accountIndex == 0 {
+		return code
+	}
+	return fmt.Sprintf("%s-%d", code, accountIndex)
+}
+
+// NewAccount creates a registry entry for the account with the given index and the default code
+// and keypath.
+func NewAccount(coinCode string, scriptType string, accountIndex uint32, name string) (*Account, error) {
+	if IsEthereum(coinCode) {
+		scriptType = ""
+	}
+	keypath, err := AccountKeypath(coinCode, scriptType, accountIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{
+		Code:         AccountCode(coinCode, scriptType, accountIndex),
+		CoinCode:     coinCode,
+		ScriptType:   scriptType,
+		AccountIndex: accountIndex,
+		Keypath:      keypath,
+		Name:         name,
+	}, nil
+}
+
+// legacyToggles returns the per-script-type active settings used before the account registry,
+// keyed by the codes of the accounts they applied to.
+func (backend *Backend) legacyToggles() map[string]bool {
+	return map[string]bool{
+		"btc-p2wpkh-p2sh":  backend.BitcoinP2WPKHP2SHActive,
+		"btc-p2wpkh":       backend.BitcoinP2WPKHActive,
+		"btc-p2pkh":        backend.BitcoinP2PKHActive,
+		"tbtc-p2wpkh-p2sh": backend.BitcoinP2WPKHP2SHActive,
+		"tbtc-p2wpkh":      backend.BitcoinP2WPKHActive,
+		"tbtc-p2pkh":       backend.BitcoinP2PKHActive,
+		"rbtc-p2wpkh-p2sh": backend.BitcoinP2WPKHP2SHActive,
+		"rbtc-p2pkh":       backend.BitcoinP2PKHActive,
+		"ltc-p2wpkh-p2sh":  backend.LitecoinP2WPKHP2SHActive,
+		"ltc-p2wpkh":       backend.LitecoinP2WPKHActive,
+		"tltc-p2wpkh-p2sh": backend.LitecoinP2WPKHP2SHActive,
+		"tltc-p2wpkh":      backend.LitecoinP2WPKHActive,
+		"eth":              backend.EthereumActive,
+		"teth":             backend.EthereumActive,
+	}
+}
+
+// defaultAccounts returns the accounts which used to be hardcoded, hidden according to the
+// per-script-type settings.
+func (backend *Backend) defaultAccounts() ([]Account, error) {
+	toggles := backend.legacyToggles()
+	accounts := []Account{}
+	for _, entry := range []struct {
+		coinCode   string
+		scriptType string
+		name       string
+	}{
+		{"btc", "p2wpkh-p2sh", "Bitcoin"},
+		{"btc", "p2wpkh", "Bitcoin: bech32"},
+		{"btc", "p2pkh", "Bitcoin Legacy"},
+		{"ltc", "p2wpkh-p2sh", "Litecoin"},
+		{"ltc", "p2wpkh", "Litecoin: bech32"},
+		{"eth", "", "Ethereum"},
+		{"tbtc", "p2wpkh-p2sh", "Bitcoin Testnet"},
+		{"tbtc", "p2wpkh", "Bitcoin Testnet: bech32"},
+		{"tbtc", "p2pkh", "Bitcoin Testnet Legacy"},
+		{"tltc", "p2wpkh-p2sh", "Litecoin Testnet"},
+		{"tltc", "p2wpkh", "Litecoin Testnet: bech32"},
+		{"teth", "", "Ethereum Rinkeby"},
+		{"rbtc", "p2pkh", "Bitcoin Regtest Legacy"},
+		{"rbtc", "p2wpkh-p2sh", "Bitcoin Regtest Segwit"},
+	} {
+		account, err := NewAccount(entry.coinCode, entry.scriptType, 0, entry.name)
+		if err != nil {
+			return nil, err
+		}
+		account.Hidden = !toggles[account.Code]
+		accounts = append(accounts, *account)
+	}
+	return accounts, nil
+}
+
+// applyLegacyToggles keeps the per-script-type settings working: if one of them changed between
+// the old and the new config, the hidden flag of the corresponding default accounts is updated.
+func (backend *Backend) applyLegacyToggles(previous *Backend) {
+	previousToggles := previous.legacyToggles()
+	for code, active := range backend.legacyToggles() {
+		if previousToggles[code] == active {
+			continue
+		}
+		if account := backend.Account(code); account != nil {
+			account.Hidden = !active
+		}
+	}
+}
+
+// Account returns the registry entry with the given code, or nil if there is none.
+func (backend *Backend) Account(code string) *Account {
+	for index := range backend.Accounts {
+		if backend.Accounts[index].Code == code {
+			return &backend.Accounts[index]
+		}
+	}
+	return nil
+}
+
+// AddAccount adds an entry to the account registry. The code must not be in use yet.
+func (backend *Backend) AddAccount(account Account) error {
+	if err := account.validate(); err != nil {
+		return err
+	}
+	if backend.Account(account.Code) != nil {
+		return errp.Newf("an account with the code %s already exists", account.Code)
+	}
+	backend.Accounts = append(backend.Accounts, account)
+	return nil
+}
+
+// UpdateAccount changes the settings of the registry entry with the same code. Only the name, the
+// hidden flag and the gap limits can be changed, as the other fields determine the addresses of the
+// account.
+func (backend *Backend) UpdateAccount(account Account) error {
+	if err := account.validate(); err != nil {
+		return err
+	}
+	existing := backend.Account(account.Code)
+	if existing == nil {
+		return errp.Newf("unknown account %s", account.Code)
+	}
+	existing.Name = account.Name
+	existing.Hidden = account.Hidden
+	existing.GapLimit = account.GapLimit
+	existing.ChangeGapLimit = account.ChangeGapLimit
+	return nil
+}
+
+// KeystoreCodeSuffix returns the suffix of the codes of the shared registry entries for the
+// keystore with the given identifier. A new keystore is assigned the given suffix, except for the
+// first one, which keeps the bare codes so that the accounts used before multiple keystores were
+// supported keep their cached data. The assignment is stored, so that a code always refers to the
+// same wallet, no matter in which order the keystores are registered.
+func (backend *Backend) KeystoreCodeSuffix(identifier string, suffix string) string {
+	if existing, ok := backend.KeystoreCodeSuffixes[identifier]; ok {
+		return existing
+	}
+	if len(backend.KeystoreCodeSuffixes) == 0 {
+		suffix = ""
+		backend.KeystoreCodeSuffixes = map[string]string{}
+	}
+	backend.KeystoreCodeSuffixes[identifier] = suffix
+	return suffix
+}
+
+func copySuffixes(suffixes map[string]string) map[string]string {
+	if suffixes == nil {
+		return nil
+	}
+	result := make(map[string]string, len(suffixes))
+	for identifier, suffix := range suffixes {
+		result[identifier] = suffix
+	}
+	return result
+}
+
+// DeleteAccount removes the entry with the given code from the account registry.
+func (backend *Backend) DeleteAccount(code string) error {
+	for index := range backend.Accounts {
+		if backend.Accounts[index].Code == code {
+			backend.Accounts = append(backend.Accounts[:index], backend.Accounts[index+1:]...)
+			return nil
+		}
+	}
+	return errp.Newf("unknown account %s", code)
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAccount(t *testing.T) {
+	account, err := config.NewAccount("btc", "p2wpkh", 0, "Bitcoin")
+	require.NoError(t, err)
+	require.Equal(t, "btc-p2wpkh", account.Code)
+	require.Equal(t, "m/84'/0'/0'", account.Keypath)
+
+	account, err = config.NewAccount("tltc", "p2wpkh-p2sh", 2, "Savings")
+	require.NoError(t, err)
+	require.Equal(t, "tltc-p2wpkh-p2sh-2", account.Code)
+	require.Equal(t, "m/49'/1'/2'", account.Keypath)
+
+	account, err = config.NewAccount("eth", "p2wpkh", 1, "Ethereum")
+	require.NoError(t, err)
+	require.Equal(t, "eth-1", account.Code)
+	require.Equal(t, "", account.ScriptType)
+	require.Equal(t, "m/44'/60'/0'/0/1", account.Keypath)
+
+	_, err = config.NewAccount("doge", "p2pkh", 0, "")
+	require.Error(t, err)
+	_, err = config.NewAccount("btc", "p2sh", 0, "")
+	require.Error(t, err)
+}
+
+func TestMigrateLegacyToggles(t *testing.T) {
+	filename := test.TstTempFile("config")
+	defer func() { _ = os.Remove(filename) }()
+	require.NoError(t, ioutil.WriteFile(filename, []byte(
+		`{"backend":{"bitcoinP2PKHActive":true,"bitcoinP2WPKHP2SHActive":false}}`), 0600))
+
+	backendConfig := newConfig(t, filename).Config().Backend
+	require.Len(t, backendConfig.Accounts, len(defaultConfig(t).Backend.Accounts))
+	require.False(t, backendConfig.Account("btc-p2pkh").Hidden)
+	require.True(t, backendConfig.Account("btc-p2wpkh-p2sh").Hidden)
+	require.True(t, backendConfig.Account("tbtc-p2wpkh-p2sh").Hidden)
+	require.False(t, backendConfig.Account("tbtc-p2pkh").Hidden)
+}
+
+func TestAccountRegistry(t *testing.T) {
+	filename := test.TstTempFile("config")
+	defer func() { _ = os.Remove(filename) }()
+	appConfig := newConfig(t, filename)
+
+	spending, err := config.NewAccount("btc", "p2wpkh", 1, "Spending")
+	require.NoError(t, err)
+	require.NoError(t, appConfig.ModifyAccounts(func(backend *config.Backend) error {
+		return backend.AddAccount(*spending)
+	}))
+	require.Error(t, appConfig.ModifyAccounts(func(backend *config.Backend) error {
+		return backend.AddAccount(*spending)
+	}))
+	require.Error(t, appConfig.ModifyAccounts(func(backend *config.Backend) error {
+		return backend.DeleteAccount("unknown")
+	}))
+
+	// Only the settings can be updated.
+	update := *spending
+	update.Name = "Daily"
+	update.Keypath = "m/84'/0'/5'"
+	update.GapLimit = 100
+	require.NoError(t, appConfig.ModifyAccounts(func(backend *config.Backend) error {
+		return backend.UpdateAccount(update)
+	}))
+	spending.Name = "Daily"
+	spending.GapLimit = 100
+	update.GapLimit = -1
+	require.Error(t, appConfig.ModifyAccounts(func(backend *config.Backend) error {
+		return backend.UpdateAccount(update)
+	}))
+
+	// Persisted.
+	reloaded := newConfig(t, filename).Config()
+	require.Equal(t, spending, reloaded.Backend.Account("btc-p2wpkh-1"))
+
+	// Changing a legacy toggle updates the hidden flag of the default account.
+	require.True(t, reloaded.Backend.Account("btc-p2pkh").Hidden)
+	reloaded.Backend.BitcoinP2PKHActive = true
+	require.NoError(t, appConfig.Set(reloaded))
+	backendConfig := appConfig.Config().Backend
+	require.False(t, backendConfig.Account("btc-p2pkh").Hidden)
+
+	require.NoError(t, appConfig.ModifyAccounts(func(backend *config.Backend) error {
+		return backend.DeleteAccount("btc-p2wpkh-1")
+	}))
+	backendConfig = appConfig.Config().Backend
+	require.Nil(t, backendConfig.Account("btc-p2wpkh-1"))
+}
+
+func TestKeystoreCodeSuffix(t *testing.T) {
+	backend := &config.Backend{}
+	// The first keystore keeps the bare codes.
+	require.Equal(t, "", backend.KeystoreCodeSuffix("first", "-first"))
+	require.Equal(t, "-second", backend.KeystoreCodeSuffix("second", "-second"))
+	// The assignments do not depend on the order in which the keystores are seen again.
+	require.Equal(t, "-second", backend.KeystoreCodeSuffix("second", "-other"))
+	require.Equal(t, "", backend.KeystoreCodeSuffix("first", "-first"))
+}
@@ -16,12 +16,14 @@ package config
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"os"
 
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+	"github.com/sirupsen/logrus"
 )
 
 // btcCoinConfig holds configurations specific to a btc-based coin.
@@ -34,8 +36,16 @@ type ethCoinConfig struct {
 	NodeURL string `json:"nodeURL"`
 }
 
+const (
+	updateChannelStable = "stable"
+	updateChannelBeta   = "beta"
+)
+
 // Backend holds the backend specific configuration.
 type Backend struct {
+	// The per-script-type settings predate the account registry. They are migrated to the
+	// registry when loading an old config, and changes to them are applied to the hidden flag of
+	// the corresponding default accounts.
 	BitcoinP2PKHActive       bool `json:"bitcoinP2PKHActive"`
 	BitcoinP2WPKHP2SHActive  bool `json:"bitcoinP2WPKHP2SHActive"`
 	BitcoinP2WPKHActive      bool `json:"bitcoinP2WPKHActive"`
@@ -43,6 +53,21 @@ type Backend struct {
 	LitecoinP2WPKHActive     bool `json:"litecoinP2WPKHActive"`
 	EthereumActive           bool `json:"ethereumActive"`
 
+	// Accounts is the account registry. Accounts of all networks are stored, the backend loads
+	// those which match the network it runs on.
+	Accounts []Account `json:"accounts"`
+	// KeystoreCodeSuffixes maps the identifiers of the keystores seen so far to the suffix of the
+	// codes of their shared registry entries, see KeystoreCodeSuffix.
+	KeystoreCodeSuffixes map[string]string `json:"keystoreCodeSuffixes,omitempty"`
+
+	// UpdateChannel is the channel the update check offers releases of, "stable" or "beta".
+	UpdateChannel string `json:"updateChannel"`
+
+	// ElectrumServerDiscovery enables the use of the Electrum servers announced by the configured
+	// ones. It is opt-in, as the certificates of the announced servers are trusted on first use. A
+	// change takes effect after a restart.
+	ElectrumServerDiscovery bool `json:"electrumServerDiscovery"`
+
 	BTC  btcCoinConfig `json:"btc"`
 	TBTC btcCoinConfig `json:"tbtc"`
 	LTC  btcCoinConfig `json:"ltc"`
@@ -51,28 +76,10 @@ type Backend struct {
 	TETH ethCoinConfig `json:"teth"`
 }
 
-// AccountActive returns the Active setting for a coin by code.
-func (backend Backend) AccountActive(code string) bool {
-	switch code {
-	case "tbtc-p2pkh", "btc-p2pkh", "rbtc-p2pkh":
-		return backend.BitcoinP2PKHActive
-	case "tbtc-p2wpkh-p2sh", "btc-p2wpkh-p2sh", "rbtc-p2wpkh-p2sh":
-		return backend.BitcoinP2WPKHP2SHActive
-	case "tbtc-p2wpkh", "btc-p2wpkh", "rbtc-p2wpkh":
-		return backend.BitcoinP2WPKHActive
-	case "tltc-p2wpkh-p2sh", "ltc-p2wpkh-p2sh":
-		return backend.LitecoinP2WPKHP2SHActive
-	case "tltc-p2wpkh", "ltc-p2wpkh":
-		return backend.LitecoinP2WPKHActive
-	case "eth", "teth":
-		return backend.EthereumActive
-	default:
-		panic(fmt.Sprintf("unknown code %s", code))
-	}
-}
-
 // AppConfig holds the whole app configuration.
 type AppConfig struct {
+	// Version is the version of the config layout, see migrations.
+	Version  int         `json:"version"`
 	Backend  Backend     `json:"backend"`
 	Frontend interface{} `json:"frontend"`
 }
@@ -116,8 +123,9 @@ ffbrVM+I91v3R03Svv2Nte2xdbx1RmoI/y3tMyZL
 `
 
 // NewDefaultConfig returns the default app config.
-func NewDefaultConfig() AppConfig {
-	return AppConfig{
+func NewDefaultConfig() (AppConfig, error) {
+	appConfig := AppConfig{
+		Version: currentVersion,
 		Backend: Backend{
 			BitcoinP2PKHActive:       false,
 			BitcoinP2WPKHP2SHActive:  true,
@@ -125,6 +133,7 @@ func NewDefaultConfig() AppConfig {
 			LitecoinP2WPKHP2SHActive: true,
 			LitecoinP2WPKHActive:     false,
 			EthereumActive:           true,
+			UpdateChannel:            updateChannelStable,
 			BTC: btcCoinConfig{
 				ElectrumServers: []*rpc.ServerInfo{
 					{
@@ -189,34 +198,156 @@ func NewDefaultConfig() AppConfig {
 			},
 		},
 	}
+	accounts, err := appConfig.Backend.defaultAccounts()
+	if err != nil {
+		return AppConfig{}, err
+	}
+	appConfig.Backend.Accounts = accounts
+	return appConfig, nil
 }
 
 // Config manages the app configuration.
 type Config struct {
 	lock     locker.Locker
 	filename string
-	config   AppConfig
+	key      *encryption.Key
+	// locked is set if the config file is encrypted and could not be decrypted. The defaults are
+	// used then, and the config file is not overwritten.
+	locked bool
+	// newer is set if the config file was written by a newer version of the app. It is loaded as
+	// far as it is understood, but not overwritten.
+	newer bool
+	// savedJSON is the JSON encoded config which was last loaded or saved. It is written to the
+	// backup file when the config is saved.
+	savedJSON []byte
+	config    AppConfig
+
+	log *logrus.Entry
 }
 
 // NewConfig creates a new Config, stored in the given location. The filename must be writable, but
 // does not have to exist.
-func NewConfig(filename string) *Config {
+func NewConfig(filename string) (*Config, error) {
 	config := &Config{
 		filename: filename,
-		config:   NewDefaultConfig(),
+		log:      logging.Get().WithGroup("config"),
+	}
+	if err := config.load(); err != nil {
+		return nil, err
 	}
-	config.load()
-	return config
+	return config, nil
 }
 
-func (config *Config) load() {
-	jsonBytes, err := ioutil.ReadFile(config.filename)
+// backupFilename is the file which holds the previous version of the config.
+func (config *Config) backupFilename() string {
+	return config.filename + ".bak"
+}
+
+// load loads the config file. If it is missing or corrupt, the backup file is loaded instead. An
+// error is only returned if the default config cannot be created.
+func (config *Config) load() error {
+	defaults, err := NewDefaultConfig()
 	if err != nil {
-		return
+		return err
 	}
-	if err := json.Unmarshal(jsonBytes, &config.config); err != nil {
-		return
+	config.config = defaults
+	config.locked = false
+	config.newer = false
+	config.savedJSON = nil
+	wrongKey := false
+	for _, filename := range []string{config.filename, config.backupFilename()} {
+		jsonBytes, err := encryption.ReadFile(filename, config.key)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err == encryption.ErrLocked:
+			config.locked = true
+			return nil
+		case err == encryption.ErrWrongKey || err == encryption.ErrPlaintext:
+			wrongKey = true
+			continue
+		case err != nil:
+			config.log.WithError(err).WithField("filename", filename).Error("Could not read the config")
+			continue
+		}
+		appConfig, version, err := parse(jsonBytes)
+		if err != nil {
+			config.log.WithError(err).WithField("filename", filename).Error("Could not parse the config")
+			continue
+		}
+		if filename != config.filename {
+			config.log.Warning("Loaded the backup of the config")
+		}
+		if version > currentVersion {
+			config.log.WithField("version", version).Warning(
+				"The config was written by a newer version of the app and will not be changed")
+			config.newer = true
+		}
+		config.config = appConfig
+		config.savedJSON = jsonBytes
+		return nil
 	}
+	config.locked = wrongKey
+	return nil
+}
+
+// parse migrates and decodes the JSON encoded config. The defaults are used for missing values.
+func parse(jsonBytes []byte) (AppConfig, int, error) {
+	jsonBytes, version, err := migrate(jsonBytes)
+	if err != nil {
+		return AppConfig{}, 0, err
+	}
+	appConfig, err := NewDefaultConfig()
+	if err != nil {
+		return AppConfig{}, 0, err
+	}
+	appConfig.Backend.Accounts = nil
+	if err := json.Unmarshal(jsonBytes, &appConfig); err != nil {
+		return AppConfig{}, 0, errp.WithStack(err)
+	}
+	if appConfig.Backend.Accounts == nil {
+		if appConfig.Backend.Accounts, err = appConfig.Backend.defaultAccounts(); err != nil {
+			return AppConfig{}, 0, err
+		}
+	}
+	return appConfig, version, nil
+}
+
+// SetEncryptionKey sets the key with which the config file is encrypted and loads the config file
+// with it. It returns an error if the config file cannot be decrypted with the key, which includes
+// a config file in plaintext, see EnableEncryption.
+func (config *Config) SetEncryptionKey(key *encryption.Key) error {
+	defer config.lock.Lock()()
+	return config.setEncryptionKey(key)
+}
+
+// EnableEncryption encrypts the config file and its backup, which were written in plaintext before
+// the encryption was enabled, and sets the key like SetEncryptionKey.
+func (config *Config) EnableEncryption(key *encryption.Key) error {
+	defer config.lock.Lock()()
+	for _, filename := range []string{config.filename, config.backupFilename()} {
+		if err := encryption.EncryptFile(filename, key); err != nil {
+			return err
+		}
+	}
+	return config.setEncryptionKey(key)
+}
+
+func (config *Config) setEncryptionKey(key *encryption.Key) error {
+	config.key = key
+	if err := config.load(); err != nil {
+		return err
+	}
+	if config.locked {
+		return errp.New("could not decrypt the config file")
+	}
+	return nil
+}
+
+// Locked returns whether the config file is encrypted and could not be decrypted yet.
+func (config *Config) Locked() bool {
+	defer config.lock.RLock()()
+	return config.locked
 }
 
 // Config returns the app config.
@@ -225,17 +356,90 @@ func (config *Config) Config() AppConfig {
 	return config.config
 }
 
-// Set sets and persists the app config.
+// Set validates, sets and persists the app config. If the given config has no account registry or
+// no keystore code suffixes, the current ones are kept. Invalid values are returned as
+// ValidationErrors.
 func (config *Config) Set(appConfig AppConfig) error {
 	defer config.lock.Lock()()
+	accounts := appConfig.Backend.Accounts
+	if accounts == nil {
+		accounts = config.config.Backend.Accounts
+	}
+	appConfig.Backend.Accounts = append([]Account{}, accounts...)
+	if appConfig.Backend.KeystoreCodeSuffixes == nil {
+		appConfig.Backend.KeystoreCodeSuffixes = config.config.Backend.KeystoreCodeSuffixes
+	}
+	appConfig.Backend.KeystoreCodeSuffixes = copySuffixes(appConfig.Backend.KeystoreCodeSuffixes)
+	appConfig.Backend.applyLegacyToggles(&config.config.Backend)
+	if err := appConfig.Validate(); err != nil {
+		return err
+	}
 	config.config = appConfig
 	return config.save()
 }
 
+// ModifyAccounts applies the given function to the account registry and persists the result if it
+// succeeds.
+func (config *Config) ModifyAccounts(f func(*Backend) error) error {
+	defer config.lock.Lock()()
+	backend := config.config.Backend
+	backend.Accounts = append([]Account{}, backend.Accounts...)
+	backend.KeystoreCodeSuffixes = copySuffixes(backend.KeystoreCodeSuffixes)
+	if err := f(&backend); err != nil {
+		return err
+	}
+	config.config.Backend = backend
+	return config.save()
+}
+
+// save writes the config file. The previous version is kept in the backup file. Both files are
+// replaced atomically, so that a crash while writing cannot corrupt them.
 func (config *Config) save() error {
+	if config.locked {
+		return errp.New("the config file is encrypted and cannot be changed before it is unlocked")
+	}
+	if config.newer {
+		return errp.New("the config file was written by a newer version of the app and cannot be changed")
+	}
+	config.config.Version = currentVersion
 	jsonBytes, err := json.Marshal(config.config)
 	if err != nil {
 		return errp.WithStack(err)
 	}
-	return errp.WithStack(ioutil.WriteFile(config.filename, jsonBytes, 0644))
+	if config.savedJSON != nil {
+		if err := config.writeFile(config.backupFilename(), config.savedJSON); err != nil {
+			return err
+		}
+	}
+	if err := config.writeFile(config.filename, jsonBytes); err != nil {
+		return err
+	}
+	config.savedJSON = jsonBytes
+	return nil
+}
+
+// writeFile writes the JSON encoded config to a temporary file, encrypted if there is a key, and
+// renames it to the given filename once it is synced to disk.
+func (config *Config) writeFile(filename string, jsonBytes []byte) error {
+	data, err := encryption.EncodeFile(jsonBytes, config.key)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Close(); err != nil {
+		return errp.WithStack(err)
+	}
+	return errp.WithStack(os.Rename(tmpFilename, filename))
 }
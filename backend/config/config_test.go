@@ -0,0 +1,145 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newConfig(t *testing.T, filename string) *config.Config {
+	t.Helper()
+	appConfig, err := config.NewConfig(filename)
+	require.NoError(t, err)
+	return appConfig
+}
+
+func defaultConfig(t *testing.T) config.AppConfig {
+	t.Helper()
+	appConfig, err := config.NewDefaultConfig()
+	require.NoError(t, err)
+	return appConfig
+}
+
+func TestMigrations(t *testing.T) {
+	filename := test.TstTempFile("config")
+	defer func() { _ = os.Remove(filename) }()
+	defer func() { _ = os.Remove(filename + ".bak") }()
+	require.NoError(t, ioutil.WriteFile(filename, []byte(
+		`{"backend":{"ethereumActive":false},"frontend":{"guide":true}}`), 0600))
+
+	appConfig := newConfig(t, filename)
+	require.Equal(t, defaultConfig(t).Version, appConfig.Config().Version)
+	backendConfig := appConfig.Config().Backend
+	require.Equal(t, "stable", backendConfig.UpdateChannel)
+	require.True(t, backendConfig.Account("eth").Hidden)
+	require.Equal(t, map[string]interface{}{"guide": true}, appConfig.Config().Frontend)
+
+	require.NoError(t, appConfig.Set(appConfig.Config()))
+	jsonBytes, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	stored := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(jsonBytes, &stored))
+	require.Equal(t, float64(defaultConfig(t).Version), stored["version"])
+}
+
+func TestNewerVersion(t *testing.T) {
+	filename := test.TstTempFile("config")
+	defer func() { _ = os.Remove(filename) }()
+	require.NoError(t, ioutil.WriteFile(filename, []byte(
+		`{"version":1000,"backend":{"updateChannel":"beta","unknown":1}}`), 0600))
+
+	// A config of a newer version is loaded as far as it is understood, but not overwritten.
+	appConfig := newConfig(t, filename)
+	require.Equal(t, "beta", appConfig.Config().Backend.UpdateChannel)
+	require.Error(t, appConfig.Set(appConfig.Config()))
+}
+
+func TestValidate(t *testing.T) {
+	appConfig := defaultConfig(t)
+	require.NoError(t, appConfig.Validate())
+
+	appConfig.Backend.BTC.ElectrumServers[0].Server = "btc.shiftcrypto.ch"
+	appConfig.Backend.TBTC.ElectrumServers[1].Server = "merkle.shiftcrypto.ch:0"
+	appConfig.Backend.LTC.ElectrumServers[0].PEMCert = "invalid"
+	appConfig.Backend.TLTC.ElectrumServers = nil
+	appConfig.Backend.ETH.NodeURL = "mainnet.infura.io"
+	appConfig.Backend.TETH.NodeURL = "ftp://rinkeby.infura.io"
+	appConfig.Backend.UpdateChannel = "nightly"
+	appConfig.Backend.Accounts = append(appConfig.Backend.Accounts, appConfig.Backend.Accounts[0])
+	err := appConfig.Validate()
+	require.Error(t, err)
+	fields := []string{}
+	for _, validationError := range err.(config.ValidationErrors) {
+		fields = append(fields, validationError.Field)
+	}
+	require.Equal(t, []string{
+		"backend.btc.electrumServers.0.server",
+		"backend.tbtc.electrumServers.1.server",
+		"backend.ltc.electrumServers.0.pemCert",
+		"backend.tltc.electrumServers",
+		"backend.eth.nodeURL",
+		"backend.teth.nodeURL",
+		"backend.updateChannel",
+		fmt.Sprintf("backend.accounts.%d.code", len(appConfig.Backend.Accounts)-1),
+	}, fields)
+
+	filename := test.TstTempFile("config")
+	defer func() { _ = os.Remove(filename) }()
+	require.Error(t, newConfig(t, filename).Set(appConfig))
+}
+
+func TestDecodeAppConfig(t *testing.T) {
+	_, err := config.DecodeAppConfig(strings.NewReader(
+		`{"backend":{"btc":{"electrumServers":[]},"unknownSetting":true},"frontend":{"any":1}}`))
+	require.Equal(t, config.ValidationErrors{{Field: "unknownSetting", Message: "unknown field"}}, err)
+
+	appConfig, err := config.DecodeAppConfig(strings.NewReader(
+		`{"backend":{"updateChannel":"beta"},"frontend":{"any":1}}`))
+	require.NoError(t, err)
+	require.Equal(t, "beta", appConfig.Backend.UpdateChannel)
+}
+
+func TestBackup(t *testing.T) {
+	filename := test.TstTempFile("config")
+	defer func() { _ = os.Remove(filename) }()
+	defer func() { _ = os.Remove(filename + ".bak") }()
+
+	appConfig := newConfig(t, filename)
+	modified := appConfig.Config()
+	modified.Backend.UpdateChannel = "beta"
+	require.NoError(t, appConfig.Set(modified))
+	_, err := os.Stat(filename + ".bak")
+	require.True(t, os.IsNotExist(err))
+
+	modified.Frontend = map[string]interface{}{"guide": true}
+	require.NoError(t, appConfig.Set(modified))
+	_, err = os.Stat(filename + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	// A corrupt config file is replaced by the previous version.
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`{"backend":`), 0600))
+	appConfig = newConfig(t, filename)
+	require.Equal(t, "beta", appConfig.Config().Backend.UpdateChannel)
+	require.Nil(t, appConfig.Config().Frontend)
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// migration converts the JSON object of a config in the layout of one version to the layout of the
+// next version.
+type migration func(appConfig map[string]interface{}) error
+
+// migrations are the migrations in order. The config of version i is migrated by migrations[i].
+// Configs written before the version was introduced have the version 0.
+var migrations = []migration{
+	migrateAccountRegistry,
+	migrateUpdateChannel,
+}
+
+// currentVersion is the version of the config layout written by this version of the app. It is the
+// number of migrations.
+const currentVersion = 2
+
+// convert converts between the JSON object and a value through their JSON encoding.
+func convert(from interface{}, to interface{}) error {
+	jsonBytes, err := json.Marshal(from)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	return errp.WithStack(json.Unmarshal(jsonBytes, to))
+}
+
+// backendObject returns the JSON object of the backend config, which is created if it is missing.
+func backendObject(appConfig map[string]interface{}) map[string]interface{} {
+	backend, ok := appConfig["backend"].(map[string]interface{})
+	if !ok {
+		backend = map[string]interface{}{}
+		appConfig["backend"] = backend
+	}
+	return backend
+}
+
+// migrateAccountRegistry adds the account registry, which replaced the per-script-type settings.
+func migrateAccountRegistry(appConfig map[string]interface{}) error {
+	backend := backendObject(appConfig)
+	if _, ok := backend["accounts"]; ok {
+		return nil
+	}
+	defaults, err := NewDefaultConfig()
+	if err != nil {
+		return err
+	}
+	legacy := defaults.Backend
+	if err := convert(backend, &legacy); err != nil {
+		return err
+	}
+	legacyAccounts, err := legacy.defaultAccounts()
+	if err != nil {
+		return err
+	}
+	var accounts interface{}
+	if err := convert(legacyAccounts, &accounts); err != nil {
+		return err
+	}
+	backend["accounts"] = accounts
+	return nil
+}
+
+// migrateUpdateChannel adds the update channel.
+func migrateUpdateChannel(appConfig map[string]interface{}) error {
+	backend := backendObject(appConfig)
+	if channel, ok := backend["updateChannel"].(string); !ok || channel == "" {
+		backend["updateChannel"] = updateChannelStable
+	}
+	return nil
+}
+
+// migrate migrates the JSON encoded config to the current version. It also returns the version the
+// config was written with. Configs written by a newer version of the app are returned unchanged.
+func migrate(jsonBytes []byte) ([]byte, int, error) {
+	appConfig := map[string]interface{}{}
+	if err := json.Unmarshal(jsonBytes, &appConfig); err != nil {
+		return nil, 0, errp.WithStack(err)
+	}
+	version := 0
+	if rawVersion, ok := appConfig["version"]; ok {
+		floatVersion, ok := rawVersion.(float64)
+		if !ok || floatVersion < 0 || floatVersion != float64(int(floatVersion)) {
+			return nil, 0, errp.Newf("invalid config version %v", rawVersion)
+		}
+		version = int(floatVersion)
+	}
+	if version >= currentVersion {
+		return jsonBytes, version, nil
+	}
+	for migrated := version; migrated < currentVersion; migrated++ {
+		if err := migrations[migrated](appConfig); err != nil {
+			return nil, 0, errp.WithMessage(err, "could not migrate the config")
+		}
+	}
+	appConfig["version"] = currentVersion
+	migratedBytes, err := json.Marshal(appConfig)
+	if err != nil {
+		return nil, 0, errp.WithStack(err)
+	}
+	return migratedBytes, version, nil
+}
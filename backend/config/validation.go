@@ -0,0 +1,159 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+)
+
+// ValidationError describes an invalid value in the config.
+type ValidationError struct {
+	// Field is the path of the value in the JSON config, e.g. "backend.btc.electrumServers.0.server".
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists all invalid values of a config.
+type ValidationErrors []ValidationError
+
+// Error implements error.
+func (validationErrors ValidationErrors) Error() string {
+	messages := []string{}
+	for _, validationError := range validationErrors {
+		messages = append(messages, fmt.Sprintf("%s: %s", validationError.Field, validationError.Message))
+	}
+	return "invalid config: " + strings.Join(messages, "; ")
+}
+
+func (validationErrors *ValidationErrors) add(field string, format string, args ...interface{}) {
+	*validationErrors = append(*validationErrors, ValidationError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// unknownFieldPrefix prefixes the error returned by a json.Decoder which disallows unknown fields.
+const unknownFieldPrefix = "json: unknown field "
+
+// DecodeAppConfig decodes a JSON encoded config. Unknown fields, except in the free-form frontend
+// config, are returned as ValidationErrors.
+func DecodeAppConfig(reader io.Reader) (AppConfig, error) {
+	var appConfig AppConfig
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&appConfig); err != nil {
+		if strings.HasPrefix(err.Error(), unknownFieldPrefix) {
+			field, unquoteErr := strconv.Unquote(strings.TrimPrefix(err.Error(), unknownFieldPrefix))
+			if unquoteErr != nil {
+				field = strings.TrimPrefix(err.Error(), unknownFieldPrefix)
+			}
+			return AppConfig{}, ValidationErrors{{Field: field, Message: "unknown field"}}
+		}
+		return AppConfig{}, errp.WithStack(err)
+	}
+	return appConfig, nil
+}
+
+func validateElectrumServer(validationErrors *ValidationErrors, field string, server *rpc.ServerInfo) {
+	if server == nil {
+		validationErrors.add(field, "missing server")
+		return
+	}
+	host, port, err := net.SplitHostPort(server.Server)
+	if err != nil || host == "" {
+		validationErrors.add(field+".server", "expected host:port, got %q", server.Server)
+	} else if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 || portNumber > 65535 {
+		validationErrors.add(field+".server", "invalid port %q", port)
+	}
+	if !server.TLS || server.PEMCert == "" {
+		return
+	}
+	block, _ := pem.Decode([]byte(server.PEMCert))
+	if block == nil || block.Type != "CERTIFICATE" {
+		validationErrors.add(field+".pemCert", "expected a PEM encoded certificate")
+		return
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		validationErrors.add(field+".pemCert", "invalid certificate: %v", err)
+	}
+}
+
+func validateNodeURL(validationErrors *ValidationErrors, field string, nodeURL string) {
+	parsed, err := url.Parse(nodeURL)
+	if err != nil || parsed.Host == "" {
+		validationErrors.add(field, "expected an absolute URL, got %q", nodeURL)
+		return
+	}
+	switch parsed.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		validationErrors.add(field, "unsupported scheme %q", parsed.Scheme)
+	}
+}
+
+// Validate checks the values of the config. It returns ValidationErrors if there are invalid
+// values.
+func (appConfig *AppConfig) Validate() error {
+	validationErrors := ValidationErrors{}
+	backend := &appConfig.Backend
+	for _, coin := range []struct {
+		code   string
+		config *btcCoinConfig
+	}{
+		{"btc", &backend.BTC},
+		{"tbtc", &backend.TBTC},
+		{"ltc", &backend.LTC},
+		{"tltc", &backend.TLTC},
+	} {
+		field := fmt.Sprintf("backend.%s.electrumServers", coin.code)
+		if len(coin.config.ElectrumServers) == 0 {
+			validationErrors.add(field, "at least one server is required")
+		}
+		for index, server := range coin.config.ElectrumServers {
+			validateElectrumServer(&validationErrors, fmt.Sprintf("%s.%d", field, index), server)
+		}
+	}
+	validateNodeURL(&validationErrors, "backend.eth.nodeURL", backend.ETH.NodeURL)
+	validateNodeURL(&validationErrors, "backend.teth.nodeURL", backend.TETH.NodeURL)
+	if backend.UpdateChannel != updateChannelStable && backend.UpdateChannel != updateChannelBeta {
+		validationErrors.add("backend.updateChannel", "unknown update channel %q", backend.UpdateChannel)
+	}
+	codes := map[string]bool{}
+	for index, account := range backend.Accounts {
+		field := fmt.Sprintf("backend.accounts.%d", index)
+		if err := account.validate(); err != nil {
+			validationErrors.add(field, "%v", err)
+		}
+		if codes[account.Code] {
+			validationErrors.add(field+".code", "duplicate account code %q", account.Code)
+		}
+		codes[account.Code] = true
+	}
+	if len(validationErrors) != 0 {
+		return validationErrors
+	}
+	return nil
+}
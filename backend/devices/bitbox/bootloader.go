@@ -26,7 +26,8 @@ import (
 
 const (
 	bootloaderMaxChunkSize = 8 * 512
-	signaturesSize         = 64 * 7 // 7 signatures à 64 bytes
+	signatureSize          = 64
+	signaturesSize         = signatureSize * 7 // 7 signatures à 64 bytes
 )
 
 // BootloaderStatus has all the info to handle the bootloader mode.
@@ -35,6 +36,8 @@ type BootloaderStatus struct {
 	Progress          float64 `json:"progress"`
 	UpgradeSuccessful bool    `json:"upgradeSuccessful"`
 	ErrMsg            string  `json:"errMsg"`
+	// Firmware describes the firmware which is being written, if it was checked before.
+	Firmware *FirmwareCheck `json:"firmware"`
 }
 
 // BootloaderStatus returns the progress of a firmware upgrade. Returns an error if the device is
@@ -122,12 +125,22 @@ func (dbb *Device) BootloaderUpgradeFirmware(signedFirmware []byte) error {
 	if dbb.bootloaderStatus == nil {
 		return errp.New("device is not in bootloader mode")
 	}
+	if len(signedFirmware) <= signaturesSize {
+		return errp.New("the firmware file is too small")
+	}
+	return dbb.bootloaderUpgradeFirmware(signedFirmware, nil)
+}
+
+// bootloaderUpgradeFirmware writes the firmware. check is reported in the bootloader status and
+// can be nil.
+func (dbb *Device) bootloaderUpgradeFirmware(signedFirmware []byte, check *FirmwareCheck) error {
 	if dbb.bootloaderStatus.Upgrading {
 		return errp.New("already in progress")
 	}
 
 	dbb.bootloaderStatus.Progress = 0
 	dbb.bootloaderStatus.Upgrading = true
+	dbb.bootloaderStatus.Firmware = check
 	dbb.fireEvent(EventBootloaderStatusChanged, nil)
 	err := func() error {
 		// Erase the firmware (required).
@@ -37,6 +37,7 @@ import (
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/device"
 	keystoreInterface "github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/jsonp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
@@ -111,9 +112,13 @@ type Device struct {
 
 	// If set, the device is in bootloader mode.
 	bootloaderStatus *BootloaderStatus
+	// firmwareSigningKeys verify uploaded firmware. If nil, only the bootloader verifies it.
+	firmwareSigningKeys *FirmwareSigningKeys
 
 	// firmware or bootloader version.
 	version *semver.SemVer
+	// installedFirmwareVersion is the version of the firmware in bootloader mode, if known.
+	installedFirmwareVersion *semver.SemVer
 
 	// If set, the device is configured with a PIN.
 	initialized bool
@@ -133,6 +138,9 @@ type Device struct {
 	// BitBox desktop app config directory.
 	// Used to read/store channel settings.
 	channelConfigDir string
+	// channelConfigKey encrypts the channel settings, which contain the keys of the channel. It is
+	// nil if they are stored in plaintext.
+	channelConfigKey *encryption.Key
 
 	mu sync.RWMutex
 	// If set, the channel can be used to communicate to the mobile.
@@ -142,6 +150,8 @@ type Device struct {
 	onEvent func(device.Event, interface{})
 	// Indicates whether Close was called.
 	closed bool
+	// quit is closed by Close to wake up listenForMobile.
+	quit chan struct{}
 
 	log *logrus.Entry
 }
@@ -150,13 +160,15 @@ type Device struct {
 // bootloader enables the bootloader API and should be true only if the device is in bootloader mode.
 // communication is used for transporting messages to/from the device.
 //
-// The channelConfigDir is the location of the channel settings file.
+// The channelConfigDir is the location of the channel settings file, which is encrypted with
+// channelConfigKey unless it is nil.
 // Callers can use util/config.AppDir to obtain user standard config dir.
 func NewDevice(
 	deviceID string,
 	bootloader bool,
 	version *semver.SemVer,
 	channelConfigDir string,
+	channelConfigKey *encryption.Key,
 	communication CommunicationInterface) (*Device, error) {
 	log := logging.Get().WithGroup("device").WithField("deviceID", deviceID)
 	log.WithFields(logrus.Fields{"deviceID": deviceID, "version": version}).Info("Plugged in device")
@@ -171,8 +183,10 @@ func NewDevice(
 		version:          version,
 		communication:    communication,
 		closed:           false,
-		channel:          relay.NewChannelFromConfigFile(channelConfigDir),
+		quit:             make(chan struct{}),
+		channel:          relay.NewChannelFromConfigFile(channelConfigDir, channelConfigKey),
 		channelConfigDir: channelConfigDir,
+		channelConfigKey: channelConfigKey,
 		log:              log,
 	}
 
@@ -285,9 +299,13 @@ func (dbb *Device) Status() Status {
 func (dbb *Device) Close() {
 	dbb.mu.Lock()
 	defer dbb.mu.Unlock()
+	if dbb.closed {
+		return
+	}
 	dbb.log.WithFields(logrus.Fields{"deviceID": dbb.deviceID}).Debug("Close connection")
 	dbb.communication.Close()
 	dbb.closed = true
+	close(dbb.quit)
 }
 
 func (dbb *Device) sendPlain(key, val string) (map[string]interface{}, error) {
@@ -1269,10 +1287,15 @@ func (dbb *Device) ecdhChallenge() error {
 }
 
 // StartPairing creates, stores and returns a new channel and finishes the pairing asynchronously.
-func (dbb *Device) StartPairing() (*relay.Channel, error) {
+// The channel uses the given relay server. If it is empty, the relay server of the previous pairing
+// is kept.
+func (dbb *Device) StartPairing(server relay.Server) (*relay.Channel, error) {
 	var removed bool
 	dbb.mu.Lock()
 	if dbb.channel != nil {
+		if server == "" {
+			server = dbb.channel.Server
+		}
 		if err := dbb.channel.RemoveConfigFile(dbb.channelConfigDir); err != nil {
 			dbb.mu.Unlock()
 			return nil, errp.WithStack(err)
@@ -1286,6 +1309,7 @@ func (dbb *Device) StartPairing() (*relay.Channel, error) {
 	}
 
 	channel := relay.NewChannelWithRandomKey()
+	channel.Server = server
 	go dbb.processPairing(channel)
 	return channel, nil
 }
@@ -1326,7 +1350,11 @@ func (dbb *Device) listenForMobile() {
 		} else {
 			dbb.fireEvent("mobileConnected", nil)
 		}
-		time.Sleep(10 * time.Second)
+		select {
+		case <-dbb.quit:
+			return
+		case <-time.After(10 * time.Second):
+		}
 	}
 }
 
@@ -68,7 +68,7 @@ func (s *dbbTestSuite) SetupTest() {
 		s.mockCommClosed = true
 	})
 	s.mockCommClosed = false
-	dbb, err := NewDevice(deviceID, false /* bootloader */, firmVer400, s.configDir, s.mockCommunication)
+	dbb, err := NewDevice(deviceID, false /* bootloader */, firmVer400, s.configDir, nil, s.mockCommunication)
 	dbb.Init(true)
 	require.NoError(s.T(), err)
 	s.dbb = dbb
@@ -388,7 +388,7 @@ func TestNewDeviceReadsChannel(t *testing.T) {
 	configDir := test.TstTempDir("dbb_device_test")
 	defer func() { _ = os.RemoveAll(configDir) }()
 	mobchan := relay.NewChannelWithRandomKey()
-	if err := mobchan.StoreToConfigFile(configDir); err != nil {
+	if err := mobchan.StoreToConfigFile(configDir, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -397,7 +397,7 @@ func TestNewDeviceReadsChannel(t *testing.T) {
 	comm.On("SendPlain", jsonArgumentMatcher(map[string]interface{}{"ping": ""})).
 		Return(map[string]interface{}{"ping": ""}, nil)
 	comm.On("Close")
-	dbb, err := NewDevice("test-device-id", false /* bootloader */, firmVer400, configDir, comm)
+	dbb, err := NewDevice("test-device-id", false /* bootloader */, firmVer400, configDir, nil, comm)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -15,9 +15,17 @@
 package bitbox
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"math/big"
+	"regexp"
 
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/semver"
+	"github.com/sirupsen/logrus"
 )
 
 //go:generate go-bindata -pkg $GOPACKAGE -o assets.go assets
@@ -39,3 +47,177 @@ func BundledFirmware() []byte {
 	}
 	return binary
 }
+
+// firmwareVersionPattern matches the version string embedded in the firmware binary.
+var firmwareVersionPattern = regexp.MustCompile(`\x00v([0-9]+\.[0-9]+\.[0-9]+)\x00`)
+
+// maxFirmwareSize is the size of the largest binary which can be written, as the chunks are
+// numbered with one byte.
+const maxFirmwareSize = 256 * bootloaderMaxChunkSize
+
+// FirmwareSigningKeys are the public keys of the firmware signers. A signed firmware has one
+// signature per signer, in the order of the keys.
+type FirmwareSigningKeys struct {
+	publicKeys []*btcec.PublicKey
+	// required is the number of valid signatures needed.
+	required int
+}
+
+// NewFirmwareSigningKeys returns the signing keys of which the given number of signatures are
+// required. There has to be one key for each of the signatures of a signed firmware.
+func NewFirmwareSigningKeys(publicKeys []*btcec.PublicKey, required int) *FirmwareSigningKeys {
+	if len(publicKeys) != signaturesSize/signatureSize {
+		panic(fmt.Sprintf("need %d firmware signing keys", signaturesSize/signatureSize))
+	}
+	return &FirmwareSigningKeys{publicKeys: publicKeys, required: required}
+}
+
+// verify returns whether enough of the signatures are valid signatures of the hash.
+func (keys *FirmwareSigningKeys) verify(hash []byte, signatures []byte) bool {
+	valid := 0
+	for index, publicKey := range keys.publicKeys {
+		signature := signatures[index*signatureSize : (index+1)*signatureSize]
+		parsed := &btcec.Signature{
+			R: new(big.Int).SetBytes(signature[:signatureSize/2]),
+			S: new(big.Int).SetBytes(signature[signatureSize/2:]),
+		}
+		if parsed.Verify(hash, publicKey) {
+			valid++
+		}
+	}
+	return valid >= keys.required
+}
+
+// SignedFirmware is a signed firmware release: the signatures of the signers followed by the
+// binary.
+type SignedFirmware struct {
+	signatures []byte
+	binary     []byte
+	version    *semver.SemVer
+}
+
+// ParseSignedFirmware parses a signed firmware release, like the bundled firmware. The version is
+// read from the version string embedded in the binary.
+func ParseSignedFirmware(signedFirmware []byte) (*SignedFirmware, error) {
+	if len(signedFirmware) <= signaturesSize {
+		return nil, errp.New("the firmware file is too small")
+	}
+	signatures, binary := signedFirmware[:signaturesSize], signedFirmware[signaturesSize:]
+	if len(binary) > maxFirmwareSize {
+		return nil, errp.New("the firmware file is too big")
+	}
+	matches := firmwareVersionPattern.FindAllSubmatch(binary, -1)
+	if len(matches) != 1 {
+		return nil, errp.New("could not find the version of the firmware")
+	}
+	version, err := semver.NewSemVerFromString(string(matches[0][1]))
+	if err != nil {
+		return nil, err
+	}
+	return &SignedFirmware{signatures: signatures, binary: binary, version: version}, nil
+}
+
+// Version returns the version of the firmware.
+func (firmware *SignedFirmware) Version() *semver.SemVer {
+	return firmware.version
+}
+
+// Hash returns the hash which is signed by the signers: the double SHA256 of the binary padded to
+// whole chunks, as it is written by the bootloader.
+func (firmware *SignedFirmware) Hash() []byte {
+	padded := append([]byte{}, firmware.binary...)
+	if remainder := len(padded) % bootloaderMaxChunkSize; remainder != 0 {
+		padded = append(padded, bytes.Repeat([]byte{0xFF}, bootloaderMaxChunkSize-remainder)...)
+	}
+	return chainhash.DoubleHashB(padded)
+}
+
+// FirmwareCheck is the result of checking a signed firmware before it is written.
+type FirmwareCheck struct {
+	Version string `json:"version"`
+	// Hash is the hex encoded hash of the firmware, see SignedFirmware.Hash().
+	Hash string `json:"hash"`
+	// SignaturesVerified is true if the signatures were verified with the known signing keys. If
+	// the keys are unknown, only the bootloader verifies them.
+	SignaturesVerified bool `json:"signaturesVerified"`
+	// InstalledVersion is the version of the firmware installed on the device, empty if it is
+	// unknown.
+	InstalledVersion string `json:"installedVersion"`
+	// Downgrade is true if the firmware is older than the firmware installed on the device.
+	Downgrade bool `json:"downgrade"`
+	// Unsupported is true if the firmware is too new to be used with this app.
+	Unsupported bool `json:"unsupported"`
+}
+
+// needsForce returns whether the firmware may only be written if forced.
+func (check *FirmwareCheck) needsForce() bool {
+	return !check.SignaturesVerified || check.InstalledVersion == "" || check.Downgrade ||
+		check.Unsupported
+}
+
+// SetFirmwareSigningKeys sets the keys with which uploaded firmware is verified.
+func (dbb *Device) SetFirmwareSigningKeys(keys *FirmwareSigningKeys) {
+	dbb.firmwareSigningKeys = keys
+}
+
+// SetInstalledFirmwareVersion sets the version of the firmware installed on a device in bootloader
+// mode, which cannot report it itself.
+func (dbb *Device) SetInstalledFirmwareVersion(version *semver.SemVer) {
+	dbb.installedFirmwareVersion = version
+}
+
+// installedFirmware returns the version of the firmware installed on the device, or nil if it is
+// unknown in bootloader mode.
+func (dbb *Device) installedFirmware() *semver.SemVer {
+	if dbb.bootloaderStatus == nil {
+		return dbb.version
+	}
+	return dbb.installedFirmwareVersion
+}
+
+// CheckFirmware parses and checks the given signed firmware. Returns an error if the firmware is
+// malformed or if the signatures are invalid.
+func (dbb *Device) CheckFirmware(signedFirmware []byte) (*FirmwareCheck, error) {
+	firmware, err := ParseSignedFirmware(signedFirmware)
+	if err != nil {
+		return nil, err
+	}
+	hash := firmware.Hash()
+	check := &FirmwareCheck{
+		Version:     firmware.Version().String(),
+		Hash:        hex.EncodeToString(hash),
+		Unsupported: firmware.Version().AtLeast(lowestNonSupportedFirmwareVersion),
+	}
+	if installed := dbb.installedFirmware(); installed != nil {
+		check.InstalledVersion = installed.String()
+		check.Downgrade = !firmware.Version().AtLeast(installed)
+	}
+	if dbb.firmwareSigningKeys != nil {
+		if !dbb.firmwareSigningKeys.verify(hash, firmware.signatures) {
+			return nil, errp.New("the firmware signatures are invalid")
+		}
+		check.SignaturesVerified = true
+	}
+	return check, nil
+}
+
+// BootloaderUploadFirmware checks the given signed firmware and uploads it to the device. Firmware
+// which is older than the installed firmware or whose age cannot be determined, too new for this
+// app, or whose signatures could not be verified is only uploaded if force is true. The progress is reported like in
+// BootloaderUpgradeFirmware().
+func (dbb *Device) BootloaderUploadFirmware(signedFirmware []byte, force bool) (*FirmwareCheck, error) {
+	if dbb.bootloaderStatus == nil {
+		return nil, errp.New("device is not in bootloader mode")
+	}
+	check, err := dbb.CheckFirmware(signedFirmware)
+	if err != nil {
+		return nil, err
+	}
+	log := dbb.log.WithFields(logrus.Fields{"version": check.Version, "hash": check.Hash})
+	if check.needsForce() && !force {
+		log.WithField("check", check).Info("firmware upload needs to be forced")
+		return check, errp.New("the firmware upload has to be forced")
+	}
+	log.Info("uploading firmware")
+	return check, dbb.bootloaderUpgradeFirmware(signedFirmware, check)
+}
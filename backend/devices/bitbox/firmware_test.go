@@ -0,0 +1,79 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bitbox
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSignedFirmware(t *testing.T) {
+	firmware, err := ParseSignedFirmware(BundledFirmware())
+	require.NoError(t, err)
+	require.Equal(t, BundledFirmwareVersion().String(), firmware.Version().String())
+	require.Len(t, firmware.Hash(), 32)
+
+	signatures := bytes.Repeat([]byte{1}, signaturesSize)
+	_, err = ParseSignedFirmware(signatures)
+	require.Error(t, err)
+	_, err = ParseSignedFirmware(append(signatures, []byte("no version")...))
+	require.Error(t, err)
+	_, err = ParseSignedFirmware(append(signatures, []byte("\x00v4.0.0\x00\x00v5.0.0\x00")...))
+	require.Error(t, err)
+	_, err = ParseSignedFirmware(append(signatures,
+		make([]byte, maxFirmwareSize+1)...))
+	require.Error(t, err)
+
+	firmware, err = ParseSignedFirmware(append(signatures, []byte("\x00v4.0.0\x00")...))
+	require.NoError(t, err)
+	require.Equal(t, "4.0.0", firmware.Version().String())
+}
+
+func TestFirmwareSigningKeys(t *testing.T) {
+	firmware, err := ParseSignedFirmware(BundledFirmware())
+	require.NoError(t, err)
+	hash := firmware.Hash()
+
+	privateKeys := []*btcec.PrivateKey{}
+	publicKeys := []*btcec.PublicKey{}
+	for i := 0; i < signaturesSize/signatureSize; i++ {
+		privateKey, err := btcec.NewPrivateKey(btcec.S256())
+		require.NoError(t, err)
+		privateKeys = append(privateKeys, privateKey)
+		publicKeys = append(publicKeys, privateKey.PubKey())
+	}
+	keys := NewFirmwareSigningKeys(publicKeys, 2)
+	sign := func(signers ...int) []byte {
+		signatures := make([]byte, signaturesSize)
+		for _, signer := range signers {
+			signature, err := privateKeys[signer].Sign(hash)
+			require.NoError(t, err)
+			signature.R.FillBytes(signatures[signer*signatureSize : signer*signatureSize+signatureSize/2])
+			signature.S.FillBytes(signatures[signer*signatureSize+signatureSize/2 : (signer+1)*signatureSize])
+		}
+		return signatures
+	}
+	require.True(t, keys.verify(hash, sign(3, 6)))
+	require.False(t, keys.verify(hash, sign(3)))
+	// A signature only counts for the signer at its position.
+	swapped := sign(3, 6)
+	copy(swapped[2*signatureSize:], swapped[3*signatureSize:4*signatureSize])
+	copy(swapped[3*signatureSize:], make([]byte, signatureSize))
+	require.False(t, keys.verify(hash, swapped))
+	require.False(t, keys.verify(hash, make([]byte, signaturesSize)))
+}
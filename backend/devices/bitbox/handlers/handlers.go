@@ -16,6 +16,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
@@ -45,7 +46,9 @@ type Bitbox interface {
 	CreateBackup(string, string) (bool, error)
 	BackupList() ([]map[string]string, error)
 	BootloaderUpgradeFirmware([]byte) error
-	StartPairing() (*relay.Channel, error)
+	CheckFirmware([]byte) (*bitbox.FirmwareCheck, error)
+	BootloaderUploadFirmware([]byte, bool) (*bitbox.FirmwareCheck, error)
+	StartPairing(relay.Server) (*relay.Channel, error)
 	Paired() bool
 	Lock() (bool, error)
 	CheckBackup(string, string) (bool, error)
@@ -88,6 +91,10 @@ func NewHandlers(
 	handleFunc("/pairing/start", handlers.postPairingStartHandler).Methods("POST")
 	handleFunc("/bootloader/upgrade-firmware",
 		handlers.postBootloaderUpgradeFirmwareHandler).Methods("POST")
+	handleFunc("/bootloader/check-firmware",
+		handlers.postBootloaderCheckFirmwareHandler).Methods("POST")
+	handleFunc("/bootloader/upload-firmware",
+		handlers.postBootloaderUploadFirmwareHandler).Methods("POST")
 	handleFunc("/lock", handlers.postLockHandler).Methods("POST")
 	handleFunc("/feature-set", handlers.postFeatureSetHandler).Methods("POST")
 	return handlers
@@ -293,8 +300,22 @@ func (handlers *Handlers) postBackupsCreateHandler(r *http.Request) (interface{}
 	return map[string]interface{}{"success": true, "verification": verification}, nil
 }
 
+// postPairingStartHandler starts a pairing. The optional field "server" of the body selects the
+// relay server of the pairing.
 func (handlers *Handlers) postPairingStartHandler(r *http.Request) (interface{}, error) {
-	return handlers.bitbox.StartPairing()
+	jsonBody := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&jsonBody); err != nil && err != io.EOF {
+		return nil, errp.WithStack(err)
+	}
+	var server relay.Server
+	if jsonBody["server"] != "" {
+		var err error
+		server, err = relay.ParseServer(jsonBody["server"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return handlers.bitbox.StartPairing(server)
 }
 
 func (handlers *Handlers) postBlinkDeviceHandler(_ *http.Request) (interface{}, error) {
@@ -324,6 +345,45 @@ func (handlers *Handlers) postBootloaderUpgradeFirmwareHandler(_ *http.Request)
 	return nil, handlers.bitbox.BootloaderUpgradeFirmware(bitbox.BundledFirmware())
 }
 
+// firmwareRequest is the body of the requests with a user supplied firmware file.
+type firmwareRequest struct {
+	// Firmware is the base64 encoded signed firmware file.
+	Firmware []byte `json:"firmware"`
+	Force    bool   `json:"force"`
+}
+
+func decodeFirmwareRequest(r *http.Request) (*firmwareRequest, error) {
+	var request firmwareRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return &request, nil
+}
+
+func (handlers *Handlers) postBootloaderCheckFirmwareHandler(r *http.Request) (interface{}, error) {
+	request, err := decodeFirmwareRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return handlers.bitbox.CheckFirmware(request.Firmware)
+}
+
+func (handlers *Handlers) postBootloaderUploadFirmwareHandler(r *http.Request) (interface{}, error) {
+	request, err := decodeFirmwareRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	check, err := handlers.bitbox.BootloaderUploadFirmware(request.Firmware, request.Force)
+	if err != nil {
+		return map[string]interface{}{
+			"success":      false,
+			"errorMessage": err.Error(),
+			"firmware":     check,
+		}, nil
+	}
+	return map[string]interface{}{"success": true, "firmware": check}, nil
+}
+
 func (handlers *Handlers) postLockHandler(_ *http.Request) (interface{}, error) {
 	return handlers.bitbox.Lock()
 }
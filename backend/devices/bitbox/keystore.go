@@ -46,6 +46,19 @@ func (keystore *keystore) CosignerIndex() int {
 	return keystore.cosignerIndex
 }
 
+// Identifier implements keystore.Keystore. It is the id in the device info, which the device
+// derives from the master public key of the unlocked wallet.
+func (keystore *keystore) Identifier() (string, error) {
+	deviceInfo, err := keystore.dbb.DeviceInfo()
+	if err != nil {
+		return "", err
+	}
+	if deviceInfo.ID == "" {
+		return "", errp.New("the device is not seeded")
+	}
+	return deviceInfo.ID, nil
+}
+
 // HasSecureOutput implements keystore.Keystore.
 func (keystore *keystore) HasSecureOutput(
 	configuration *signing.Configuration, coin coin.Coin) bool {
@@ -18,13 +18,14 @@ import (
 	"time"
 
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/relay"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 )
 
 // finishPairing finalizes the persistence of the pairing configuration, actively listens on the
 // mobile channel and fires an event to indicate pairing success or failure.
 func (device *Device) finishPairing(channel *relay.Channel) {
 	device.mu.Lock()
-	if err := channel.StoreToConfigFile(device.channelConfigDir); err != nil {
+	if err := channel.StoreToConfigFile(device.channelConfigDir, device.channelConfigKey); err != nil {
 		device.mu.Unlock() // fireEvent below needs read-lock
 		device.log.WithError(err).Error("Failed to store the channel config file.")
 		device.fireEvent(EventPairingError, nil)
@@ -38,6 +39,18 @@ func (device *Device) finishPairing(channel *relay.Channel) {
 	device.fireEvent(EventPairingSuccess, nil)
 }
 
+// SetChannelConfigKey sets the key with which the channel settings are encrypted, and stores the
+// channel settings of the current pairing with it.
+func (device *Device) SetChannelConfigKey(key *encryption.Key) error {
+	device.mu.Lock()
+	defer device.mu.Unlock()
+	device.channelConfigKey = key
+	if device.channel == nil {
+		return nil
+	}
+	return device.channel.StoreToConfigFile(device.channelConfigDir, key)
+}
+
 // processPairing processes the pairing after the channel has been displayed as a QR code.
 func (device *Device) processPairing(channel *relay.Channel) {
 	if err := channel.WaitForScanningSuccess(time.Minute); err != nil {
@@ -105,7 +105,7 @@ func TestFinishPairing(t *testing.T) {
 			if !test.wantPaired {
 				return
 			}
-			storedChan := relay.NewChannelFromConfigFile(test.configDir)
+			storedChan := relay.NewChannelFromConfigFile(test.configDir, nil)
 			if storedChan == nil {
 				t.Fatalf("relay.NewChannelFromConfigFile(%q) returned nil", test.configDir)
 			}
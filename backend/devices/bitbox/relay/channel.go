@@ -20,6 +20,7 @@ import (
 
 	"github.com/btcsuite/btcutil/base58"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
@@ -43,6 +44,10 @@ type Channel struct {
 	// AuthenticationKey is used to authenticate messages between the desktop and the mobile.
 	AuthenticationKey []byte `json:"mac"`
 
+	// Server is the relay server through which the messages are passed. If empty, the default
+	// server is used.
+	Server Server `json:"server,omitempty"`
+
 	// messageBuffer buffers the messages that were not expected by the caller of waitForValue.
 	messageBuffer [][]byte
 
@@ -73,9 +78,10 @@ func NewChannelWithRandomKey() *Channel {
 }
 
 // NewChannelFromConfigFile returns a new channel with the channel identifier and encryption key
-// from the config file or nil if the config file does not exist.
-func NewChannelFromConfigFile(configDir string) *Channel {
-	configFile := config.NewFile(configDir, configFileName)
+// from the config file or nil if the config file does not exist. The config file is decrypted with
+// the given key if it is encrypted.
+func NewChannelFromConfigFile(configDir string, key *encryption.Key) *Channel {
+	configFile := config.NewEncryptedFile(configDir, configFileName, key)
 	if configFile.Exists() {
 		var configuration configuration
 		if err := configFile.ReadJSON(&configuration); err != nil {
@@ -86,11 +92,12 @@ func NewChannelFromConfigFile(configDir string) *Channel {
 	return nil
 }
 
-// StoreToConfigFile stores the channel to the config file located in the provided configDir.
+// StoreToConfigFile stores the channel to the config file located in the provided configDir,
+// encrypted with the given key unless it is nil.
 // Callers can use config.AppDir to obtain standard user location config dir.
-func (channel *Channel) StoreToConfigFile(configDir string) error {
+func (channel *Channel) StoreToConfigFile(configDir string, key *encryption.Key) error {
 	configuration := newConfiguration(channel)
-	configFile := config.NewFile(configDir, configFileName)
+	configFile := config.NewEncryptedFile(configDir, configFileName, key)
 	return configFile.WriteJSON(configuration)
 }
 
@@ -100,10 +107,12 @@ func (channel *Channel) RemoveConfigFile(configDir string) error {
 	return config.NewFile(configDir, configFileName).Remove()
 }
 
-// relayServer returns the configured relay server.
-// The server is hardcoded for now but can be loaded from the settings in the future.
-func relayServer() Server {
-	return DefaultServer
+// relayServer returns the relay server of the channel.
+func (channel *Channel) relayServer() Server {
+	if channel.Server == "" {
+		return DefaultServer
+	}
+	return channel.Server
 }
 
 // getValueFromMessage returns the value of the field in the message and true, if found, or
@@ -146,7 +155,7 @@ func (channel *Channel) waitForValue(duration time.Duration, name string) (strin
 			unlock()
 		} else {
 			unlock()
-			message, err := PullOldestMessage(relayServer(), channel)
+			message, err := PullOldestMessage(channel.relayServer(), channel)
 			if err != nil {
 				return "", err
 			}
@@ -202,21 +211,21 @@ func (channel *Channel) WaitForCommand(duration time.Duration) (string, error) {
 
 // SendHashPubKey sends the hash of the public key from the BitBox to the mobile to finish pairing.
 func (channel *Channel) SendHashPubKey(verifyPass interface{}) error {
-	return PushMessage(relayServer(), channel, map[string]interface{}{
+	return PushMessage(channel.relayServer(), channel, map[string]interface{}{
 		"ecdh": verifyPass,
 	})
 }
 
 // SendPubKey sends the ECDH public key from the BitBox to the paired mobile to finish pairing.
 func (channel *Channel) SendPubKey(verifyPass interface{}) error {
-	return PushMessage(relayServer(), channel, map[string]interface{}{
+	return PushMessage(channel.relayServer(), channel, map[string]interface{}{
 		"ecdh": verifyPass,
 	})
 }
 
 // SendPairingTest sends the encrypted test string from the BitBox to the paired mobile.
 func (channel *Channel) SendPairingTest(tfaTestString string) error {
-	return PushMessage(relayServer(), channel, map[string]string{
+	return PushMessage(channel.relayServer(), channel, map[string]string{
 		"tfa": tfaTestString,
 	})
 }
@@ -228,7 +237,7 @@ type action struct {
 
 // SendPing sends a 'ping' to the paired mobile to which it automatically responds with 'pong'.
 func (channel *Channel) SendPing() error {
-	return PushMessage(relayServer(), channel, &action{"ping"})
+	return PushMessage(channel.relayServer(), channel, &action{"ping"})
 }
 
 // WaitForPong waits for the given duration for the 'pong' from the mobile after sending 'ping'.
@@ -245,12 +254,12 @@ func (channel *Channel) WaitForPong(duration time.Duration) error {
 
 // SendClear clears the screen of the paired mobile.
 func (channel *Channel) SendClear() error {
-	return PushMessage(relayServer(), channel, &action{"clear"})
+	return PushMessage(channel.relayServer(), channel, &action{"clear"})
 }
 
 // SendXpubEcho sends the encrypted xpub echo from the BitBox to the paired mobile.
 func (channel *Channel) SendXpubEcho(xpubEcho string, typ string) error {
-	return PushMessage(relayServer(), channel, map[string]string{
+	return PushMessage(channel.relayServer(), channel, map[string]string{
 		"echo": xpubEcho,
 		"type": typ,
 	})
@@ -263,7 +272,7 @@ func (channel *Channel) SendSigningEcho(
 	scriptType string,
 	transaction string,
 ) error {
-	return PushMessage(relayServer(), channel, map[string]string{
+	return PushMessage(channel.relayServer(), channel, map[string]string{
 		"echo":               signingEcho,
 		"coin":               coin,
 		"inputAndChangeType": scriptType,
@@ -280,7 +289,7 @@ func (channel *Channel) WaitForSigningPin(duration time.Duration) (string, error
 
 // SendRandomNumberEcho sends the encrypted random number echo from the BitBox to the paired mobile.
 func (channel *Channel) SendRandomNumberEcho(randomNumberEcho string) error {
-	return PushMessage(relayServer(), channel, map[string]string{
+	return PushMessage(channel.relayServer(), channel, map[string]string{
 		"echo": randomNumberEcho,
 	})
 }
@@ -18,6 +18,8 @@ type configuration struct {
 	ChannelID         string `json:"channel"`
 	EncryptionKey     []byte `json:"encryption"`
 	AuthenticationKey []byte `json:"authentication"`
+	// Server is the relay server of the pairing. Empty for the default server.
+	Server Server `json:"server,omitempty"`
 }
 
 func newConfiguration(channel *Channel) *configuration {
@@ -25,9 +27,12 @@ func newConfiguration(channel *Channel) *configuration {
 		ChannelID:         channel.ChannelID,
 		EncryptionKey:     channel.EncryptionKey,
 		AuthenticationKey: channel.AuthenticationKey,
+		Server:            channel.Server,
 	}
 }
 
 func (config *configuration) channel() *Channel {
-	return NewChannel(config.ChannelID, config.EncryptionKey, config.AuthenticationKey)
+	channel := NewChannel(config.ChannelID, config.EncryptionKey, config.AuthenticationKey)
+	channel.Server = config.Server
+	return channel
 }
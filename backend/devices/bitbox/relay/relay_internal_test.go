@@ -17,23 +17,27 @@ package relay
 import (
 	"encoding/base64"
 	"encoding/json"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/relay/relayserver"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/crypto"
-	"github.com/stretchr/testify/assert"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
 )
 
-const online = false
-
-func TestDeleteAllMessages(t *testing.T) {
-	if online {
-		assert.NoError(t, DeleteAllMessages(relayServer()))
-	}
+// newTestChannel returns a channel using a local relay server, which has to be closed by the caller.
+func newTestChannel(t *testing.T, expiry time.Duration) (*Channel, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(relayserver.NewServer(100*time.Millisecond, expiry))
+	channel := NewChannelWithRandomKey()
+	channel.Server = Server(server.URL)
+	return channel, server
 }
 
-func sendPongAsMobile(channel *Channel) error {
-	data := map[string]string{"action": "pong"}
+func sendAsMobile(channel *Channel, data interface{}) error {
 	bytes, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -45,7 +49,7 @@ func sendPongAsMobile(channel *Channel) error {
 	content := base64.StdEncoding.EncodeToString(encrypted)
 
 	request := &request{
-		server:  relayServer(),
+		server:  channel.relayServer(),
 		command: PushMessageCommand,
 		sender:  Mobile,
 		channel: channel,
@@ -60,11 +64,104 @@ func sendPongAsMobile(channel *Channel) error {
 	return response.getErrorIfNok()
 }
 
-func TestPingPong(t *testing.T) {
-	if online {
-		channel := NewChannelWithRandomKey()
-		assert.NoError(t, channel.SendPing())
-		assert.NoError(t, sendPongAsMobile(channel))
-		assert.NoError(t, channel.WaitForPong(2*time.Second))
+// receiveAsMobile pulls the oldest message for the mobile and decodes it into value.
+func receiveAsMobile(t *testing.T, channel *Channel, value interface{}) {
+	t.Helper()
+	request := &request{
+		server:  channel.relayServer(),
+		command: PullOldestMessageCommand,
+		sender:  Mobile,
+		channel: channel,
 	}
+	response, err := request.send()
+	require.NoError(t, err)
+	require.NoError(t, response.getErrorIfNok())
+	require.Len(t, response.Data, 1)
+	decoded, err := base64.StdEncoding.DecodeString(response.Data[0].Payload)
+	require.NoError(t, err)
+	message, err := crypto.MACThenDecrypt(decoded, channel.EncryptionKey, channel.AuthenticationKey)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(message, value))
+}
+
+func TestDeleteAllMessages(t *testing.T) {
+	channel, server := newTestChannel(t, 50*time.Millisecond)
+	defer server.Close()
+	require.NoError(t, sendAsMobile(channel, map[string]string{"action": "pong"}))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, DeleteAllMessages(channel.relayServer()))
+	message, err := PullOldestMessage(channel.relayServer(), channel)
+	require.NoError(t, err)
+	require.Nil(t, message)
+}
+
+func TestPingPong(t *testing.T) {
+	channel, server := newTestChannel(t, relayserver.DefaultExpiry)
+	defer server.Close()
+	require.NoError(t, channel.SendPing())
+	ping := map[string]string{}
+	receiveAsMobile(t, channel, &ping)
+	require.Equal(t, "ping", ping["action"])
+
+	require.NoError(t, sendAsMobile(channel, map[string]string{"action": "pong"}))
+	require.NoError(t, channel.WaitForPong(2*time.Second))
+
+	// No pong.
+	require.Error(t, channel.WaitForPong(200*time.Millisecond))
+}
+
+func TestEcho(t *testing.T) {
+	channel, server := newTestChannel(t, relayserver.DefaultExpiry)
+	defer server.Close()
+
+	require.NoError(t, channel.SendXpubEcho("xpub echo", "p2wpkh"))
+	xpubEcho := map[string]string{}
+	receiveAsMobile(t, channel, &xpubEcho)
+	require.Equal(t, map[string]string{"echo": "xpub echo", "type": "p2wpkh"}, xpubEcho)
+
+	require.NoError(t, channel.SendSigningEcho("signing echo", "btc", "p2wpkh", "tx"))
+	signingEcho := map[string]string{}
+	receiveAsMobile(t, channel, &signingEcho)
+	require.Equal(t, map[string]string{
+		"echo":               "signing echo",
+		"coin":               "btc",
+		"inputAndChangeType": "p2wpkh",
+		"tx":                 "tx",
+	}, signingEcho)
+
+	// Messages which are not waited for are buffered.
+	require.NoError(t, sendAsMobile(channel, map[string]string{"action": "pong"}))
+	require.NoError(t, sendAsMobile(channel, map[string]string{"pin": "123456"}))
+	pin, err := channel.WaitForSigningPin(2 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "123456", pin)
+	require.NoError(t, channel.WaitForPong(time.Second))
+}
+
+func TestConfigFile(t *testing.T) {
+	channel, server := newTestChannel(t, relayserver.DefaultExpiry)
+	defer server.Close()
+	configDir := test.TstTempDir("relay")
+	require.Nil(t, NewChannelFromConfigFile(configDir, nil))
+	require.NoError(t, channel.StoreToConfigFile(configDir, nil))
+	stored := NewChannelFromConfigFile(configDir, nil)
+	require.NotNil(t, stored)
+	require.Equal(t, channel.Server, stored.Server)
+	require.Equal(t, channel.ChannelID, stored.ChannelID)
+
+	// The encrypted config file can only be read with the key.
+	key := encryption.NewKey([]byte("secret"))
+	require.NoError(t, channel.StoreToConfigFile(configDir, key))
+	require.Nil(t, NewChannelFromConfigFile(configDir, nil))
+	require.Nil(t, NewChannelFromConfigFile(configDir, encryption.NewKey([]byte("other"))))
+	stored = NewChannelFromConfigFile(configDir, key)
+	require.NotNil(t, stored)
+	require.Equal(t, channel.EncryptionKey, stored.EncryptionKey)
+
+	require.Equal(t, DefaultServer, NewChannelWithRandomKey().relayServer())
+	_, err := ParseServer("ftp://relay.example.com")
+	require.Error(t, err)
+	parsed, err := ParseServer("https://relay.example.com/relay")
+	require.NoError(t, err)
+	require.Equal(t, Server("https://relay.example.com/relay"), parsed)
 }
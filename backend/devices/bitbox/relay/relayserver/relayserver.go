@@ -0,0 +1,246 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relayserver implements the relay server which passes the encrypted messages between the
+// desktop and the paired mobile. It speaks the protocol of the default relay server, so that it
+// can be used in its place.
+package relayserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPollTimeout is how long a pull waits for a message before returning none.
+	DefaultPollTimeout = 10 * time.Second
+
+	// DefaultExpiry is the age at which messages are deleted.
+	DefaultExpiry = 40 * time.Second
+
+	// maxRequestSize limits the size of the requests, which only contain small encrypted messages.
+	maxRequestSize = 1 << 20
+)
+
+// The commands of the protocol, see relay.Command.
+const (
+	pushMessageCommand       = "data"
+	pullOldestMessageCommand = "gd"
+	deleteAllMessagesCommand = "dd"
+)
+
+// The parties of the protocol, see relay.Party.
+const (
+	desktop = "0"
+	mobile  = "1"
+)
+
+type message struct {
+	id      int
+	channel string
+	sender  string
+	payload string
+	created time.Time
+}
+
+// data is an entry in the data of a successful pull response.
+type data struct {
+	ID      int    `json:"id"`
+	Age     int    `json:"age"`
+	Payload string `json:"payload"`
+}
+
+// response is the JSON reply of every request.
+type response struct {
+	Status string  `json:"status"`
+	Data   []data  `json:"data,omitempty"`
+	Error  *string `json:"error,omitempty"`
+}
+
+// Server keeps the messages in memory. It implements http.Handler.
+type Server struct {
+	pollTimeout time.Duration
+	expiry      time.Duration
+
+	messages []*message
+	nextID   int
+	// pushed is closed and replaced whenever a message is pushed, waking up the waiting pulls.
+	pushed chan struct{}
+	lock   locker.Locker
+
+	log *logrus.Entry
+}
+
+// NewServer creates a relay server. Pulls wait up to pollTimeout for a message and messages are
+// deleted once they are older than expiry.
+func NewServer(pollTimeout time.Duration, expiry time.Duration) *Server {
+	return &Server{
+		pollTimeout: pollTimeout,
+		expiry:      expiry,
+		messages:    []*message{},
+		nextID:      1,
+		pushed:      make(chan struct{}),
+		log:         logging.Get().WithGroup("relayserver"),
+	}
+}
+
+// parseRequest parses the form encoded request body. The values are not unescaped, as the clients
+// do not escape the base64 encoded payloads (see relay.request.encode).
+func parseRequest(body string) map[string]string {
+	values := map[string]string{}
+	for _, pair := range strings.Split(body, "&") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	return values
+}
+
+// ServeHTTP implements http.Handler.
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		server.reply(writer, errorResponse("only POST requests are supported"))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxRequestSize))
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		server.reply(writer, errorResponse("could not read the request"))
+		return
+	}
+	server.reply(writer, server.handle(request, parseRequest(string(body))))
+}
+
+func (server *Server) reply(writer http.ResponseWriter, response *response) {
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		server.log.WithError(err).Debug("could not send the response")
+	}
+}
+
+func errorResponse(message string) *response {
+	return &response{Status: "nok", Error: &message}
+}
+
+func (server *Server) handle(request *http.Request, values map[string]string) *response {
+	command := values["c"]
+	if command == deleteAllMessagesCommand {
+		server.DeleteExpired()
+		return &response{Status: "ok"}
+	}
+	sender := values["dt"]
+	if sender != desktop && sender != mobile {
+		return errorResponse("invalid device type")
+	}
+	channel := values["uuid"]
+	if channel == "" {
+		return errorResponse("missing channel")
+	}
+	switch command {
+	case pushMessageCommand:
+		payload, ok := values["pl"]
+		if !ok {
+			return errorResponse("missing payload")
+		}
+		server.push(channel, sender, payload)
+		return &response{Status: "ok"}
+	case pullOldestMessageCommand:
+		message := server.pull(request, channel, sender)
+		if message == nil {
+			return &response{Status: "ok"}
+		}
+		return &response{Status: "ok", Data: []data{{
+			ID:      message.id,
+			Age:     int(time.Since(message.created).Seconds()),
+			Payload: message.payload,
+		}}}
+	default:
+		return errorResponse("unknown command")
+	}
+}
+
+func (server *Server) push(channel string, sender string, payload string) {
+	defer server.lock.Lock()()
+	server.messages = append(server.messages, &message{
+		id:      server.nextID,
+		channel: channel,
+		sender:  sender,
+		payload: payload,
+		created: time.Now(),
+	})
+	server.nextID++
+	close(server.pushed)
+	server.pushed = make(chan struct{})
+}
+
+// pull removes and returns the oldest message on the channel for the given recipient. It waits up
+// to the poll timeout for a message and returns nil if there is none.
+func (server *Server) pull(request *http.Request, channel string, recipient string) *message {
+	timeout := time.NewTimer(server.pollTimeout)
+	defer timeout.Stop()
+	for {
+		message, pushed := server.takeOldest(channel, recipient)
+		if message != nil {
+			return message
+		}
+		select {
+		case <-pushed:
+		case <-timeout.C:
+			return nil
+		case <-request.Context().Done():
+			return nil
+		}
+	}
+}
+
+// takeOldest removes and returns the oldest message which is not expired. If there is none, it
+// returns the channel which is closed when the next message is pushed.
+func (server *Server) takeOldest(channel string, recipient string) (*message, <-chan struct{}) {
+	defer server.lock.Lock()()
+	server.removeExpired()
+	for index, message := range server.messages {
+		if message.channel == channel && message.sender != recipient {
+			server.messages = append(server.messages[:index], server.messages[index+1:]...)
+			return message, nil
+		}
+	}
+	return nil, server.pushed
+}
+
+// DeleteExpired deletes the expired messages of all channels. Expired messages are never returned,
+// but they are only deleted by this and by pulls on their channel.
+func (server *Server) DeleteExpired() {
+	defer server.lock.Lock()()
+	server.removeExpired()
+}
+
+// removeExpired removes the expired messages. The lock must be held.
+func (server *Server) removeExpired() {
+	messages := []*message{}
+	for _, message := range server.messages {
+		if time.Since(message.created) < server.expiry {
+			messages = append(messages, message)
+		}
+	}
+	server.messages = messages
+}
@@ -14,6 +14,12 @@
 
 package relay
 
+import (
+	"net/url"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
 // Server models the relay server, which relays messages between the paired parties.
 type Server string
 
@@ -21,3 +27,15 @@ const (
 	// DefaultServer stores the default server.
 	DefaultServer Server = "https://digitalbitbox.com/smartverification/index.php"
 )
+
+// ParseServer returns the relay server at the given http or https URL.
+func ParseServer(rawURL string) (Server, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errp.WithStack(err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", errp.Newf("invalid relay server URL %s", rawURL)
+	}
+	return Server(rawURL), nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+const (
+	// chunkSize is the size of the firmware chunks written by the bootloader.
+	chunkSize = 8 * 512
+
+	// firmwareSigners is the number of signatures in front of a signed firmware, and
+	// firmwareSignaturesRequired the number of them which have to be valid.
+	firmwareSigners            = 7
+	firmwareSignaturesRequired = 4
+	signatureSize              = 64
+)
+
+// firmwareSigningKeys are the keys of the simulated firmware signers. They are deterministic, so
+// that firmware signed with SignFirmware() can be flashed to any simulator.
+var firmwareSigningKeys = func() []*btcec.PrivateKey {
+	keys := []*btcec.PrivateKey{}
+	for i := 0; i < firmwareSigners; i++ {
+		secret := sha256.Sum256([]byte(fmt.Sprintf("bitbox simulator firmware signer %d", i)))
+		privateKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), secret[:])
+		keys = append(keys, privateKey)
+	}
+	return keys
+}()
+
+// FirmwareSigningKeys returns the public keys of the simulated firmware signers, which verify the
+// firmware signed with SignFirmware().
+func FirmwareSigningKeys() *bitbox.FirmwareSigningKeys {
+	publicKeys := []*btcec.PublicKey{}
+	for _, privateKey := range firmwareSigningKeys {
+		publicKeys = append(publicKeys, privateKey.PubKey())
+	}
+	return bitbox.NewFirmwareSigningKeys(publicKeys, firmwareSignaturesRequired)
+}
+
+// firmwareHash returns the hash which is signed, which covers the binary padded to the chunk
+// size, like the bootloader writes it.
+func firmwareHash(firmware []byte) []byte {
+	padded := append([]byte{}, firmware...)
+	if remainder := len(padded) % chunkSize; remainder != 0 {
+		padded = append(padded, bytes.Repeat([]byte{0xFF}, chunkSize-remainder)...)
+	}
+	return chainhash.DoubleHashB(padded)
+}
+
+// SignFirmware signs the firmware binary with the keys of the simulated signers. The result has
+// the layout expected by bitbox.Device.BootloaderUpgradeFirmware(): the signatures of all signers
+// followed by the binary.
+func SignFirmware(firmware []byte) []byte {
+	hash := firmwareHash(firmware)
+	signed := []byte{}
+	for _, privateKey := range firmwareSigningKeys {
+		signature, err := privateKey.Sign(hash)
+		if err != nil {
+			panic(errp.WithStack(err))
+		}
+		signed = append(signed, paddedBytes(signature.R)...)
+		signed = append(signed, paddedBytes(signature.S)...)
+	}
+	return append(signed, firmware...)
+}
+
+func paddedBytes(number *big.Int) []byte {
+	result := make([]byte, signatureSize/2)
+	numberBytes := number.Bytes()
+	copy(result[len(result)-len(numberBytes):], numberBytes)
+	return result
+}
+
+// verifyFirmware returns whether enough of the signatures are valid for the firmware hash.
+func verifyFirmware(hash []byte, signatures []byte) bool {
+	valid := 0
+	for i, privateKey := range firmwareSigningKeys {
+		signature := signatures[i*signatureSize : (i+1)*signatureSize]
+		parsed := &btcec.Signature{
+			R: new(big.Int).SetBytes(signature[:signatureSize/2]),
+			S: new(big.Int).SetBytes(signature[signatureSize/2:]),
+		}
+		if parsed.Verify(hash, privateKey.PubKey()) {
+			valid++
+		}
+	}
+	return valid >= firmwareSignaturesRequired
+}
+
+// SetBootloaderMode simulates replugging the device, entering the bootloader if bootloader is
+// true (holding the touch button while plugging in). Entering the bootloader fails if it is
+// locked.
+func (simulator *Simulator) SetBootloaderMode(bootloader bool) error {
+	defer simulator.lock.Lock()()
+	if bootloader && simulator.bootlock {
+		return errp.New("the bootloader is locked")
+	}
+	simulator.bootloader = bootloader
+	simulator.pendingSign = nil
+	simulator.chunks = nil
+	return nil
+}
+
+// Bootloader returns whether the simulator is in bootloader mode.
+func (simulator *Simulator) Bootloader() bool {
+	defer simulator.lock.RLock()()
+	return simulator.bootloader
+}
+
+// Firmware returns the last flashed firmware which passed the signature verification, padded to
+// the chunk size. It is nil if no firmware was flashed.
+func (simulator *Simulator) Firmware() []byte {
+	defer simulator.lock.RLock()()
+	return simulator.firmware
+}
+
+// SendBootloader implements bitbox.CommunicationInterface. The reply is the command followed by
+// '0' on success, and by 'E' on failure.
+func (simulator *Simulator) SendBootloader(msg []byte) ([]byte, error) {
+	defer simulator.lock.Lock()()
+	if !simulator.bootloader {
+		return nil, errp.New("the simulator is not in bootloader mode")
+	}
+	if len(msg) == 0 {
+		return nil, errp.New("empty bootloader command")
+	}
+	cmd := msg[0]
+	if !simulator.bootloaderCommand(cmd, msg[1:]) {
+		return []byte{cmd, 'E'}, nil
+	}
+	return []byte{cmd, '0'}, nil
+}
+
+// bootloaderCommand executes a bootloader command and returns whether it succeeded.
+func (simulator *Simulator) bootloaderCommand(cmd byte, data []byte) bool {
+	switch cmd {
+	case 'e':
+		// Erase.
+		simulator.chunks = map[byte][]byte{}
+		simulator.firmware = nil
+		return true
+	case 'w':
+		// Write a chunk: the chunk number followed by the chunk padded to the chunk size.
+		if simulator.chunks == nil || len(data) != 1+chunkSize {
+			return false
+		}
+		simulator.chunks[data[0]] = append([]byte{}, data[1:]...)
+		return true
+	case 's':
+		// Verify the signatures: '0' followed by the hex encoded signatures.
+		if len(data) != 1+2*firmwareSigners*signatureSize || data[0] != '0' {
+			return false
+		}
+		signatures, err := hex.DecodeString(string(data[1:]))
+		if err != nil || len(simulator.chunks) == 0 {
+			return false
+		}
+		firmware := []byte{}
+		for i := 0; i < len(simulator.chunks); i++ {
+			chunk, ok := simulator.chunks[byte(i)]
+			if !ok {
+				return false
+			}
+			firmware = append(firmware, chunk...)
+		}
+		if !verifyFirmware(chainhash.DoubleHashB(firmware), signatures) {
+			return false
+		}
+		simulator.firmware = firmware
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/jsonp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/random"
+)
+
+// signData is a hash to sign with the key at the keypath.
+type signData struct {
+	Hash    string `json:"hash"`
+	Keypath string `json:"keypath"`
+}
+
+// checkPub is a public key of the change output, which the device checks against the keypath.
+type checkPub struct {
+	Pubkey  string `json:"pubkey"`
+	Keypath string `json:"keypath"`
+}
+
+// decode decodes the value of a command.
+func decode(value json.RawMessage, target interface{}) error {
+	if err := json.Unmarshal(value, target); err != nil {
+		return newError("JSON parse error.", errIOJSONParse)
+	}
+	return nil
+}
+
+func errInvalidCommand() error {
+	return newError("Invalid command.", errIOInvalidCmd)
+}
+
+func errLocked() error {
+	return newError("Disabled while the device is locked (2FA).", errIOLocked)
+}
+
+// echo encodes the value like the echo sent to the mobile app. The firmware encrypts it with the
+// key shared with the mobile, which the simulator does not have.
+func echo(value interface{}) string {
+	return base64.StdEncoding.EncodeToString(jsonp.MustMarshal(value))
+}
+
+// handle executes an authenticated command. hidden is true if the password of the hidden wallet
+// was used.
+func (simulator *Simulator) handle(name string, value json.RawMessage, hidden bool) (
+	interface{}, error) {
+	var str string
+	isString := json.Unmarshal(value, &str) == nil
+	switch name {
+	case "device":
+		return simulator.handleDevice(str, hidden)
+	case "password":
+		if !isString || str == "" {
+			return nil, errInvalidCommand()
+		}
+		if simulator.locked {
+			return nil, errLocked()
+		}
+		if hidden {
+			simulator.hiddenPIN = str
+		} else {
+			simulator.pin = str
+		}
+		return map[string]string{"password": responseSuccess}, nil
+	case "name":
+		if !isString {
+			return nil, errInvalidCommand()
+		}
+		if str != "" {
+			simulator.name = str
+		}
+		return map[string]string{"name": simulator.name}, nil
+	case "led":
+		if str != "blink" {
+			return nil, errInvalidCommand()
+		}
+		return map[string]string{"led": responseSuccess}, nil
+	case "random":
+		if str != "true" && str != "pseudo" {
+			return nil, errInvalidCommand()
+		}
+		randomHex := hex.EncodeToString(random.BytesOrPanic(16))
+		return map[string]string{"random": randomHex, "echo": echo(randomHex)}, nil
+	case "seed":
+		return simulator.handleSeed(value)
+	case "backup":
+		if isString {
+			return simulator.handleBackupList(str)
+		}
+		return simulator.handleBackup(value, hidden)
+	case "hidden_password":
+		return simulator.handleHiddenPassword(value)
+	case "xpub":
+		return simulator.handleXPub(str, hidden)
+	case "sign":
+		if isString && str == "" {
+			return simulator.handleSign("", hidden)
+		}
+		var tfa struct {
+			PIN *string `json:"pin"`
+		}
+		if err := decode(value, &tfa); err != nil {
+			return nil, err
+		}
+		if tfa.PIN != nil {
+			return simulator.handleSign(*tfa.PIN, hidden)
+		}
+		return simulator.handleSignData(value, hidden)
+	case "reset":
+		if str != "__ERASE__" {
+			return nil, errInvalidCommand()
+		}
+		if !simulator.touch(name) {
+			return nil, errAbort()
+		}
+		simulator.reset()
+		return map[string]string{"reset": responseSuccess}, nil
+	case "bootloader":
+		switch str {
+		case "lock":
+			simulator.bootlock = true
+		case "unlock":
+			if simulator.locked {
+				return nil, errLocked()
+			}
+			if !simulator.touch(name) {
+				return nil, errAbort()
+			}
+			simulator.bootlock = false
+		default:
+			return nil, errInvalidCommand()
+		}
+		return map[string]string{"bootloader": str}, nil
+	case "feature_set":
+		var features bitbox.FeatureSet
+		if err := decode(value, &features); err != nil {
+			return nil, err
+		}
+		simulator.newHiddenWallet = features.NewHiddenWallet
+		return map[string]string{"feature_set": responseSuccess}, nil
+	default:
+		return nil, errInvalidCommand()
+	}
+}
+
+func (simulator *Simulator) handleDevice(value string, hidden bool) (interface{}, error) {
+	switch value {
+	case "info":
+		return map[string]interface{}{"device": simulator.deviceInfo(hidden)}, nil
+	case "lock":
+		if simulator.entropy == nil {
+			return nil, newError("A wallet is not loaded.", errKeyNotSeeded)
+		}
+		if !simulator.touch("lock") {
+			return nil, errAbort()
+		}
+		simulator.locked = true
+		return map[string]interface{}{"device": map[string]bool{"lock": true}}, nil
+	default:
+		return nil, errInvalidCommand()
+	}
+}
+
+func (simulator *Simulator) handleSeed(value json.RawMessage) (interface{}, error) {
+	var seed struct {
+		Source   string `json:"source"`
+		Key      string `json:"key"`
+		Filename string `json:"filename"`
+	}
+	if err := decode(value, &seed); err != nil {
+		return nil, err
+	}
+	if simulator.locked {
+		return nil, errLocked()
+	}
+	if seed.Key == "" || seed.Filename == "" {
+		return nil, errInvalidCommand()
+	}
+	if !simulator.sdCardInserted {
+		return nil, newError("Please insert SD card.", bitbox.ErrSDCard)
+	}
+	var entropy []byte
+	switch seed.Source {
+	case "create":
+		if _, ok := simulator.sdCard[seed.Filename]; ok {
+			return nil, newError("Backup file already exists.", errSDFileExists)
+		}
+		entropy = random.BytesOrPanic(32)
+		simulator.sdCard[seed.Filename] = entropy
+	case "backup":
+		var ok bool
+		entropy, ok = simulator.sdCard[seed.Filename]
+		if !ok {
+			return nil, newError("Backup file not found.", errSDFileNotFound)
+		}
+	default:
+		// U2F seeding is not simulated.
+		return nil, errInvalidCommand()
+	}
+	if !simulator.touch("seed") {
+		return nil, errAbort()
+	}
+	simulator.entropy = entropy
+	simulator.master = masterKey(entropy, seed.Key)
+	simulator.hiddenPIN = ""
+	simulator.hiddenMaster = nil
+	return map[string]string{"seed": responseSuccess}, nil
+}
+
+func (simulator *Simulator) handleBackupList(value string) (interface{}, error) {
+	if value != "list" {
+		return nil, errInvalidCommand()
+	}
+	if !simulator.sdCardInserted {
+		return nil, newError("Please insert SD card.", bitbox.ErrSDCard)
+	}
+	return map[string]interface{}{"backup": simulator.backups()}, nil
+}
+
+func (simulator *Simulator) handleBackup(value json.RawMessage, hidden bool) (interface{}, error) {
+	var backup struct {
+		Key      string  `json:"key"`
+		Check    *string `json:"check"`
+		Filename *string `json:"filename"`
+		Erase    *string `json:"erase"`
+	}
+	if err := decode(value, &backup); err != nil {
+		return nil, err
+	}
+	if simulator.locked {
+		return nil, errLocked()
+	}
+	if !simulator.sdCardInserted {
+		return nil, newError("Please insert SD card.", bitbox.ErrSDCard)
+	}
+	errNoMatch := newError("Backup file does not match wallet.", bitbox.ErrSDNoMatch)
+	switch {
+	case backup.Erase != nil:
+		if _, ok := simulator.sdCard[*backup.Erase]; !ok {
+			return nil, newError("Backup file not found.", errSDFileNotFound)
+		}
+		delete(simulator.sdCard, *backup.Erase)
+	case backup.Check != nil:
+		entropy, ok := simulator.sdCard[*backup.Check]
+		if !ok {
+			return nil, newError("Backup file not found.", errSDFileNotFound)
+		}
+		master := simulator.walletMaster(hidden)
+		if master == nil {
+			return nil, newError("A wallet is not loaded.", errKeyNotSeeded)
+		}
+		if masterKey(entropy, backup.Key).String() != master.String() {
+			return nil, errNoMatch
+		}
+	case backup.Filename != nil:
+		master := simulator.walletMaster(hidden)
+		if master == nil {
+			return nil, newError("A wallet is not loaded.", errKeyNotSeeded)
+		}
+		if *backup.Filename == "" {
+			return nil, newError("Invalid backup filename.", errSDInvalidFormat)
+		}
+		if _, ok := simulator.sdCard[*backup.Filename]; ok {
+			return nil, newError("Backup file already exists.", errSDFileExists)
+		}
+		simulator.sdCard[*backup.Filename] = simulator.entropy
+		// The backup is created even if the password does not match the wallet.
+		if masterKey(simulator.entropy, backup.Key).String() != master.String() {
+			return nil, errNoMatch
+		}
+	default:
+		return nil, errInvalidCommand()
+	}
+	return map[string]string{"backup": responseSuccess}, nil
+}
+
+func (simulator *Simulator) handleHiddenPassword(value json.RawMessage) (interface{}, error) {
+	var hiddenPassword struct {
+		Key      string `json:"key"`
+		Password string `json:"password"`
+	}
+	if err := decode(value, &hiddenPassword); err != nil {
+		return nil, err
+	}
+	if simulator.locked {
+		return nil, errLocked()
+	}
+	if simulator.entropy == nil {
+		return nil, newError("A wallet is not loaded.", errKeyNotSeeded)
+	}
+	if hiddenPassword.Key == "" || hiddenPassword.Password == "" ||
+		hiddenPassword.Password == simulator.pin {
+		return nil, errInvalidCommand()
+	}
+	if !simulator.touch("hidden_password") {
+		return nil, errAbort()
+	}
+	simulator.hiddenPIN = hiddenPassword.Password
+	simulator.hiddenMaster = masterKey(simulator.entropy, hiddenPassword.Key)
+	return map[string]string{"hidden_password": responseSuccess}, nil
+}
+
+// derive returns the extended private key at the keypath.
+func (simulator *Simulator) derive(keypath string, hidden bool) (*hdkeychain.ExtendedKey, error) {
+	master := simulator.walletMaster(hidden)
+	if master == nil {
+		return nil, newError("A wallet is not loaded.", errKeyNotSeeded)
+	}
+	absoluteKeypath, err := signing.NewAbsoluteKeypath(keypath)
+	if err != nil {
+		return nil, newError("Invalid keypath.", errKeyInvalidPath)
+	}
+	return absoluteKeypath.Derive(master)
+}
+
+func (simulator *Simulator) handleXPub(keypath string, hidden bool) (interface{}, error) {
+	xprv, err := simulator.derive(keypath, hidden)
+	if err != nil {
+		return nil, err
+	}
+	xpub, err := xprv.Neuter()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"xpub": xpub.String(), "echo": echo(xpub.String())}, nil
+}
+
+// handleSignData handles the first signing call, which stores the data and returns the echo.
+func (simulator *Simulator) handleSignData(value json.RawMessage, hidden bool) (
+	interface{}, error) {
+	var sign struct {
+		Data     []signData `json:"data"`
+		Meta     string     `json:"meta"`
+		CheckPub []checkPub `json:"checkpub"`
+	}
+	if err := decode(value, &sign); err != nil {
+		return nil, err
+	}
+	simulator.pendingSign = nil
+	if len(sign.Data) == 0 || len(sign.Data) > signatureBatchSize {
+		return nil, newError(
+			fmt.Sprintf("Between 1 and %d hashes can be signed at once.", signatureBatchSize),
+			errSignDataLength)
+	}
+	for _, data := range sign.Data {
+		hash, err := hex.DecodeString(data.Hash)
+		if err != nil || len(hash) > 32 {
+			return nil, newError("Invalid hash.", errSignDataLength)
+		}
+		if _, err := simulator.derive(data.Keypath, hidden); err != nil {
+			return nil, err
+		}
+	}
+	for _, check := range sign.CheckPub {
+		xprv, err := simulator.derive(check.Keypath, hidden)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := xprv.ECPubKey()
+		if err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(publicKey.SerializeCompressed()) != check.Pubkey {
+			return nil, newError("The change public key does not match the keypath.",
+				errSignChangePub)
+		}
+	}
+	pending := &pendingSign{data: sign.Data}
+	echoValue := map[string]interface{}{"sign": map[string]interface{}{
+		"data": sign.Data,
+		"meta": sign.Meta,
+	}}
+	if simulator.locked {
+		pending.tfaPIN = hex.EncodeToString(random.BytesOrPanic(4))
+		echoValue["pin"] = pending.tfaPIN
+	}
+	simulator.pendingSign = pending
+	return map[string]string{"echo": echo(echoValue)}, nil
+}
+
+// handleSign handles the second signing call, which signs the pending data after the user
+// confirmed with a touch. tfaPIN is required if the device is locked.
+func (simulator *Simulator) handleSign(tfaPIN string, hidden bool) (interface{}, error) {
+	pending := simulator.pendingSign
+	simulator.pendingSign = nil
+	if pending == nil {
+		return nil, newError("No data to sign.", errSignNoData)
+	}
+	if pending.tfaPIN != tfaPIN {
+		return nil, newError("Incorrect 2FA PIN.", errSignTFAPIN)
+	}
+	if !simulator.touch("sign") {
+		return nil, errAbort()
+	}
+	signatures := []map[string]string{}
+	for _, data := range pending.data {
+		xprv, err := simulator.derive(data.Keypath, hidden)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := xprv.ECPrivKey()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hex.DecodeString(data.Hash)
+		if err != nil {
+			return nil, err
+		}
+		// The compact signature is the recovery header (27 + 4 for compressed keys + recid),
+		// followed by R and S.
+		compact, err := btcec.SignCompact(btcec.S256(), privateKey, hash, true)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, map[string]string{
+			"sig":   hex.EncodeToString(compact[1:]),
+			"recid": fmt.Sprintf("%02x", compact[0]-27-4),
+		})
+	}
+	return map[string]interface{}{"sign": signatures}, nil
+}
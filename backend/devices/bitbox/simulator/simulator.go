@@ -0,0 +1,371 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package simulator implements a BitBox in software. It speaks the JSON protocol of the firmware
+// and the bootloader, so that the device, keystore and backend flows can be used without hardware.
+package simulator
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/jsonp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/random"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/semver"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// maxAttempts is the number of failed logins after which the device resets itself.
+	maxAttempts = 15
+
+	// touchAttempts is the number of failed logins after which every login requires a long touch.
+	touchAttempts = 10
+
+	// signatureBatchSize is the maximum number of hashes which can be signed at once.
+	signatureBatchSize = 15
+
+	defaultName = "Digital Bitbox"
+
+	responseSuccess = "success"
+)
+
+// Error codes used by the simulator in addition to the ones defined in the bitbox package. They
+// follow the ranges of the firmware: 1xx for the IO, 2xx for the keys, 3xx for signing, 4xx for the
+// SD card and 6xx for the touch button.
+const (
+	errIOInvalidCmd    = 104
+	errIOMultipleCmd   = 105
+	errIODecrypt       = 108
+	errIOJSONParse     = 109
+	errIOPasswordSet   = 110
+	errIOLocked        = 111
+	errKeyNotSeeded    = 201
+	errKeyInvalidPath  = 202
+	errSignDataLength  = 301
+	errSignNoData      = 302
+	errSignChangePub   = 303
+	errSignTFAPIN      = 304
+	errSDFileExists    = 401
+	errSDFileNotFound  = 404
+	errSDInvalidFormat = 405
+)
+
+// Touch decides whether the user confirms (true) or aborts (false) an action on the device. The
+// action is the name of the command, e.g. "sign", "reset" or "seed", or "login" for a login which
+// requires a long touch after too many failed attempts.
+type Touch func(action string) bool
+
+// pendingSign is the data of the first signing call, which is signed in the second call.
+type pendingSign struct {
+	data []signData
+	// tfaPIN is the nonce which has to be provided to sign if the device is locked (2FA). In the
+	// real setup, it is shown by the mobile app after verifying the transaction.
+	tfaPIN string
+}
+
+// Simulator simulates a BitBox. It implements bitbox.CommunicationInterface, and its state
+// changes like the one of the device, so the same instance must be kept to simulate replugging.
+// It is safe for concurrent use.
+type Simulator struct {
+	lock    locker.Locker
+	version *semver.SemVer
+	serial  string
+	touch   Touch
+
+	// pin is empty if the device is uninitialized.
+	pin            string
+	failedAttempts int
+
+	// entropy is nil if the device is not seeded. master is derived from the entropy and the
+	// stretched backup password.
+	entropy []byte
+	master  *hdkeychain.ExtendedKey
+
+	// hiddenPIN unlocks the hidden wallet, derived from the same entropy and the hidden backup
+	// password.
+	hiddenPIN    string
+	hiddenMaster *hdkeychain.ExtendedKey
+
+	name            string
+	bootlock        bool
+	locked          bool
+	newHiddenWallet bool
+	pendingSign     *pendingSign
+
+	sdCardInserted bool
+	// sdCard maps the backup filenames to the entropy they contain.
+	sdCard map[string][]byte
+
+	bootloader bool
+	// chunks are the firmware chunks written since the last erase, firmware is the last firmware
+	// which passed the signature verification.
+	chunks   map[byte][]byte
+	firmware []byte
+}
+
+// NewSimulator creates a new, uninitialized simulator running the given firmware version. The SD
+// card is inserted and the bootloader is unlocked, like on a factory new device.
+func NewSimulator(version *semver.SemVer) *Simulator {
+	return &Simulator{
+		version:        version,
+		serial:         hex.EncodeToString(random.BytesOrPanic(16)),
+		touch:          func(string) bool { return true },
+		name:           defaultName,
+		sdCardInserted: true,
+		sdCard:         map[string][]byte{},
+	}
+}
+
+// Version returns the firmware version of the simulator.
+func (simulator *Simulator) Version() *semver.SemVer {
+	return simulator.version
+}
+
+// SetTouch installs the function which decides the outcome of every action requiring a touch.
+func (simulator *Simulator) SetTouch(touch Touch) {
+	defer simulator.lock.Lock()()
+	simulator.touch = touch
+}
+
+// InsertSDCard inserts the SD card, which keeps its backups while it is removed.
+func (simulator *Simulator) InsertSDCard() {
+	defer simulator.lock.Lock()()
+	simulator.sdCardInserted = true
+}
+
+// RemoveSDCard removes the SD card.
+func (simulator *Simulator) RemoveSDCard() {
+	defer simulator.lock.Lock()()
+	simulator.sdCardInserted = false
+}
+
+// Backups returns the sorted filenames of the backups on the SD card.
+func (simulator *Simulator) Backups() []string {
+	defer simulator.lock.RLock()()
+	return simulator.backups()
+}
+
+func (simulator *Simulator) backups() []string {
+	filenames := []string{}
+	for filename := range simulator.sdCard {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// TFAPIN returns the nonce which is needed to finish the pending signing of a locked device, or
+// an empty string if there is none. It simulates the mobile app, which shows it after verifying
+// the transaction.
+func (simulator *Simulator) TFAPIN() string {
+	defer simulator.lock.RLock()()
+	if simulator.pendingSign == nil {
+		return ""
+	}
+	return simulator.pendingSign.tfaPIN
+}
+
+// Close implements bitbox.CommunicationInterface. The state is kept, as the device can be
+// plugged in again.
+func (simulator *Simulator) Close() {
+}
+
+// masterKey derives the wallet from the entropy and the stretched backup password, like the
+// firmware derives the BIP39 seed from the mnemonic and the passphrase.
+func masterKey(entropy []byte, key string) *hdkeychain.ExtendedKey {
+	seed := pbkdf2.Key(entropy, []byte("mnemonic"+key), 2048, 64, sha512.New)
+	// The firmware always uses the mainnet version bytes for the extended keys.
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		panic(errp.WithStack(err))
+	}
+	return master
+}
+
+func newError(message string, code float64) error {
+	return errp.WithStack(bitbox.NewError(message, code))
+}
+
+func errAbort() error {
+	return newError("Aborted by user.", bitbox.ErrTouchAbort)
+}
+
+// reply encodes the reply as JSON and decodes it again, so that the caller gets the same types as
+// from the USB communication.
+func reply(value interface{}) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(jsonp.MustMarshal(value), &result); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return result, nil
+}
+
+// parseCommand returns the name and the value of the single command in the message.
+func parseCommand(msg string) (string, json.RawMessage, error) {
+	command := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(msg), &command); err != nil {
+		return "", nil, newError("JSON parse error.", errIOJSONParse)
+	}
+	if len(command) != 1 {
+		return "", nil, newError("Only one command allowed at a time.", errIOMultipleCmd)
+	}
+	for name, value := range command {
+		return name, value, nil
+	}
+	panic("unreachable")
+}
+
+// SendPlain implements bitbox.CommunicationInterface. Only the ping and setting the first
+// password are accepted unencrypted.
+func (simulator *Simulator) SendPlain(msg string) (map[string]interface{}, error) {
+	defer simulator.lock.Lock()()
+	if simulator.bootloader {
+		return nil, errp.New("the simulator is in bootloader mode")
+	}
+	name, value, err := parseCommand(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "ping":
+		if simulator.pin != "" {
+			return reply(map[string]string{"ping": "password"})
+		}
+		return reply(map[string]string{"ping": "false"})
+	case "password":
+		if simulator.pin != "" {
+			return nil, newError("A password is already set. Reset the device to set a new one.",
+				errIOPasswordSet)
+		}
+		var pin string
+		if err := json.Unmarshal(value, &pin); err != nil || pin == "" {
+			return nil, newError("Invalid password.", errIOInvalidCmd)
+		}
+		simulator.pin = pin
+		simulator.failedAttempts = 0
+		return reply(map[string]string{"password": responseSuccess})
+	default:
+		return nil, newError("Invalid command.", errIOInvalidCmd)
+	}
+}
+
+// SendEncrypt implements bitbox.CommunicationInterface. The message is not actually encrypted,
+// but the password is checked like the device does when decrypting, including the lockout after
+// too many failed attempts.
+func (simulator *Simulator) SendEncrypt(msg, password string) (map[string]interface{}, error) {
+	defer simulator.lock.Lock()()
+	if simulator.bootloader {
+		return nil, errp.New("the simulator is in bootloader mode")
+	}
+	if simulator.pin == "" {
+		return nil, newError("Please set a password.", bitbox.ErrIONoPassword)
+	}
+	if simulator.failedAttempts >= touchAttempts && !simulator.touch("login") {
+		return nil, errAbort()
+	}
+	hidden := simulator.hiddenPIN != "" && password == simulator.hiddenPIN
+	if password != simulator.pin && !hidden {
+		return nil, simulator.failedLogin()
+	}
+	simulator.failedAttempts = 0
+	name, value, err := parseCommand(msg)
+	if err != nil {
+		return nil, err
+	}
+	// Any other command cancels a pending signing.
+	if name != "sign" {
+		simulator.pendingSign = nil
+	}
+	result, err := simulator.handle(name, value, hidden)
+	if err != nil {
+		return nil, err
+	}
+	return reply(result)
+}
+
+// failedLogin counts a failed login and resets the device if there are no attempts left.
+func (simulator *Simulator) failedLogin() error {
+	simulator.failedAttempts++
+	remaining := maxAttempts - simulator.failedAttempts
+	needsLongTouch := simulator.failedAttempts >= touchAttempts
+	if remaining <= 0 {
+		simulator.reset()
+		remaining = 0
+	}
+	message := fmt.Sprintf("Incorrect password. %d attempts remain before the device is reset.",
+		remaining)
+	if needsLongTouch {
+		message += " The next login requires holding the touch button for 3 seconds."
+	}
+	return newError(message, errIODecrypt)
+}
+
+// reset erases everything except for the SD card and the bootloader lock.
+func (simulator *Simulator) reset() {
+	simulator.pin = ""
+	simulator.failedAttempts = 0
+	simulator.entropy = nil
+	simulator.master = nil
+	simulator.hiddenPIN = ""
+	simulator.hiddenMaster = nil
+	simulator.name = defaultName
+	simulator.locked = false
+	simulator.newHiddenWallet = false
+	simulator.pendingSign = nil
+}
+
+// walletMaster returns the master key of the wallet unlocked by the password, or nil if the device
+// is not seeded.
+func (simulator *Simulator) walletMaster(hidden bool) *hdkeychain.ExtendedKey {
+	if hidden {
+		return simulator.hiddenMaster
+	}
+	return simulator.master
+}
+
+func (simulator *Simulator) deviceInfo(hidden bool) map[string]interface{} {
+	id := ""
+	if master := simulator.walletMaster(hidden); master != nil {
+		publicKey, err := master.ECPubKey()
+		if err != nil {
+			panic(errp.WithStack(err))
+		}
+		hash := sha256.Sum256(publicKey.SerializeCompressed())
+		id = hex.EncodeToString(hash[:])
+	}
+	return map[string]interface{}{
+		"version":           "v" + simulator.version.String(),
+		"serial":            simulator.serial,
+		"id":                id,
+		"TFA":               "",
+		"bootlock":          simulator.bootlock,
+		"name":              simulator.name,
+		"sdcard":            simulator.sdCardInserted,
+		"lock":              simulator.locked,
+		"U2F":               true,
+		"U2F_hijack":        true,
+		"seeded":            simulator.entropy != nil,
+		"new_hidden_wallet": simulator.newHiddenWallet,
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/simulator"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/semver"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	pin              = "1234"
+	recoveryPassword = "recovery password"
+)
+
+// plugIn creates a device communicating with the simulator, like the usb manager does when the
+// device is plugged in.
+func plugIn(t *testing.T, sim *simulator.Simulator) *bitbox.Device {
+	t.Helper()
+	device, err := bitbox.NewDevice("simulator", sim.Bootloader(), sim.Version(),
+		test.TstTempDir("simulator_test"), nil, sim)
+	require.NoError(t, err)
+	device.Init(true)
+	return device
+}
+
+// newSeededDevice returns a simulator with a wallet, and a device which is logged in.
+func newSeededDevice(t *testing.T) (*simulator.Simulator, *bitbox.Device) {
+	t.Helper()
+	sim := simulator.NewSimulator(semver.NewSemVer(5, 0, 0))
+	device := plugIn(t, sim)
+	require.NoError(t, device.SetPassword(pin))
+	require.NoError(t, device.CreateWallet("wallet", recoveryPassword))
+	require.Equal(t, bitbox.StatusSeeded, device.Status())
+	return sim, device
+}
+
+func errorCode(err error) float64 {
+	dbbErr, ok := errp.Cause(err).(*bitbox.Error)
+	if !ok {
+		return 0
+	}
+	return dbbErr.Code
+}
+
+func TestPasswordAndLogin(t *testing.T) {
+	sim := simulator.NewSimulator(semver.NewSemVer(5, 0, 0))
+	device := plugIn(t, sim)
+	require.Equal(t, bitbox.StatusUninitialized, device.Status())
+	require.NoError(t, device.SetPassword(pin))
+	require.Equal(t, bitbox.StatusLoggedIn, device.Status())
+	device.Close()
+
+	device = plugIn(t, sim)
+	defer device.Close()
+	require.Equal(t, bitbox.StatusInitialized, device.Status())
+	needsLongTouch, remainingAttempts, err := device.Login("wrong")
+	require.Error(t, err)
+	require.False(t, needsLongTouch)
+	require.Equal(t, "14", remainingAttempts)
+
+	_, _, err = device.Login(pin)
+	require.NoError(t, err)
+	require.Equal(t, bitbox.StatusLoggedIn, device.Status())
+	// The login locks the bootloader.
+	deviceInfo, err := device.DeviceInfo()
+	require.NoError(t, err)
+	require.True(t, deviceInfo.Bootlock)
+	require.False(t, deviceInfo.Seeded)
+
+	require.NoError(t, device.ChangePassword(pin, "5678"))
+	device.Close()
+	device = plugIn(t, sim)
+	_, _, err = device.Login(pin)
+	require.Error(t, err)
+	_, _, err = device.Login("5678")
+	require.NoError(t, err)
+}
+
+func TestLockout(t *testing.T) {
+	sim := simulator.NewSimulator(semver.NewSemVer(5, 0, 0))
+	device := plugIn(t, sim)
+	require.NoError(t, device.SetPassword(pin))
+	device.Close()
+	device = plugIn(t, sim)
+	defer device.Close()
+
+	for attempt := 1; attempt < 15; attempt++ {
+		needsLongTouch, remainingAttempts, err := device.Login("wrong")
+		require.Error(t, err)
+		require.Equal(t, strconv.Itoa(15-attempt), remainingAttempts)
+		require.Equal(t, attempt >= 10, needsLongTouch)
+	}
+
+	// Aborting the long touch does not count as an attempt.
+	sim.SetTouch(func(action string) bool { return action != "login" })
+	_, _, err := device.Login("wrong")
+	require.Equal(t, float64(bitbox.ErrTouchAbort), errorCode(err))
+	sim.SetTouch(func(string) bool { return true })
+
+	// The last attempt resets the device.
+	needsLongTouch, remainingAttempts, err := device.Login("wrong")
+	require.Error(t, err)
+	require.True(t, needsLongTouch)
+	require.Equal(t, "0", remainingAttempts)
+	require.Equal(t, bitbox.StatusUninitialized, device.Status())
+}
+
+func TestBackups(t *testing.T) {
+	sim, device := newSeededDevice(t)
+	defer device.Close()
+	xpub, err := device.ExtendedPublicKey(signing.NewEmptyAbsoluteKeypath().Child(0, true))
+	require.NoError(t, err)
+
+	backups, err := device.BackupList()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	require.Equal(t, "wallet", backups[0]["name"])
+	filename := backups[0]["id"]
+
+	matches, err := device.CheckBackup(recoveryPassword, filename)
+	require.NoError(t, err)
+	require.True(t, matches)
+	matches, err = device.CheckBackup("wrong password", filename)
+	require.NoError(t, err)
+	require.False(t, matches)
+
+	sim.RemoveSDCard()
+	_, err = device.CreateBackup("second", recoveryPassword)
+	require.True(t, bitbox.IsErrorSDCard(err))
+	sim.InsertSDCard()
+	matches, err = device.CreateBackup("second", recoveryPassword)
+	require.NoError(t, err)
+	require.True(t, matches)
+	require.Len(t, sim.Backups(), 2)
+	require.NoError(t, device.EraseBackup(filename))
+	backups, err = device.BackupList()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+
+	// The wallet is restored from the backup after the reset.
+	erased, err := device.Reset(pin)
+	require.NoError(t, err)
+	require.True(t, erased)
+	require.Equal(t, bitbox.StatusUninitialized, device.Status())
+	require.NoError(t, device.SetPassword(pin))
+	restored, err := device.RestoreBackup(recoveryPassword, backups[0]["id"])
+	require.NoError(t, err)
+	require.True(t, restored)
+	restoredXPub, err := device.ExtendedPublicKey(signing.NewEmptyAbsoluteKeypath().Child(0, true))
+	require.NoError(t, err)
+	require.Equal(t, xpub.String(), restoredXPub.String())
+}
+
+func TestHiddenWallet(t *testing.T) {
+	sim, device := newSeededDevice(t)
+	defer device.Close()
+	keypath := signing.NewEmptyAbsoluteKeypath().Child(0, true)
+	xpub, err := device.ExtendedPublicKey(keypath)
+	require.NoError(t, err)
+	created, err := device.SetHiddenPassword("hidden", "hidden recovery password")
+	require.NoError(t, err)
+	require.True(t, created)
+	device.Close()
+
+	device = plugIn(t, sim)
+	_, _, err = device.Login("hidden")
+	require.NoError(t, err)
+	hiddenXPub, err := device.ExtendedPublicKey(keypath)
+	require.NoError(t, err)
+	require.NotEqual(t, xpub.String(), hiddenXPub.String())
+}
+
+func TestSign(t *testing.T) {
+	sim, device := newSeededDevice(t)
+	defer device.Close()
+	keypath, err := signing.NewAbsoluteKeypath("m/84'/0'/0'/0/0")
+	require.NoError(t, err)
+	xpub, err := device.ExtendedPublicKey(keypath)
+	require.NoError(t, err)
+	publicKey, err := xpub.ECPubKey()
+	require.NoError(t, err)
+
+	hashes := [][]byte{}
+	keypaths := []string{}
+	for i := 0; i < 16; i++ {
+		hashes = append(hashes, chainhash.DoubleHashB([]byte{byte(i)}))
+		keypaths = append(keypaths, keypath.Encode())
+	}
+	signatures, err := device.Sign(nil, hashes, keypaths)
+	require.NoError(t, err)
+	require.Len(t, signatures, 16)
+	for i, signature := range signatures {
+		require.True(t, signature.Verify(hashes[i], publicKey))
+	}
+
+	sim.SetTouch(func(action string) bool { return action != "sign" })
+	_, err = device.Sign(nil, hashes[:1], keypaths[:1])
+	require.Equal(t, float64(bitbox.ErrTouchAbort), errorCode(err))
+}
+
+// TestSignLocked signs with a device locked for 2FA, providing the nonce which the mobile app
+// would show.
+func TestSignLocked(t *testing.T) {
+	sim, device := newSeededDevice(t)
+	defer device.Close()
+	locked, err := device.Lock()
+	require.NoError(t, err)
+	require.True(t, locked)
+	_, err = device.CreateBackup("locked", recoveryPassword)
+	require.Error(t, err)
+
+	signCommand := `{"sign":{"data":[{"hash":"` +
+		"0000000000000000000000000000000000000000000000000000000000000001" +
+		`","keypath":"m/44'/0'/0'/0/0"}]}}`
+	reply, err := sim.SendEncrypt(signCommand, pin)
+	require.NoError(t, err)
+	tfaPIN := sim.TFAPIN()
+	require.NotEmpty(t, tfaPIN)
+	echo, err := base64.StdEncoding.DecodeString(reply["echo"].(string))
+	require.NoError(t, err)
+	echoValue := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(echo, &echoValue))
+	require.Equal(t, tfaPIN, echoValue["pin"])
+
+	_, err = sim.SendEncrypt(`{"sign":{"pin":"wrong"}}`, pin)
+	require.Error(t, err)
+	// A failed attempt cancels the signing.
+	_, err = sim.SendEncrypt(signCommand, pin)
+	require.NoError(t, err)
+	reply, err = sim.SendEncrypt(`{"sign":{"pin":"`+sim.TFAPIN()+`"}}`, pin)
+	require.NoError(t, err)
+	require.Len(t, reply["sign"], 1)
+}
+
+func TestNameBlinkRandom(t *testing.T) {
+	_, device := newSeededDevice(t)
+	defer device.Close()
+	require.NoError(t, device.SetName("simulated"))
+	deviceInfo, err := device.DeviceInfo()
+	require.NoError(t, err)
+	require.Equal(t, "simulated", deviceInfo.Name)
+	require.NoError(t, device.Blink())
+	random, err := device.Random("true")
+	require.NoError(t, err)
+	require.Len(t, random, 32)
+}
+
+func TestFirmwareUpgrade(t *testing.T) {
+	sim, device := newSeededDevice(t)
+	device.Close()
+	// The login locks the bootloader.
+	device = plugIn(t, sim)
+	_, _, err := device.Login(pin)
+	require.NoError(t, err)
+	require.Error(t, sim.SetBootloaderMode(true))
+	unlocked, err := device.UnlockBootloader()
+	require.NoError(t, err)
+	require.True(t, unlocked)
+	device.Close()
+
+	require.NoError(t, sim.SetBootloaderMode(true))
+	device = plugIn(t, sim)
+	require.Equal(t, bitbox.StatusBootloader, device.Status())
+	firmware := append(bytes.Repeat([]byte("firmware"), 1000), []byte("\x00v5.1.0\x00")...)
+	signedFirmware := simulator.SignFirmware(firmware)
+
+	tampered := append([]byte{}, signedFirmware...)
+	tampered[len(tampered)-1] ^= 1
+	require.Error(t, device.BootloaderUpgradeFirmware(tampered))
+	device.Close()
+
+	device = plugIn(t, sim)
+	defer device.Close()
+	// Without the signing keys, the signatures are only verified by the bootloader.
+	check, err := device.CheckFirmware(signedFirmware)
+	require.NoError(t, err)
+	require.Equal(t, "5.1.0", check.Version)
+	require.False(t, check.SignaturesVerified)
+	_, err = device.BootloaderUploadFirmware(signedFirmware, false)
+	require.Error(t, err)
+
+	device.SetFirmwareSigningKeys(simulator.FirmwareSigningKeys())
+	_, err = device.CheckFirmware(tampered)
+	require.Error(t, err)
+	// The installed version is unknown, so it could be a downgrade.
+	check, err = device.BootloaderUploadFirmware(signedFirmware, false)
+	require.Error(t, err)
+	require.True(t, check.SignaturesVerified)
+	require.Empty(t, check.InstalledVersion)
+	// Older than the firmware installed on the device.
+	device.SetInstalledFirmwareVersion(semver.NewSemVer(5, 2, 0))
+	check, err = device.CheckFirmware(signedFirmware)
+	require.NoError(t, err)
+	require.True(t, check.Downgrade)
+	device.SetInstalledFirmwareVersion(semver.NewSemVer(5, 0, 0))
+	check, err = device.BootloaderUploadFirmware(signedFirmware, false)
+	require.NoError(t, err)
+	require.True(t, check.SignaturesVerified)
+	require.False(t, check.Downgrade)
+	status, err := device.BootloaderStatus()
+	require.NoError(t, err)
+	require.True(t, status.UpgradeSuccessful)
+	require.Equal(t, check, status.Firmware)
+	require.True(t, bytes.HasPrefix(sim.Firmware(), firmware))
+}
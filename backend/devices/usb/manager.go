@@ -15,14 +15,18 @@
 package usb
 
 import (
+	"context"
 	"encoding/hex"
 	"os"
 	"regexp"
 	"time"
 
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/simulator"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/device"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/semver"
 	"github.com/karalabe/hid"
@@ -32,6 +36,9 @@ import (
 const (
 	bitboxVendorID  = 0x03eb
 	bitboxProductID = 0x2402
+
+	// simulatorDeviceID is the device ID of the simulated BitBox.
+	simulatorDeviceID = "simulator"
 )
 
 func isBitBox(deviceInfo hid.DeviceInfo) bool {
@@ -58,33 +65,68 @@ func DeviceInfos() []hid.DeviceInfo {
 type Manager struct {
 	devices          map[string]device.Interface
 	channelConfigDir string // passed to each device during initialization
+	channelConfigKey *encryption.Key
+	channelKeyLock   locker.Locker
 
 	onRegister   func(device.Interface) error
 	onUnregister func(string)
 
+	// simulator is registered like a plugged in BitBox if set. simulatorBootloader is the mode in
+	// which it was registered, so that a mode change can be handled like replugging.
+	simulator           *simulator.Simulator
+	simulatorBootloader bool
+
+	// firmwareVersion is the firmware version of the BitBox last registered in firmware mode. It
+	// is passed to the BitBox registered in bootloader mode, which is usually the same device
+	// rebooted for an upgrade, as the bootloader does not report it.
+	firmwareVersion *semver.SemVer
+
+	// ctx is cancelled by Close(). done is closed when the listen loop returned.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
 	log *logrus.Entry
 }
 
 // NewManager creates a new Manager. onRegister is called when a device has been
 // inserted. onUnregister is called when the device has been removed.
 //
-// The channelConfigDir argument is passed to each device during initialization,
-// before onRegister is called.
+// The channelConfigDir and channelConfigKey arguments are passed to each device during
+// initialization, before onRegister is called.
 func NewManager(
 	channelConfigDir string,
+	channelConfigKey *encryption.Key,
 	onRegister func(device.Interface) error,
 	onUnregister func(string),
 ) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Manager{
 		devices:          map[string]device.Interface{},
 		channelConfigDir: channelConfigDir,
+		channelConfigKey: channelConfigKey,
 		onRegister:       onRegister,
 		onUnregister:     onUnregister,
+		ctx:              ctx,
+		cancel:           cancel,
+		done:             make(chan struct{}),
 
 		log: logging.Get().WithGroup("manager"),
 	}
 }
 
+// SetChannelConfigKey sets the key with which the devices plugged in from now on encrypt their
+// channel settings.
+func (manager *Manager) SetChannelConfigKey(key *encryption.Key) {
+	defer manager.channelKeyLock.Lock()()
+	manager.channelConfigKey = key
+}
+
+func (manager *Manager) getChannelConfigKey() *encryption.Key {
+	defer manager.channelKeyLock.RLock()()
+	return manager.channelConfigKey
+}
+
 func deviceIdentifier(deviceInfo hid.DeviceInfo) string {
 	return hex.EncodeToString([]byte(deviceInfo.Path))
 }
@@ -125,24 +167,90 @@ func (manager *Manager) makeBitBox(deviceInfo hid.DeviceInfo) (*bitbox.Device, e
 		bootloader,
 		firmwareVersion,
 		manager.channelConfigDir,
+		manager.getChannelConfigKey(),
 		NewCommunication(hidDevice, usbWriteReportSize, usbReadReportSize, hmac),
 	)
 	if err != nil {
 		return nil, errp.WithMessage(err, "Failed to establish communication to device")
 	}
+	// The public keys of the BitBox firmware signers are not known to the app, so the signatures
+	// of uploaded firmware are only verified by the bootloader.
+	if bootloader {
+		device.SetInstalledFirmwareVersion(manager.firmwareVersion)
+	} else {
+		manager.firmwareVersion = firmwareVersion
+	}
 
-	// Unlock the device automatically if the user set the PIN as an environment variable.
+	if err := manager.loginFromEnvironment(device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// loginFromEnvironment unlocks the device automatically if the user set the PIN as an environment
+// variable.
+func (manager *Manager) loginFromEnvironment(device *bitbox.Device) error {
 	pin := os.Getenv("BITBOX_PIN")
-	if pin != "" {
-		if _, _, err := device.Login(pin); err != nil {
-			return nil, errp.WithMessage(err, "Failed to unlock the BitBox with the provided PIN.")
-		}
-		manager.log.Info("Successfully unlocked the device with the PIN from the environment.")
+	if pin == "" || device.Status() == bitbox.StatusBootloader {
+		return nil
 	}
+	if _, _, err := device.Login(pin); err != nil {
+		return errp.WithMessage(err, "Failed to unlock the BitBox with the provided PIN.")
+	}
+	manager.log.Info("Successfully unlocked the device with the PIN from the environment.")
+	return nil
+}
+
+// AddSimulator registers the simulator like a plugged in BitBox. Switching the simulator between
+// the firmware and the bootloader mode is handled like replugging the device. It must be called
+// before Start().
+func (manager *Manager) AddSimulator(simulator *simulator.Simulator) {
+	manager.simulator = simulator
+}
 
+func (manager *Manager) makeSimulator() (*bitbox.Device, error) {
+	manager.log.Info("Registering the BitBox simulator")
+	manager.simulatorBootloader = manager.simulator.Bootloader()
+	device, err := bitbox.NewDevice(
+		simulatorDeviceID,
+		manager.simulatorBootloader,
+		manager.simulator.Version(),
+		manager.channelConfigDir,
+		manager.getChannelConfigKey(),
+		manager.simulator,
+	)
+	if err != nil {
+		return nil, errp.WithMessage(err, "Failed to establish communication to the simulator")
+	}
+	device.SetFirmwareSigningKeys(simulator.FirmwareSigningKeys())
+	if err := manager.loginFromEnvironment(device); err != nil {
+		return nil, err
+	}
 	return device, nil
 }
 
+// listenSimulator registers the simulator, and unregisters it when its mode changes.
+func (manager *Manager) listenSimulator() {
+	if device, ok := manager.devices[simulatorDeviceID]; ok {
+		if manager.simulator.Bootloader() == manager.simulatorBootloader {
+			return
+		}
+		device.Close()
+		delete(manager.devices, simulatorDeviceID)
+		manager.onUnregister(simulatorDeviceID)
+		manager.log.Info("Unregistered the BitBox simulator")
+	}
+	device, err := manager.makeSimulator()
+	if err != nil {
+		manager.log.WithError(err).Error("Failed to register the BitBox simulator")
+		return
+	}
+	manager.devices[simulatorDeviceID] = device
+	if err := manager.onRegister(device); err != nil {
+		manager.log.WithError(err).Error("Failed to execute on-register")
+	}
+}
+
 // checkIfRemoved returns true if a device was plugged in, but is not plugged in anymore.
 func (manager *Manager) checkIfRemoved(deviceID string) bool {
 	// In edge cases, device enumeration hangs waiting for the device, and can be empty for a very
@@ -160,10 +268,11 @@ func (manager *Manager) checkIfRemoved(deviceID string) bool {
 }
 
 func (manager *Manager) listen() {
+	defer close(manager.done)
 	for {
 		for deviceID, device := range manager.devices {
 			// Check if device was removed.
-			if manager.checkIfRemoved(deviceID) {
+			if deviceID != simulatorDeviceID && manager.checkIfRemoved(deviceID) {
 				device.Close()
 				delete(manager.devices, deviceID)
 				manager.onUnregister(deviceID)
@@ -195,11 +304,31 @@ func (manager *Manager) listen() {
 				manager.log.WithError(err).Error("Failed to execute on-register")
 			}
 		}
-		time.Sleep(time.Second)
+		if manager.simulator != nil {
+			manager.listenSimulator()
+		}
+		select {
+		case <-manager.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
 	}
 }
 
-// Start listens for inserted/removed devices forever.
+// Start listens for inserted/removed devices until Close() is called.
 func (manager *Manager) Start() {
 	go manager.listen()
 }
+
+// Close stops listening and unregisters and closes all registered devices. It must only be called
+// after Start(). It is safe to call it more than once.
+func (manager *Manager) Close() {
+	manager.cancel()
+	<-manager.done
+	for deviceID, device := range manager.devices {
+		device.Close()
+		delete(manager.devices, deviceID)
+		manager.onUnregister(deviceID)
+		manager.log.WithField("device-id", deviceID).Info("Unregistered device")
+	}
+}
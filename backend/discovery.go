@@ -0,0 +1,157 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+)
+
+// discoveryTarget is a coin and script type for which accounts are discovered.
+type discoveryTarget struct {
+	coinCode   string
+	scriptType string
+}
+
+// discoveryTargets returns the coins and script types of the enabled keystore accounts. Ethereum
+// accounts are not discovered, as they are not backed by an Electrum server.
+func (backend *Backend) discoveryTargets() ([]discoveryTarget, map[discoveryTarget]string) {
+	coinCodes := backend.accountCoinCodes()
+	targets := []discoveryTarget{}
+	names := map[discoveryTarget]string{}
+	for _, accountConfig := range backend.config.Config().Backend.Accounts {
+		if _, ok := coinCodes[accountConfig.CoinCode]; !ok ||
+			config.IsEthereum(accountConfig.CoinCode) ||
+			accountConfig.Hidden ||
+			accountConfig.WatchOnly() {
+			continue
+		}
+		target := discoveryTarget{coinCode: accountConfig.CoinCode, scriptType: accountConfig.ScriptType}
+		if _, ok := names[target]; ok {
+			if accountConfig.AccountIndex == 0 {
+				names[target] = accountConfig.Name
+			}
+			continue
+		}
+		targets = append(targets, target)
+		names[target] = accountConfig.Name
+	}
+	return targets, names
+}
+
+// discoverAccounts scans the accounts of the keystore at increasing indices of every enabled coin
+// and script type and stops at the first unused account. Used accounts which are not in the account
+// registry yet are added to it, tied to the keystore. The first account always exists and is never
+// added.
+func (backend *Backend) discoverAccounts(registered *registeredKeystore) {
+	keystores := registered.keystores
+	targets, names := backend.discoveryTargets()
+	discovered := []config.Account{}
+	for _, target := range targets {
+		if backend.ctx.Err() != nil {
+			return
+		}
+		log := backend.log.WithField("coin", target.coinCode).WithField("script-type", target.scriptType)
+		theCoin, err := backend.Coin(target.coinCode)
+		if err != nil {
+			log.WithError(err).Error("account discovery failed")
+			continue
+		}
+		btcCoin, ok := theCoin.(*btc.Coin)
+		if !ok {
+			continue
+		}
+		btcCoin.Initialize()
+		scriptType, err := signing.DecodeScriptType(target.scriptType)
+		if err != nil {
+			log.WithError(err).Error("account discovery failed")
+			continue
+		}
+		for accountIndex := uint32(0); ; accountIndex++ {
+			accountConfig, err := config.NewAccount(target.coinCode, target.scriptType, accountIndex,
+				fmt.Sprintf("%s %d", names[target], accountIndex+1))
+			if err != nil {
+				log.WithError(err).Error("account discovery failed")
+				break
+			}
+			keypath, err := signing.NewAbsoluteKeypath(accountConfig.Keypath)
+			if err != nil {
+				log.WithError(err).Error("account discovery failed")
+				break
+			}
+			signingConfiguration, err := keystores.Configuration(scriptType, keypath, keystores.Count())
+			if err != nil {
+				log.WithError(err).Error("account discovery failed")
+				break
+			}
+			used, err := btc.AccountUsed(backend.ctx, btcCoin.Blockchain(), signingConfiguration,
+				btcCoin.Net(), btc.DiscoveryGapLimit, log)
+			if err != nil {
+				log.WithError(err).Error("account discovery failed")
+				break
+			}
+			if !used {
+				break
+			}
+			if accountIndex > 0 &&
+				!backend.hasAccountConfig(target.coinCode, accountConfig.Keypath, registered.identifier) {
+				log.WithField("keypath", accountConfig.Keypath).Info("discovered account")
+				accountConfig.Code += registered.codeSuffix
+				accountConfig.Keystore = registered.identifier
+				discovered = append(discovered, *accountConfig)
+			}
+		}
+	}
+	if len(discovered) == 0 {
+		return
+	}
+	if !backend.isRegistered(registered) {
+		backend.log.Info("keystore changed during account discovery")
+		return
+	}
+	codes := []string{}
+	if err := backend.config.ModifyAccounts(func(backendConfig *config.Backend) error {
+		for _, accountConfig := range discovered {
+			if err := backendConfig.AddAccount(accountConfig); err != nil {
+				backend.log.WithError(err).Error("could not add discovered account")
+				continue
+			}
+			codes = append(codes, accountConfig.Code)
+		}
+		return nil
+	}); err != nil {
+		backend.log.WithError(err).Error("could not persist discovered accounts")
+		return
+	}
+	backend.uninitKeystoreAccounts(registered)
+	backend.initConfiguredAccounts(registered)
+	backend.emit(events.BackendPayload{Data: "accountsDiscovered", Meta: codes})
+}
+
+// hasAccountConfig returns whether the account registry contains an account of the given coin at
+// the given keypath for the keystore with the given identifier.
+func (backend *Backend) hasAccountConfig(coinCode string, keypath string, identifier string) bool {
+	for _, accountConfig := range backend.config.Config().Backend.Accounts {
+		if accountConfig.CoinCode == coinCode && accountConfig.Keypath == keypath &&
+			accountConfig.ForKeystore(identifier) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/relay"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// encryptionFilename is the name of the file in the main directory which stores how the key is
+// derived from the password. The wallet data is encrypted if it exists.
+const encryptionFilename = "encryption.json"
+
+// EncryptionStatus describes whether the wallet data is encrypted at rest.
+type EncryptionStatus struct {
+	Enabled bool `json:"enabled"`
+	// Locked is true until the password is entered. The accounts and devices are only loaded
+	// afterwards.
+	Locked bool `json:"locked"`
+}
+
+// encryptionFile is the content of the encryption file.
+type encryptionFile struct {
+	*encryption.PasswordKey
+	// Migrating is set while the data written in plaintext is encrypted, so that an interrupted
+	// migration is completed when the wallet data is unlocked.
+	Migrating bool `json:"migrating,omitempty"`
+}
+
+func (backend *Backend) encryptionFilename() string {
+	return filepath.Join(backend.arguments.MainDirectoryPath(), encryptionFilename)
+}
+
+// loadPasswordKey loads the password key if the encryption is enabled.
+func (backend *Backend) loadPasswordKey() error {
+	jsonBytes, err := ioutil.ReadFile(backend.encryptionFilename())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	file := encryptionFile{}
+	if err := json.Unmarshal(jsonBytes, &file); err != nil {
+		return errp.WithStack(err)
+	}
+	if file.PasswordKey == nil {
+		return errp.New("the encryption file has no password key")
+	}
+	backend.passwordKey = file.PasswordKey
+	backend.migrating = file.Migrating
+	return nil
+}
+
+// storePasswordKey writes the encryption file.
+func (backend *Backend) storePasswordKey(passwordKey *encryption.PasswordKey, migrating bool) error {
+	jsonBytes, err := json.Marshal(encryptionFile{PasswordKey: passwordKey, Migrating: migrating})
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	return errp.WithStack(ioutil.WriteFile(backend.encryptionFilename(), jsonBytes, 0600))
+}
+
+// dbKey returns the key with which the databases and config files are encrypted, or nil if they
+// are stored in plaintext.
+func (backend *Backend) dbKey() *encryption.Key {
+	defer backend.encryptionLock.RLock()()
+	return backend.key
+}
+
+// EncryptionStatus returns whether the wallet data is encrypted and whether it is unlocked.
+func (backend *Backend) EncryptionStatus() EncryptionStatus {
+	defer backend.encryptionLock.RLock()()
+	return backend.encryptionStatus()
+}
+
+func (backend *Backend) encryptionStatus() EncryptionStatus {
+	return EncryptionStatus{
+		Enabled: backend.passwordKey != nil,
+		Locked:  backend.passwordKey != nil && backend.key == nil,
+	}
+}
+
+// Unlock derives the key from the password and loads the encrypted config. Afterwards, the accounts
+// and devices are loaded. It returns encryption.ErrWrongPassword if the password is wrong.
+func (backend *Backend) Unlock(password string) error {
+	err := func() error {
+		defer backend.coinsLock.Lock()()
+		defer backend.encryptionLock.Lock()()
+		if !backend.encryptionStatus().Locked {
+			return errp.New("the wallet data is not locked")
+		}
+		key, err := backend.passwordKey.Unlock(password)
+		if err != nil {
+			return err
+		}
+		if backend.migrating {
+			backend.log.Info("Resuming the encryption of the wallet data")
+			if err := backend.encryptWalletData(key); err != nil {
+				return err
+			}
+		} else if err := backend.config.SetEncryptionKey(key); err != nil {
+			return err
+		}
+		backend.key = key
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	backend.log.Info("Unlocked the wallet data")
+	backend.emit(events.BackendPayload{Data: "unlocked"})
+	if backend.started {
+		backend.startWallet()
+	}
+	return nil
+}
+
+// EnableEncryption encrypts the wallet data with a key derived from the given password, which has to
+// be entered when the app starts from now on. The data written in plaintext so far is encrypted
+// right away, and plaintext data is rejected afterwards. If this is interrupted or fails, the wallet
+// data stays locked and the encryption is completed when it is unlocked.
+func (backend *Backend) EnableEncryption(password string) error {
+	// The databases of the accounts are replaced by encrypted copies, so they must not be open.
+	backend.uninitAccounts()
+	err := func() error {
+		defer backend.coinsLock.Lock()()
+		defer backend.encryptionLock.Lock()()
+		if backend.passwordKey != nil {
+			return errp.New("the encryption is already enabled")
+		}
+		passwordKey, key, err := encryption.NewPasswordKey(password)
+		if err != nil {
+			return err
+		}
+		if err := backend.storePasswordKey(passwordKey, true); err != nil {
+			return err
+		}
+		backend.passwordKey = passwordKey
+		backend.migrating = true
+		if err := backend.encryptWalletData(key); err != nil {
+			return err
+		}
+		backend.key = key
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	backend.log.Info("Enabled the encryption of the wallet data")
+	if backend.started {
+		backend.initAccounts()
+	}
+	return nil
+}
+
+// encryptWalletData encrypts the config, the pairing and the files in the cache directory which
+// were written in plaintext, and marks the migration as completed. The files which are already
+// encrypted are skipped, so that an interrupted migration can be repeated. The coins are closed, as
+// they keep the databases open and are created again with the key. It must be called with the
+// coins and the encryption locked.
+func (backend *Backend) encryptWalletData(key *encryption.Key) error {
+	for _, coin := range backend.coins {
+		coin.Close()
+	}
+	backend.coins = map[string]coin.Coin{}
+	if err := backend.config.EnableEncryption(key); err != nil {
+		return err
+	}
+	if err := backend.encryptPairings(key); err != nil {
+		return err
+	}
+	encryptFunctions := map[string]func(filename string, key *encryption.Key) error{
+		"electrum-servers-*.json": encryption.EncryptFile,
+		"labels-*.json":           encryption.EncryptFile,
+		"account-*.db":            encryption.EncryptDB,
+		"headers-*.db":            encryption.EncryptDB,
+	}
+	for pattern, encrypt := range encryptFunctions {
+		filenames, err := filepath.Glob(filepath.Join(backend.arguments.CacheDirectoryPath(), pattern))
+		if err != nil {
+			return errp.WithStack(err)
+		}
+		for _, filename := range filenames {
+			if err := encrypt(filename, key); err != nil {
+				return errp.WithMessage(err, filename)
+			}
+		}
+	}
+	if err := backend.storePasswordKey(backend.passwordKey, false); err != nil {
+		return err
+	}
+	backend.migrating = false
+	return nil
+}
+
+// encryptPairings encrypts the stored pairing and makes the devices store their pairing encrypted.
+func (backend *Backend) encryptPairings(key *encryption.Key) error {
+	if backend.usbManager != nil {
+		backend.usbManager.SetChannelConfigKey(key)
+	}
+	for _, device := range backend.DevicesRegistered() {
+		if bitboxDevice, ok := device.(*bitbox.Device); ok {
+			if err := bitboxDevice.SetChannelConfigKey(key); err != nil {
+				return err
+			}
+		}
+	}
+	// The pairing is only read without the key if it is still stored in plaintext.
+	channelConfigDir := backend.arguments.MainDirectoryPath()
+	if channel := relay.NewChannelFromConfigFile(channelConfigDir, nil); channel != nil {
+		return channel.StoreToConfigFile(channelConfigDir, key)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/arguments"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	mainDir := test.TstTempDir("backend_encryption_test")
+	newArguments := func() *arguments.Arguments {
+		return arguments.NewArguments(mainDir, true, true, false, false, false)
+	}
+
+	theBackend := newBackend(t, newArguments())
+	require.Equal(t, backend.EncryptionStatus{}, theBackend.EncryptionStatus())
+	appConfig := theBackend.Config().Config()
+	appConfig.Backend.UpdateChannel = backend.UpdateChannelBeta
+	require.NoError(t, theBackend.Config().Set(appConfig))
+	require.NoError(t, theBackend.EnableEncryption("password"))
+	require.Error(t, theBackend.EnableEncryption("password"))
+	require.Equal(t, backend.EncryptionStatus{Enabled: true}, theBackend.EncryptionStatus())
+	theBackend.Close()
+
+	configBytes, err := ioutil.ReadFile(newArguments().ConfigFilename())
+	require.NoError(t, err)
+	require.True(t, encryption.IsEncrypted(configBytes))
+
+	// The wallet data is locked when the app starts.
+	theBackend = newBackend(t, newArguments())
+	defer theBackend.Close()
+	require.Equal(t, backend.EncryptionStatus{Enabled: true, Locked: true}, theBackend.EncryptionStatus())
+	require.True(t, theBackend.Config().Locked())
+	require.Error(t, theBackend.Config().Set(theBackend.Config().Config()))
+	_, err = theBackend.Coin("tbtc")
+	require.Error(t, err)
+
+	require.Equal(t, encryption.ErrWrongPassword, theBackend.Unlock("wrong"))
+	require.NoError(t, theBackend.Unlock("password"))
+	require.Equal(t, backend.EncryptionStatus{Enabled: true}, theBackend.EncryptionStatus())
+	require.Equal(t, backend.UpdateChannelBeta, theBackend.Config().Config().Backend.UpdateChannel)
+	_, err = theBackend.Coin("tbtc")
+	require.NoError(t, err)
+}
+
+func TestEncryptionResumesMigration(t *testing.T) {
+	mainDir := test.TstTempDir("backend_encryption_migration_test")
+	newArguments := func() *arguments.Arguments {
+		return arguments.NewArguments(mainDir, true, true, false, false, false)
+	}
+
+	theBackend := newBackend(t, newArguments())
+	appConfig := theBackend.Config().Config()
+	appConfig.Backend.UpdateChannel = backend.UpdateChannelBeta
+	require.NoError(t, theBackend.Config().Set(appConfig))
+	theBackend.Close()
+	serversFilename := filepath.Join(newArguments().CacheDirectoryPath(), "electrum-servers-tbtc.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(serversFilename), 0700))
+	require.NoError(t, ioutil.WriteFile(serversFilename, []byte("[]"), 0600))
+
+	// The app stopped after the encryption file was written, before the data was encrypted.
+	passwordKey, _, err := encryption.NewPasswordKey("password")
+	require.NoError(t, err)
+	jsonBytes, err := json.Marshal(passwordKey)
+	require.NoError(t, err)
+	encryptionFile := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(jsonBytes, &encryptionFile))
+	encryptionFile["migrating"] = true
+	jsonBytes, err = json.Marshal(encryptionFile)
+	require.NoError(t, err)
+	encryptionFilename := filepath.Join(mainDir, "encryption.json")
+	require.NoError(t, ioutil.WriteFile(encryptionFilename, jsonBytes, 0600))
+
+	theBackend = newBackend(t, newArguments())
+	defer theBackend.Close()
+	require.Equal(t, backend.EncryptionStatus{Enabled: true, Locked: true}, theBackend.EncryptionStatus())
+	require.NoError(t, theBackend.Unlock("password"))
+	require.Equal(t, backend.UpdateChannelBeta, theBackend.Config().Config().Backend.UpdateChannel)
+	for _, filename := range []string{newArguments().ConfigFilename(), serversFilename} {
+		data, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		require.True(t, encryption.IsEncrypted(data), filename)
+	}
+	jsonBytes, err = ioutil.ReadFile(encryptionFilename)
+	require.NoError(t, err)
+	require.NotContains(t, string(jsonBytes), "migrating")
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
+)
+
+// Bus distributes events to its subscribers. Publishing never blocks: every subscriber has its own
+// buffer, and events which do not fit into it are dropped for this subscriber only. The subscriber
+// is told about them by a KindDropped event. The most recent events are kept in a history, so that
+// subscribers can resume from a sequence number after reconnecting.
+type Bus struct {
+	lock locker.Locker
+
+	sequence    uint64
+	history     []*Event
+	historySize int
+
+	subscriptions map[*Subscription]struct{}
+	closed        bool
+}
+
+// NewBus creates a new bus which keeps the last historySize events.
+func NewBus(historySize int) *Bus {
+	return &Bus{
+		history:       []*Event{},
+		historySize:   historySize,
+		subscriptions: map[*Subscription]struct{}{},
+	}
+}
+
+// Publish assigns the next sequence number to an event with the given payload and delivers it to
+// the matching subscribers. Events published after Close() are ignored.
+func (bus *Bus) Publish(payload Payload) {
+	defer bus.lock.Lock()()
+	if bus.closed {
+		return
+	}
+	bus.sequence++
+	event := &Event{
+		Kind:      payload.Kind(),
+		Sequence:  bus.sequence,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}
+	if len(bus.history) == bus.historySize && len(bus.history) != 0 {
+		bus.history[0] = nil
+		bus.history = bus.history[1:]
+	}
+	if bus.historySize > 0 {
+		bus.history = append(bus.history, event)
+	}
+	for subscription := range bus.subscriptions {
+		subscription.deliver(event)
+	}
+}
+
+// Sequence returns the sequence number of the last published event.
+func (bus *Bus) Sequence() uint64 {
+	defer bus.lock.RLock()()
+	return bus.sequence
+}
+
+// Subscribe registers a subscriber for the events matching the filter. Up to bufferSize events are
+// buffered for the subscriber.
+//
+// If after is 0, only events published from now on are delivered. Otherwise, the events in the
+// history with a sequence number larger than after are delivered first, preceded by a KindDropped
+// event if some of them are not in the history anymore. If after is larger than the current
+// sequence number, e.g. because the backend was restarted, the whole history is delivered.
+//
+// If the bus is closed, the channel of the returned subscription is closed.
+func (bus *Bus) Subscribe(filter Filter, after uint64, bufferSize int) *Subscription {
+	defer bus.lock.Lock()()
+	subscription := &Subscription{
+		bus:    bus,
+		filter: filter,
+		events: make(chan *Event, bufferSize),
+	}
+	if bus.closed {
+		subscription.close()
+		return subscription
+	}
+	bus.subscriptions[subscription] = struct{}{}
+	if after == 0 {
+		return subscription
+	}
+	replayFrom := after + 1
+	if after > bus.sequence {
+		replayFrom = 1
+	}
+	oldest := bus.sequence + 1
+	if len(bus.history) != 0 {
+		oldest = bus.history[0].Sequence
+	}
+	if replayFrom < oldest {
+		subscription.dropped = int(oldest - replayFrom)
+		subscription.droppedFrom = replayFrom
+	}
+	for _, event := range bus.history {
+		if event.Sequence >= replayFrom {
+			subscription.deliver(event)
+		}
+	}
+	return subscription
+}
+
+// Close closes the channels of all subscriptions. Afterwards, published events are ignored. It is
+// safe to call it more than once.
+func (bus *Bus) Close() {
+	defer bus.lock.Lock()()
+	bus.closed = true
+	for subscription := range bus.subscriptions {
+		subscription.close()
+	}
+}
+
+// Subscription is a subscriber of a bus.
+type Subscription struct {
+	bus    *Bus
+	filter Filter
+	events chan *Event
+
+	// dropped is the number of events dropped since the last delivered one. droppedFrom is the
+	// sequence number of the first of them.
+	dropped     int
+	droppedFrom uint64
+	closed      bool
+}
+
+// Events returns the channel of the delivered events. It is closed when the subscription or the
+// bus is closed.
+func (subscription *Subscription) Events() <-chan *Event {
+	return subscription.events
+}
+
+// Close unsubscribes and closes the events channel. It is safe to call it more than once.
+func (subscription *Subscription) Close() {
+	defer subscription.bus.lock.Lock()()
+	subscription.close()
+}
+
+// close requires the bus lock.
+func (subscription *Subscription) close() {
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	delete(subscription.bus.subscriptions, subscription)
+	close(subscription.events)
+}
+
+// deliver sends the event to the subscriber if it matches the filter, without blocking. If events
+// were dropped before, a KindDropped event is sent first. Requires the bus lock.
+func (subscription *Subscription) deliver(event *Event) {
+	if !subscription.filter.Matches(event) {
+		return
+	}
+	if subscription.dropped != 0 {
+		dropped := &Event{
+			Kind:      KindDropped,
+			Timestamp: time.Now(),
+			Payload: DroppedPayload{
+				Count: subscription.dropped,
+				From:  subscription.droppedFrom,
+			},
+		}
+		if !subscription.send(dropped) {
+			subscription.dropped++
+			return
+		}
+		subscription.dropped = 0
+	}
+	if !subscription.send(event) {
+		subscription.dropped = 1
+		subscription.droppedFrom = event.Sequence
+	}
+}
+
+// send returns false if the buffer is full.
+func (subscription *Subscription) send(event *Event) bool {
+	select {
+	case subscription.events <- event:
+		return true
+	default:
+		return false
+	}
+}
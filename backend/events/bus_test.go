@@ -0,0 +1,161 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/observable"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/observable/action"
+	"github.com/stretchr/testify/require"
+)
+
+// receive returns the buffered events of the subscription.
+func receive(subscription *events.Subscription) []*events.Event {
+	result := []*events.Event{}
+	for {
+		select {
+		case event := <-subscription.Events():
+			result = append(result, event)
+		default:
+			return result
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	bus := events.NewBus(10)
+	all := bus.Subscribe(events.Filter{}, 0, 10)
+	accounts := bus.Subscribe(events.Filter{Kinds: []events.Kind{events.KindAccount}}, 0, 10)
+	btcAccount := bus.Subscribe(events.Filter{Accounts: []string{"btc"}}, 0, 10)
+
+	bus.Publish(events.BackendPayload{Data: "accountsStatusChanged"})
+	bus.Publish(events.AccountPayload{Code: "btc", Data: "syncdone"})
+	bus.Publish(events.AccountPayload{Code: "ltc", Data: "syncdone"})
+	require.Equal(t, uint64(3), bus.Sequence())
+
+	received := receive(all)
+	require.Len(t, received, 3)
+	for index, event := range received {
+		require.Equal(t, uint64(index+1), event.Sequence)
+	}
+	require.Equal(t, events.KindBackend, received[0].Kind)
+	require.Equal(t, events.AccountPayload{Code: "ltc", Data: "syncdone"}, received[2].Payload)
+
+	received = receive(accounts)
+	require.Len(t, received, 2)
+	require.Equal(t, uint64(2), received[0].Sequence)
+
+	// The account filter does not affect other kinds.
+	received = receive(btcAccount)
+	require.Len(t, received, 2)
+	require.Equal(t, events.KindBackend, received[0].Kind)
+	require.Equal(t, events.AccountPayload{Code: "btc", Data: "syncdone"}, received[1].Payload)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	bus := events.NewBus(10)
+	slow := bus.Subscribe(events.Filter{}, 0, 2)
+	fast := bus.Subscribe(events.Filter{}, 0, 10)
+	for i := 0; i < 5; i++ {
+		bus.Publish(events.DevicesPayload{Data: "registeredChanged"})
+	}
+	require.Len(t, receive(fast), 5)
+	received := receive(slow)
+	require.Len(t, received, 2)
+	require.Equal(t, uint64(2), received[1].Sequence)
+
+	// The subscriber is told about the dropped events before the next event.
+	bus.Publish(events.DevicesPayload{Data: "registeredChanged"})
+	received = receive(slow)
+	require.Len(t, received, 2)
+	require.Equal(t, events.KindDropped, received[0].Kind)
+	require.Equal(t, events.DroppedPayload{Count: 3, From: 3}, received[0].Payload)
+	require.Equal(t, uint64(6), received[1].Sequence)
+}
+
+func TestResume(t *testing.T) {
+	bus := events.NewBus(3)
+	for i := 0; i < 5; i++ {
+		bus.Publish(events.AccountPayload{Code: "btc", Data: "syncdone"})
+	}
+
+	// All missed events are still in the history.
+	received := receive(bus.Subscribe(events.Filter{}, 3, 10))
+	require.Len(t, received, 2)
+	require.Equal(t, uint64(4), received[0].Sequence)
+	require.Equal(t, uint64(5), received[1].Sequence)
+
+	// Event 2 is not in the history anymore.
+	received = receive(bus.Subscribe(events.Filter{}, 1, 10))
+	require.Len(t, received, 4)
+	require.Equal(t, events.DroppedPayload{Count: 1, From: 2}, received[0].Payload)
+	require.Equal(t, uint64(3), received[1].Sequence)
+
+	// Nothing was missed.
+	require.Empty(t, receive(bus.Subscribe(events.Filter{}, 5, 10)))
+	// Without resuming, only new events are delivered.
+	require.Empty(t, receive(bus.Subscribe(events.Filter{}, 0, 10)))
+}
+
+func TestClose(t *testing.T) {
+	bus := events.NewBus(10)
+	subscription := bus.Subscribe(events.Filter{}, 0, 10)
+	closedSubscription := bus.Subscribe(events.Filter{}, 0, 10)
+	closedSubscription.Close()
+	closedSubscription.Close()
+	_, ok := <-closedSubscription.Events()
+	require.False(t, ok)
+
+	bus.Close()
+	bus.Close()
+	_, ok = <-subscription.Events()
+	require.False(t, ok)
+	bus.Publish(events.BackendPayload{Data: "accountsStatusChanged"})
+	require.Equal(t, uint64(0), bus.Sequence())
+	_, ok = <-bus.Subscribe(events.Filter{}, 0, 10).Events()
+	require.False(t, ok)
+	subscription.Close()
+}
+
+func TestMarshalJSON(t *testing.T) {
+	bus := events.NewBus(10)
+	subscription := bus.Subscribe(events.Filter{}, 0, 10)
+	bus.Publish(events.AccountPayload{Code: "btc", Data: "syncdone"})
+	bus.Publish(events.ObservablePayload(observable.Event{
+		Subject: "rates", Action: action.Replace, Object: 1}))
+	received := receive(subscription)
+	require.Len(t, received, 2)
+
+	var decoded map[string]interface{}
+	encoded, err := json.Marshal(received[0])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Equal(t, "account", decoded["type"])
+	require.Equal(t, "btc", decoded["code"])
+	require.Equal(t, "syncdone", decoded["data"])
+	require.Equal(t, float64(1), decoded["seq"])
+	require.Contains(t, decoded, "timestamp")
+
+	encoded, err = json.Marshal(received[1])
+	require.NoError(t, err)
+	decoded = nil
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Equal(t, "observable", decoded["type"])
+	require.Equal(t, "rates", decoded["subject"])
+	require.Equal(t, "replace", decoded["action"])
+}
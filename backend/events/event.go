@@ -0,0 +1,211 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events contains the events pushed by the backend to its clients, and the bus
+// distributing them.
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/observable"
+)
+
+// Kind identifies the kind of an event, which determines the type of its payload.
+type Kind string
+
+const (
+	// KindBackend events concern the backend as a whole, e.g. the accounts changed. The payload is
+	// a BackendPayload.
+	KindBackend Kind = "backend"
+
+	// KindDevices events are fired when the registered devices change. The payload is a
+	// DevicesPayload.
+	KindDevices Kind = "devices"
+
+	// KindDevice events are fired by a device. The payload is a DevicePayload.
+	KindDevice Kind = "device"
+
+	// KindAccount events are fired by an account. The payload is an AccountPayload.
+	KindAccount Kind = "account"
+
+	// KindObservable events describe a change of the data of an API endpoint, e.g. the exchange
+	// rates. The payload is an ObservablePayload.
+	KindObservable Kind = "observable"
+
+	// KindDropped events are sent to a subscriber instead of the events which did not fit into its
+	// buffer. They are not part of the sequence of events. The payload is a DroppedPayload.
+	KindDropped Kind = "dropped"
+)
+
+// kinds are all known kinds.
+var kinds = []Kind{KindBackend, KindDevices, KindDevice, KindAccount, KindObservable, KindDropped}
+
+// ParseKind returns the kind with the given name.
+func ParseKind(name string) (Kind, error) {
+	for _, kind := range kinds {
+		if string(kind) == name {
+			return kind, nil
+		}
+	}
+	return "", errp.Newf("unknown event kind %q", name)
+}
+
+// Payload is the kind specific content of an event.
+type Payload interface {
+	Kind() Kind
+}
+
+// BackendPayload is the payload of KindBackend events.
+type BackendPayload struct {
+	Data string      `json:"data"`
+	Meta interface{} `json:"meta,omitempty"`
+}
+
+// Kind implements Payload.
+func (BackendPayload) Kind() Kind { return KindBackend }
+
+// DevicesPayload is the payload of KindDevices events.
+type DevicesPayload struct {
+	Data string `json:"data"`
+}
+
+// Kind implements Payload.
+func (DevicesPayload) Kind() Kind { return KindDevices }
+
+// DevicePayload is the payload of KindDevice events.
+type DevicePayload struct {
+	DeviceID string `json:"deviceID"`
+	// TODO: rename Data to Event, Meta to Data.
+	Data string      `json:"data"`
+	Meta interface{} `json:"meta"`
+}
+
+// Kind implements Payload.
+func (DevicePayload) Kind() Kind { return KindDevice }
+
+// AccountPayload is the payload of KindAccount events.
+type AccountPayload struct {
+	Code string `json:"code"`
+	Data string `json:"data"`
+}
+
+// Kind implements Payload.
+func (AccountPayload) Kind() Kind { return KindAccount }
+
+// ObservablePayload is the payload of KindObservable events.
+type ObservablePayload observable.Event
+
+// Kind implements Payload.
+func (ObservablePayload) Kind() Kind { return KindObservable }
+
+// DroppedPayload is the payload of KindDropped events.
+type DroppedPayload struct {
+	// Count is the number of dropped events.
+	Count int `json:"count"`
+	// From is the sequence number of the first dropped event. Subscribing again with `after` set
+	// to From-1 delivers the dropped events, as long as they are still in the history.
+	From uint64 `json:"from"`
+}
+
+// Kind implements Payload.
+func (DroppedPayload) Kind() Kind { return KindDropped }
+
+// Event is an event distributed by the bus.
+type Event struct {
+	Kind Kind
+	// Sequence numbers start at 1 and increase by one with every published event.
+	Sequence  uint64
+	Timestamp time.Time
+	Payload   Payload
+}
+
+// account returns the code of the account the event belongs to, or "" if it is not an account
+// event.
+func (event *Event) account() string {
+	if payload, ok := event.Payload.(AccountPayload); ok {
+		return payload.Code
+	}
+	return ""
+}
+
+// MarshalJSON implements json.Marshaler. The fields of the payload are inlined, and the kind is
+// stored in the `type` field, for compatibility with the events before the kinds were introduced.
+func (event *Event) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	for key, value := range map[string]interface{}{
+		"type":      event.Kind,
+		"seq":       event.Sequence,
+		"timestamp": event.Timestamp,
+	} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+		fields[key] = encoded
+	}
+	return json.Marshal(fields)
+}
+
+// Filter selects the events delivered to a subscriber.
+type Filter struct {
+	// Kinds are the kinds of the delivered events. All kinds are delivered if it is empty.
+	// KindDropped events are always delivered.
+	Kinds []Kind
+	// Accounts restricts KindAccount events to the accounts with the given codes. All account
+	// events are delivered if it is empty. Other kinds are not affected.
+	Accounts []string
+}
+
+// Matches returns whether the event passes the filter.
+func (filter *Filter) Matches(event *Event) bool {
+	if event.Kind == KindDropped {
+		return true
+	}
+	if len(filter.Kinds) != 0 && !containsKind(filter.Kinds, event.Kind) {
+		return false
+	}
+	if event.Kind == KindAccount && len(filter.Accounts) != 0 &&
+		!containsString(filter.Accounts, event.account()) {
+		return false
+	}
+	return true
+}
+
+func containsKind(kinds []Kind, kind Kind) bool {
+	for _, candidate := range kinds {
+		if candidate == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
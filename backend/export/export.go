@@ -0,0 +1,342 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export writes the transaction history of one or more accounts in formats suitable for
+// spreadsheets, accounting software and tax tools.
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// Format is the layout of an exported file. See the Format* constants.
+type Format string
+
+const (
+	// FormatCSV is the original BitBox CSV layout with amounts in the smallest coin unit.
+	FormatCSV Format = "csv"
+	// FormatAccountingCSV is a generic CSV layout with fiat values for bookkeeping.
+	FormatAccountingCSV Format = "accounting-csv"
+	// FormatKoinly is the Koinly universal import format.
+	FormatKoinly Format = "koinly"
+	// FormatCoinTracking is the CoinTracking CSV import format.
+	FormatCoinTracking Format = "cointracking"
+	// FormatOFX is an Open Financial Exchange bank statement.
+	FormatOFX Format = "ofx"
+	// FormatQIF is a Quicken Interchange Format bank register.
+	FormatQIF Format = "qif"
+)
+
+// needsFiat returns true if the format contains fiat values, which requires historical rates.
+func (format Format) needsFiat() bool {
+	switch format {
+	case FormatAccountingCSV, FormatKoinly:
+		return true
+	}
+	return false
+}
+
+// Account is the part of an account needed to export its transactions.
+type Account interface {
+	Code() string
+	Name() string
+	Coin() coin.Coin
+	Transactions() ([]coin.Transaction, error)
+}
+
+// HistoricalRates provides the fiat price of one unit of a coin at a given time. The lookup is
+// aborted when ctx is cancelled.
+type HistoricalRates interface {
+	HistoricalRate(ctx context.Context, coinUnit string, fiat string, at time.Time) (float64, error)
+}
+
+// Options configure an export.
+type Options struct {
+	Format Format
+	// From is the inclusive start of the date range. nil for no lower bound.
+	From *time.Time
+	// To is the exclusive end of the date range. nil for no upper bound.
+	To *time.Time
+	// Fiat is the fiat currency code used for fiat columns and the gains report, e.g. "USD".
+	Fiat string
+	// CostBasis is the lot matching method of the realized gains report. If empty, no report is
+	// created.
+	CostBasis Method
+	// Rates is needed for formats with fiat values and for the realized gains report.
+	Rates HistoricalRates
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Dates can be given as "2006-01-02" or in RFC3339.
+func (options *Options) UnmarshalJSON(jsonBytes []byte) error {
+	jsonBody := struct {
+		Format    string `json:"format"`
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Fiat      string `json:"fiat"`
+		CostBasis string `json:"costBasis"`
+	}{}
+	if err := json.Unmarshal(jsonBytes, &jsonBody); err != nil {
+		return errp.WithStack(err)
+	}
+	options.Format = FormatCSV
+	if jsonBody.Format != "" {
+		options.Format = Format(jsonBody.Format)
+	}
+	options.Fiat = strings.ToUpper(jsonBody.Fiat)
+	if options.Fiat == "" {
+		options.Fiat = "USD"
+	}
+	options.CostBasis = Method(jsonBody.CostBasis)
+	var err error
+	if options.From, err = ParseDate(jsonBody.From); err != nil {
+		return err
+	}
+	if options.To, err = ParseDate(jsonBody.To); err != nil {
+		return err
+	}
+	return options.validate()
+}
+
+// ParseDate parses a date given as "2006-01-02" or in RFC3339. It returns nil for an empty string.
+func ParseDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return &date, nil
+		}
+	}
+	return nil, errp.Newf("invalid date %q", value)
+}
+
+func (options *Options) validate() error {
+	switch options.Format {
+	case FormatCSV, FormatAccountingCSV, FormatKoinly, FormatCoinTracking, FormatOFX, FormatQIF:
+	default:
+		return errp.Newf("unknown export format %q", options.Format)
+	}
+	switch options.CostBasis {
+	case "", MethodFIFO, MethodLIFO, MethodHIFO:
+	default:
+		return errp.Newf("unknown cost basis method %q", options.CostBasis)
+	}
+	if options.From != nil && options.To != nil && !options.From.Before(*options.To) {
+		return errp.New("the start of the date range must be before the end")
+	}
+	return nil
+}
+
+// inRange returns true if the timestamp falls into the configured date range. Transactions without
+// a timestamp (unconfirmed, or headers not synced yet) are only in range if no range is set.
+func (options *Options) inRange(timestamp *time.Time) bool {
+	if timestamp == nil {
+		return options.From == nil && options.To == nil
+	}
+	if options.From != nil && timestamp.Before(*options.From) {
+		return false
+	}
+	if options.To != nil && !timestamp.Before(*options.To) {
+		return false
+	}
+	return true
+}
+
+// File is an exported file.
+type File struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Data        string `json:"data"`
+}
+
+// WriteToDir stores the file in the given directory and returns its path.
+func (file *File) WriteToDir(dir string) (string, error) {
+	path := filepath.Join(dir, file.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errp.WithStack(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(file.Data), 0600); err != nil {
+		return "", errp.WithStack(err)
+	}
+	return path, nil
+}
+
+// Result holds the exported transactions and, if requested, the realized gains report.
+type Result struct {
+	Transactions *File `json:"transactions"`
+	Gains        *File `json:"gains"`
+}
+
+// Entry is a transaction of an account, along with its fiat rate if available.
+type Entry struct {
+	Account     Account
+	Transaction coin.Transaction
+	// Rate is the fiat price of one coin unit at the time of the transaction. 0 if not
+	// requested or if the transaction is not confirmed yet.
+	Rate float64
+}
+
+// Time returns the timestamp of the transaction, or nil if it has none.
+func (entry *Entry) Time() *time.Time {
+	return entry.Transaction.Timestamp()
+}
+
+// SignedAmount is the change of the account balance caused by the transaction, in the smallest
+// unit, including the fee.
+func (entry *Entry) SignedAmount() *big.Int {
+	transaction := entry.Transaction
+	amount := transaction.Amount().BigInt()
+	fee := big.NewInt(0)
+	if transaction.Fee() != nil {
+		fee = transaction.Fee().BigInt()
+	}
+	switch transaction.Type() {
+	case coin.TxTypeReceive:
+		return amount
+	case coin.TxTypeSendSelf:
+		return fee.Neg(fee)
+	default:
+		return amount.Neg(amount.Add(amount, fee))
+	}
+}
+
+// unit returns the unit used to look up rates. Testnet coins are priced like their mainnet
+// counterparts.
+func (entry *Entry) unit() string {
+	return rateUnit(entry.Account.Coin().Unit())
+}
+
+func rateUnit(unit string) string {
+	if len(unit) == 4 && strings.HasPrefix(unit, "T") {
+		return unit[1:]
+	}
+	return unit
+}
+
+// byTime sorts entries chronologically. Entries without a timestamp come last.
+type byTime []*Entry
+
+func (s byTime) Len() int { return len(s) }
+func (s byTime) Less(i, j int) bool {
+	ti, tj := s[i].Time(), s[j].Time()
+	if ti == nil {
+		return false
+	}
+	if tj == nil {
+		return true
+	}
+	return ti.Before(*tj)
+}
+func (s byTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// collectEntries gathers the transactions of all accounts in chronological order. Rates are looked
+// up if withRates is true. Unconfirmed transactions get no rate, as the formats with fiat values
+// and the realized gains skip them.
+func collectEntries(
+	ctx context.Context, accounts []Account, options *Options, withRates bool) ([]*Entry, error) {
+	if withRates && options.Rates == nil {
+		return nil, errp.New("historical rates are required for fiat values")
+	}
+	entries := []*Entry{}
+	for _, account := range accounts {
+		transactions, err := account.Transactions()
+		if err != nil {
+			return nil, err
+		}
+		for _, transaction := range transactions {
+			entry := &Entry{Account: account, Transaction: transaction}
+			if withRates && transaction.Timestamp() != nil {
+				rate, err := options.Rates.HistoricalRate(
+					ctx, entry.unit(), options.Fiat, *transaction.Timestamp())
+				if err != nil {
+					return nil, errp.WithMessage(err, "Failed to get the historical rate")
+				}
+				entry.Rate = rate
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Stable(byTime(entries))
+	return entries, nil
+}
+
+// Export exports the transactions of the given accounts according to the options. Looking up the
+// fiat rates is aborted when ctx is cancelled.
+func Export(ctx context.Context, accounts []Account, options *Options) (*Result, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, errp.New("no accounts to export")
+	}
+	entries, err := collectEntries(ctx, accounts, options,
+		options.Format.needsFiat() || options.CostBasis != "")
+	if err != nil {
+		return nil, err
+	}
+	inRange := []*Entry{}
+	for _, entry := range entries {
+		if options.inRange(entry.Time()) {
+			inRange = append(inRange, entry)
+		}
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := writers[options.Format].write(buffer, inRange, accounts, options); err != nil {
+		return nil, err
+	}
+	baseName := fileBaseName(accounts)
+	result := &Result{
+		Transactions: &File{
+			Name:        baseName + "-export." + writers[options.Format].extension,
+			ContentType: writers[options.Format].contentType,
+			Data:        buffer.String(),
+		},
+	}
+	if options.CostBasis != "" {
+		// Lots have to be matched over the whole history, but only disposals in the date range
+		// are reported.
+		disposals := RealizedGains(entries, options.CostBasis)
+		buffer := &bytes.Buffer{}
+		if err := writeGainsReport(buffer, disposals, options); err != nil {
+			return nil, err
+		}
+		result.Gains = &File{
+			Name:        baseName + "-gains-" + string(options.CostBasis) + ".csv",
+			ContentType: "text/csv",
+			Data:        buffer.String(),
+		}
+	}
+	return result, nil
+}
+
+func fileBaseName(accounts []Account) string {
+	name := time.Now().Format("2006-01-02-at-15-04-05-")
+	if len(accounts) == 1 {
+		return name + accounts[0].Code()
+	}
+	return name + "accounts"
+}
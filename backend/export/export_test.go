@@ -0,0 +1,213 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export_test
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/export"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+var tbtc = btc.NewCoin("tbtc", "TBTC", &chaincfg.TestNet3Params, ".", nil, []*rpc.ServerInfo{}, false, "")
+
+type transaction struct {
+	id        string
+	txType    coin.TxType
+	amount    int64
+	fee       *int64
+	timestamp *time.Time
+}
+
+func (tx *transaction) Fee() *coin.Amount {
+	if tx.fee == nil {
+		return nil
+	}
+	fee := coin.NewAmountFromInt64(*tx.fee)
+	return &fee
+}
+func (tx *transaction) Timestamp() *time.Time { return tx.timestamp }
+func (tx *transaction) ID() string            { return tx.id }
+func (tx *transaction) NumConfirmations() int {
+	if tx.timestamp == nil {
+		return 0
+	}
+	return 1
+}
+func (tx *transaction) BlockHeight() int    { return tx.NumConfirmations() }
+func (tx *transaction) Type() coin.TxType   { return tx.txType }
+func (tx *transaction) Amount() coin.Amount { return coin.NewAmountFromInt64(tx.amount) }
+func (tx *transaction) Addresses() []string { return []string{"address-" + tx.id} }
+
+type account struct {
+	code         string
+	transactions []coin.Transaction
+}
+
+func (a *account) Code() string    { return a.code }
+func (a *account) Name() string    { return "Account " + a.code }
+func (a *account) Coin() coin.Coin { return tbtc }
+func (a *account) Transactions() ([]coin.Transaction, error) {
+	return a.transactions, nil
+}
+
+// rates returns the day of the month times 1000 as the price of one BTC. Only the rates of the
+// confirmed test transactions are expected to be requested.
+type rates struct{}
+
+func (rates) HistoricalRate(ctx context.Context, coinUnit string, fiat string, at time.Time) (float64, error) {
+	if coinUnit != "BTC" || fiat != "USD" || at.Year() != 2018 {
+		panic("unexpected rate request")
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return float64(at.Day() * 1000), nil
+}
+
+func date(day int) *time.Time {
+	t := time.Date(2018, time.March, day, 12, 0, 0, 0, time.UTC)
+	return &t
+}
+
+func fee(value int64) *int64 { return &value }
+
+func testAccount() *account {
+	return &account{
+		code: "tbtc-p2wpkh",
+		transactions: []coin.Transaction{
+			&transaction{id: "c", txType: coin.TxTypeSend, amount: 150000000, fee: fee(1000), timestamp: date(3)},
+			&transaction{id: "b", txType: coin.TxTypeReceive, amount: 100000000, timestamp: date(2)},
+			&transaction{id: "a", txType: coin.TxTypeReceive, amount: 100000000, timestamp: date(1)},
+			&transaction{id: "d", txType: coin.TxTypeReceive, amount: 5000, timestamp: nil},
+		},
+	}
+}
+
+func readCSV(t *testing.T, file *export.File) [][]string {
+	records, err := csv.NewReader(strings.NewReader(file.Data)).ReadAll()
+	require.NoError(t, err)
+	return records
+}
+
+func TestOptionsJSON(t *testing.T) {
+	options := &export.Options{}
+	require.NoError(t, json.Unmarshal(
+		[]byte(`{"format":"koinly","from":"2018-01-01","to":"2019-01-01T00:00:00Z","costBasis":"hifo"}`),
+		options))
+	require.Equal(t, export.FormatKoinly, options.Format)
+	require.Equal(t, "USD", options.Fiat)
+	require.Equal(t, export.MethodHIFO, options.CostBasis)
+	require.Equal(t, 2018, options.From.Year())
+	require.Equal(t, 2019, options.To.Year())
+
+	require.Error(t, json.Unmarshal([]byte(`{"format":"xls"}`), &export.Options{}))
+	require.Error(t, json.Unmarshal([]byte(`{"costBasis":"avg"}`), &export.Options{}))
+	require.Error(t, json.Unmarshal([]byte(`{"from":"2019-01-01","to":"2018-01-01"}`), &export.Options{}))
+}
+
+func TestExportCSV(t *testing.T) {
+	result, err := export.Export(context.Background(), []export.Account{testAccount()}, &export.Options{Format: export.FormatCSV})
+	require.NoError(t, err)
+	require.Nil(t, result.Gains)
+	require.True(t, strings.HasSuffix(result.Transactions.Name, "tbtc-p2wpkh-export.csv"))
+	records := readCSV(t, result.Transactions)
+	require.Equal(t, []string{"Time", "Type", "Amount", "Fee", "Address", "Transaction ID"}, records[0])
+	require.Len(t, records, 5)
+	require.Equal(t,
+		[]string{"2018-03-03T12:00:00Z", "sent", "150000000", "1000", "address-c", "c"},
+		records[3])
+	// Unconfirmed transactions come last.
+	require.Equal(t, "d", records[4][5])
+}
+
+func TestExportDateRange(t *testing.T) {
+	result, err := export.Export(context.Background(), []export.Account{testAccount()}, &export.Options{
+		Format: export.FormatCSV,
+		From:   date(2),
+		To:     date(3),
+	})
+	require.NoError(t, err)
+	records := readCSV(t, result.Transactions)
+	require.Len(t, records, 2)
+	require.Equal(t, "b", records[1][5])
+}
+
+func TestExportAccountingCSV(t *testing.T) {
+	_, err := export.Export(context.Background(), []export.Account{testAccount()},
+		&export.Options{Format: export.FormatAccountingCSV, Fiat: "USD"})
+	require.Error(t, err, "rates are required")
+
+	result, err := export.Export(context.Background(), []export.Account{testAccount()},
+		&export.Options{Format: export.FormatAccountingCSV, Fiat: "USD", Rates: rates{}})
+	require.NoError(t, err)
+	records := readCSV(t, result.Transactions)
+	require.Len(t, records, 4)
+	require.Equal(t, []string{
+		"2018-03-03T12:00:00Z", "tbtc-p2wpkh", "Account tbtc-p2wpkh", "send", "TBTC", "-1.50001",
+		"0.00001", "USD", "3000", "-4500.03", "0.03", "address-c", "c",
+	}, records[3])
+}
+
+func TestExportCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := export.Export(ctx, []export.Account{testAccount()},
+		&export.Options{Format: export.FormatAccountingCSV, Fiat: "USD", Rates: rates{}})
+	require.Error(t, err)
+}
+
+func TestExportKoinlyAndCoinTracking(t *testing.T) {
+	result, err := export.Export(context.Background(), []export.Account{testAccount()},
+		&export.Options{Format: export.FormatKoinly, Fiat: "USD", Rates: rates{}})
+	require.NoError(t, err)
+	records := readCSV(t, result.Transactions)
+	require.Equal(t, []string{
+		"2018-03-03 12:00:00 UTC", "1.5", "TBTC", "", "", "0.00001", "TBTC", "4500.00", "USD", "",
+		"Account tbtc-p2wpkh", "c",
+	}, records[3])
+
+	result, err = export.Export(context.Background(), []export.Account{testAccount()},
+		&export.Options{Format: export.FormatCoinTracking})
+	require.NoError(t, err)
+	records = readCSV(t, result.Transactions)
+	require.Equal(t, "Deposit", records[1][0])
+	require.Equal(t, "Withdrawal", records[3][0])
+	require.Equal(t, "2018-03-03 12:00:00", records[3][10])
+}
+
+func TestExportOFXAndQIF(t *testing.T) {
+	result, err := export.Export(context.Background(), []export.Account{testAccount()}, &export.Options{Format: export.FormatOFX})
+	require.NoError(t, err)
+	require.Equal(t, "application/x-ofx", result.Transactions.ContentType)
+	require.Contains(t, result.Transactions.Data, "<TRNAMT>-1.50001</TRNAMT>")
+	require.Contains(t, result.Transactions.Data, "<FITID>a</FITID>")
+	require.Contains(t, result.Transactions.Data, "<BALAMT>0.50004</BALAMT>")
+	require.NotContains(t, result.Transactions.Data, "<FITID>d</FITID>")
+
+	result, err = export.Export(context.Background(), []export.Account{testAccount()}, &export.Options{Format: export.FormatQIF})
+	require.NoError(t, err)
+	require.Contains(t, result.Transactions.Data, "!Type:Bank\nD03/01/2018\nT1\nPaddress-a\n")
+	require.Contains(t, result.Transactions.Data, "D03/03/2018\nT-1.50001\n")
+}
@@ -0,0 +1,379 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+type writer struct {
+	extension   string
+	contentType string
+	write       func(w io.Writer, entries []*Entry, accounts []Account, options *Options) error
+}
+
+var writers = map[Format]writer{
+	FormatCSV:           {"csv", "text/csv", writeCSV},
+	FormatAccountingCSV: {"csv", "text/csv", writeAccountingCSV},
+	FormatKoinly:        {"csv", "text/csv", writeKoinly},
+	FormatCoinTracking:  {"csv", "text/csv", writeCoinTracking},
+	FormatOFX:           {"ofx", "application/x-ofx", writeOFX},
+	FormatQIF:           {"qif", "application/qif", writeQIF},
+}
+
+// formatAmount formats an amount in the smallest unit in the default unit of the coin, keeping the
+// sign.
+func formatAmount(c coin.Coin, amount *big.Int) string {
+	if amount.Sign() < 0 {
+		return "-" + c.FormatAmount(coin.NewAmount(new(big.Int).Neg(amount)))
+	}
+	return c.FormatAmount(coin.NewAmount(amount))
+}
+
+func formatFiat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+func toUnit(c coin.Coin, amount *big.Int) float64 {
+	return c.ToUnit(coin.NewAmount(amount))
+}
+
+func feeOf(transaction coin.Transaction) *big.Int {
+	if transaction.Fee() == nil {
+		return big.NewInt(0)
+	}
+	return transaction.Fee().BigInt()
+}
+
+func writeRecords(w io.Writer, header []string, records [][]string) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(header); err != nil {
+		return errp.WithStack(err)
+	}
+	if err := csvWriter.WriteAll(records); err != nil {
+		return errp.WithStack(err)
+	}
+	return nil
+}
+
+// writeCSV writes the original export layout. Amounts are in the smallest unit.
+func writeCSV(w io.Writer, entries []*Entry, _ []Account, _ *Options) error {
+	records := [][]string{}
+	for _, entry := range entries {
+		transaction := entry.Transaction
+		transactionType := map[coin.TxType]string{
+			coin.TxTypeReceive:  "received",
+			coin.TxTypeSend:     "sent",
+			coin.TxTypeSendSelf: "sent_to_yourself",
+		}[transaction.Type()]
+		feeString := ""
+		if fee := transaction.Fee(); fee != nil {
+			feeString = fee.BigInt().String()
+		}
+		timeString := ""
+		if transaction.Timestamp() != nil {
+			timeString = transaction.Timestamp().Format(time.RFC3339)
+		}
+		records = append(records, []string{
+			timeString,
+			transactionType,
+			transaction.Amount().BigInt().String(),
+			feeString,
+			strings.Join(transaction.Addresses(), "; "),
+			transaction.ID(),
+		})
+	}
+	return writeRecords(w,
+		[]string{"Time", "Type", "Amount", "Fee", "Address", "Transaction ID"},
+		records)
+}
+
+func writeAccountingCSV(w io.Writer, entries []*Entry, _ []Account, options *Options) error {
+	records := [][]string{}
+	for _, entry := range entries {
+		transaction := entry.Transaction
+		if transaction.Timestamp() == nil {
+			continue
+		}
+		theCoin := entry.Account.Coin()
+		signedAmount := entry.SignedAmount()
+		fee := feeOf(transaction)
+		records = append(records, []string{
+			transaction.Timestamp().UTC().Format(time.RFC3339),
+			entry.Account.Code(),
+			entry.Account.Name(),
+			string(transaction.Type()),
+			theCoin.Unit(),
+			formatAmount(theCoin, signedAmount),
+			formatAmount(theCoin, fee),
+			options.Fiat,
+			strconv.FormatFloat(entry.Rate, 'f', -1, 64),
+			formatFiat(toUnit(theCoin, signedAmount) * entry.Rate),
+			formatFiat(toUnit(theCoin, fee) * entry.Rate),
+			strings.Join(transaction.Addresses(), "; "),
+			transaction.ID(),
+		})
+	}
+	return writeRecords(w,
+		[]string{
+			"Date", "Account", "Account Name", "Type", "Currency", "Net Amount", "Fee",
+			"Fiat Currency", "Fiat Rate", "Fiat Net Amount", "Fiat Fee", "Addresses",
+			"Transaction ID",
+		},
+		records)
+}
+
+// writeKoinly writes the Koinly universal format:
+// https://help.koinly.io/en/articles/3662999-how-to-create-a-custom-csv-file-with-your-data
+func writeKoinly(w io.Writer, entries []*Entry, _ []Account, options *Options) error {
+	records := [][]string{}
+	for _, entry := range entries {
+		transaction := entry.Transaction
+		if transaction.Timestamp() == nil {
+			continue
+		}
+		theCoin := entry.Account.Coin()
+		unit := theCoin.Unit()
+		amount := transaction.Amount().BigInt()
+		fee := feeOf(transaction)
+		var sentAmount, sentCurrency, receivedAmount, receivedCurrency, feeAmount, feeCurrency string
+		var netWorth float64
+		switch transaction.Type() {
+		case coin.TxTypeReceive:
+			receivedAmount, receivedCurrency = formatAmount(theCoin, amount), unit
+			netWorth = toUnit(theCoin, amount) * entry.Rate
+		case coin.TxTypeSend:
+			sentAmount, sentCurrency = formatAmount(theCoin, amount), unit
+			feeAmount, feeCurrency = formatAmount(theCoin, fee), unit
+			netWorth = toUnit(theCoin, amount) * entry.Rate
+		case coin.TxTypeSendSelf:
+			// A transfer between own addresses only costs the fee.
+			sentAmount, sentCurrency = formatAmount(theCoin, amount), unit
+			receivedAmount, receivedCurrency = formatAmount(theCoin, amount), unit
+			feeAmount, feeCurrency = formatAmount(theCoin, fee), unit
+			netWorth = toUnit(theCoin, amount) * entry.Rate
+		}
+		records = append(records, []string{
+			transaction.Timestamp().UTC().Format("2006-01-02 15:04:05 UTC"),
+			sentAmount, sentCurrency,
+			receivedAmount, receivedCurrency,
+			feeAmount, feeCurrency,
+			formatFiat(netWorth), options.Fiat,
+			"",
+			entry.Account.Name(),
+			transaction.ID(),
+		})
+	}
+	return writeRecords(w,
+		[]string{
+			"Date", "Sent Amount", "Sent Currency", "Received Amount", "Received Currency",
+			"Fee Amount", "Fee Currency", "Net Worth Amount", "Net Worth Currency", "Label",
+			"Description", "TxHash",
+		},
+		records)
+}
+
+// writeCoinTracking writes the CoinTracking CSV import format with deposits and withdrawals.
+func writeCoinTracking(w io.Writer, entries []*Entry, _ []Account, _ *Options) error {
+	records := [][]string{}
+	for _, entry := range entries {
+		transaction := entry.Transaction
+		if transaction.Timestamp() == nil {
+			continue
+		}
+		theCoin := entry.Account.Coin()
+		unit := theCoin.Unit()
+		amount := transaction.Amount().BigInt()
+		fee := feeOf(transaction)
+		var txType, buyAmount, buyCurrency, sellAmount, sellCurrency, feeAmount, feeCurrency string
+		switch transaction.Type() {
+		case coin.TxTypeReceive:
+			txType = "Deposit"
+			buyAmount, buyCurrency = formatAmount(theCoin, amount), unit
+		case coin.TxTypeSend:
+			txType = "Withdrawal"
+			sellAmount, sellCurrency = formatAmount(theCoin, amount), unit
+			feeAmount, feeCurrency = formatAmount(theCoin, fee), unit
+		case coin.TxTypeSendSelf:
+			// Only the fee leaves the wallet.
+			txType = "Other Fee"
+			sellAmount, sellCurrency = formatAmount(theCoin, fee), unit
+		}
+		records = append(records, []string{
+			txType,
+			buyAmount, buyCurrency,
+			sellAmount, sellCurrency,
+			feeAmount, feeCurrency,
+			"BitBox",
+			entry.Account.Name(),
+			strings.Join(transaction.Addresses(), "; "),
+			transaction.Timestamp().UTC().Format("2006-01-02 15:04:05"),
+			transaction.ID(),
+		})
+	}
+	return writeRecords(w,
+		[]string{
+			"Type", "Buy Amount", "Buy Currency", "Sell Amount", "Sell Currency", "Fee",
+			"Fee Currency", "Exchange", "Trade-Group", "Comment", "Date", "Tx-ID",
+		},
+		records)
+}
+
+const ofxDateLayout = "20060102150405"
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxTransaction struct {
+	Type     string `xml:"TRNTYPE"`
+	Posted   string `xml:"DTPOSTED"`
+	Amount   string `xml:"TRNAMT"`
+	ID       string `xml:"FITID"`
+	Name     string `xml:"NAME"`
+	Memo     string `xml:"MEMO,omitempty"`
+	Currency string `xml:"CURRENCY>CURSYM,omitempty"`
+}
+
+type ofxStatement struct {
+	TransactionUID string            `xml:"TRNUID"`
+	Status         ofxStatus         `xml:"STATUS"`
+	Currency       string            `xml:"STMTRS>CURDEF"`
+	BankID         string            `xml:"STMTRS>BANKACCTFROM>BANKID"`
+	AccountID      string            `xml:"STMTRS>BANKACCTFROM>ACCTID"`
+	AccountType    string            `xml:"STMTRS>BANKACCTFROM>ACCTTYPE"`
+	Start          string            `xml:"STMTRS>BANKTRANLIST>DTSTART"`
+	End            string            `xml:"STMTRS>BANKTRANLIST>DTEND"`
+	Transactions   []*ofxTransaction `xml:"STMTRS>BANKTRANLIST>STMTTRN"`
+	Balance        string            `xml:"STMTRS>LEDGERBAL>BALAMT"`
+	BalanceDate    string            `xml:"STMTRS>LEDGERBAL>DTASOF"`
+}
+
+// writeOFX writes an OFX 2.2 bank statement with one statement per account. Amounts are in the
+// default unit of the coin.
+func writeOFX(w io.Writer, entries []*Entry, accounts []Account, options *Options) error {
+	now := time.Now().UTC()
+	type ofxDocument struct {
+		XMLName    xml.Name        `xml:"OFX"`
+		Status     ofxStatus       `xml:"SIGNONMSGSRSV1>SONRS>STATUS"`
+		ServerDate string          `xml:"SIGNONMSGSRSV1>SONRS>DTSERVER"`
+		Language   string          `xml:"SIGNONMSGSRSV1>SONRS>LANGUAGE"`
+		Statements []*ofxStatement `xml:"BANKMSGSRSV1>STMTTRNRS"`
+	}
+	document := &ofxDocument{
+		Status:     ofxStatus{Code: 0, Severity: "INFO"},
+		ServerDate: now.Format(ofxDateLayout),
+		Language:   "ENG",
+	}
+	for index, account := range accounts {
+		start, end := now, now
+		if options.From != nil {
+			start = *options.From
+		}
+		if options.To != nil {
+			end = *options.To
+		}
+		statement := &ofxStatement{
+			TransactionUID: strconv.Itoa(index),
+			Status:         ofxStatus{Code: 0, Severity: "INFO"},
+			Currency:       account.Coin().Unit(),
+			BankID:         "BitBox",
+			AccountID:      account.Code(),
+			AccountType:    "CHECKING",
+			Start:          start.UTC().Format(ofxDateLayout),
+			End:            end.UTC().Format(ofxDateLayout),
+			BalanceDate:    now.Format(ofxDateLayout),
+		}
+		transactions, err := account.Transactions()
+		if err != nil {
+			return err
+		}
+		balance := big.NewInt(0)
+		for _, transaction := range transactions {
+			balance.Add(balance, (&Entry{Account: account, Transaction: transaction}).SignedAmount())
+		}
+		statement.Balance = formatAmount(account.Coin(), balance)
+		for _, entry := range entries {
+			transaction := entry.Transaction
+			if entry.Account != account || transaction.Timestamp() == nil {
+				continue
+			}
+			signedAmount := entry.SignedAmount()
+			trnType := "CREDIT"
+			switch transaction.Type() {
+			case coin.TxTypeSend:
+				trnType = "DEBIT"
+			case coin.TxTypeSendSelf:
+				trnType = "FEE"
+			}
+			statement.Transactions = append(statement.Transactions, &ofxTransaction{
+				Type:   trnType,
+				Posted: transaction.Timestamp().UTC().Format(ofxDateLayout),
+				Amount: formatAmount(account.Coin(), signedAmount),
+				ID:     transaction.ID(),
+				Name:   string(transaction.Type()),
+				Memo:   strings.Join(transaction.Addresses(), "; "),
+			})
+		}
+		document.Statements = append(document.Statements, statement)
+	}
+	if _, err := io.WriteString(w, xml.Header+
+		`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>`+
+		"\n"); err != nil {
+		return errp.WithStack(err)
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return errp.WithStack(encoder.Encode(document))
+}
+
+// writeQIF writes one bank register per account. Amounts are in the default unit of the coin.
+func writeQIF(w io.Writer, entries []*Entry, accounts []Account, _ *Options) error {
+	builder := &strings.Builder{}
+	for _, account := range accounts {
+		fmt.Fprintf(builder, "!Account\nN%s\nTBank\nD%s (%s)\n^\n!Type:Bank\n",
+			account.Name(), account.Code(), account.Coin().Unit())
+		for _, entry := range entries {
+			transaction := entry.Transaction
+			if entry.Account != account || transaction.Timestamp() == nil {
+				continue
+			}
+			payee := string(transaction.Type())
+			if addresses := transaction.Addresses(); len(addresses) > 0 {
+				payee = addresses[0]
+			}
+			fmt.Fprintf(builder, "D%s\nT%s\nP%s\nM%s %s\n^\n",
+				transaction.Timestamp().UTC().Format("01/02/2006"),
+				formatAmount(account.Coin(), entry.SignedAmount()),
+				payee,
+				transaction.Type(),
+				transaction.ID(),
+			)
+		}
+	}
+	_, err := io.WriteString(w, builder.String())
+	return errp.WithStack(err)
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"io"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+)
+
+// Method is a lot matching method used to compute the cost basis of disposed coins. See the
+// Method* constants.
+type Method string
+
+const (
+	// MethodFIFO disposes the oldest lots first.
+	MethodFIFO Method = "fifo"
+	// MethodLIFO disposes the newest lots first.
+	MethodLIFO Method = "lifo"
+	// MethodHIFO disposes the lots with the highest cost per unit first.
+	MethodHIFO Method = "hifo"
+)
+
+// longTermHolding is the holding period after which a gain counts as long-term.
+const longTermHolding = 365 * 24 * time.Hour
+
+// lot is an acquisition of coins, of which remaining is not disposed yet.
+type lot struct {
+	acquired  time.Time
+	remaining *big.Int
+	// rate is the fiat cost of one coin unit.
+	rate float64
+	txID string
+}
+
+// Disposal is a realized gain or loss from disposing (part of) a lot.
+type Disposal struct {
+	Coin coin.Coin
+	// Amount disposed, in the smallest unit.
+	Amount   *big.Int
+	Disposed time.Time
+	// Acquired is nil if the disposed coins could not be matched to an acquisition, e.g. if the
+	// history of the account the coins came from is not part of the export.
+	Acquired  *time.Time
+	Proceeds  float64
+	CostBasis float64
+	TxID      string
+}
+
+// Gain returns the realized gain (positive) or loss (negative).
+func (disposal *Disposal) Gain() float64 {
+	return disposal.Proceeds - disposal.CostBasis
+}
+
+// LongTerm returns whether the disposed coins were held for more than a year.
+func (disposal *Disposal) LongTerm() bool {
+	return disposal.Acquired != nil && disposal.Disposed.Sub(*disposal.Acquired) > longTermHolding
+}
+
+// movement is the net change of the holdings of one currency caused by one transaction, over all
+// exported accounts. A transfer between two exported accounts only moves the fee out of the
+// holdings.
+type movement struct {
+	coin   coin.Coin
+	time   time.Time
+	amount *big.Int
+	rate   float64
+	txID   string
+}
+
+// netMovements combines the entries by currency and transaction ID.
+func netMovements(entries []*Entry) map[string][]*movement {
+	result := map[string][]*movement{}
+	index := map[string]*movement{}
+	for _, entry := range entries {
+		timestamp := entry.Time()
+		if timestamp == nil {
+			// Not confirmed yet, so not realized either.
+			continue
+		}
+		unit := entry.Account.Coin().Unit()
+		key := unit + "/" + entry.Transaction.ID()
+		if existing, ok := index[key]; ok {
+			existing.amount.Add(existing.amount, entry.SignedAmount())
+			continue
+		}
+		theMovement := &movement{
+			coin:   entry.Account.Coin(),
+			time:   *timestamp,
+			amount: entry.SignedAmount(),
+			rate:   entry.Rate,
+			txID:   entry.Transaction.ID(),
+		}
+		index[key] = theMovement
+		result[unit] = append(result[unit], theMovement)
+	}
+	return result
+}
+
+// nextLot returns the index of the lot to dispose next according to the method. The lots are
+// ordered by acquisition time.
+func nextLot(lots []*lot, method Method) int {
+	switch method {
+	case MethodLIFO:
+		return len(lots) - 1
+	case MethodHIFO:
+		best := 0
+		for index, lot := range lots {
+			if lot.rate > lots[best].rate {
+				best = index
+			}
+		}
+		return best
+	default:
+		return 0
+	}
+}
+
+// RealizedGains matches disposals to acquisitions using the given method. Entries have to be sorted
+// chronologically and carry their fiat rate. Each currency is matched independently.
+func RealizedGains(entries []*Entry, method Method) []*Disposal {
+	disposals := []*Disposal{}
+	units := []string{}
+	movementsByUnit := netMovements(entries)
+	for unit := range movementsByUnit {
+		units = append(units, unit)
+	}
+	sort.Strings(units)
+	for _, unit := range units {
+		lots := []*lot{}
+		for _, theMovement := range movementsByUnit[unit] {
+			switch theMovement.amount.Sign() {
+			case 1:
+				lots = append(lots, &lot{
+					acquired:  theMovement.time,
+					remaining: new(big.Int).Set(theMovement.amount),
+					rate:      theMovement.rate,
+					txID:      theMovement.txID,
+				})
+			case -1:
+				toDispose := new(big.Int).Neg(theMovement.amount)
+				for toDispose.Sign() > 0 {
+					disposal := &Disposal{
+						Coin:     theMovement.coin,
+						Disposed: theMovement.time,
+						TxID:     theMovement.txID,
+					}
+					if len(lots) == 0 {
+						// Unknown origin, zero cost basis.
+						disposal.Amount = new(big.Int).Set(toDispose)
+						toDispose.SetInt64(0)
+					} else {
+						index := nextLot(lots, method)
+						matched := lots[index]
+						disposal.Amount = new(big.Int).Set(toDispose)
+						if matched.remaining.Cmp(toDispose) <= 0 {
+							disposal.Amount.Set(matched.remaining)
+							lots = append(lots[:index], lots[index+1:]...)
+						}
+						matched.remaining.Sub(matched.remaining, disposal.Amount)
+						toDispose.Sub(toDispose, disposal.Amount)
+						acquired := matched.acquired
+						disposal.Acquired = &acquired
+						disposal.CostBasis = toUnit(theMovement.coin, disposal.Amount) * matched.rate
+					}
+					disposal.Proceeds = toUnit(theMovement.coin, disposal.Amount) * theMovement.rate
+					disposals = append(disposals, disposal)
+				}
+			}
+		}
+	}
+	return disposals
+}
+
+func writeGainsReport(w io.Writer, disposals []*Disposal, options *Options) error {
+	records := [][]string{}
+	for _, disposal := range disposals {
+		disposed := disposal.Disposed
+		if !options.inRange(&disposed) {
+			continue
+		}
+		acquired := "unknown"
+		if disposal.Acquired != nil {
+			acquired = disposal.Acquired.UTC().Format(time.RFC3339)
+		}
+		term := "short"
+		if disposal.LongTerm() {
+			term = "long"
+		}
+		records = append(records, []string{
+			disposal.Coin.Unit(),
+			formatAmount(disposal.Coin, disposal.Amount),
+			acquired,
+			disposal.Disposed.UTC().Format(time.RFC3339),
+			options.Fiat,
+			formatFiat(disposal.Proceeds),
+			formatFiat(disposal.CostBasis),
+			formatFiat(disposal.Gain()),
+			term,
+			disposal.TxID,
+		})
+	}
+	return writeRecords(w,
+		[]string{
+			"Currency", "Amount", "Date Acquired", "Date Disposed", "Fiat Currency", "Proceeds",
+			"Cost Basis", "Gain", "Term", "Transaction ID",
+		},
+		records)
+}
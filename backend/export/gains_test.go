@@ -0,0 +1,99 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/export"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGainsMethods(t *testing.T) {
+	// Bought 1 BTC at 1000 and 1 BTC at 2000, sold 1.5 BTC at 3000 (plus fee).
+	for method, expected := range map[export.Method][]struct {
+		amount    int64
+		costBasis float64
+	}{
+		export.MethodFIFO: {{100000000, 1000}, {50001000, 1000.02}},
+		export.MethodLIFO: {{100000000, 2000}, {50001000, 500.01}},
+		export.MethodHIFO: {{100000000, 2000}, {50001000, 500.01}},
+	} {
+		result, err := export.Export(context.Background(), []export.Account{testAccount()}, &export.Options{
+			Format:    export.FormatCSV,
+			Fiat:      "USD",
+			CostBasis: method,
+			Rates:     rates{},
+		})
+		require.NoError(t, err)
+		require.NotNil(t, result.Gains)
+		records := readCSV(t, result.Gains)
+		require.Len(t, records, 1+len(expected), string(method))
+		for index, disposal := range expected {
+			record := records[index+1]
+			require.Equal(t, "c", record[9])
+			require.Equal(t, tbtc.FormatAmount(coin.NewAmountFromInt64(disposal.amount)), record[1])
+			require.Equal(t, strconv.FormatFloat(disposal.costBasis, 'f', 2, 64), record[6], string(method))
+			require.Equal(t, "short", record[8])
+		}
+	}
+}
+
+func TestGainsTransferBetweenAccounts(t *testing.T) {
+	// Moving coins between two exported accounts only disposes the fee.
+	sender := &account{
+		code: "sender",
+		transactions: []coin.Transaction{
+			&transaction{id: "in", txType: coin.TxTypeReceive, amount: 100000000, timestamp: date(1)},
+			&transaction{id: "move", txType: coin.TxTypeSend, amount: 90000000, fee: fee(10000000), timestamp: date(2)},
+		},
+	}
+	receiver := &account{
+		code: "receiver",
+		transactions: []coin.Transaction{
+			&transaction{id: "move", txType: coin.TxTypeReceive, amount: 90000000, timestamp: date(2)},
+		},
+	}
+	result, err := export.Export(context.Background(), []export.Account{sender, receiver}, &export.Options{
+		Format:    export.FormatCSV,
+		Fiat:      "USD",
+		CostBasis: export.MethodFIFO,
+		Rates:     rates{},
+	})
+	require.NoError(t, err)
+	records := readCSV(t, result.Gains)
+	require.Len(t, records, 2)
+	require.Equal(t, "0.1", records[1][1])
+	require.Equal(t, "200.00", records[1][5])
+	require.Equal(t, "100.00", records[1][6])
+	require.Equal(t, "100.00", records[1][7])
+}
+
+func TestGainsUnknownOrigin(t *testing.T) {
+	disposals := export.RealizedGains([]*export.Entry{
+		{
+			Account:     testAccount(),
+			Transaction: &transaction{id: "x", txType: coin.TxTypeSend, amount: 100, fee: fee(0), timestamp: date(1)},
+			Rate:        1000,
+		},
+	}, export.MethodFIFO)
+	require.Len(t, disposals, 1)
+	require.Nil(t, disposals[0].Acquired)
+	require.Equal(t, 0.0, disposals[0].CostBasis)
+	require.False(t, disposals[0].LongTerm())
+}
@@ -19,25 +19,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
 	"runtime/debug"
 	"strconv"
+	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/electrum"
 	accountHandlers "github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc/handlers"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/coin"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/config"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox"
 	bitboxHandlers "github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/handlers"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/device"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/export"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore/software"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
 	utilConfig "github.com/digitalbitbox/bitbox-wallet-app/util/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/jsonp"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
@@ -50,10 +57,13 @@ import (
 	"golang.org/x/text/language"
 )
 
+// eventsBufferSize is the number of events buffered for a websocket client.
+const eventsBufferSize = 1000
+
 // Backend models the API of the backend.
 type Backend interface {
 	Config() *config.Config
-	DefaultConfig() config.AppConfig
+	DefaultConfig() (config.AppConfig, error)
 	Coin(string) (coin.Coin, error)
 	AccountsStatus() string
 	Testing() bool
@@ -63,15 +73,22 @@ type Backend interface {
 		code string,
 		name string,
 		scriptType signing.ScriptType,
+		gapLimits *btc.GapLimits,
 		getSigningConfiguration func() (*signing.Configuration, error),
+		keystores keystore.Keystores,
 	)
+	AccountConfigs() []config.Account
+	AddAccountConfig(config.Account) (*config.Account, error)
+	UpdateAccountConfig(config.Account) error
+	DeleteAccountConfig(code string) error
 	UserLanguage() language.Tag
 	OnAccountInit(f func(btc.Interface))
 	OnAccountUninit(f func(btc.Interface))
 	OnDeviceInit(f func(device.Interface))
 	OnDeviceUninit(f func(deviceID string))
 	DevicesRegistered() map[string]device.Interface
-	Start() <-chan interface{}
+	Start()
+	Events() *events.Bus
 	Keystores() keystore.Keystores
 	RegisterKeystore(keystore.Keystore)
 	DeregisterKeystore()
@@ -80,6 +97,10 @@ type Backend interface {
 	Rates() map[string]map[string]float64
 	DownloadCert(string) (string, error)
 	CheckElectrumServer(string, string) error
+	Update() *backend.UpdateFile
+	EncryptionStatus() backend.EncryptionStatus
+	Unlock(password string) error
+	EnableEncryption(password string) error
 }
 
 // Handlers provides a web api to the backend.
@@ -90,9 +111,9 @@ type Handlers struct {
 	// backend to secure the API call. The data is fed into the static javascript app
 	// that is served, so the client knows where and how to connect to.
 	apiData           *ConnectionData
-	backendEvents     <-chan interface{}
 	websocketUpgrader websocket.Upgrader
-	log               *logrus.Entry
+
+	log *logrus.Entry
 }
 
 // ConnectionData contains the port and authorization token for communication with the backend.
@@ -151,10 +172,19 @@ func NewHandlers(
 	getAPIRouter(apiRouter)("/open", handlers.postOpenHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/update", handlers.getUpdateHandler).Methods("GET")
 	getAPIRouter(apiRouter)("/version", handlers.getVersionHandler).Methods("GET")
+	getAPIRouter(apiRouter)("/encryption", handlers.getEncryptionHandler).Methods("GET")
+	getAPIRouter(apiRouter)("/encryption/enable", handlers.postEncryptionEnableHandler).Methods("POST")
+	getAPIRouter(apiRouter)("/encryption/unlock", handlers.postEncryptionUnlockHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/testing", handlers.getTestingHandler).Methods("GET")
 	getAPIRouter(apiRouter)("/account-add", handlers.postAddAccountHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/accounts", handlers.getAccountsHandler).Methods("GET")
+	getAPIRouter(apiRouter)("/account-configs", handlers.getAccountConfigsHandler).Methods("GET")
+	getAPIRouter(apiRouter)("/account-configs", handlers.postAccountConfigsHandler).Methods("POST")
+	getAPIRouter(apiRouter)("/account-configs/{code}", handlers.getAccountConfigHandler).Methods("GET")
+	getAPIRouter(apiRouter)("/account-configs/{code}", handlers.postAccountConfigHandler).Methods("POST")
+	getAPIRouter(apiRouter)("/account-configs/{code}/delete", handlers.postAccountConfigDeleteHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/accounts-status", handlers.getAccountsStatusHandler).Methods("GET")
+	getAPIRouter(apiRouter)("/export", handlers.postExportHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/test/register", handlers.registerTestKeyStoreHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/test/deregister", handlers.deregisterTestKeyStoreHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/rates", handlers.getRatesHandler).Methods("GET")
@@ -164,6 +194,14 @@ func NewHandlers(
 	getAPIRouter(apiRouter)("/coins/tbtc/headers/status", handlers.getHeadersStatus("tbtc")).Methods("GET")
 	getAPIRouter(apiRouter)("/coins/ltc/headers/status", handlers.getHeadersStatus("ltc")).Methods("GET")
 	getAPIRouter(apiRouter)("/coins/btc/headers/status", handlers.getHeadersStatus("btc")).Methods("GET")
+	for _, coinCode := range []string{"tltc", "tbtc", "ltc", "btc"} {
+		getAPIRouter(apiRouter)(fmt.Sprintf("/coins/%s/electrum-servers", coinCode),
+			handlers.getElectrumServers(coinCode)).Methods("GET")
+		getAPIRouter(apiRouter)(fmt.Sprintf("/coins/%s/electrum-servers/pin", coinCode),
+			handlers.postElectrumServerPin(coinCode)).Methods("POST")
+		getAPIRouter(apiRouter)(fmt.Sprintf("/coins/%s/electrum-servers/ban", coinCode),
+			handlers.postElectrumServerBan(coinCode)).Methods("POST")
+	}
 	getAPIRouter(apiRouter)("/certs/download", handlers.postCertsDownloadHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/certs/check", handlers.postCertsCheckHandler).Methods("POST")
 
@@ -215,7 +253,7 @@ func NewHandlers(
 
 	apiRouter.HandleFunc("/events", handlers.eventsHandler)
 
-	handlers.backendEvents = backend.Start()
+	backend.Start()
 
 	return handlers
 }
@@ -244,15 +282,24 @@ func (handlers *Handlers) getConfigHandler(_ *http.Request) (interface{}, error)
 }
 
 func (handlers *Handlers) getDefaultConfigHandler(_ *http.Request) (interface{}, error) {
-	return handlers.backend.DefaultConfig(), nil
+	return handlers.backend.DefaultConfig()
 }
 
 func (handlers *Handlers) postConfigHandler(r *http.Request) (interface{}, error) {
-	appConfig := config.AppConfig{}
-	if err := json.NewDecoder(r.Body).Decode(&appConfig); err != nil {
-		return nil, errp.WithStack(err)
+	appConfig, err := config.DecodeAppConfig(r.Body)
+	if err == nil {
+		err = handlers.backend.Config().Set(appConfig)
 	}
-	return nil, handlers.backend.Config().Set(appConfig)
+	if validationErrors, ok := errp.Cause(err).(config.ValidationErrors); ok {
+		return map[string]interface{}{
+			"success": false,
+			"errors":  validationErrors,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true}, nil
 }
 
 func (handlers *Handlers) postOpenHandler(r *http.Request) (interface{}, error) {
@@ -307,7 +354,34 @@ func (handlers *Handlers) postOpenHandler(r *http.Request) (interface{}, error)
 }
 
 func (handlers *Handlers) getUpdateHandler(_ *http.Request) (interface{}, error) {
-	return backend.CheckForUpdateIgnoringErrors(), nil
+	return handlers.backend.Update(), nil
+}
+
+func (handlers *Handlers) getEncryptionHandler(_ *http.Request) (interface{}, error) {
+	return handlers.backend.EncryptionStatus(), nil
+}
+
+func (handlers *Handlers) postEncryptionEnableHandler(r *http.Request) (interface{}, error) {
+	var password string
+	if err := json.NewDecoder(r.Body).Decode(&password); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return nil, handlers.backend.EnableEncryption(password)
+}
+
+func (handlers *Handlers) postEncryptionUnlockHandler(r *http.Request) (interface{}, error) {
+	var password string
+	if err := json.NewDecoder(r.Body).Decode(&password); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	err := handlers.backend.Unlock(password)
+	if err == encryption.ErrWrongPassword {
+		return map[string]interface{}{"success": false, "errorCode": "wrongPassword"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true}, nil
 }
 
 func (handlers *Handlers) getVersionHandler(_ *http.Request) (interface{}, error) {
@@ -354,12 +428,83 @@ func (handlers *Handlers) postAddAccountHandler(r *http.Request) (interface{}, e
 		}
 	}
 	configuration := signing.NewSinglesigConfiguration(scriptType, keypath, extendedPublicKey)
-	getSigningConfiguration := func() (*signing.Configuration, error) {
-		return configuration, nil
+	accountConfig, err := handlers.backend.AddAccountConfig(config.Account{
+		Code:              fmt.Sprintf("%s-%s", configuration.Hash(), coin.Code()),
+		CoinCode:          coin.Code(),
+		ScriptType:        jsonScriptType,
+		Name:              jsonAccountName,
+		ExtendedPublicKey: jsonExtendedPublicKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"success": true, "accountCode": accountConfig.Code}, nil
+}
+
+func (handlers *Handlers) getAccountConfigsHandler(_ *http.Request) (interface{}, error) {
+	return handlers.backend.AccountConfigs(), nil
+}
+
+func (handlers *Handlers) postAccountConfigsHandler(r *http.Request) (interface{}, error) {
+	accountConfig := config.Account{}
+	if err := json.NewDecoder(r.Body).Decode(&accountConfig); err != nil {
+		return nil, errp.WithStack(err)
 	}
-	accountCode := fmt.Sprintf("%s-%s", configuration.Hash(), coin.Code())
-	handlers.backend.CreateAndAddAccount(coin, accountCode, jsonAccountName, scriptType, getSigningConfiguration)
-	return map[string]interface{}{"success": true, "accountCode": accountCode}, nil
+	return handlers.backend.AddAccountConfig(accountConfig)
+}
+
+func (handlers *Handlers) accountConfig(code string) (*config.Account, error) {
+	for _, accountConfig := range handlers.backend.AccountConfigs() {
+		if accountConfig.Code == code {
+			accountConfig := accountConfig
+			return &accountConfig, nil
+		}
+	}
+	return nil, errp.Newf("unknown account %s", code)
+}
+
+func (handlers *Handlers) getAccountConfigHandler(r *http.Request) (interface{}, error) {
+	return handlers.accountConfig(mux.Vars(r)["code"])
+}
+
+func (handlers *Handlers) postAccountConfigHandler(r *http.Request) (interface{}, error) {
+	accountConfig, err := handlers.accountConfig(mux.Vars(r)["code"])
+	if err != nil {
+		return nil, err
+	}
+	// Fields missing in the request keep their value.
+	jsonBody := struct {
+		Name           *string `json:"name"`
+		Hidden         *bool   `json:"hidden"`
+		GapLimit       *int    `json:"gapLimit"`
+		ChangeGapLimit *int    `json:"changeGapLimit"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&jsonBody); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if jsonBody.Name != nil {
+		accountConfig.Name = *jsonBody.Name
+	}
+	if jsonBody.Hidden != nil {
+		accountConfig.Hidden = *jsonBody.Hidden
+	}
+	if jsonBody.GapLimit != nil {
+		accountConfig.GapLimit = *jsonBody.GapLimit
+	}
+	if jsonBody.ChangeGapLimit != nil {
+		accountConfig.ChangeGapLimit = *jsonBody.ChangeGapLimit
+	}
+	if err := handlers.backend.UpdateAccountConfig(*accountConfig); err != nil {
+		return nil, err
+	}
+	return accountConfig, nil
+}
+
+func (handlers *Handlers) postAccountConfigDeleteHandler(r *http.Request) (interface{}, error) {
+	if err := handlers.backend.DeleteAccountConfig(mux.Vars(r)["code"]); err != nil {
+		return nil, err
+	}
+	return true, nil
 }
 
 func (handlers *Handlers) getAccountsHandler(_ *http.Request) (interface{}, error) {
@@ -381,6 +526,78 @@ func (handlers *Handlers) getAccountsHandler(_ *http.Request) (interface{}, erro
 	return accounts, nil
 }
 
+// postExportHandler exports the transactions of several accounts at once. The body contains the
+// export options (see export.Options), the codes of the accounts to export (all if empty) and
+// whether the files should also be stored in the downloads folder. The exported files are returned
+// in the response, so the export also works without access to the local file system.
+func (handlers *Handlers) postExportHandler(r *http.Request) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	jsonBody := struct {
+		Accounts        []string `json:"accounts"`
+		SaveToDownloads bool     `json:"saveToDownloads"`
+	}{}
+	if err := json.Unmarshal(body, &jsonBody); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	options := &export.Options{}
+	if err := json.Unmarshal(body, options); err != nil {
+		return nil, err
+	}
+	options.Rates = backend.GetRatesUpdaterInstance()
+
+	accounts := []export.Account{}
+	for _, account := range handlers.backend.Accounts() {
+		if len(jsonBody.Accounts) != 0 && !containsString(jsonBody.Accounts, account.Code()) {
+			continue
+		}
+		if !account.Initialized() {
+			return nil, errp.Newf("account %s is not synced yet", account.Code())
+		}
+		accounts = append(accounts, account)
+	}
+	if len(accounts) != len(jsonBody.Accounts) && len(jsonBody.Accounts) != 0 {
+		return nil, errp.New("unknown account code")
+	}
+	result, err := export.Export(r.Context(), accounts, options)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	if jsonBody.SaveToDownloads {
+		downloadsDir, err := utilConfig.DownloadsDir()
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range []*export.File{result.Transactions, result.Gains} {
+			if file == nil {
+				continue
+			}
+			path, err := file.WriteToDir(downloadsDir)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, path)
+		}
+	}
+	return map[string]interface{}{
+		"transactions": result.Transactions,
+		"gains":        result.Gains,
+		"paths":        paths,
+	}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func (handlers *Handlers) getAccountsStatusHandler(_ *http.Request) (interface{}, error) {
 	return handlers.backend.AccountsStatus(), nil
 }
@@ -467,6 +684,71 @@ func (handlers *Handlers) getHeadersStatus(coinCode string) func(*http.Request)
 	}
 }
 
+// electrumServers returns the Electrum servers of the coin.
+func (handlers *Handlers) electrumServers(coinCode string) (*electrum.Servers, error) {
+	coin, err := handlers.backend.Coin(coinCode)
+	if err != nil {
+		return nil, err
+	}
+	servers := coin.(*btc.Coin).ElectrumServers()
+	if servers == nil {
+		return nil, errp.New("the coin is not initialized")
+	}
+	return servers, nil
+}
+
+// getElectrumServers returns the known servers, the preferred ones first, and which one we are
+// connected to.
+func (handlers *Handlers) getElectrumServers(coinCode string) func(*http.Request) (interface{}, error) {
+	return func(_ *http.Request) (interface{}, error) {
+		servers, err := handlers.electrumServers(coinCode)
+		if err != nil {
+			return nil, err
+		}
+		return servers.List(), nil
+	}
+}
+
+func (handlers *Handlers) postElectrumServerPin(coinCode string) func(*http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		var jsonBody struct {
+			Server string `json:"server"`
+			Pinned bool   `json:"pinned"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jsonBody); err != nil {
+			return nil, errp.WithStack(err)
+		}
+		servers, err := handlers.electrumServers(coinCode)
+		if err != nil {
+			return nil, err
+		}
+		if err := servers.Pin(jsonBody.Server, jsonBody.Pinned); err != nil {
+			return map[string]interface{}{"success": false, "errorMessage": err.Error()}, nil
+		}
+		return map[string]interface{}{"success": true}, nil
+	}
+}
+
+func (handlers *Handlers) postElectrumServerBan(coinCode string) func(*http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		var jsonBody struct {
+			Server string `json:"server"`
+			Banned bool   `json:"banned"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jsonBody); err != nil {
+			return nil, errp.WithStack(err)
+		}
+		servers, err := handlers.electrumServers(coinCode)
+		if err != nil {
+			return nil, err
+		}
+		if err := servers.Ban(jsonBody.Server, jsonBody.Banned); err != nil {
+			return map[string]interface{}{"success": false, "errorMessage": err.Error()}, nil
+		}
+		return map[string]interface{}{"success": true}, nil
+	}
+}
+
 func (handlers *Handlers) postCertsDownloadHandler(r *http.Request) (interface{}, error) {
 	var server string
 	if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
@@ -507,24 +789,66 @@ func (handlers *Handlers) postCertsCheckHandler(r *http.Request) (interface{}, e
 	}, nil
 }
 
+// parseEventsQuery parses the query parameters of the events endpoint: `kinds` and `accounts` are
+// comma separated lists restricting the delivered events (see events.Filter), and `after` is the
+// sequence number of the last event received before reconnecting.
+func parseEventsQuery(query url.Values) (events.Filter, uint64, error) {
+	filter := events.Filter{}
+	if kinds := query.Get("kinds"); kinds != "" {
+		for _, name := range strings.Split(kinds, ",") {
+			kind, err := events.ParseKind(name)
+			if err != nil {
+				return filter, 0, err
+			}
+			filter.Kinds = append(filter.Kinds, kind)
+		}
+	}
+	if accounts := query.Get("accounts"); accounts != "" {
+		filter.Accounts = strings.Split(accounts, ",")
+	}
+	var after uint64
+	if afterString := query.Get("after"); afterString != "" {
+		var err error
+		after, err = strconv.ParseUint(afterString, 10, 64)
+		if err != nil {
+			return filter, 0, errp.Newf("invalid sequence number %q", afterString)
+		}
+	}
+	return filter, after, nil
+}
+
+// eventsHandler pushes the backend events to a websocket. Events which do not fit into the buffer
+// of a slow client are dropped, and the client is told about it by a KindDropped event. The
+// websocket is closed when the backend is closed.
 func (handlers *Handlers) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, after, err := parseEventsQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	conn, err := handlers.websocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		panic(err)
 	}
 
 	sendChan, quitChan := runWebsocket(conn, handlers.apiData, handlers.log)
+	subscription := handlers.backend.Events().Subscribe(filter, after, eventsBufferSize)
 	go func() {
+		defer subscription.Close()
 		for {
 			select {
 			case <-quitChan:
 				return
-			default:
+			case event, ok := <-subscription.Events():
+				if !ok {
+					// The backend is closed. Closing sendChan closes the websocket.
+					close(sendChan)
+					return
+				}
 				select {
 				case <-quitChan:
 					return
-				case event := <-handlers.backendEvents:
-					sendChan <- jsonp.MustMarshal(event)
+				case sendChan <- jsonp.MustMarshal(event):
 				}
 			}
 		}
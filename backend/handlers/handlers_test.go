@@ -16,16 +16,62 @@ package handlers_test
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/digitalbitbox/bitbox-wallet-app/backend"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/arguments"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/handlers"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
 )
 
+// TestClose checks that closing the backend stops all goroutines and closes the websockets.
+func TestClose(t *testing.T) {
+	defer test.CheckGoroutineLeaks(t)()
+	dir := test.TstTempDir("bitbox-wallet-close-")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	const token = "token"
+	theBackend, err := backend.NewBackend(arguments.NewArguments(dir, true, false, false, false, false))
+	require.NoError(t, err)
+	theHandlers := handlers.NewHandlers(theBackend, handlers.NewConnectionData(-1, token))
+	server := httptest.NewServer(theHandlers.Router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws:"+strings.TrimPrefix(server.URL, "http:")+"/api/events", nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("Authorization: Basic "+token)))
+
+	subscription := theBackend.Events().Subscribe(events.Filter{}, 0, 10)
+	theBackend.Close()
+	// Closing twice is fine.
+	theBackend.Close()
+	for range subscription.Events() {
+	}
+	_, ok := <-theBackend.Events().Subscribe(events.Filter{}, 0, 10).Events()
+	require.False(t, ok, "subscriptions after closing must be closed")
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			require.True(t, websocket.IsCloseError(err, websocket.CloseNoStatusReceived),
+				"expected the websocket to be closed by the server, got %v", err)
+			break
+		}
+	}
+}
+
 // List all routes with `go test backend/handlers/handlers_test.go -v`.
 func TestListRoutes(t *testing.T) {
 	const skip = true
@@ -33,10 +79,11 @@ func TestListRoutes(t *testing.T) {
 		t.Skip("manual listing of handlers")
 	}
 	connectionData := handlers.NewConnectionData(8082, "")
-	backend := backend.NewBackend(arguments.NewArguments(
-		test.TstTempDir("bitbox-wallet-listroutes-"), false, false, false, false))
+	backend, err := backend.NewBackend(arguments.NewArguments(
+		test.TstTempDir("bitbox-wallet-listroutes-"), false, false, false, false, false))
+	require.NoError(t, err)
 	handlers := handlers.NewHandlers(backend, connectionData)
-	err := handlers.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+	err = handlers.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		pathTemplate, err := route.GetPathTemplate()
 		if err != nil {
 			return err
@@ -68,3 +115,42 @@ func TestListRoutes(t *testing.T) {
 		fmt.Println(err)
 	}
 }
+
+// TestEvents checks the filters and resuming of the events websocket.
+func TestEvents(t *testing.T) {
+	dir := test.TstTempDir("bitbox-wallet-events-")
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	theBackend, err := backend.NewBackend(arguments.NewArguments(dir, true, false, false, false, false))
+	require.NoError(t, err)
+	defer theBackend.Close()
+	const token = "token"
+	theHandlers := handlers.NewHandlers(theBackend, handlers.NewConnectionData(-1, token))
+	server := httptest.NewServer(theHandlers.Router)
+	defer server.Close()
+	eventsURL := "ws:" + strings.TrimPrefix(server.URL, "http:") + "/api/events"
+
+	_, response, err := websocket.DefaultDialer.Dial(eventsURL+"?kinds=unknown", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	after := theBackend.Events().Sequence()
+	theBackend.Events().Publish(events.AccountPayload{Code: "tbtc", Data: "syncdone"})
+	theBackend.Events().Publish(events.AccountPayload{Code: "tltc", Data: "syncdone"})
+
+	conn, _, err := websocket.DefaultDialer.Dial(
+		fmt.Sprintf("%s?kinds=account&accounts=tltc&after=%d", eventsURL, after), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("Authorization: Basic "+token)))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var event struct {
+		Type     string `json:"type"`
+		Code     string `json:"code"`
+		Sequence uint64 `json:"seq"`
+	}
+	require.NoError(t, conn.ReadJSON(&event))
+	require.Equal(t, "account", event.Type)
+	require.Equal(t, "tltc", event.Code)
+	require.Equal(t, after+2, event.Sequence)
+}
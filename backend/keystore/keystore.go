@@ -36,6 +36,10 @@ type Keystore interface {
 	// The returned value is always zero for a singlesig configuration.
 	CosignerIndex() int
 
+	// Identifier identifies the wallet of the keystore. It is derived from the master public key,
+	// so it is the same for all keystores backed by the same seed.
+	Identifier() (string, error)
+
 	// HasSecureOutput returns whether the keystore supports to output an address securely.
 	// This is typically done through a screen on the device or through a paired mobile phone.
 	HasSecureOutput(*signing.Configuration, coin.Coin) bool
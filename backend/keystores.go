@@ -0,0 +1,221 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/device"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
+)
+
+// codeSuffixLength is the number of characters of the keystore identifier appended to the account
+// codes of a keystore.
+const codeSuffixLength = 8
+
+// registeredKeystore is a keystore registered at the backend outside of multisig mode. It has its
+// own accounts, which are taken down when the keystore is deregistered.
+type registeredKeystore struct {
+	keystore   keystore.Keystore
+	identifier string
+	// keystores is the collection passed to the accounts of the keystore. It contains only this
+	// keystore and identifies the accounts which belong to it.
+	keystores keystore.Keystores
+	// codeSuffix is appended to the codes of the registry entries which are shared by all
+	// keystores, so that the accounts of simultaneously registered keystores do not clash. It is
+	// empty for the first keystore ever registered, see config.Backend.KeystoreCodeSuffix.
+	codeSuffix string
+}
+
+// keystoreCodeSuffix returns the suffix of the account codes of the keystore with the given
+// identifier, assigning and persisting one if the keystore is new.
+func (backend *Backend) keystoreCodeSuffix(identifier string) string {
+	suffix := identifier
+	if len(suffix) > codeSuffixLength {
+		suffix = suffix[:codeSuffixLength]
+	}
+	suffix = "-" + suffix
+	if err := backend.config.ModifyAccounts(func(backendConfig *config.Backend) error {
+		suffix = backendConfig.KeystoreCodeSuffix(identifier, suffix)
+		return nil
+	}); err != nil {
+		backend.log.WithError(err).Error("could not persist the account code suffix of the keystore")
+	}
+	return suffix
+}
+
+// registered returns the registered keystores in the order of registration.
+func (backend *Backend) registered() []*registeredKeystore {
+	defer backend.keystoresLock.RLock()()
+	return append([]*registeredKeystore{}, backend.registeredKeystores...)
+}
+
+// isRegistered returns whether the keystore is still registered.
+func (backend *Backend) isRegistered(registered *registeredKeystore) bool {
+	for _, element := range backend.registered() {
+		if element == registered {
+			return true
+		}
+	}
+	return false
+}
+
+// Keystores returns the keystores registered at this backend.
+func (backend *Backend) Keystores() keystore.Keystores {
+	return backend.keystores
+}
+
+// RegisterKeystore registers the given keystore at this backend. Outside of multisig mode, the
+// accounts of the keystore are added next to the accounts of the other keystores. A keystore of a
+// wallet which is already registered replaces the previous one.
+func (backend *Backend) RegisterKeystore(theKeystore keystore.Keystore) {
+	if backend.arguments.Multisig() {
+		backend.log.Info("registering keystore")
+		count := func() int {
+			defer backend.keystoresLock.Lock()()
+			if err := backend.keystores.Add(theKeystore); err != nil {
+				backend.log.Panic("Failed to add a keystore.", err)
+			}
+			return backend.keystores.Count()
+		}()
+		if count == 2 {
+			backend.initAccounts()
+		}
+		return
+	}
+	identifier, err := theKeystore.Identifier()
+	if err != nil {
+		backend.log.WithError(err).Error("could not identify the keystore")
+		return
+	}
+	backend.log.WithField("keystore", identifier).Info("registering keystore")
+	registered := &registeredKeystore{
+		keystore:   theKeystore,
+		identifier: identifier,
+		keystores:  keystore.NewKeystores(theKeystore),
+		codeSuffix: backend.keystoreCodeSuffix(identifier),
+	}
+	replaced := func() *registeredKeystore {
+		defer backend.keystoresLock.Lock()()
+		var replaced *registeredKeystore
+		for index, element := range backend.registeredKeystores {
+			if element.identifier == identifier {
+				replaced = element
+				backend.registeredKeystores = append(
+					backend.registeredKeystores[:index], backend.registeredKeystores[index+1:]...)
+				_ = backend.keystores.Remove(element.keystore)
+				break
+			}
+		}
+		if err := backend.keystores.Add(theKeystore); err != nil {
+			backend.log.Panic("Failed to add a keystore.", err)
+		}
+		backend.registeredKeystores = append(backend.registeredKeystores, registered)
+		return replaced
+	}()
+	if replaced != nil {
+		backend.uninitKeystoreAccounts(replaced)
+	}
+	backend.initConfiguredAccounts(registered)
+	backend.spawn(func() { backend.discoverAccounts(registered) })
+}
+
+// DeregisterKeystore removes all registered keystores and their accounts.
+func (backend *Backend) DeregisterKeystore() {
+	backend.log.Info("deregistering keystores")
+	func() {
+		defer backend.keystoresLock.Lock()()
+		backend.keystores = keystore.NewKeystores()
+		backend.registeredKeystores = nil
+		backend.deviceKeystores = map[string]keystore.Keystore{}
+	}()
+	backend.initAccounts()
+}
+
+// deregisterKeystore removes the given keystore. Outside of multisig mode, only the accounts of the
+// keystore are taken down.
+func (backend *Backend) deregisterKeystore(theKeystore keystore.Keystore) {
+	var removed *registeredKeystore
+	func() {
+		defer backend.keystoresLock.Lock()()
+		_ = backend.keystores.Remove(theKeystore)
+		for index, element := range backend.registeredKeystores {
+			if element.keystore == theKeystore {
+				removed = element
+				backend.registeredKeystores = append(
+					backend.registeredKeystores[:index], backend.registeredKeystores[index+1:]...)
+				break
+			}
+		}
+	}()
+	if backend.arguments.Multisig() {
+		backend.log.Info("deregistering keystore")
+		backend.initAccounts()
+		return
+	}
+	if removed == nil {
+		return
+	}
+	backend.log.WithField("keystore", removed.identifier).Info("deregistering keystore")
+	backend.uninitKeystoreAccounts(removed)
+}
+
+// registerDeviceKeystore registers the keystore of the unlocked device, replacing the keystore
+// previously registered for it. Outside of multisig mode, every device keystore is the only
+// keystore of its accounts and therefore has the cosigner index 0.
+func (backend *Backend) registerDeviceKeystore(theDevice device.Interface) {
+	backend.deregisterDeviceKeystore(theDevice.Identifier())
+	deviceKeystore := func() keystore.Keystore {
+		defer backend.keystoresLock.Lock()()
+		cosignerIndex := 0
+		if backend.arguments.Multisig() {
+			cosignerIndex = backend.keystores.Count()
+		}
+		deviceKeystore := theDevice.KeystoreForConfiguration(nil, cosignerIndex)
+		backend.deviceKeystores[theDevice.Identifier()] = deviceKeystore
+		return deviceKeystore
+	}()
+	backend.RegisterKeystore(deviceKeystore)
+}
+
+// deregisterDeviceKeystore removes the keystore of the device with the given ID, if there is one.
+func (backend *Backend) deregisterDeviceKeystore(deviceID string) {
+	deviceKeystore, ok := func() (keystore.Keystore, bool) {
+		defer backend.keystoresLock.Lock()()
+		deviceKeystore, ok := backend.deviceKeystores[deviceID]
+		delete(backend.deviceKeystores, deviceID)
+		return deviceKeystore, ok
+	}()
+	if ok {
+		backend.deregisterKeystore(deviceKeystore)
+	}
+}
+
+// uninitKeystoreAccounts closes and removes the accounts of the given keystore.
+func (backend *Backend) uninitKeystoreAccounts(registered *registeredKeystore) {
+	defer backend.accountsLock.Lock()()
+	accounts := []btc.Interface{}
+	for _, account := range backend.accounts {
+		if account.Keystores() != registered.keystores {
+			accounts = append(accounts, account)
+			continue
+		}
+		backend.onAccountUninit(account)
+		account.Close()
+	}
+	backend.accounts = accounts
+	backend.emit(events.BackendPayload{Data: "accountsStatusChanged"})
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/arguments"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/coins/btc"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/device"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/keystore/software"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/signing"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+// softwareDevice is a device backed by a software keystore.
+type softwareDevice struct {
+	identifier string
+	pin        string
+	onEvent    func(device.Event, interface{})
+}
+
+func (device *softwareDevice) Init(bool)           {}
+func (device *softwareDevice) ProductName() string { return "software" }
+func (device *softwareDevice) Identifier() string  { return device.identifier }
+func (device *softwareDevice) Close()              {}
+
+func (device *softwareDevice) KeystoreForConfiguration(
+	_ *signing.Configuration, cosignerIndex int) keystore.Keystore {
+	return software.NewKeystoreFromPIN(cosignerIndex, device.pin)
+}
+
+func (device *softwareDevice) SetOnEvent(onEvent func(device.Event, interface{})) {
+	device.onEvent = onEvent
+}
+
+func accountCodes(theBackend *backend.Backend) []string {
+	codes := []string{}
+	for _, account := range theBackend.Accounts() {
+		codes = append(codes, account.Code())
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// requireSigningConfigurations checks that the signing configuration of every account can be
+// derived from its keystores.
+func requireSigningConfigurations(t *testing.T, theBackend *backend.Backend) {
+	t.Helper()
+	keypath, err := signing.NewAbsoluteKeypath("m/84'/1'/0'")
+	require.NoError(t, err)
+	for _, account := range theBackend.Accounts() {
+		keystores := account.Keystores()
+		require.Equal(t, 1, keystores.Count())
+		_, err := keystores.Configuration(signing.ScriptTypeP2WPKH, keypath, keystores.Count())
+		require.NoError(t, err, account.Code())
+	}
+}
+
+func TestMultipleDevices(t *testing.T) {
+	theBackend := newBackend(t, arguments.NewArguments(
+		test.TstTempDir("backend_test"), true, true, false, false, false))
+	defer theBackend.Close()
+	theBackend.OnAccountInit(func(btc.Interface) {})
+	theBackend.OnAccountUninit(func(btc.Interface) {})
+	theBackend.OnDeviceInit(func(device.Interface) {})
+	theBackend.OnDeviceUninit(func(string) {})
+
+	personal := &softwareDevice{identifier: "personal", pin: "1"}
+	company := &softwareDevice{identifier: "company", pin: "2"}
+	personalIdentifier, err := software.NewKeystoreFromPIN(0, personal.pin).Identifier()
+	require.NoError(t, err)
+	companyIdentifier, err := software.NewKeystoreFromPIN(0, company.pin).Identifier()
+	require.NoError(t, err)
+
+	require.NoError(t, theBackend.Register(personal))
+	personal.onEvent(device.EventKeystoreAvailable, nil)
+	personalCodes := accountCodes(theBackend)
+	require.NotEmpty(t, personalCodes)
+	requireSigningConfigurations(t, theBackend)
+	personalAccount := theBackend.Accounts()[0]
+
+	// The first keystore keeps the bare codes, so that the cached data of the accounts is reused.
+	for _, code := range personalCodes {
+		require.NotContains(t, code, personalIdentifier[:8])
+	}
+
+	// The accounts of the second device are added next to the ones of the first device.
+	require.NoError(t, theBackend.Register(company))
+	company.onEvent(device.EventKeystoreAvailable, nil)
+	require.Len(t, theBackend.Accounts(), 2*len(personalCodes))
+	require.Equal(t, personalAccount, theBackend.Accounts()[0])
+	requireSigningConfigurations(t, theBackend)
+	companyCodes := []string{}
+	for _, code := range personalCodes {
+		companyCodes = append(companyCodes, code+"-"+companyIdentifier[:8])
+	}
+	allCodes := append(append([]string{}, personalCodes...), companyCodes...)
+	sort.Strings(allCodes)
+	require.Equal(t, allCodes, accountCodes(theBackend))
+
+	// Unplugging the first device only takes down its accounts.
+	theBackend.Deregister(personal.Identifier())
+	require.Equal(t, companyCodes, accountCodes(theBackend))
+	require.Equal(t, 1, theBackend.Keystores().Count())
+
+	// The codes do not depend on the order in which the devices are plugged in.
+	require.NoError(t, theBackend.Register(personal))
+	personal.onEvent(device.EventKeystoreAvailable, nil)
+	require.Equal(t, allCodes, accountCodes(theBackend))
+	requireSigningConfigurations(t, theBackend)
+	theBackend.Deregister(personal.Identifier())
+
+	company.onEvent(device.EventKeystoreGone, nil)
+	require.Empty(t, theBackend.Accounts())
+	require.Equal(t, 0, theBackend.Keystores().Count())
+}
@@ -15,6 +15,7 @@
 package backend
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -24,6 +25,8 @@ import (
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/observable"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/observable/action"
@@ -35,6 +38,10 @@ var fiats = []string{"USD", "EUR", "CHF", "GBP", "JPY", "KRW", "CNY", "RUB"}
 
 const interval = time.Minute
 const url = "https://min-api.cryptocompare.com/data/pricemulti?fsyms=%s&tsyms=%s"
+const historicalURL = "https://min-api.cryptocompare.com/data/pricehistorical?fsym=%s&tsyms=%s&ts=%d"
+
+// historicalTimeout limits a historical rate lookup, as an export waits for them.
+const historicalTimeout = 30 * time.Second
 
 var (
 	ratesUpdaterInstance     *RatesUpdater
@@ -53,17 +60,60 @@ func GetRatesUpdaterInstance() *RatesUpdater {
 type RatesUpdater struct {
 	observable.Implementation
 	last map[string]map[string]float64
-	log  *logrus.Entry
+
+	// historical caches daily historical rates by coin, fiat and day.
+	historical       map[string]float64
+	historicalLock   locker.Locker
+	historicalClient *http.Client
+
+	// users counts the Start() calls without a matching Stop(). The updates run while it is
+	// positive.
+	users     int
+	cancel    context.CancelFunc
+	done      chan struct{}
+	usersLock locker.Locker
+
+	log *logrus.Entry
 }
 
-// NewRatesUpdater returns a new rates updater.
+// NewRatesUpdater returns a new rates updater. The rates are updated periodically between Start()
+// and Stop().
 func NewRatesUpdater() *RatesUpdater {
-	updater := &RatesUpdater{
-		last: map[string]map[string]float64{},
-		log:  logging.Get().WithGroup("rates"),
+	return &RatesUpdater{
+		last:             map[string]map[string]float64{},
+		historical:       map[string]float64{},
+		historicalClient: &http.Client{Timeout: historicalTimeout},
+		log:              logging.Get().WithGroup("rates"),
+	}
+}
+
+// Start starts updating the rates periodically. Each call must be matched by a call to Stop(), as
+// the updater is shared.
+func (updater *RatesUpdater) Start() {
+	defer updater.usersLock.Lock()()
+	updater.users++
+	if updater.users > 1 {
+		return
 	}
-	go updater.start()
-	return updater
+	ctx, cancel := context.WithCancel(context.Background())
+	updater.cancel = cancel
+	updater.done = make(chan struct{})
+	go updater.start(ctx, updater.done)
+}
+
+// Stop stops the updates started by Start() once the last user stopped them, and waits until the
+// update loop returned.
+func (updater *RatesUpdater) Stop() {
+	defer updater.usersLock.Lock()()
+	if updater.users == 0 {
+		return
+	}
+	updater.users--
+	if updater.users > 0 {
+		return
+	}
+	updater.cancel()
+	<-updater.done
 }
 
 // Last returns the last rates for a given coin and fiat or nil if not available.
@@ -71,11 +121,16 @@ func (updater *RatesUpdater) Last() map[string]map[string]float64 {
 	return updater.last
 }
 
-func (updater *RatesUpdater) update() {
-	response, err := http.Get(fmt.Sprintf(url,
+func (updater *RatesUpdater) update(ctx context.Context) {
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf(url,
 		strings.Join(coins, ","),
 		strings.Join(fiats, ","),
-	))
+	), nil)
+	if err != nil {
+		updater.last = nil
+		return
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
 	if err != nil {
 		updater.last = nil
 		return
@@ -104,9 +159,53 @@ func (updater *RatesUpdater) update() {
 	})
 }
 
-func (updater *RatesUpdater) start() {
+func (updater *RatesUpdater) start(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
 	for {
-		updater.update()
-		time.Sleep(interval)
+		updater.update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// HistoricalRate returns the daily closing price of the coin in the fiat currency on the day of the
+// given time. The rates are cached, as they do not change any more. The lookup is aborted when ctx
+// is cancelled.
+func (updater *RatesUpdater) HistoricalRate(
+	ctx context.Context, coinUnit string, fiat string, at time.Time) (float64, error) {
+	day := at.UTC().Truncate(24 * time.Hour)
+	key := fmt.Sprintf("%s-%s-%d", coinUnit, fiat, day.Unix())
+	if rate, ok := func() (float64, bool) {
+		defer updater.historicalLock.RLock()()
+		rate, ok := updater.historical[key]
+		return rate, ok
+	}(); ok {
+		return rate, nil
+	}
+	request, err := http.NewRequest(
+		http.MethodGet, fmt.Sprintf(historicalURL, coinUnit, fiat, day.Unix()), nil)
+	if err != nil {
+		return 0, errp.WithStack(err)
+	}
+	response, err := updater.historicalClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return 0, errp.WithStack(err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	var rates map[string]map[string]float64
+	if err := json.NewDecoder(response.Body).Decode(&rates); err != nil {
+		return 0, errp.WithStack(err)
+	}
+	rate, ok := rates[coinUnit][fiat]
+	if !ok {
+		return 0, errp.Newf("no historical rate for %s/%s", coinUnit, fiat)
 	}
+	defer updater.historicalLock.Lock()()
+	updater.historical[key] = rate
+	return rate, nil
 }
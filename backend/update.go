@@ -15,22 +15,72 @@
 package backend
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/locker"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/semver"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
 )
 
-const updateFileURL = "https://shiftcrypto.ch/updates/desktop.json"
+const (
+	// updateManifestURL is the location of the update manifest. Its detached signature is expected
+	// at the same location with the suffix updateSignatureSuffix.
+	updateManifestURL     = "https://shiftcrypto.ch/updates/desktop.json"
+	updateSignatureSuffix = ".asc"
+
+	// updateCheckInterval is the time between two checks for updates.
+	updateCheckInterval = 6 * time.Hour
+
+	// maxUpdateManifestSize limits the size of the downloaded manifest and signature.
+	maxUpdateManifestSize = 1 << 20
+)
+
+const (
+	// UpdateChannelStable only offers stable releases.
+	UpdateChannelStable = "stable"
+	// UpdateChannelBeta offers beta releases and stable releases, whichever is newer.
+	UpdateChannelBeta = "beta"
+)
 
 var (
 	// Version of the backend as displayed to the user.
 	Version = semver.NewSemVer(4, 3, 0)
 )
 
-// UpdateFile is retrieved from the server.
+// UpdateDownload is the download of a release for one platform.
+type UpdateDownload struct {
+	URL string `json:"url"`
+	// SHA256 is the hex encoded hash of the downloaded file.
+	SHA256 string `json:"sha256"`
+}
+
+// UpdateRelease is a release in the update manifest.
+type UpdateRelease struct {
+	Version *semver.SemVer `json:"version"`
+	// Description gives a short summary of the release.
+	Description  string `json:"description"`
+	ReleaseNotes string `json:"releaseNotes"`
+	// Downloads are keyed by the platform, as in runtime.GOOS (linux, darwin, windows, ...).
+	Downloads map[string]UpdateDownload `json:"downloads"`
+}
+
+// UpdateManifest is the signed file which describes the latest release of each update channel.
+type UpdateManifest struct {
+	Channels map[string]*UpdateRelease `json:"channels"`
+}
+
+// UpdateFile describes a release which is newer than the running version.
 type UpdateFile struct {
 	// CurrentVersion stores the current version and is not loaded from the server.
 	CurrentVersion *semver.SemVer `json:"current"`
@@ -40,39 +90,211 @@ type UpdateFile struct {
 
 	// Description gives additional information on the release.
 	Description string `json:"description"`
+
+	ReleaseNotes string `json:"releaseNotes"`
+
+	// Channel is the update channel of the release.
+	Channel string `json:"channel"`
+
+	// Download is the download for the platform the app runs on, if there is one.
+	Download *UpdateDownload `json:"download,omitempty"`
+
+	// Downloads are the downloads of all platforms.
+	Downloads map[string]UpdateDownload `json:"downloads"`
 }
 
-// CheckForUpdate checks whether a newer version of this application has been released.
-// It returns the retrieved update file if a newer version has been released and nil otherwise.
-func CheckForUpdate() (*UpdateFile, error) {
-	response, err := http.Get(updateFileURL)
+// release returns the release offered on the given channel.
+func (manifest *UpdateManifest) release(channel string) (string, *UpdateRelease) {
+	stable := manifest.Channels[UpdateChannelStable]
+	if channel == UpdateChannelBeta {
+		beta := manifest.Channels[UpdateChannelBeta]
+		if beta != nil && beta.Version != nil &&
+			(stable == nil || stable.Version == nil || !stable.Version.AtLeast(beta.Version)) {
+			return UpdateChannelBeta, beta
+		}
+	}
+	return UpdateChannelStable, stable
+}
+
+// UpdateChecker periodically checks the signed update manifest for a newer release.
+type UpdateChecker struct {
+	manifestURL    string
+	keyring        openpgp.EntityList
+	currentVersion *semver.SemVer
+	// channel returns the update channel the user chose.
+	channel func() string
+	// onUpdate is called when a release newer than the previously found one is found.
+	onUpdate func(*UpdateFile)
+
+	last     *UpdateFile
+	lastLock locker.Locker
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	log *logrus.Entry
+}
+
+// NewUpdateChecker creates an update checker for the manifest at the given URL, which has to be
+// signed by one of the keys of the keyring. The checks run between Start() and Stop().
+func NewUpdateChecker(
+	manifestURL string,
+	keyring openpgp.EntityList,
+	currentVersion *semver.SemVer,
+	channel func() string,
+	onUpdate func(*UpdateFile),
+) *UpdateChecker {
+	return &UpdateChecker{
+		manifestURL:    manifestURL,
+		keyring:        keyring,
+		currentVersion: currentVersion,
+		channel:        channel,
+		onUpdate:       onUpdate,
+		log:            logging.Get().WithGroup("update"),
+	}
+}
+
+// bundledUpdateKeyring returns the keys which sign the update manifest.
+func bundledUpdateKeyring() (openpgp.EntityList, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(updateSigningKeys))
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return keyring, nil
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
 	if err != nil {
 		return nil, errp.WithStack(err)
 	}
 	defer func() {
 		_ = response.Body.Close()
 	}()
-
-	var updateFile UpdateFile
-	err = json.NewDecoder(response.Body).Decode(&updateFile)
+	if response.StatusCode != http.StatusOK {
+		return nil, errp.Newf("could not download %s: %s", url, response.Status)
+	}
+	body, err := ioutil.ReadAll(&limitedReader{reader: response.Body, remaining: maxUpdateManifestSize})
 	if err != nil {
 		return nil, errp.WithStack(err)
 	}
+	return body, nil
+}
 
-	if Version.AtLeast(updateFile.NewVersion) {
-		return nil, nil
+// limitedReader fails instead of truncating if the limit is exceeded.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int
+}
+
+func (reader *limitedReader) Read(buffer []byte) (int, error) {
+	if reader.remaining < 0 {
+		return 0, errp.New("the response is too big")
+	}
+	if len(buffer) > reader.remaining+1 {
+		buffer = buffer[:reader.remaining+1]
 	}
+	n, err := reader.reader.Read(buffer)
+	reader.remaining -= n
+	if reader.remaining < 0 {
+		return n, errp.New("the response is too big")
+	}
+	return n, err
+}
 
-	updateFile.CurrentVersion = Version
-	return &updateFile, nil
+// Check downloads the update manifest and verifies its signature. It returns the release of the
+// chosen update channel if it is newer than the running version and nil otherwise.
+func (checker *UpdateChecker) Check(ctx context.Context) (*UpdateFile, error) {
+	manifestBytes, err := download(ctx, checker.manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := download(ctx, checker.manifestURL+updateSignatureSuffix)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := openpgp.CheckArmoredDetachedSignature(
+		checker.keyring, bytes.NewReader(manifestBytes), bytes.NewReader(signature))
+	if err != nil {
+		return nil, errp.WithMessage(errp.WithStack(err), "invalid signature of the update manifest")
+	}
+	checker.log.WithField("signer", signer.PrimaryKey.KeyIdString()).Debug("verified the update manifest")
+	var manifest UpdateManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	channel, release := manifest.release(checker.channel())
+	if release == nil || release.Version == nil || checker.currentVersion.AtLeast(release.Version) {
+		return nil, nil
+	}
+	updateFile := &UpdateFile{
+		CurrentVersion: checker.currentVersion,
+		NewVersion:     release.Version,
+		Description:    release.Description,
+		ReleaseNotes:   release.ReleaseNotes,
+		Channel:        channel,
+		Downloads:      release.Downloads,
+	}
+	if platformDownload, ok := release.Downloads[runtime.GOOS]; ok {
+		updateFile.Download = &platformDownload
+	}
+	return updateFile, nil
 }
 
-// CheckForUpdateIgnoringErrors suppresses any errors that are triggered, for example, when offline.
-func CheckForUpdateIgnoringErrors() *UpdateFile {
-	updateFile, err := CheckForUpdate()
+// update checks for an update and calls onUpdate if a newer release than the last one was found.
+// Failed checks keep the last result, as they happen when offline.
+func (checker *UpdateChecker) update(ctx context.Context) {
+	updateFile, err := checker.Check(ctx)
 	if err != nil {
-		logging.Get().WithGroup("update").WithError(err).Warn("Check for update failed.")
-		return nil
+		checker.log.WithError(err).Warn("Check for update failed.")
+		return
+	}
+	notify := func() bool {
+		defer checker.lastLock.Lock()()
+		previous := checker.last
+		checker.last = updateFile
+		return updateFile != nil &&
+			(previous == nil || !previous.NewVersion.AtLeast(updateFile.NewVersion))
+	}()
+	if notify {
+		checker.log.WithField("version", updateFile.NewVersion).Info("update available")
+		checker.onUpdate(updateFile)
+	}
+}
+
+// Last returns the release found by the last successful check, or nil if there is no newer release.
+func (checker *UpdateChecker) Last() *UpdateFile {
+	defer checker.lastLock.RLock()()
+	return checker.last
+}
+
+// Start checks for updates right away and then in the given interval until Stop() is called.
+func (checker *UpdateChecker) Start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	checker.cancel = cancel
+	checker.done = make(chan struct{})
+	go func() {
+		defer close(checker.done)
+		for {
+			checker.update(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// Stop stops the checks and waits until a running check returned.
+func (checker *UpdateChecker) Stop() {
+	if checker.cancel == nil {
+		return
 	}
-	return updateFile
+	checker.cancel()
+	<-checker.done
 }
@@ -0,0 +1,70 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+// updateSigningKeys are the PGP keys of which one has to sign the update manifest. They are the
+// keys in pgp/pubkeys/.
+const updateSigningKeys = `
+-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mQINBFqO98YBEADrjdZE10TXbqyW7zm4igIw06O7KOieQgul2JNULK1w3LFIsVXF
+LGs4i47LmqhvtE6yGg9jKQDbJs9sL0QvyJoaikSX7sw/AAbN30gyKCm+RcPPB+pE
+WEPDY+xRcwU//qhJnKWw7p7RWJn5NH9/uaIxeLkCgJSC9XgZpOTPvzfbOlGi1Zge
+XbEjrSknmNkNlrafyhkPNekTUIFF9zPvwEuigx120lbXP11btWpUZd/k3DdjfItd
+mqPRMH5Y13XUvMt6BCMjl3oYPSxaPEdh/XrLqsifilHIXrrOFvi6msWuPFG5hIRa
+vDMA4rp6IAJXePh+ZheLDL45q7BxKRhTqL0H+0gLsmYI1++nO96OPsuHjR8PWfEe
+kFcB98mSDi/7DNuBBUY62z/6w8JDn9i4M6HbAH8RZ+sQfIVdjCdJP+tHJwEyzCHe
+ITbZ1KiR4arAnel9ZEzdng6RlVyaEXxkn4e1PfaCxzGStJk9RjzWgagrmgIPPKhJ
+Q8J5Ly+ijXdLO9KpHaYhsz3goflvH3KZU2R/AuDFaBAsDpphhn1Em8r7l1PdSTe2
+paOX1Lh/2BjJhGxfFH8VLLQEQlKFWutEFWs+tlD3klzxayeyp1fUJXmMLQA2EALn
+VlUajkiqJKc4R1H5PM+/+G733uR40UeM6bZSvjfSuP7pRlKzRrz0Sr8vXwARAQAB
+tCJNYXJrbyBCZW5jdW4gPG1iQHNoaWZ0ZGV2aWNlcy5jb20+iQI3BBMBCAAhBQJa
+jvfGAhsDBQsJCAcCBhUICQoLAgQWAgMBAh4BAheAAAoJEE81WIqvDnKKJTQP/37B
+7vIQikJ8/Jhu8RIPH0koab1OinxR20xTCDaH+HITjXfj8Viv5+KugMK5uis5pvxS
+441hts6jNU70gSt4ZZhztmNMBGyEi5img4uspW0GQhUHTs+yvvLe8WcGtDwz07qU
+AUnYf5c4beRMN3iGbE2Hbd8WWL8XSjifwoPGAlgAtoacrIt41ZUgSqPrMHunYdYO
+StZk+y9SnvngZZzYsENbj86WWNx8WPyv/nXLcXMEXK+rCyKyekES/TE8U2rgmuen
+NrtzB56kpq0tSSwmP3DgKqCURIdMpkTIIN86vvoNVqCniyVLg2aWVzoSp1TdaCvO
+hYZR8NPy/0lU5PaI/yynjHYEGSwjP/swAhiraSHYizzTa4SQbywm8TV2Mv56wEb5
+z+ZDf2+ah5oh7qNOu2wNG1t/q4DDaG6x31ynynEQICxcgdocFGWy+cfNBlaUbYQy
+cRfr8IvQJmW/kD8oFPzli/BL10DiYElAmhliY4JydxRVqhARwv89gqg+f5mdXrDM
++iEYd6usnOMhqi2SCzMo8UMBY9m8xxkxHyUzkIfRr37QYNDj2xxZumMtUHEiuOsf
+C9BszEy4NMhTs4L+PomDNCrmzyf3vduMD9cfco1tcoDybW1CkoTLtz4oLh6hv6WC
+z/ZtLmEL2iDgSdB2Q931A/viQXyhPPLjJcemiUzKuQINBFqO98YBEACjl10Y2c+r
+omzOKeWghVf/OrrhADK4hbLuOYPiywg5m1oK94hrcMK0MZT8vUoHve0oksz7oHr+
+JBpWgFtNrYigA0IOofIzV5MBYvVN0FNmJB12Sl2xIjJ7Kt2eAerbUt7Mkd/VRg6X
+skE9Rcs720/c9c4GCnaWqJA09oxUt1hqmEYnIXU8FxuKPzN4lIJFg0cbxQ1bY+DQ
+xxA5qfvM9l+ye2qsIjbJFfVwEfgMhg0/XL3bL0PaS8S4jGI6J+GYWsaUv8/JC6mY
+ihwiImfK44MuwXjYQS67Lrwbe7xUiSv/arLsRhF7lEry3DoIE8mHu0m2/DZduNX1
+MYM3DwUxE2tg0gqQQFv/d8jZ+0UoTdCrz03ZRbuB5ubhtyvCf7KbrfxcDhryy++P
+w608fx+MWWvWtmBxebEM+uCP2UwNCTM7d82Lv2mlzL6+DTNTPlL8AvNdQ7xLHsGM
+KSnro5E8TVNVuBWEnxTfN8Pv6oVWTy4Tq0GFOyETDIsEDkUbgYcmmdGwgaEQPpeX
+/QWJf9gONE0SEhfXCL2h5j6X4lf/yGarvoZlmV8VfFJuPtb5FfRtiUL05SPpyjEK
+xfld2ttJD2/70g8MQrQupSMnmnAPOuTBrnmhJNVmnccRIn0OtzpR6qQRQRYjMJ2o
+jzSFG0cImJU/1n0WxCbBjAzzC+J2yfUSwwARAQABiQIfBBgBCAAJBQJajvfGAhsM
+AAoJEE81WIqvDnKKK3gQAJzm8EBZ1MkmV+CwOH347GSm5lItN/nRAP40utYfW4Hj
+k1EcIpVY6VJZYCgGkOwvh93t+uA1d0mmcesRidMkO38wXFfj4CM1VEzBI6O+vm4R
+mm5rfCjhvm2WrPtsWdzje4DXjFGLuMUkmE9Jq+eBoJqfO9JXnsdTx4/LmWoT2Whi
+OPf+EKhPVx7GmZNx8b+URVCVofnX3gJbq3nUgAxqheYRyGczPe/m0uyQyl6C6ypA
+NYMrZZiwefe+XrZNAS57cee+EI1pwXOTLzgX2MwmeG0mffFerWtXcfhlWsT8I2HB
+FW8CwACSpkVupQ3jsIJLxONYGHaVvjs2b/feN4bBT2piNUI8j/92YxjdCbUW3w7E
+1/JW/FlgtTm3jw2bZkljrVf4wnyiay+pFVBiUYkDN2XewYaQ6ulWRvo0uYTMelh9
+99c6Dedkb4EAZRsJp5B9b2cVCAZZpeL1eZ/q2SWAV5zyXhAcpuzatS5EC1bwb1p2
+jlBu6MHoKh1NuA/B8JFp/tDX51u9IBtm6Xk/84qqKtJd4+KpNSGoCpOJuQjLRtmI
+nRj1B2GRjoJT9wfGshBrGmsfiVUA4/yEHShaQCV6zwKk34KfiIR4/Wmd6Z2sY3nY
+mfCdbHcejbGtJa0sIPub2eqF1m7OzhxsMhmiVqWbZBydntDS7Uib5Y42DtyiBh8u
+=ffcV
+-----END PGP PUBLIC KEY BLOCK-----
+`
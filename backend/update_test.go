@@ -0,0 +1,151 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/semver"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+)
+
+const testManifest = `{
+  "channels": {
+    "stable": {
+      "version": "4.4.0",
+      "description": "Stable release.",
+      "releaseNotes": "Bug fixes.",
+      "downloads": {
+        "` + runtime.GOOS + `": {"url": "https://example.com/app", "sha256": "00ff"}
+      }
+    },
+    "beta": {
+      "version": "4.5.0",
+      "description": "Beta release.",
+      "releaseNotes": "New features.",
+      "downloads": {}
+    }
+  }
+}`
+
+// manifestServer serves the manifest at /desktop.json and its detached signature by the signer.
+func manifestServer(t *testing.T, manifest string, signer *openpgp.Entity) *httptest.Server {
+	t.Helper()
+	signature := &bytes.Buffer{}
+	require.NoError(t, openpgp.ArmoredDetachSign(signature, signer, bytes.NewBufferString(manifest), nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desktop.json", func(writer http.ResponseWriter, _ *http.Request) {
+		_, _ = writer.Write([]byte(manifest))
+	})
+	mux.HandleFunc("/desktop.json.asc", func(writer http.ResponseWriter, _ *http.Request) {
+		_, _ = writer.Write(signature.Bytes())
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestEntity(t *testing.T) *openpgp.Entity {
+	t.Helper()
+	entity, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	require.NoError(t, err)
+	return entity
+}
+
+func TestUpdateCheck(t *testing.T) {
+	signer := newTestEntity(t)
+	server := manifestServer(t, testManifest, signer)
+	defer server.Close()
+	keyring := openpgp.EntityList{signer}
+	noUpdate := func(*backend.UpdateFile) {}
+
+	stable := backend.NewUpdateChecker(server.URL+"/desktop.json", keyring, semver.NewSemVer(4, 3, 0),
+		func() string { return backend.UpdateChannelStable }, noUpdate)
+	updateFile, err := stable.Check(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, updateFile)
+	require.Equal(t, semver.NewSemVer(4, 4, 0), updateFile.NewVersion)
+	require.Equal(t, semver.NewSemVer(4, 3, 0), updateFile.CurrentVersion)
+	require.Equal(t, backend.UpdateChannelStable, updateFile.Channel)
+	require.Equal(t, "Bug fixes.", updateFile.ReleaseNotes)
+	require.Equal(t, &backend.UpdateDownload{URL: "https://example.com/app", SHA256: "00ff"},
+		updateFile.Download)
+
+	beta := backend.NewUpdateChecker(server.URL+"/desktop.json", keyring, semver.NewSemVer(4, 3, 0),
+		func() string { return backend.UpdateChannelBeta }, noUpdate)
+	updateFile, err = beta.Check(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, semver.NewSemVer(4, 5, 0), updateFile.NewVersion)
+	require.Equal(t, backend.UpdateChannelBeta, updateFile.Channel)
+	require.Nil(t, updateFile.Download)
+
+	upToDate := backend.NewUpdateChecker(server.URL+"/desktop.json", keyring, semver.NewSemVer(4, 4, 0),
+		func() string { return backend.UpdateChannelStable }, noUpdate)
+	updateFile, err = upToDate.Check(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, updateFile)
+
+	// The manifest has to be signed by one of the bundled keys.
+	untrusted := backend.NewUpdateChecker(server.URL+"/desktop.json",
+		openpgp.EntityList{newTestEntity(t)}, semver.NewSemVer(4, 3, 0),
+		func() string { return backend.UpdateChannelStable }, noUpdate)
+	_, err = untrusted.Check(context.Background())
+	require.Error(t, err)
+
+	// The signature does not cover a tampered manifest.
+	tampered := manifestServer(t, testManifest, signer)
+	defer tampered.Close()
+	tamperedServer := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/desktop.json" {
+				_, _ = writer.Write(bytes.Replace([]byte(testManifest), []byte("4.4.0"), []byte("9.9.9"), 1))
+				return
+			}
+			http.Redirect(writer, request, tampered.URL+request.URL.Path, http.StatusFound)
+		}))
+	defer tamperedServer.Close()
+	_, err = backend.NewUpdateChecker(tamperedServer.URL+"/desktop.json", keyring,
+		semver.NewSemVer(4, 3, 0), func() string { return backend.UpdateChannelStable }, noUpdate,
+	).Check(context.Background())
+	require.Error(t, err)
+}
+
+func TestUpdateCheckerEvents(t *testing.T) {
+	signer := newTestEntity(t)
+	server := manifestServer(t, testManifest, signer)
+	defer server.Close()
+	updates := make(chan *backend.UpdateFile, 10)
+	checker := backend.NewUpdateChecker(server.URL+"/desktop.json", openpgp.EntityList{signer},
+		semver.NewSemVer(4, 3, 0), func() string { return backend.UpdateChannelStable },
+		func(updateFile *backend.UpdateFile) { updates <- updateFile })
+	checker.Start(10 * time.Millisecond)
+	select {
+	case updateFile := <-updates:
+		require.Equal(t, semver.NewSemVer(4, 4, 0), updateFile.NewVersion)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no update event")
+	}
+	// The same release is only announced once.
+	time.Sleep(100 * time.Millisecond)
+	checker.Stop()
+	require.Empty(t, updates)
+	require.Equal(t, semver.NewSemVer(4, 4, 0), checker.Last().NewVersion)
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command relayserver runs a relay server for the mobile pairing and the 2FA of the BitBox. Its
+// URL can be used as the relay server of a pairing instead of the default server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/devices/bitbox/relay/relayserver"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout limits how long open requests are waited for when the server stops. It is longer
+// than the default poll timeout, so that waiting pulls can finish.
+const shutdownTimeout = 15 * time.Second
+
+func main() {
+	flags := flag.NewFlagSet("relayserver", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8090", "address to listen on")
+	tlsCert := flags.String("tlscert", "", "TLS certificate file; serves plain HTTP if empty")
+	tlsKey := flags.String("tlskey", "", "TLS key file")
+	pollTimeout := flags.Duration("polltimeout", relayserver.DefaultPollTimeout,
+		"how long a pull waits for a message")
+	expiry := flags.Duration("expiry", relayserver.DefaultExpiry, "age at which messages are deleted")
+	logLevel := flags.String("loglevel", "info", "log level")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: relayserver [flags]\n\n"+
+			"Relays the encrypted messages between the BitBox wallet app and the paired mobile.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "-tlscert and -tlskey must be given together")
+		os.Exit(2)
+	}
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logging.Set(&logging.Configuration{Output: "STDERR", Level: level})
+	log := logging.Get().WithGroup("relayserver")
+	relayServer := relayserver.NewServer(*pollTimeout, *expiry)
+	server := &http.Server{Addr: *listen, Handler: relayServer}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.WithField("address", *listen).WithField("tls", *tlsCert != "").Info("Listening for HTTP")
+		if *tlsCert != "" {
+			serverErr <- server.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	// Messages of abandoned channels are never pulled.
+	cleanup := time.NewTicker(*expiry)
+	defer cleanup.Stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+loop:
+	for {
+		select {
+		case err := <-serverErr:
+			log.WithError(err).Error("relayserver failed")
+			os.Exit(1)
+		case <-cleanup.C:
+			relayServer.DeleteExpired()
+		case sig := <-signals:
+			log.WithField("signal", sig.String()).Info("Shutting down")
+			break loop
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("could not shut down")
+	}
+	log.Info("Stopped")
+}
@@ -36,6 +36,7 @@ func main() {
 	regtest := flag.Bool("regtest", false, "use regtest instead of testnet coins")
 	multisig := flag.Bool("multisig", false, "use the app in multisig mode")
 	devmode := flag.Bool("devmode", true, "switch to dev mode")
+	simulator := flag.Bool("simulator", false, "register a simulated BitBox")
 	flag.Parse()
 
 	logging.Set(&logging.Configuration{Output: "STDERR", Level: logrus.DebugLevel})
@@ -51,8 +52,11 @@ func main() {
 	log.Info("--------------- Started application --------------")
 	// since we are in dev-mode, we can drop the authorization token
 	connectionData := backendHandlers.NewConnectionData(-1, "")
-	backend := backend.NewBackend(
-		arguments.NewArguments(".", !*mainnet, *regtest, *multisig, *devmode))
+	backend, err := backend.NewBackend(
+		arguments.NewArguments(".", !*mainnet, *regtest, *multisig, *devmode, *simulator))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create the backend")
+	}
 	handlers := backendHandlers.NewHandlers(backend, connectionData)
 	log.WithFields(logrus.Fields{"address": address, "port": port}).Info("Listening for HTTP")
 	fmt.Printf("Listening on: http://localhost:%d\n", port)
@@ -0,0 +1,142 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// tokenEnv is the environment variable from which the API token is read if no flag is given.
+const tokenEnv = "WALLETCLI_TOKEN"
+
+type clientOptions struct {
+	url       string
+	token     string
+	tokenFile string
+	caCert    string
+	insecure  bool
+}
+
+// client calls the REST API of the daemon.
+type client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func newClient(options *clientOptions) (*client, error) {
+	token := options.token
+	if token == "" && options.tokenFile != "" {
+		data, err := ioutil.ReadFile(options.tokenFile)
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		token = os.Getenv(tokenEnv)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.insecure} // #nosec G402
+	if options.caCert != "" {
+		pem, err := ioutil.ReadFile(options.caCert)
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errp.Newf("no certificates found in %s", options.caCert)
+		}
+	}
+	if _, err := url.Parse(options.url); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return &client{
+		baseURL: strings.TrimSuffix(options.url, "/") + "/api/",
+		token:   token,
+		httpClient: &http.Client{
+			Timeout:   5 * time.Minute,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// get calls the endpoint with a GET request and decodes the response into result.
+func (client *client) get(endpoint string, result interface{}) error {
+	return client.call(http.MethodGet, endpoint, nil, result)
+}
+
+// post calls the endpoint with a POST request. A nil body sends an empty request body.
+func (client *client) post(endpoint string, body interface{}, result interface{}) error {
+	return client.call(http.MethodPost, endpoint, body, result)
+}
+
+func (client *client) call(method string, endpoint string, body interface{}, result interface{}) error {
+	var requestBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return errp.WithStack(err)
+		}
+		requestBody = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, client.baseURL+endpoint, requestBody)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if client.token != "" {
+		request.Header.Set("Authorization", "Basic "+client.token)
+	}
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return errp.Newf("%s %s: %s: %s", method, endpoint, response.Status, strings.TrimSpace(string(data)))
+	}
+	// Handler errors are returned with status 200 as {"error": "..."}.
+	var apiError struct {
+		Error *string `json:"error"`
+	}
+	if json.Unmarshal(data, &apiError) == nil && apiError.Error != nil {
+		return errp.Newf("%s %s: %s", method, endpoint, *apiError.Error)
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return errp.Wrap(err, fmt.Sprintf("%s %s: unexpected response", method, endpoint))
+	}
+	return nil
+}
+
+// accountEndpoint returns the endpoint of an account, escaping the account code.
+func accountEndpoint(code string, endpoint string) string {
+	return "account/" + url.PathEscape(code) + "/" + endpoint
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/export"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+func runAccounts(client *client, args []string) error {
+	if _, err := parseArgs(commandFlags("accounts"), args, 0); err != nil {
+		return err
+	}
+	var accounts interface{}
+	if err := client.get("accounts", &accounts); err != nil {
+		return err
+	}
+	return printJSON(accounts)
+}
+
+func runBalance(client *client, args []string) error {
+	args, err := parseArgs(commandFlags("balance"), args, 1)
+	if err != nil {
+		return err
+	}
+	var balance interface{}
+	if err := client.get(accountEndpoint(args[0], "balance"), &balance); err != nil {
+		return err
+	}
+	return printJSON(balance)
+}
+
+func runTransactions(client *client, args []string) error {
+	args, err := parseArgs(commandFlags("transactions"), args, 1)
+	if err != nil {
+		return err
+	}
+	var transactions interface{}
+	if err := client.get(accountEndpoint(args[0], "transactions"), &transactions); err != nil {
+		return err
+	}
+	return printJSON(transactions)
+}
+
+func runReceive(client *client, args []string) error {
+	flags := commandFlags("receive")
+	all := flags.Bool("all", false, "list all unused receive addresses")
+	args, err := parseArgs(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	var addresses []struct {
+		Address   string `json:"address"`
+		AddressID string `json:"addressID"`
+	}
+	if err := client.get(accountEndpoint(args[0], "receive-addresses"), &addresses); err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		return errp.New("the account has no unused receive address")
+	}
+	if *all {
+		for _, address := range addresses {
+			fmt.Println(address.Address)
+		}
+		return nil
+	}
+	fmt.Println(addresses[0].Address)
+	return nil
+}
+
+// runSendTx returns the command which posts a transaction to the given account endpoint. The
+// proposal and the send endpoints take the same input.
+func runSendTx(name string, endpoint string) func(*client, []string) error {
+	return func(client *client, args []string) error {
+		flags := commandFlags(name)
+		feeTarget := flags.String("fee", "normal", "fee target (low, economy, normal, high)")
+		var utxos stringList
+		flags.Var(&utxos, "utxo", "spend only the given outputs (txid:index, repeatable)")
+		args, err := parseArgs(flags, args, 3)
+		if err != nil {
+			return err
+		}
+		input := map[string]interface{}{
+			"address":       args[1],
+			"amount":        args[2],
+			"feeTarget":     *feeTarget,
+			"sendAll":       "",
+			"selectedUTXOS": []string(utxos),
+			"data":          "",
+		}
+		if args[2] == "all" {
+			input["amount"] = ""
+			input["sendAll"] = "yes"
+		}
+		if utxos == nil {
+			input["selectedUTXOS"] = []string{}
+		}
+		var result map[string]interface{}
+		if err := client.post(accountEndpoint(args[0], endpoint), input, &result); err != nil {
+			return err
+		}
+		if err := printJSON(result); err != nil {
+			return err
+		}
+		if success, _ := result["success"].(bool); !success {
+			return errp.Newf("%s failed", name)
+		}
+		return nil
+	}
+}
+
+func runExport(client *client, args []string) error {
+	flags := commandFlags("export")
+	format := flags.String("format", string(export.FormatCSV),
+		"csv, accounting-csv, koinly, cointracking, ofx or qif")
+	fiat := flags.String("fiat", "USD", "fiat currency of the fiat columns and the gains report")
+	from := flags.String("from", "", "inclusive start date (2006-01-02 or RFC3339)")
+	to := flags.String("to", "", "exclusive end date (2006-01-02 or RFC3339)")
+	costBasis := flags.String("cost-basis", "", "also create a realized gains report (fifo, lifo, hifo)")
+	out := flags.String("out", ".", "directory to which the files are written")
+	args, err := parseArgs(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	options := map[string]string{
+		"format":    *format,
+		"fiat":      *fiat,
+		"from":      *from,
+		"to":        *to,
+		"costBasis": *costBasis,
+	}
+	var result export.Result
+	if err := client.post(accountEndpoint(args[0], "export"), options, &result); err != nil {
+		return err
+	}
+	for _, file := range []*export.File{result.Transactions, result.Gains} {
+		if file == nil {
+			continue
+		}
+		path, err := file.WriteToDir(*out)
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+	return nil
+}
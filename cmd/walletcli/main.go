@@ -0,0 +1,172 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command walletcli calls the REST API of a running wallet daemon (walletd).
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// command is a subcommand of the client.
+type command struct {
+	usage       string
+	description string
+	run         func(client *client, args []string) error
+}
+
+// commands is filled in init, as the commands refer to it for their usage.
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"accounts": {
+			usage:       "accounts",
+			description: "list the loaded accounts",
+			run:         runAccounts,
+		},
+		"balance": {
+			usage:       "balance <account>",
+			description: "show the balance of an account",
+			run:         runBalance,
+		},
+		"transactions": {
+			usage:       "transactions <account>",
+			description: "list the transactions of an account",
+			run:         runTransactions,
+		},
+		"receive": {
+			usage:       "receive [-all] <account>",
+			description: "show an unused receive address",
+			run:         runReceive,
+		},
+		"propose": {
+			usage:       "propose [-fee target] [-utxo txid:index]... <account> <address> <amount|all>",
+			description: "compute the amount and fee of a transaction without sending it",
+			run:         runSendTx("propose", "tx-proposal"),
+		},
+		"send": {
+			usage:       "send [-fee target] [-utxo txid:index]... <account> <address> <amount|all>",
+			description: "sign and broadcast a transaction",
+			run:         runSendTx("send", "sendtx"),
+		},
+		"export": {
+			usage: "export [-format format] [-fiat code] [-from date] [-to date] " +
+				"[-cost-basis fifo|lifo|hifo] [-out dir] <account>",
+			description: "export the transactions of an account to files",
+			run:         runExport,
+		},
+	}
+}
+
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: walletcli [flags] <command> [command flags] [arguments]\n\nCommands:\n")
+		for _, name := range []string{"accounts", "balance", "transactions", "receive", "propose", "send", "export"} {
+			fmt.Fprintf(out, "  %-14s%s\n      %s\n", name, commands[name].description, commands[name].usage)
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(out, "\nThe token can also be passed in the %s environment variable.\n", tokenEnv)
+	}
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("walletcli", flag.ContinueOnError)
+	flags.Usage = usage(flags)
+	options := &clientOptions{}
+	flags.StringVar(&options.url, "url", "http://127.0.0.1:8085", "base URL of the wallet daemon")
+	flags.StringVar(&options.token, "token", "", "API token")
+	flags.StringVar(&options.tokenFile, "token-file", "", "file containing the API token")
+	flags.StringVar(&options.caCert, "cacert", "", "PEM file of the CA which signed the daemon certificate")
+	flags.BoolVar(&options.insecure, "insecure", false, "do not verify the TLS certificate of the daemon")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errp.New("missing command")
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		flags.Usage()
+		return errp.Newf("unknown command %s", flags.Arg(0))
+	}
+	client, err := newClient(options)
+	if err != nil {
+		return err
+	}
+	return cmd.run(client, flags.Args()[1:])
+}
+
+// printJSON writes the value as indented JSON to stdout.
+func printJSON(value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// commandFlags returns a flag set for the arguments of a command.
+func commandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: walletcli %s\n", commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseArgs parses the command flags and checks the number of positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string, count int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != count {
+		flags.Usage()
+		return nil, errp.Newf("expected %d arguments, got %d", count, flags.NArg())
+	}
+	return flags.Args(), nil
+}
+
+// stringList is a flag which can be given multiple times.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
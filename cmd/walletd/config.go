@@ -0,0 +1,175 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	utilConfig "github.com/digitalbitbox/bitbox-wallet-app/util/config"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/random"
+)
+
+// config holds the settings of the daemon. They are read from the JSON config file given by
+// -config, and overridden by the flags which are set explicitly.
+type config struct {
+	DataDir   string `json:"datadir"`
+	Listen    string `json:"listen"`
+	TLSCert   string `json:"tlsCert"`
+	TLSKey    string `json:"tlsKey"`
+	Token     string `json:"token"`
+	TokenFile string `json:"tokenFile"`
+	Mainnet   bool   `json:"mainnet"`
+	Regtest   bool   `json:"regtest"`
+	Multisig  bool   `json:"multisig"`
+	Simulator bool   `json:"simulator"`
+	LogLevel  string `json:"logLevel"`
+	LogOutput string `json:"logOutput"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		DataDir:  utilConfig.AppDir(),
+		Listen:   "127.0.0.1:8085",
+		LogLevel: "info",
+	}
+}
+
+// loadConfig parses the command line arguments and the config file they point to.
+func loadConfig(args []string) (*config, error) {
+	flags := flag.NewFlagSet("walletd", flag.ContinueOnError)
+	flags.Usage = usage(flags)
+	configFile := flags.String("config", "", "path to a JSON config file")
+	fromFlags := defaultConfig()
+	flags.StringVar(&fromFlags.DataDir, "datadir", fromFlags.DataDir, "directory of the wallet data")
+	flags.StringVar(&fromFlags.Listen, "listen", fromFlags.Listen, "address on which the API is served")
+	flags.StringVar(&fromFlags.TLSCert, "tls-cert", "", "TLS certificate file; enables HTTPS together with -tls-key")
+	flags.StringVar(&fromFlags.TLSKey, "tls-key", "", "TLS private key file")
+	flags.StringVar(&fromFlags.Token, "token", "", "API token; prefer -token-file, as flags are visible to other users")
+	flags.StringVar(&fromFlags.TokenFile, "token-file", "",
+		"file containing the API token; generated if missing (default <datadir>/api-token)")
+	flags.BoolVar(&fromFlags.Mainnet, "mainnet", false, "use mainnet instead of testnet coins")
+	flags.BoolVar(&fromFlags.Regtest, "regtest", false, "use regtest instead of testnet coins")
+	flags.BoolVar(&fromFlags.Multisig, "multisig", false, "use the app in multisig mode")
+	flags.BoolVar(&fromFlags.Simulator, "simulator", false, "register a simulated BitBox")
+	flags.StringVar(&fromFlags.LogLevel, "loglevel", fromFlags.LogLevel, "log level (debug, info, warning, error)")
+	flags.StringVar(&fromFlags.LogOutput, "log-output", "", "log file, STDOUT or STDERR (default STDERR)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 0 {
+		return nil, errp.Newf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	result := defaultConfig()
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+		if err := json.Unmarshal(data, result); err != nil {
+			return nil, errp.Wrap(err, "invalid config file "+*configFile)
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "datadir":
+			result.DataDir = fromFlags.DataDir
+		case "listen":
+			result.Listen = fromFlags.Listen
+		case "tls-cert":
+			result.TLSCert = fromFlags.TLSCert
+		case "tls-key":
+			result.TLSKey = fromFlags.TLSKey
+		case "token":
+			result.Token = fromFlags.Token
+		case "token-file":
+			result.TokenFile = fromFlags.TokenFile
+		case "mainnet":
+			result.Mainnet = fromFlags.Mainnet
+		case "regtest":
+			result.Regtest = fromFlags.Regtest
+		case "multisig":
+			result.Multisig = fromFlags.Multisig
+		case "simulator":
+			result.Simulator = fromFlags.Simulator
+		case "loglevel":
+			result.LogLevel = fromFlags.LogLevel
+		case "log-output":
+			result.LogOutput = fromFlags.LogOutput
+		}
+	})
+	if err := result.validate(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (config *config) validate() error {
+	if config.DataDir == "" {
+		return errp.New("the data directory must be set")
+	}
+	if config.Mainnet && config.Regtest {
+		return errp.New("mainnet and regtest cannot be used together")
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return errp.New("TLS needs both a certificate and a key")
+	}
+	return nil
+}
+
+// tls returns whether the API is served over HTTPS.
+func (config *config) tls() bool {
+	return config.TLSCert != ""
+}
+
+// apiToken returns the configured API token. If none is configured, the token is read from the
+// token file, which is created with a random token if it does not exist yet.
+func (config *config) apiToken() (string, error) {
+	if config.Token != "" {
+		return config.Token, nil
+	}
+	tokenFile := config.TokenFile
+	if tokenFile == "" {
+		tokenFile = filepath.Join(config.DataDir, "api-token")
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", errp.Newf("the token file %s is empty", tokenFile)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errp.WithStack(err)
+	}
+	token, err := random.HexString(32)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(tokenFile), 0700); err != nil {
+		return "", errp.WithStack(err)
+	}
+	if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		return "", errp.WithStack(err)
+	}
+	return token, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command walletd runs the wallet backend as a headless daemon which serves the REST API.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/backend"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/arguments"
+	backendHandlers "github.com/digitalbitbox/bitbox-wallet-app/backend/handlers"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout limits how long open requests are waited for when the daemon stops.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	daemonConfig, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	level, err := logrus.ParseLevel(daemonConfig.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logOutput := daemonConfig.LogOutput
+	if logOutput == "" {
+		logOutput = "STDERR"
+	}
+	logging.Set(&logging.Configuration{Output: logOutput, Level: level})
+	log := logging.Get().WithGroup("walletd")
+	if err := run(daemonConfig, log); err != nil {
+		log.WithError(err).Error("walletd failed")
+		os.Exit(1)
+	}
+}
+
+func run(daemonConfig *config, log *logrus.Entry) error {
+	token, err := daemonConfig.apiToken()
+	if err != nil {
+		return err
+	}
+	_, portString, err := net.SplitHostPort(daemonConfig.Listen)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+	if !daemonConfig.tls() && !isLoopback(daemonConfig.Listen) {
+		log.Warning("Serving the API on a non-loopback address without TLS")
+	}
+
+	log.WithField("datadir", daemonConfig.DataDir).Info("--------------- Started walletd --------------")
+	theBackend, err := backend.NewBackend(arguments.NewArguments(
+		daemonConfig.DataDir, !daemonConfig.Mainnet, daemonConfig.Regtest, daemonConfig.Multisig, false,
+		daemonConfig.Simulator))
+	if err != nil {
+		return err
+	}
+	handlers := backendHandlers.NewHandlers(theBackend, backendHandlers.NewConnectionData(port, token))
+
+	server := &http.Server{Addr: daemonConfig.Listen, Handler: handlers.Router}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.WithField("address", daemonConfig.Listen).WithField("tls", daemonConfig.tls()).
+			Info("Listening for HTTP")
+		if daemonConfig.tls() {
+			serverErr <- server.ListenAndServeTLS(daemonConfig.TLSCert, daemonConfig.TLSKey)
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case err := <-serverErr:
+		return err
+	case sig := <-signals:
+		log.WithField("signal", sig.String()).Info("Shutting down")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	// Closes the accounts and their databases, and the remaining websockets.
+	theBackend.Close()
+	log.Info("Stopped")
+	return nil
+}
+
+// isLoopback returns whether the listen address only accepts local connections.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// usage prints the usage of the daemon.
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(flags.Output(), "Usage: walletd [flags]\n\n"+
+			"Runs the wallet backend and serves its REST API. Flags override the values of the\n"+
+			"config file.\n\n")
+		flags.PrintDefaults()
+	}
+}
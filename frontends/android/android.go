@@ -15,6 +15,7 @@
 package android
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/digitalbitbox/bitbox-wallet-app/backend"
@@ -24,7 +25,13 @@ import (
 	"github.com/digitalbitbox/bitbox-wallet-app/util/random"
 )
 
-// Serve serves the BitBox Wallet API for use in a mobile client.
+var (
+	theBackend *backend.Backend
+	server     *http.Server
+)
+
+// Serve serves the BitBox Wallet API for use in a mobile client. It returns after Shutdown() was
+// called.
 func Serve() {
 	log := logging.Get().WithGroup("android")
 	token, err := random.HexString(16)
@@ -32,10 +39,26 @@ func Serve() {
 		log.WithError(err).Fatal("Failed to generate random string")
 	}
 	connectionData := backendHandlers.NewConnectionData(8082, token)
-	backend := backend.NewBackend(arguments.NewArguments(".", false, false, false, false))
-	handlers := backendHandlers.NewHandlers(backend, connectionData)
-	err = http.ListenAndServe("localhost:8082", handlers.Router)
+	theBackend, err = backend.NewBackend(arguments.NewArguments(".", false, false, false, false, false))
 	if err != nil {
+		log.WithError(err).Fatal("Failed to create the backend")
+	}
+	handlers := backendHandlers.NewHandlers(theBackend, connectionData)
+	server = &http.Server{Addr: "localhost:8082", Handler: handlers.Router}
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
+
+// Shutdown stops serving the API and closes the backend.
+func Shutdown() {
+	log := logging.Get().WithGroup("android")
+	if server == nil {
+		return
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.WithError(err).Error("Failed to shut down the server")
+	}
+	theBackend.Close()
+}
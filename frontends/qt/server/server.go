@@ -43,6 +43,7 @@ import (
 
 	"github.com/digitalbitbox/bitbox-wallet-app/backend"
 	"github.com/digitalbitbox/bitbox-wallet-app/backend/arguments"
+	"github.com/digitalbitbox/bitbox-wallet-app/backend/events"
 	backendHandlers "github.com/digitalbitbox/bitbox-wallet-app/backend/handlers"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/config"
 	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
@@ -51,6 +52,10 @@ import (
 	"github.com/digitalbitbox/bitbox-wallet-app/util/random"
 )
 
+// eventsBufferSize is the number of events buffered for the frontend.
+const eventsBufferSize = 1000
+
+var theBackend *backend.Backend
 var handlers *backendHandlers.Handlers
 var responseCallback C.responseCallback
 var token string
@@ -120,12 +125,15 @@ func serve(pushNotificationsCallback C.pushNotificationsCallback, theResponseCal
 	if err != nil {
 		log.WithError(err).Fatal("Failed to generate random string")
 	}
-	theBackend := backend.NewBackend(arguments.NewArguments(
-		config.AppDir(), *testnet, false, false, false))
-	events := theBackend.Events()
+	theBackend, err = backend.NewBackend(arguments.NewArguments(
+		config.AppDir(), *testnet, false, false, false, false))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create the backend")
+	}
+	subscription := theBackend.Events().Subscribe(events.Filter{}, 0, eventsBufferSize)
 	go func() {
-		for {
-			C.pushNotify(pushNotificationsCallback, C.CString(string(jsonp.MustMarshal(<-events))))
+		for event := range subscription.Events() {
+			C.pushNotify(pushNotificationsCallback, C.CString(string(jsonp.MustMarshal(event))))
 		}
 	}()
 	// the port is unused in the Qt app, as we bridge directly without a server.
@@ -133,6 +141,13 @@ func serve(pushNotificationsCallback C.pushNotificationsCallback, theResponseCal
 	handlers = backendHandlers.NewHandlers(theBackend, backendHandlers.NewConnectionData(port, token))
 }
 
+//export shutdown
+func shutdown() {
+	if theBackend != nil {
+		theBackend.Close()
+	}
+}
+
 // Don't remove - needed for the C compilation.
 func main() {
 }
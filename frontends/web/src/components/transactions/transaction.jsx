@@ -72,6 +72,7 @@ export default class Transaction extends Component {
         numConfirmations,
         time,
         addresses,
+        conflicted,
     }, {
         collapsed,
     }) {
@@ -80,6 +81,7 @@ export default class Transaction extends Component {
         const sign = ((type === 'send') && '−') || ((type === 'receive') && '+') || null;
         const date = time ? this.parseTime(time) : (numConfirmations <= 0 ? t('transaction.pending') : 'Time not yet available');
         const sDate = time ? this.parseTimeShort(time) : (numConfirmations <= 0 ? t('transaction.pending') : 'Time not yet available');
+        const status = conflicted ? t('transaction.conflicted') : null;
         return (
             <div class={[style.transactionContainer, collapsed ? style.collapsed : style.expanded].join(' ')}>
                 <div class={['flex flex-column flex-start', style.transaction].join(' ')}>
@@ -96,8 +98,8 @@ export default class Transaction extends Component {
                             </div>
                             <div>
                                 <div class={style.date}>
-                                    <span>{date}</span>
-                                    <span>{sDate}</span>
+                                    <span>{status || date}</span>
+                                    <span>{status || sDate}</span>
                                 </div>
                                 <div class={[style.address, style.multiline].join(' ')}>{addresses.join(', ')}</div>
                             </div>
@@ -20,13 +20,22 @@ import { translate, TranslateProps } from '../../decorators/translate';
 import A from '../anchor/anchor';
 import Status from '../status/status';
 
+interface Download {
+    url: string;
+    sha256: string;
+}
+
 /**
- * Describes the file that is loaded from 'https://shiftcrypto.ch/updates/desktop.json'.
+ * Describes the newer release found in the signed manifest 'https://shiftcrypto.ch/updates/desktop.json'.
  */
 interface File {
     current: string;
     version: string;
     description: string;
+    releaseNotes: string;
+    channel: 'stable' | 'beta';
+    download?: Download;
+    downloads: { [platform: string]: Download };
 }
 
 interface LoadedProps {
@@ -47,6 +47,7 @@ export default class Account extends Component {
         determiningStatus: false,
         initialized: false,
         connected: false,
+        syncError: null,
         transactions: [],
         balance: null,
         hasCard: false,
@@ -132,6 +133,13 @@ export default class Account extends Component {
                     this.setState({ accountInfo });
                 });
             }
+            if (status.includes('accountError')) {
+                apiGet(`account/${code}/sync-error`).then(syncError => {
+                    this.setState({ syncError });
+                });
+            } else {
+                state.syncError = null;
+            }
 
             this.setState(state);
             this.onAccountChanged();
@@ -144,7 +152,7 @@ export default class Account extends Component {
             apiGet(`account/${this.props.code}/balance`).then(balance => {
                 this.setState({ balance });
             });
-            apiGet(`account/${this.props.code}/transactions`).then(transactions => {
+            apiGet(`account/${this.props.code}/transactions`).then(({ transactions }) => {
                 this.setState({ transactions });
             });
         } else {
@@ -181,6 +189,7 @@ export default class Account extends Component {
         transactions,
         initialized,
         connected,
+        syncError,
         determiningStatus,
         balance,
         hasCard,
@@ -203,6 +212,13 @@ export default class Account extends Component {
                             </Status>
                         ) : null
                     }
+                    {
+                        syncError ? (
+                            <Status>
+                                <p>{t('account.syncError', { error: syncError })}</p>
+                            </Status>
+                        ) : null
+                    }
                     <Header
                         title={
                             <h2 className={componentStyle.title}>
@@ -16,9 +16,10 @@ package config
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
 )
 
 // File models a config file in the application's directory.
@@ -26,6 +27,7 @@ import (
 type File struct {
 	dir  string
 	name string
+	key  *encryption.Key
 }
 
 // NewFile creates a new config file with the given name in a directory dir.
@@ -33,6 +35,12 @@ func NewFile(dir, name string) *File {
 	return &File{dir: dir, name: name}
 }
 
+// NewEncryptedFile creates a new config file like NewFile, which is encrypted with the given key. A
+// nil key stores the file in plaintext.
+func NewEncryptedFile(dir, name string, key *encryption.Key) *File {
+	return &File{dir: dir, name: name, key: key}
+}
+
 // Path returns the absolute path to the config file.
 func (file *File) Path() string {
 	return filepath.Join(file.dir, file.name)
@@ -51,7 +59,7 @@ func (file *File) Remove() error {
 
 // read reads the config file and returns its data (or an error if the config file does not exist).
 func (file *File) read() ([]byte, error) {
-	return ioutil.ReadFile(file.Path())
+	return encryption.ReadFile(file.Path(), file.key)
 }
 
 // ReadJSON reads the config file as JSON to the given object. Make sure the config file exists!
@@ -68,7 +76,7 @@ func (file *File) write(data []byte) error {
 	if err := os.MkdirAll(file.dir, 0700); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(file.Path(), data, 0600)
+	return encryption.WriteFile(file.Path(), data, 0600, file.key)
 }
 
 // WriteJSON writes the given object as JSON to the config file.
@@ -0,0 +1,106 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dbschema versions the schema of bbolt databases and migrates them to the current schema.
+package dbschema
+
+import (
+	"encoding/binary"
+
+	bbolt "github.com/coreos/bbolt"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+const (
+	// bucketMetadata holds the schema version of the database.
+	bucketMetadata = "metadata"
+	keyVersion     = "version"
+)
+
+// Migration migrates the database from one schema version to the next. It runs in the same db
+// transaction which stores the new version, so it is either applied completely or not at all. A
+// migration must also work on a new, empty database.
+type Migration func(tx *bbolt.Tx) error
+
+// ErrNewerVersion is returned by Migrate if the database was written by a newer version of the
+// app.
+var ErrNewerVersion = errp.New("the database was written by a newer version of the app")
+
+// Version returns the schema version of the database. Databases which were created before the
+// version was stored have the version 0.
+func Version(tx *bbolt.Tx, key *encryption.Key) (int, error) {
+	bucket := tx.Bucket([]byte(bucketMetadata))
+	if bucket == nil {
+		return 0, nil
+	}
+	value, err := encryption.NewBucket(bucket, bucketMetadata, key).Get([]byte(keyVersion))
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return 0, nil
+	}
+	version, n := binary.Uvarint(value)
+	if n <= 0 {
+		return 0, errp.New("invalid schema version")
+	}
+	return int(version), nil
+}
+
+func putVersion(tx *bbolt.Tx, key *encryption.Key, version int) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketMetadata))
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	value := make([]byte, binary.MaxVarintLen64)
+	value = value[:binary.PutUvarint(value, uint64(version))]
+	return encryption.NewBucket(bucket, bucketMetadata, key).Put([]byte(keyVersion), value)
+}
+
+// Migrate brings the database to the schema version len(migrations). The database of version i is
+// migrated by migrations[i]. Each migration runs in its own db transaction, so that an interrupted
+// migration resumes where it stopped the next time the database is opened. The metadata is
+// encrypted with the key, unless it is nil.
+func Migrate(db *bbolt.DB, key *encryption.Key, migrations []Migration) error {
+	for {
+		done := false
+		err := db.Update(func(tx *bbolt.Tx) error {
+			version, err := Version(tx, key)
+			if err != nil {
+				return err
+			}
+			if version > len(migrations) {
+				return ErrNewerVersion
+			}
+			if version == len(migrations) {
+				done = true
+				if tx.Bucket([]byte(bucketMetadata)) != nil {
+					return nil
+				}
+				return putVersion(tx, key, version)
+			}
+			if err := migrations[version](tx); err != nil {
+				return errp.WithMessage(err, "could not migrate the database")
+			}
+			return putVersion(tx, key, version+1)
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
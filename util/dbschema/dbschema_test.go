@@ -0,0 +1,87 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbschema_test
+
+import (
+	"testing"
+
+	bbolt "github.com/coreos/bbolt"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/dbschema"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func version(t *testing.T, db *bbolt.DB, key *encryption.Key) int {
+	t.Helper()
+	var version int
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		var err error
+		version, err = dbschema.Version(tx, key)
+		return err
+	}))
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	key := encryption.NewKey([]byte("secret"))
+	db, err := encryption.OpenDB(test.TstTempFile("dbschema_test"), key)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.Equal(t, 0, version(t, db, key))
+
+	applied := []string{}
+	migration := func(name string) dbschema.Migration {
+		return func(tx *bbolt.Tx) error {
+			applied = append(applied, name)
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			return errp.WithStack(err)
+		}
+	}
+	failing := func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("partial"))
+		require.NoError(t, err)
+		return errp.New("failed")
+	}
+
+	// A failed migration is rolled back, the previous ones are kept.
+	require.Error(t, dbschema.Migrate(db, key, []dbschema.Migration{migration("first"), failing}))
+	require.Equal(t, []string{"first"}, applied)
+	require.Equal(t, 1, version(t, db, key))
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte("partial")))
+		return nil
+	}))
+
+	require.NoError(t, dbschema.Migrate(db, key,
+		[]dbschema.Migration{migration("first"), migration("second"), migration("third")}))
+	require.Equal(t, []string{"first", "second", "third"}, applied)
+	require.Equal(t, 3, version(t, db, key))
+
+	require.Equal(t, dbschema.ErrNewerVersion, dbschema.Migrate(db, key, []dbschema.Migration{}))
+}
+
+func TestMigrateNew(t *testing.T) {
+	db, err := encryption.OpenDB(test.TstTempFile("dbschema_test"), nil)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.NoError(t, dbschema.Migrate(db, nil, []dbschema.Migration{}))
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		require.NotNil(t, tx.Bucket([]byte("metadata")))
+		return nil
+	}))
+	require.Equal(t, 0, version(t, db, nil))
+}
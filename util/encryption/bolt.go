@@ -0,0 +1,255 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"os"
+	"time"
+
+	bbolt "github.com/coreos/bbolt"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+const (
+	// bucketEncryption marks an encrypted database and stores the check value of its key.
+	bucketEncryption = "encryption"
+	checkKey         = "check"
+)
+
+// OpenDB opens the bbolt database. If the key is not nil, the entries of the buckets accessed
+// through Bucket are encrypted. It returns ErrLocked if the database is encrypted and the key is
+// nil, ErrWrongKey if it is encrypted with a different key, and ErrPlaintext if it is opened with a
+// key but holds plaintext entries, see EncryptDB.
+func OpenDB(filename string, key *Key) (*bbolt.DB, error) {
+	db, err := bbolt.Open(filename, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(bucketEncryption)); bucket != nil {
+			if key == nil {
+				return ErrLocked
+			}
+			if !hmac.Equal(bucket.Get([]byte(checkKey)), key.check()) {
+				return ErrWrongKey
+			}
+			return nil
+		}
+		if key == nil {
+			return nil
+		}
+		empty := true
+		if err := tx.ForEach(func([]byte, *bbolt.Bucket) error {
+			empty = false
+			return nil
+		}); err != nil {
+			return errp.WithStack(err)
+		}
+		if !empty {
+			return ErrPlaintext
+		}
+		return markEncrypted(tx, key)
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// markEncrypted stores the check value of the key, by which OpenDB recognizes the database as
+// encrypted.
+func markEncrypted(tx *bbolt.Tx, key *Key) error {
+	bucket, err := tx.CreateBucket([]byte(bucketEncryption))
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	return errp.WithStack(bucket.Put([]byte(checkKey), key.check()))
+}
+
+// EncryptDB replaces a plaintext database by a copy whose entries are encrypted with the key. The
+// copy is written to a new file, as the plaintext would remain in the free pages of the database if
+// it was encrypted in place. Databases which do not exist or are already encrypted are left as they
+// are. The database must not be open.
+func EncryptDB(filename string, key *Key) error {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	source, err := bbolt.Open(filename, 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	defer func() { _ = source.Close() }()
+	encrypted := false
+	if err := source.View(func(tx *bbolt.Tx) error {
+		encrypted = tx.Bucket([]byte(bucketEncryption)) != nil
+		return nil
+	}); err != nil {
+		return errp.WithStack(err)
+	}
+	if encrypted {
+		return nil
+	}
+	copyFilename := filename + ".encrypted"
+	if err := os.Remove(copyFilename); err != nil && !os.IsNotExist(err) {
+		return errp.WithStack(err)
+	}
+	target, err := bbolt.Open(copyFilename, 0600, nil)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	err = source.View(func(sourceTx *bbolt.Tx) error {
+		return target.Update(func(targetTx *bbolt.Tx) error {
+			if err := sourceTx.ForEach(func(name []byte, bucket *bbolt.Bucket) error {
+				targetBucket, err := targetTx.CreateBucket(name)
+				if err != nil {
+					return errp.WithStack(err)
+				}
+				return copyBucket(bucket, targetBucket, string(name), key)
+			}); err != nil {
+				return err
+			}
+			return markEncrypted(targetTx, key)
+		})
+	})
+	if closeErr := target.Close(); err == nil {
+		err = errp.WithStack(closeErr)
+	}
+	if err != nil {
+		_ = os.Remove(copyFilename)
+		return err
+	}
+	if err := source.Close(); err != nil {
+		return errp.WithStack(err)
+	}
+	return errp.WithStack(os.Rename(copyFilename, filename))
+}
+
+// copyBucket encrypts the entries of the plaintext bucket and of its nested buckets into the target
+// bucket.
+func copyBucket(source *bbolt.Bucket, target *bbolt.Bucket, name string, key *Key) error {
+	encrypted := NewBucket(target, name, key)
+	return source.ForEach(func(entryKey []byte, value []byte) error {
+		if value == nil {
+			if nested := source.Bucket(entryKey); nested != nil {
+				targetNested, err := target.CreateBucket(entryKey)
+				if err != nil {
+					return errp.WithStack(err)
+				}
+				return copyBucket(nested, targetNested, name+"/"+string(entryKey), key)
+			}
+		}
+		return encrypted.Put(entryKey, value)
+	})
+}
+
+// Bucket encrypts the entries of a bbolt bucket. The keys are stored as a MAC, and the values are
+// stored encrypted together with their key and the name of the bucket, so that the entries can be
+// iterated and cannot be moved to another bucket. The iteration order is thus not the order of the
+// keys. With a nil key, the entries are stored in plaintext.
+type Bucket struct {
+	bucket *bbolt.Bucket
+	name   []byte
+	key    *Key
+}
+
+// NewBucket wraps the given bucket. The name identifies the bucket in the database; the names of
+// nested buckets are prefixed by the names of their parents, separated by "/". The key may be nil.
+func NewBucket(bucket *bbolt.Bucket, name string, key *Key) *Bucket {
+	return &Bucket{bucket: bucket, name: []byte(name), key: key}
+}
+
+// seal encrypts the value together with the bucket name and its key.
+func (bucket *Bucket) seal(entryKey []byte, value []byte) ([]byte, error) {
+	plaintext := appendLengthPrefixed(nil, bucket.name)
+	plaintext = appendLengthPrefixed(plaintext, entryKey)
+	return bucket.key.Encrypt(append(plaintext, value...))
+}
+
+// open decrypts an entry stored by seal.
+func (bucket *Bucket) open(sealed []byte) ([]byte, []byte, error) {
+	plaintext, err := bucket.key.Decrypt(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, rest, err := splitLengthPrefixed(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(name, bucket.name) {
+		return nil, nil, errp.Newf("the entry belongs to the bucket %q instead of %q", name, bucket.name)
+	}
+	return splitLengthPrefixed(rest)
+}
+
+// splitLengthPrefixed splits the data appended by appendLengthPrefixed from the rest.
+func splitLengthPrefixed(buffer []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(buffer)
+	if n <= 0 || uint64(len(buffer)-n) < length {
+		return nil, nil, errp.New("invalid encrypted entry")
+	}
+	return buffer[n : n+int(length)], buffer[n+int(length):], nil
+}
+
+// Get returns the value of the key, or nil if there is none.
+func (bucket *Bucket) Get(entryKey []byte) ([]byte, error) {
+	if bucket.key == nil {
+		return bucket.bucket.Get(entryKey), nil
+	}
+	sealed := bucket.bucket.Get(bucket.key.index(bucket.name, entryKey))
+	if sealed == nil {
+		return nil, nil
+	}
+	_, value, err := bucket.open(sealed)
+	return value, err
+}
+
+// Put sets the value of the key.
+func (bucket *Bucket) Put(entryKey []byte, value []byte) error {
+	if bucket.key == nil {
+		return bucket.bucket.Put(entryKey, value)
+	}
+	sealed, err := bucket.seal(entryKey, value)
+	if err != nil {
+		return err
+	}
+	return bucket.bucket.Put(bucket.key.index(bucket.name, entryKey), sealed)
+}
+
+// Delete removes the key.
+func (bucket *Bucket) Delete(entryKey []byte) error {
+	if bucket.key == nil {
+		return bucket.bucket.Delete(entryKey)
+	}
+	return bucket.bucket.Delete(bucket.key.index(bucket.name, entryKey))
+}
+
+// ForEach calls the function with every entry of the bucket. The bucket must not be modified by the
+// function.
+func (bucket *Bucket) ForEach(f func(entryKey []byte, value []byte) error) error {
+	if bucket.key == nil {
+		return bucket.bucket.ForEach(f)
+	}
+	return bucket.bucket.ForEach(func(_ []byte, sealed []byte) error {
+		entryKey, value, err := bucket.open(sealed)
+		if err != nil {
+			return err
+		}
+		return f(entryKey, value)
+	})
+}
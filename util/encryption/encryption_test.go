@@ -0,0 +1,166 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	bbolt "github.com/coreos/bbolt"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/encryption"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordKey(t *testing.T) {
+	_, _, err := encryption.NewPasswordKey("")
+	require.Error(t, err)
+	passwordKey, key, err := encryption.NewPasswordKey("password")
+	require.NoError(t, err)
+	unlocked, err := passwordKey.Unlock("password")
+	require.NoError(t, err)
+	require.Equal(t, key, unlocked)
+	_, err = passwordKey.Unlock("wrong")
+	require.Equal(t, encryption.ErrWrongPassword, err)
+}
+
+func TestFile(t *testing.T) {
+	filename := test.TstTempFile("encryption_test")
+	key := encryption.NewKey([]byte("secret"))
+
+	// Plaintext files are only read without a key.
+	require.NoError(t, encryption.WriteFile(filename, []byte(`{"a":1}`), 0600, nil))
+	data, err := encryption.ReadFile(filename, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"a":1}`), data)
+	_, err = encryption.ReadFile(filename, key)
+	require.Equal(t, encryption.ErrPlaintext, err)
+
+	require.NoError(t, encryption.EncryptFile(filename, key))
+	data, err = encryption.ReadFile(filename, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"a":1}`), data)
+	// Encrypted and missing files are left as they are.
+	require.NoError(t, encryption.EncryptFile(filename, encryption.NewKey([]byte("other"))))
+	require.NoError(t, encryption.EncryptFile(filename+".missing", key))
+	_, err = os.Stat(filename + ".missing")
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, encryption.WriteFile(filename, []byte(`{"a":2}`), 0600, key))
+	raw, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.True(t, encryption.IsEncrypted(raw))
+	require.False(t, bytes.Contains(raw, []byte(`"a"`)))
+	data, err = encryption.ReadFile(filename, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"a":2}`), data)
+	_, err = encryption.ReadFile(filename, nil)
+	require.Equal(t, encryption.ErrLocked, err)
+	_, err = encryption.ReadFile(filename, encryption.NewKey([]byte("other")))
+	require.Equal(t, encryption.ErrWrongKey, err)
+}
+
+func put(t *testing.T, db *bbolt.DB, key *encryption.Key, entryKey string, value string) {
+	t.Helper()
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("outer"))
+		require.NoError(t, err)
+		nested, err := bucket.CreateBucketIfNotExists([]byte("nested"))
+		require.NoError(t, err)
+		return encryption.NewBucket(nested, "outer/nested", key).Put([]byte(entryKey), []byte(value))
+	}))
+}
+
+func entries(t *testing.T, db *bbolt.DB, key *encryption.Key) map[string]string {
+	t.Helper()
+	result := map[string]string{}
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		bucket := encryption.NewBucket(
+			tx.Bucket([]byte("outer")).Bucket([]byte("nested")), "outer/nested", key)
+		value, err := bucket.Get([]byte("address"))
+		require.NoError(t, err)
+		require.Equal(t, "history", string(value))
+		return bucket.ForEach(func(entryKey []byte, value []byte) error {
+			result[string(entryKey)] = string(value)
+			return nil
+		})
+	}))
+	return result
+}
+
+func TestOpenDB(t *testing.T) {
+	filename := test.TstTempFile("encryption_test_db")
+	key := encryption.NewKey([]byte("secret"))
+
+	db, err := encryption.OpenDB(filename, nil)
+	require.NoError(t, err)
+	put(t, db, nil, "address", "history")
+	require.NoError(t, db.Close())
+
+	// The plaintext database is rejected with a key until it is encrypted.
+	_, err = encryption.OpenDB(filename, key)
+	require.Equal(t, encryption.ErrPlaintext, err)
+	require.NoError(t, encryption.EncryptDB(filename, key))
+	require.NoError(t, encryption.EncryptDB(filename, encryption.NewKey([]byte("other"))))
+	require.NoError(t, encryption.EncryptDB(filename+".missing", key))
+	_, err = os.Stat(filename + ".missing")
+	require.True(t, os.IsNotExist(err))
+
+	raw, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, []byte("address")))
+	require.False(t, bytes.Contains(raw, []byte("history")))
+
+	db, err = encryption.OpenDB(filename, key)
+	require.NoError(t, err)
+	put(t, db, key, "txid", "")
+	require.Equal(t, map[string]string{"address": "history", "txid": ""}, entries(t, db, key))
+	require.NoError(t, db.Close())
+
+	_, err = encryption.OpenDB(filename, nil)
+	require.Equal(t, encryption.ErrLocked, err)
+	_, err = encryption.OpenDB(filename, encryption.NewKey([]byte("other")))
+	require.Equal(t, encryption.ErrWrongKey, err)
+
+	db, err = encryption.OpenDB(filename, key)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		return encryption.NewBucket(
+			tx.Bucket([]byte("outer")).Bucket([]byte("nested")), "outer/nested", key).
+			Delete([]byte("txid"))
+	}))
+	require.Equal(t, map[string]string{"address": "history"}, entries(t, db, key))
+
+	// Entries moved to another bucket are rejected.
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		nested := tx.Bucket([]byte("outer")).Bucket([]byte("nested"))
+		other, err := tx.CreateBucket([]byte("other"))
+		require.NoError(t, err)
+		return nested.ForEach(func(entryKey []byte, value []byte) error {
+			return other.Put(entryKey, value)
+		})
+	}))
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		other := encryption.NewBucket(tx.Bucket([]byte("other")), "other", key)
+		value, err := other.Get([]byte("address"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+		require.Error(t, other.ForEach(func([]byte, []byte) error { return nil }))
+		return nil
+	}))
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+)
+
+// fileMagic prefixes encrypted files. The stored files are JSON, so plaintext files never start
+// with it.
+var fileMagic = []byte("bitbox-encrypted-v1:")
+
+// IsEncrypted returns whether the given file contents are encrypted.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, fileMagic)
+}
+
+// ReadFile reads the file and decrypts it if it is encrypted, see DecodeFile.
+func ReadFile(filename string, key *Key) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeFile(data, key)
+}
+
+// DecodeFile decrypts the file contents if they are encrypted. Plaintext files are returned as they
+// are if the key is nil. It returns ErrLocked if the file is encrypted and the key is nil, and
+// ErrPlaintext if the file is not encrypted but the key is not nil, see EncryptFile.
+func DecodeFile(data []byte, key *Key) ([]byte, error) {
+	if !IsEncrypted(data) {
+		if key != nil {
+			return nil, ErrPlaintext
+		}
+		return data, nil
+	}
+	if key == nil {
+		return nil, ErrLocked
+	}
+	return key.Decrypt(data[len(fileMagic):])
+}
+
+// WriteFile writes the data to the file, encrypted if the key is not nil.
+func WriteFile(filename string, data []byte, perm os.FileMode, key *Key) error {
+	data, err := EncodeFile(data, key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, perm)
+}
+
+// EncodeFile returns the file contents for the data, encrypted if the key is not nil.
+func EncodeFile(data []byte, key *Key) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	encrypted, err := key.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, fileMagic...), encrypted...), nil
+}
+
+// EncryptFile replaces a plaintext file, which was written before the encryption was enabled, by
+// its encryption with the key. Files which do not exist or are already encrypted are left as they
+// are.
+func EncryptFile(filename string, key *Key) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if IsEncrypted(data) {
+		return nil
+	}
+	data, err = EncodeFile(data, key)
+	if err != nil {
+		return err
+	}
+	encryptedFilename := filename + ".encrypted"
+	file, err := os.OpenFile(encryptedFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Close(); err != nil {
+		return errp.WithStack(err)
+	}
+	return errp.WithStack(os.Rename(encryptedFilename, filename))
+}
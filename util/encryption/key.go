@@ -0,0 +1,163 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryption encrypts the databases and config files which the app stores at rest. A nil
+// *Key stands for no encryption, so that the stores work the same with and without it.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/crypto"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/errp"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/random"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	saltSize = 32
+
+	// The scrypt parameters recommended for interactive logins.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	// ErrLocked is returned when encrypted data is read without a key.
+	ErrLocked = errp.New("the data is encrypted and no key is available")
+
+	// ErrWrongKey is returned when encrypted data is read with a different key.
+	ErrWrongKey = errp.New("the data is encrypted with a different key")
+
+	// ErrPlaintext is returned when plaintext data is read with a key. The data written before the
+	// encryption was enabled is encrypted once when it is enabled, so that plaintext data which
+	// appears later cannot be trusted.
+	ErrPlaintext = errp.New("the data is not encrypted")
+
+	// ErrWrongPassword is returned when the key is unlocked with a wrong password.
+	ErrWrongPassword = errp.New("wrong password")
+)
+
+// Key encrypts the values and hides the database keys of the stores.
+type Key struct {
+	encryptionKey     []byte
+	authenticationKey []byte
+	indexKey          []byte
+	checkKey          []byte
+}
+
+func derive(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// NewKey derives the key from the given secret.
+func NewKey(secret []byte) *Key {
+	return &Key{
+		encryptionKey:     derive(secret, "encryption"),
+		authenticationKey: derive(secret, "authentication"),
+		indexKey:          derive(secret, "index"),
+		checkKey:          derive(secret, "check"),
+	}
+}
+
+// check returns a value by which the stores recognize the key they are encrypted with.
+func (key *Key) check() []byte {
+	return derive(key.checkKey, "check")
+}
+
+// index maps a database key to the key under which its entry is stored, so that the database keys,
+// which are addresses, transaction IDs and outpoints, are not stored in plaintext. The bucket name
+// is included so that the same database key maps to different entries in different buckets.
+func (key *Key) index(bucketName []byte, dbKey []byte) []byte {
+	mac := hmac.New(sha256.New, key.indexKey)
+	_, _ = mac.Write(appendLengthPrefixed(nil, bucketName))
+	_, _ = mac.Write(dbKey)
+	return mac.Sum(nil)
+}
+
+// appendLengthPrefixed appends the length of the data as an uvarint followed by the data.
+func appendLengthPrefixed(buffer []byte, data []byte) []byte {
+	length := make([]byte, binary.MaxVarintLen64)
+	buffer = append(buffer, length[:binary.PutUvarint(length, uint64(len(data)))]...)
+	return append(buffer, data...)
+}
+
+// Encrypt encrypts and authenticates the given plaintext.
+func (key *Key) Encrypt(plaintext []byte) ([]byte, error) {
+	return crypto.EncryptThenMAC(plaintext, key.encryptionKey, key.authenticationKey)
+}
+
+// Decrypt authenticates and decrypts the given ciphertext. It does not modify the ciphertext, which
+// may be read-only memory of a database.
+func (key *Key) Decrypt(ciphertext []byte) ([]byte, error) {
+	// IV, at least one block and the MAC.
+	if len(ciphertext) < 2*aes.BlockSize+sha256.Size {
+		return nil, errp.New("the ciphertext is too short")
+	}
+	plaintext, err := crypto.MACThenDecrypt(
+		append([]byte{}, ciphertext...), key.encryptionKey, key.authenticationKey)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return plaintext, nil
+}
+
+// PasswordKey stores how the key is derived from the password of the user. It does not contain any
+// secret and is stored next to the encrypted data.
+type PasswordKey struct {
+	Salt  []byte `json:"salt"`
+	Check []byte `json:"check"`
+}
+
+func passwordSecret(password string, salt []byte) ([]byte, error) {
+	secret, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return secret, nil
+}
+
+// NewPasswordKey derives a new key from the given password with a random salt.
+func NewPasswordKey(password string) (*PasswordKey, *Key, error) {
+	if password == "" {
+		return nil, nil, errp.New("the password must not be empty")
+	}
+	salt := random.BytesOrPanic(saltSize)
+	secret, err := passwordSecret(password, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := NewKey(secret)
+	return &PasswordKey{Salt: salt, Check: key.check()}, key, nil
+}
+
+// Unlock derives the key from the given password. It returns ErrWrongPassword if the password is
+// not the one the key was created with.
+func (passwordKey *PasswordKey) Unlock(password string) (*Key, error) {
+	secret, err := passwordSecret(password, passwordKey.Salt)
+	if err != nil {
+		return nil, err
+	}
+	key := NewKey(secret)
+	if !hmac.Equal(key.check(), passwordKey.Check) {
+		return nil, ErrWrongPassword
+	}
+	return key, nil
+}
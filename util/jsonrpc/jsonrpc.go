@@ -16,6 +16,8 @@ package jsonrpc
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -86,11 +88,14 @@ type heartBeat struct {
 // RPCClient is a generic json rpc client, which is able to invoke remote methods and subscribe to
 // remote notifications.
 type RPCClient struct {
-	connection *connection
-	connLock   locker.Locker
+	// connection is the active connection, nil if there is none. It is guarded by connectionLock.
+	connection     *connection
+	connectionLock locker.Locker
+	// connLock serializes establishing a new connection and closing the client.
+	connLock locker.Locker
 
-	backends     []rpc.Backend
-	backendsLock locker.Locker
+	// backends returns the backends in the order in which connecting to them is attempted.
+	backends func() []rpc.Backend
 
 	pendingRequests     map[int]*request
 	pendingRequestsLock locker.Locker
@@ -104,7 +109,8 @@ type RPCClient struct {
 	retryLock locker.Locker
 
 	status                              rpc.Status
-	onConnectionStatusChangesNotify     []func(rpc.Status)
+	onConnectionStatusChangesNotify     map[int]func(rpc.Status)
+	onConnectionStatusChangesNotifyID   int
 	onConnectionStatusChangesNotifyLock locker.Locker
 
 	onConnectCallback func() error
@@ -112,25 +118,52 @@ type RPCClient struct {
 
 	msgID     int
 	msgIDLock sync.Mutex
-	close     bool
 
-	notificationsCallbacks     map[string][]func([]byte)
+	// ctx is cancelled when the client is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// goroutines tracks the goroutines of the client, so that Close can wait for them.
+	goroutines     sync.WaitGroup
+	goroutinesLock locker.Locker
+
+	notificationsCallbacks     map[string]map[int]func([]byte)
+	notificationsCallbacksID   int
 	notificationsCallbacksLock locker.Locker
 
-	log *logrus.Entry
+	// log is extended by the current backend. It is guarded by logLock.
+	log     *logrus.Entry
+	logLock locker.Locker
 }
 
 // NewRPCClient creates a new RPCClient. conn is used for transport (e.g. a tcp/tls connection).
+// The backends are tried starting at a random one, to balance the load between multiple backends
+// for multiple desktop applications.
 func NewRPCClient(backends []rpc.Backend, log *logrus.Entry) *RPCClient {
+	return NewRPCClientWithBackends(func() []rpc.Backend {
+		if len(backends) == 0 {
+			return nil
+		}
+		start := rand.Intn(len(backends))
+		ordered := append([]rpc.Backend{}, backends[start:]...)
+		return append(ordered, backends[:start]...)
+	}, log)
+}
+
+// NewRPCClientWithBackends creates a new RPCClient. backends is called whenever a new connection is
+// needed and returns the backends in the order in which they are tried.
+func NewRPCClientWithBackends(backends func() []rpc.Backend, log *logrus.Entry) *RPCClient {
+	ctx, cancel := context.WithCancel(context.Background())
 	client := &RPCClient{
 		backends:                        backends,
 		msgID:                           0,
 		status:                          rpc.CONNECTED,
-		onConnectionStatusChangesNotify: []func(rpc.Status){},
+		onConnectionStatusChangesNotify: map[int]func(rpc.Status){},
 		pendingRequests:                 map[int]*request{},
 		pingRequests:                    map[int]bool{},
 		subscriptionRequests:            []*request{},
-		notificationsCallbacks:          map[string][]func([]byte){},
+		ctx:                             ctx,
+		cancel:                          cancel,
+		notificationsCallbacks:          map[string]map[int]func([]byte){},
 		log:                             log,
 	}
 	return client
@@ -144,18 +177,35 @@ func (client *RPCClient) ConnectionStatus() rpc.Status {
 	return rpc.CONNECTED
 }
 
-// RegisterOnConnectionStatusChangedEvent registers an event that is fired if the connection status changes.
-// After registration it fires the event to notify the holder of the callback about the current status.
-// TODO: eventually return a de-register method that deletes the callback. Will be required once we
-// allow the user to manage their accounts fully.
-func (client *RPCClient) RegisterOnConnectionStatusChangedEvent(onConnectionStatusChangedEvent func(rpc.Status)) {
+// RegisterOnConnectionStatusChangedEvent registers an event that is fired if the connection status
+// changes. The returned function deregisters the callback again.
+func (client *RPCClient) RegisterOnConnectionStatusChangedEvent(onConnectionStatusChangedEvent func(rpc.Status)) func() {
 	defer client.onConnectionStatusChangesNotifyLock.Lock()()
-	client.onConnectionStatusChangesNotify = append(client.onConnectionStatusChangesNotify, onConnectionStatusChangedEvent)
+	id := client.onConnectionStatusChangesNotifyID
+	client.onConnectionStatusChangesNotifyID++
+	client.onConnectionStatusChangesNotify[id] = onConnectionStatusChangedEvent
+	return func() {
+		defer client.onConnectionStatusChangesNotifyLock.Lock()()
+		delete(client.onConnectionStatusChangesNotify, id)
+	}
+}
+
+// spawn runs f in a goroutine which Close waits for. Nothing is started once the client is closed.
+func (client *RPCClient) spawn(f func()) {
+	defer client.goroutinesLock.Lock()()
+	if client.IsClosed() {
+		return
+	}
+	client.goroutines.Add(1)
+	go func() {
+		defer client.goroutines.Done()
+		f()
+	}()
 }
 
 func (client *RPCClient) requeueSubscriptions() {
 	defer client.subscriptionRequestsLock.Lock()()
-	client.log.Debugf("Got %v subscriptions that need to be resubscribed", len(client.subscriptionRequests))
+	client.logger().Debugf("Got %v subscriptions that need to be resubscribed", len(client.subscriptionRequests))
 	for _, r := range client.subscriptionRequests {
 		client.prepare(r.responseCallbacks.success, r.responseCallbacks.setupAndTeardown, r.method, r.params...)
 	}
@@ -163,17 +213,28 @@ func (client *RPCClient) requeueSubscriptions() {
 }
 
 func (client *RPCClient) resendPendingRequests() {
-	defer client.pendingRequestsLock.RLock()()
-	client.log.Debugf("Queueing %v pending requests to resend.", len(client.pendingRequests))
+	pendingRequests := func() []*request {
+		defer client.pendingRequestsLock.RLock()()
+		requests := make([]*request, 0, len(client.pendingRequests))
+		for _, request := range client.pendingRequests {
+			requests = append(requests, request)
+		}
+		return requests
+	}()
+	client.logger().Debugf("Queueing %v pending requests to resend.", len(pendingRequests))
 	// This needs to be executed in a go-routine so that it doesn't block if the connection fails
 	// and a failover is initiated.
-	go func() {
-		for _, request := range client.pendingRequests {
+	client.spawn(func() {
+		for _, request := range pendingRequests {
 			err := client.send(request.jsonText)
 			if err != nil {
 				wait := time.Minute / 4
-				client.log.Debugf("Resending failed. Waiting for %v", wait)
-				time.Sleep(wait)
+				client.logger().Debugf("Resending failed. Waiting for %v", wait)
+				select {
+				case <-client.ctx.Done():
+					return
+				case <-time.After(wait):
+				}
 				// Resend again to collect all the subscriptions that were successfully registered
 				// on the now-failed connection.
 				client.resendPendingRequestsAndSubscriptions(err.connection)
@@ -181,26 +242,33 @@ func (client *RPCClient) resendPendingRequests() {
 				return
 			}
 		}
-	}()
+	})
 }
 
 // resendPendingRequestsAndSubscriptions tries to re-subscribe to all subscriptions associated with the given
 // connection and tries to issue pending methods via another connection.
 func (client *RPCClient) resendPendingRequestsAndSubscriptions(failed *connection) {
+	if client.IsClosed() {
+		return
+	}
 	alreadyHandled := func() bool {
 		defer client.retryLock.Lock()()
-		return client.connection != failed
+		defer client.connectionLock.Lock()()
+		if client.connection != failed {
+			return true
+		}
+		client.connection = nil
+		return false
 	}
 	if alreadyHandled() {
 		return
 	}
-	client.connection = nil
 	if failed != nil {
-		client.log.Debugf("Backend %v failed. Trying to re-subscribe and send pending requests via another connection", failed.backend.ServerInfo().Server)
+		client.logger().Debugf("Backend %v failed. Trying to re-subscribe and send pending requests via another connection", failed.backend.ServerInfo().Server)
 	} else {
 		// in case socket error does not have any information about the connection, for example
 		// when a timeout happens in the MethodSync function
-		client.log.Debugf("Last backend failed. Trying to re-subscribe and send pending requests via another connection")
+		client.logger().Debugf("Last backend failed. Trying to re-subscribe and send pending requests via another connection")
 	}
 	unlock := client.pingRequestsLock.Lock()
 	client.pingRequests = map[int]bool{}
@@ -210,16 +278,24 @@ func (client *RPCClient) resendPendingRequestsAndSubscriptions(failed *connectio
 }
 
 // read reads incoming data from the given connection and executes the given success message.
-// Any panics are caught and handled by retring to subscribe on another connection and sending
-// out any pending methods via another connection.
+// Socket and response errors are caught and handled by retrying to subscribe on another connection
+// and sending out any pending methods via another connection.
 func (client *RPCClient) read(connection *connection, success func(*connection, []byte)) {
 	defer func() {
 		_ = connection.conn.Close()
 		if r := recover(); r != nil {
 			if sockErr, ok := r.(*SocketError); ok {
+				// Reading fails when the connection is closed by Close().
 				client.resendPendingRequestsAndSubscriptions(sockErr.connection)
 				return
 			}
+			if responseErr, ok := r.(*ResponseError); ok {
+				// The server sent an error or a response which was rejected. The request is still
+				// pending and is sent to another server.
+				client.logger().WithError(responseErr).Error("Unexpected response, failing over")
+				client.resendPendingRequestsAndSubscriptions(connection)
+				return
+			}
 			if err, ok := r.(error); ok {
 				panic(errp.Wrap(err, "Unrecoverable error happened in read channel"))
 			} else {
@@ -228,7 +304,7 @@ func (client *RPCClient) read(connection *connection, success func(*connection,
 		}
 	}()
 	reader := bufio.NewReader(connection.conn)
-	for !client.close {
+	for !client.IsClosed() {
 		line, err := reader.ReadBytes(byte('\n'))
 		if err != nil {
 			panic(&SocketError{errp.Wrap(err, "Failed to read from socket"), connection})
@@ -242,23 +318,34 @@ func (client *RPCClient) read(connection *connection, success func(*connection,
 // separate go routine to listen for incoming data.
 func (client *RPCClient) establishConnection(backend rpc.Backend) error {
 	conn, err := backend.EstablishConnection()
-	client.log = client.log.WithField("backend", backend.ServerInfo().Server)
+	client.setLogBackend(backend.ServerInfo().Server)
 	if err != nil {
 		return err
 	}
-	client.log.Debugf("Established connection to backend")
-	client.connection = &connection{conn, backend}
-	go client.read(client.connection, client.handleResponse)
+	client.logger().Debugf("Established connection to backend")
+	newConnection := &connection{conn, backend}
+	client.setConnection(newConnection)
+	client.spawn(func() { client.read(newConnection, client.handleResponse) })
 	if err := client.onConnectCallback(); err != nil {
-		client.log.WithError(err).Error("Error happened in connect callback")
+		client.logger().WithError(err).Error("Error happened in connect callback")
+		// The backend is not used. Unset first, so that the reader does not fail over.
+		client.setConnection(nil)
+		_ = conn.Close()
 		return err
 	}
-	go client.ping()
+	client.spawn(client.ping)
 	return nil
 }
 
 func (client *RPCClient) notify(status rpc.Status) {
-	for _, callback := range client.onConnectionStatusChangesNotify {
+	callbacks := []func(rpc.Status){}
+	func() {
+		defer client.onConnectionStatusChangesNotifyLock.RLock()()
+		for _, callback := range client.onConnectionStatusChangesNotify {
+			callbacks = append(callbacks, callback)
+		}
+	}()
+	for _, callback := range callbacks {
 		callback(status)
 	}
 }
@@ -266,45 +353,63 @@ func (client *RPCClient) notify(status rpc.Status) {
 func (client *RPCClient) setStatus(status rpc.Status) {
 	if status != client.status {
 		client.status = status
-		go client.notify(status)
+		client.spawn(func() { client.notify(status) })
 	}
 }
 
 // conn returns either the currently active connection or, if none was found, establishes a new connection
-// to any of the configured backends.
-// The selection process is randomized, to balance the load between multiple backends for multiple
-// desktop applications, but we store the active connection and ping it regularly to
-// keep it alive (see ping()).
+// to any of the configured backends, in the order given by the backends function. We store the
+// active connection and ping it regularly to keep it alive (see ping()).
 func (client *RPCClient) conn() (*connection, error) {
-	if client.connection == nil {
-		defer client.connLock.Lock()()
-		if client.connection == nil {
-			defer client.backendsLock.RLock()()
-			start := 0
-			if len(client.backends) > 0 {
-				start = rand.Intn(len(client.backends))
-			}
-			for i := 0; i < len(client.backends); i++ {
-				client.log.Debugf("Trying to connect to backend %v", client.backends[start].ServerInfo().Server)
-				err := client.establishConnection(client.backends[start])
-				if err != nil {
-					client.log.WithError(err).Info("Failover: backend is down")
-					start = (start + 1) % len(client.backends)
-				} else {
-					client.log.Debug("Successfully connected to backend")
-					break
-				}
-			}
-			if client.connection == nil {
-				client.log = client.log.WithField("backend", "offline")
-				// tried all backends
-				client.setStatus(rpc.DISCONNECTED)
-				return nil, errp.Newf("Disconnected from all backends")
-			}
-			go client.setStatus(rpc.CONNECTED)
+	if client.IsClosed() {
+		return nil, errp.New("client closed")
+	}
+	if connection := client.getConnection(); connection != nil {
+		return connection, nil
+	}
+	defer client.connLock.Lock()()
+	if connection := client.getConnection(); connection != nil {
+		return connection, nil
+	}
+	for _, backend := range client.backends() {
+		client.logger().Debugf("Trying to connect to backend %v", backend.ServerInfo().Server)
+		err := client.establishConnection(backend)
+		if err != nil {
+			client.logger().WithError(err).Info("Failover: backend is down")
+		} else {
+			client.logger().Debug("Successfully connected to backend")
+			break
 		}
 	}
-	return client.connection, nil
+	connection := client.getConnection()
+	if connection == nil {
+		client.setLogBackend("offline")
+		// tried all backends
+		client.setStatus(rpc.DISCONNECTED)
+		return nil, errp.Newf("Disconnected from all backends")
+	}
+	client.spawn(func() { client.setStatus(rpc.CONNECTED) })
+	return connection, nil
+}
+
+func (client *RPCClient) logger() *logrus.Entry {
+	defer client.logLock.RLock()()
+	return client.log
+}
+
+func (client *RPCClient) setLogBackend(server string) {
+	defer client.logLock.Lock()()
+	client.log = client.log.WithField("backend", server)
+}
+
+func (client *RPCClient) getConnection() *connection {
+	defer client.connectionLock.RLock()()
+	return client.connection
+}
+
+func (client *RPCClient) setConnection(connection *connection) {
+	defer client.connectionLock.Lock()()
+	client.connection = connection
 }
 
 // cleanupFinishedRequest removes the finished request from the collection of pending requests
@@ -324,8 +429,7 @@ func (client *RPCClient) cleanupFinishedRequest(conn *connection, responseID int
 			// if connection is still up and running we add it to the list of subscription requests and
 			// remove it from the collection of pending requests.
 			// Otherwise it remains in the collection of pending requests.
-			defer client.connLock.Lock()()
-			if client.connection == conn {
+			if client.getConnection() == conn {
 				client.subscriptionRequests = append(client.subscriptionRequests, finishedRequest)
 				delete(client.pendingRequests, responseID)
 			}
@@ -340,6 +444,20 @@ func (client *RPCClient) cleanupFinishedRequest(conn *connection, responseID int
 func (client *RPCClient) handleResponse(conn *connection, responseBytes []byte) {
 	// fmt.Println("got response ", string(responseBytes))
 
+	// The responses to a batch request arrive as an array, in any order. They are matched to the
+	// requests by their id like single responses.
+	if trimmed := bytes.TrimSpace(responseBytes); len(trimmed) != 0 && trimmed[0] == '[' {
+		responses := []json.RawMessage{}
+		if err := json.Unmarshal(trimmed, &responses); err != nil {
+			// panic will be caught in read(), which fails over to another connection
+			panic(&ResponseError{errp.Wrap(err, "Failed to unmarshal batch response")})
+		}
+		for _, response := range responses {
+			client.handleResponse(conn, response)
+		}
+		return
+	}
+
 	// Catch all response.
 	// A notification contains:
 	// - jsonrpc
@@ -359,11 +477,11 @@ func (client *RPCClient) handleResponse(conn *connection, responseBytes []byte)
 		Params  json.RawMessage  `json:"params"`
 	}{}
 	if err := json.Unmarshal(responseBytes, response); err != nil {
-		// panic will be caught in read() and subscribed connections will be re-subscribed
+		// panic will be caught in read(), which fails over to another connection
 		panic(&ResponseError{errp.Wrap(err, "Failed to unmarshal response")})
 	}
 	if response.JSONRPC != "2.0" {
-		// panic will be caught in read() and subscribed connections will be re-subscribed
+		// panic will be caught in read(), which fails over to another connection
 		panic(&ResponseError{errp.Newf("Unexpected json rpc version: %s", response.JSONRPC)})
 	}
 
@@ -400,10 +518,10 @@ func (client *RPCClient) handleResponse(conn *connection, responseBytes []byte)
 			unlock := client.pingRequestsLock.Lock()
 			_, ok := client.pingRequests[*response.ID]
 			if ok {
-				client.log.Debug("Pong")
+				client.logger().Debug("Pong")
 				delete(client.pingRequests, *response.ID)
 			} else {
-				client.log.WithField("request_id", *response.ID).WithField("response", string(response.Result)).Info("Request not found in list of " +
+				client.logger().WithField("request_id", *response.ID).WithField("response", string(response.Result)).Info("Request not found in list of " +
 					"pending requests. It's likely that it finished before a failover and we therefore " +
 					"do not have to do anything.")
 			}
@@ -412,13 +530,16 @@ func (client *RPCClient) handleResponse(conn *connection, responseBytes []byte)
 	}
 	// Handle notification.
 	if response.Method != nil {
-		client.log.Debug("Calling subscription callbacks")
+		client.logger().Debug("Calling subscription callbacks")
 		if len(response.Params) == 0 {
 			return
 		}
 		func() {
+			responseCallbacks := []func([]byte){}
 			unlock := client.notificationsCallbacksLock.RLock()
-			responseCallbacks := client.notificationsCallbacks[*response.Method]
+			for _, responseCallback := range client.notificationsCallbacks[*response.Method] {
+				responseCallbacks = append(responseCallbacks, responseCallback)
+			}
 			unlock()
 			for _, responseCallback := range responseCallbacks {
 				responseCallback([]byte(response.Params))
@@ -445,8 +566,12 @@ func (client *RPCClient) RegisterHeartbeat(
 
 // ping periodically pings the server to keep the connection alive.
 func (client *RPCClient) ping() {
-	for !client.close {
-		time.Sleep(time.Minute)
+	for {
+		select {
+		case <-client.ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
 		if client.heartBeat == nil {
 			continue
 		}
@@ -455,10 +580,10 @@ func (client *RPCClient) ping() {
 		unlock := client.pingRequestsLock.Lock()
 		client.pingRequests[msgID] = true
 		unlock()
-		client.log.Debug("Ping")
+		client.logger().Debug("Ping")
 		err := client.send(jsonText)
 		if err != nil {
-			client.log.Debug("Resend triggered in ping")
+			client.logger().Debug("Resend triggered in ping")
 			client.resendPendingRequestsAndSubscriptions(err.connection)
 			// ping will be restarted when the connection is established.
 			return
@@ -505,10 +630,10 @@ func (client *RPCClient) prepare(
 
 	msgID, jsonText := client.transform(method, params...)
 
-	client.log.Debugf("Waiting for pending requests lock (prepare): %v", method)
-	defer client.log.Debugf("Releasing pending request lock (prepare).")
+	client.logger().Debugf("Waiting for pending requests lock (prepare): %v", method)
+	defer client.logger().Debugf("Releasing pending request lock (prepare).")
 	defer client.pendingRequestsLock.Lock()()
-	client.log.Debugf("Prepared: %v", string(jsonText))
+	client.logger().Debugf("Prepared: %v", string(jsonText))
 	client.pendingRequests[msgID] = &request{
 		callbacks{
 			success:          success,
@@ -534,15 +659,35 @@ func (client *RPCClient) Method(
 	jsonText := client.prepare(success, setupAndTeardown, method, params...)
 	err := client.send(jsonText)
 	if err != nil {
-		client.log.Debugf("Resend triggered in Method (%v)", method)
-		go client.resendPendingRequestsAndSubscriptions(err.connection)
+		client.logger().Debugf("Resend triggered in Method (%v)", method)
+		client.spawn(func() { client.resendPendingRequestsAndSubscriptions(err.connection) })
+	}
+}
+
+// Batch implements rpc.Client. The requests are sent as one JSON-RPC batch, but are pending and
+// resent after a failover individually.
+func (client *RPCClient) Batch(requests []*rpc.Request) {
+	if len(requests) == 0 {
+		return
+	}
+	batch := make([]json.RawMessage, len(requests))
+	for index, request := range requests {
+		jsonText := client.prepare(
+			request.Success, request.SetupAndTeardown, request.Method, request.Params...)
+		batch[index] = bytes.TrimSuffix(jsonText, []byte{'\n'})
+	}
+	err := client.send(append(jsonp.MustMarshal(batch), byte('\n')))
+	if err != nil {
+		client.logger().Debugf("Resend triggered in Batch (%d requests)", len(requests))
+		client.spawn(func() { client.resendPendingRequestsAndSubscriptions(err.connection) })
 	}
 }
 
 // MethodSync is the same as method, but blocks until the response is available. The result is
 // json-deserialized into response.
 func (client *RPCClient) MethodSync(response interface{}, method string, params ...interface{}) error {
-	responseChan := make(chan []byte)
+	// Buffered, so that a response arriving after the timeout does not block the reader.
+	responseChan := make(chan []byte, 1)
 	errChan := make(chan error)
 
 	client.Method(
@@ -563,18 +708,28 @@ func (client *RPCClient) MethodSync(response interface{}, method string, params
 		}
 	case <-time.After(responseTimeout):
 		return &SocketError{errp.New("response timeout"), nil}
+	case <-client.ctx.Done():
+		return errp.New("client closed")
 	}
 	return nil
 }
 
 // SubscribeNotifications installs a callback for a method which is called with notifications from
-// the server.
-func (client *RPCClient) SubscribeNotifications(method string, callback func([]byte)) {
+// the server. The returned function removes the callback again.
+func (client *RPCClient) SubscribeNotifications(method string, callback func([]byte)) func() {
 	defer client.notificationsCallbacksLock.Lock()()
 	if _, ok := client.notificationsCallbacks[method]; !ok {
-		client.notificationsCallbacks[method] = []func([]byte){}
+		client.notificationsCallbacks[method] = map[int]func([]byte){}
+	}
+	id := client.notificationsCallbacksID
+	client.notificationsCallbacksID++
+	client.notificationsCallbacks[method][id] = callback
+	return func() {
+		defer client.notificationsCallbacksLock.Lock()()
+		// The method stays registered, so that responses to its pending subscription requests
+		// are still recognized as such.
+		delete(client.notificationsCallbacks[method], id)
 	}
-	client.notificationsCallbacks[method] = append(client.notificationsCallbacks[method], callback)
 }
 
 func (client *RPCClient) send(msg []byte) *SocketError {
@@ -589,12 +744,24 @@ func (client *RPCClient) send(msg []byte) *SocketError {
 	return nil
 }
 
-// Close shuts down the connection.
+// Close shuts down the connection and waits until all goroutines of the client have stopped. It is
+// safe to call it more than once.
 func (client *RPCClient) Close() {
-	client.close = true
+	func() {
+		defer client.goroutinesLock.Lock()()
+		client.cancel()
+	}()
+	func() {
+		defer client.connLock.Lock()()
+		if connection := client.getConnection(); connection != nil {
+			// Unblocks the reader.
+			_ = connection.conn.Close()
+		}
+	}()
+	client.goroutines.Wait()
 }
 
 // IsClosed returns true if the client is closed and false otherwise.
 func (client *RPCClient) IsClosed() bool {
-	return client.close
+	return client.ctx.Err() != nil
 }
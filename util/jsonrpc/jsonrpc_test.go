@@ -0,0 +1,200 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonrpc_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/digitalbitbox/bitbox-wallet-app/util/jsonrpc"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/logging"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/rpc"
+	"github.com/digitalbitbox/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+)
+
+// pongServer answers every request with its first param, or with "pong" if it has none. The
+// responses to a batch request are sent in reverse order.
+type pongServer struct {
+	listener    net.Listener
+	connections int32
+}
+
+func newPongServer(t *testing.T) *pongServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &pongServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *pongServer) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var response []byte
+		if line[0] == '[' {
+			var requests []pongRequest
+			if err := json.Unmarshal(line, &requests); err != nil {
+				return
+			}
+			responses := []interface{}{}
+			for index := len(requests) - 1; index >= 0; index-- {
+				responses = append(responses, requests[index].response())
+			}
+			response, _ = json.Marshal(responses)
+		} else {
+			var request pongRequest
+			if err := json.Unmarshal(line, &request); err != nil {
+				return
+			}
+			response, _ = json.Marshal(request.response())
+		}
+		if _, err := conn.Write(append(response, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+type pongRequest struct {
+	ID     int      `json:"id"`
+	Params []string `json:"params"`
+}
+
+func (request *pongRequest) response() map[string]interface{} {
+	result := "pong"
+	if len(request.Params) != 0 {
+		result = request.Params[0]
+	}
+	return map[string]interface{}{"jsonrpc": "2.0", "id": request.ID, "result": result}
+}
+
+// EstablishConnection implements rpc.Backend.
+func (server *pongServer) EstablishConnection() (io.ReadWriteCloser, error) {
+	atomic.AddInt32(&server.connections, 1)
+	return net.Dial("tcp", server.listener.Addr().String())
+}
+
+// ServerInfo implements rpc.Backend.
+func (server *pongServer) ServerInfo() *rpc.ServerInfo {
+	return &rpc.ServerInfo{Server: server.listener.Addr().String()}
+}
+
+func TestClose(t *testing.T) {
+	defer test.CheckGoroutineLeaks(t)()
+	server := newPongServer(t)
+	defer func() { _ = server.listener.Close() }()
+
+	client := jsonrpc.NewRPCClient([]rpc.Backend{server}, logging.Get().WithGroup("jsonrpc_test"))
+	client.OnConnect(func() error { return nil })
+	statusChanges := 0
+	unregister := client.RegisterOnConnectionStatusChangedEvent(func(rpc.Status) { statusChanges++ })
+	unregister()
+
+	var result string
+	require.NoError(t, client.MethodSync(&result, "server.ping"))
+	require.Equal(t, "pong", result)
+
+	client.Close()
+	require.True(t, client.IsClosed())
+	// Closing twice is fine.
+	client.Close()
+
+	require.Error(t, client.MethodSync(&result, "server.ping"))
+	// The client does not reconnect after it was closed.
+	require.Equal(t, int32(1), atomic.LoadInt32(&server.connections))
+	require.Equal(t, 0, statusChanges)
+}
+
+func TestBatch(t *testing.T) {
+	server := newPongServer(t)
+	defer func() { _ = server.listener.Close() }()
+	client := jsonrpc.NewRPCClient([]rpc.Backend{server}, logging.Get().WithGroup("jsonrpc_test"))
+	client.OnConnect(func() error { return nil })
+	defer client.Close()
+
+	results := make(chan [2]string, 3)
+	cleanups := make(chan struct{}, 3)
+	requests := []*rpc.Request{}
+	for _, param := range []string{"a", "b", "c"} {
+		param := param
+		requests = append(requests, &rpc.Request{
+			Success: func(responseBytes []byte) error {
+				var result string
+				require.NoError(t, json.Unmarshal(responseBytes, &result))
+				results <- [2]string{param, result}
+				return nil
+			},
+			SetupAndTeardown: func() func() {
+				return func() { cleanups <- struct{}{} }
+			},
+			Method: "server.echo",
+			Params: []interface{}{param},
+		})
+	}
+	client.Batch(requests)
+	for range requests {
+		result := <-results
+		require.Equal(t, result[0], result[1])
+		<-cleanups
+	}
+	// Single requests still work on the same connection.
+	var result string
+	require.NoError(t, client.MethodSync(&result, "server.ping"))
+	require.Equal(t, "pong", result)
+	require.Equal(t, int32(1), atomic.LoadInt32(&server.connections))
+}
+
+func TestRejectedResponse(t *testing.T) {
+	server := newPongServer(t)
+	defer func() { _ = server.listener.Close() }()
+	client := jsonrpc.NewRPCClient([]rpc.Backend{server}, logging.Get().WithGroup("jsonrpc_test"))
+	client.OnConnect(func() error { return nil })
+	defer client.Close()
+
+	// A rejected response makes the client fail over, and the request is sent again.
+	var attempts int32
+	results := make(chan string, 1)
+	client.Method(func(responseBytes []byte) error {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return errors.New("invalid response")
+		}
+		var result string
+		require.NoError(t, json.Unmarshal(responseBytes, &result))
+		results <- result
+		return nil
+	}, func() func() { return func() {} }, "server.echo", "a")
+	require.Equal(t, "a", <-results)
+	require.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	require.Equal(t, int32(2), atomic.LoadInt32(&server.connections))
+}
@@ -32,13 +32,28 @@ const (
 type Client interface {
 	Method(func([]byte) error, func() func(), string, ...interface{})
 	MethodSync(interface{}, string, ...interface{}) error
-	SubscribeNotifications(string, func([]byte))
+	// Batch sends the requests in one batch. Each request is handled like one sent with Method().
+	Batch([]*Request)
+	// SubscribeNotifications returns a function to unsubscribe again.
+	SubscribeNotifications(string, func([]byte)) func()
+	// Close closes the connection and stops all goroutines of the client. It is safe to call it
+	// more than once.
 	Close()
 	IsClosed() bool
 	RegisterHeartbeat(string, ...interface{})
 	OnConnect(func() error)
 	ConnectionStatus() Status
-	RegisterOnConnectionStatusChangedEvent(func(Status))
+	// RegisterOnConnectionStatusChangedEvent returns a function to deregister the callback again.
+	RegisterOnConnectionStatusChangedEvent(func(Status)) func()
+}
+
+// Request is a method call sent with Client.Batch(). The fields are the arguments of
+// Client.Method().
+type Request struct {
+	Success          func([]byte) error
+	SetupAndTeardown func() func()
+	Method           string
+	Params           []interface{}
 }
 
 // ServerInfo holds information about the backend server(s).
@@ -0,0 +1,94 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ignoredGoroutines are stack substrings of goroutines which are owned by the runtime or the
+// standard library and outlive the code under test, e.g. idle HTTP keep-alive connections.
+var ignoredGoroutines = []string{
+	"testing.tRunner",
+	"net/http.(*persistConn)",
+	"os/signal.signal_recv",
+}
+
+// goroutines returns the stacks of all goroutines except the calling one.
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	result := map[string]string{}
+	stacks := strings.Split(string(buf), "\n\n")
+	// The first stack is the calling goroutine.
+	for _, stack := range stacks[1:] {
+		header := strings.SplitN(stack, "\n", 2)[0]
+		// "goroutine 42 [running]:"
+		fields := strings.Fields(header)
+		if len(fields) < 2 {
+			continue
+		}
+		result[fields[1]] = stack
+	}
+	return result
+}
+
+func ignored(stack string) bool {
+	for _, ignore := range ignoredGoroutines {
+		if strings.Contains(stack, ignore) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckGoroutineLeaks records the running goroutines and returns a function which fails the test
+// if goroutines started after the call are still running when it is called. Goroutines are given
+// a few seconds to exit. Use it as `defer test.CheckGoroutineLeaks(t)()`.
+func CheckGoroutineLeaks(t *testing.T) func() {
+	t.Helper()
+	before := goroutines()
+	return func() {
+		t.Helper()
+		var leaked []string
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			leaked = nil
+			for id, stack := range goroutines() {
+				if _, ok := before[id]; ok || ignored(stack) {
+					continue
+				}
+				leaked = append(leaked, stack)
+			}
+			if len(leaked) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if len(leaked) != 0 {
+			t.Errorf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+	}
+}